@@ -0,0 +1,242 @@
+// alist-export runs the operations of the export package against a driver from the command line,
+// which helps to verify the addition of a driver before using it as the storage of JuiceFS
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	_ "github.com/alist-org/alist/v3/drivers"
+	"github.com/alist-org/alist/v3/export"
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+const (
+	exitOK = iota
+	exitErr
+	exitUsage
+	exitNotFound
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// usageError is returned for bad arguments so that they exit with exitUsage
+type usageError struct {
+	error
+}
+
+// run executes the command in args and returns the exit code
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var driverName, addition string
+	var fsys export.FileSystem
+	root := &cobra.Command{
+		Use:           "alist-export",
+		Short:         "Run file operations of the export package against an alist driver",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if cmd.Name() == "help" {
+				return nil
+			}
+			var err error
+			fsys, err = newFS(cmd.Context(), driverName, addition)
+			return err
+		},
+	}
+	root.PersistentFlags().StringVar(&driverName, "driver", "", "name of the driver, e.g. Local")
+	root.PersistentFlags().StringVar(&addition, "addition", "{}", "addition of the driver in JSON, or @file to read it from file")
+	root.CompletionOptions.DisableDefaultCmd = true
+	root.SetArgs(args)
+	root.SetIn(stdin)
+	root.SetOut(stdout)
+	root.SetErr(stderr)
+	root.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		return usageError{err}
+	})
+
+	var offset, length int64
+	cat := &cobra.Command{
+		Use:   "cat <path>",
+		Short: "Write the content of a file to stdout",
+		Args:  exactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if length < 0 {
+				info, err := fsys.Stat(cmd.Context(), args[0])
+				if err != nil {
+					return err
+				}
+				length = max(info.Size-offset, 0)
+			}
+			rc, err := fsys.Read(cmd.Context(), args[0], offset, length)
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+			_, err = io.Copy(stdout, rc)
+			return errors.WithStack(err)
+		},
+	}
+	cat.Flags().Int64Var(&offset, "offset", 0, "offset to start reading from")
+	cat.Flags().Int64Var(&length, "length", -1, "number of bytes to read, to the end if negative")
+
+	var dryRun bool
+	fsck := &cobra.Command{
+		Use:   "dedup-fsck",
+		Short: "Rebuild the reference ledger of a dedup layer from its pointers and remove the orphan blobs",
+		Args:  exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			r, err := export.FsckDedup(cmd.Context(), fsys, dryRun)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(stdout, "pointers: %d\nblobs: %d\n", r.Pointers, r.Blobs)
+			for _, l := range []struct {
+				name  string
+				items []string
+			}{{"fixed", r.Fixed}, {"orphan", r.Orphans}, {"missing", r.Missing}} {
+				for _, item := range l.items {
+					fmt.Fprintf(stdout, "%s\t%s\n", l.name, item)
+				}
+			}
+			return nil
+		},
+	}
+	fsck.Flags().BoolVar(&dryRun, "dry-run", false, "only report, without writing the ledger nor removing the orphans")
+
+	root.AddCommand(
+		&cobra.Command{
+			Use:   "ls <dir>",
+			Short: "List a directory",
+			Args:  exactArgs(1),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				entries, err := fsys.List(cmd.Context(), args[0])
+				if err != nil {
+					return err
+				}
+				for _, e := range entries {
+					name := e.Name
+					if e.IsDir {
+						name += "/"
+					}
+					fmt.Fprintf(stdout, "%d\t%s\t%s\n", e.Size, e.Modified.Format(time.RFC3339), name)
+				}
+				return nil
+			},
+		},
+		cat,
+		&cobra.Command{
+			Use:   "put <path> [file]",
+			Short: "Upload a file, or stdin if file is omitted or -",
+			Args:  rangeArgs(1, 2),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				if len(args) == 1 || args[1] == "-" {
+					return fsys.Put(cmd.Context(), args[0], stdin)
+				}
+				f, err := os.Open(args[1])
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				defer f.Close()
+				fi, err := f.Stat()
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				return fsys.PutWithSize(cmd.Context(), args[0], f, fi.Size())
+			},
+		},
+		&cobra.Command{
+			Use:   "rm <path>",
+			Short: "Remove a file or an empty directory",
+			Args:  exactArgs(1),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				// Delete ignores missing objects, stat to report them
+				if _, err := fsys.Stat(cmd.Context(), args[0]); err != nil {
+					return err
+				}
+				return fsys.Delete(cmd.Context(), args[0])
+			},
+		},
+		&cobra.Command{
+			Use:   "stat <path>",
+			Short: "Show the metadata of an object",
+			Args:  exactArgs(1),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				info, err := fsys.Stat(cmd.Context(), args[0])
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(stdout, "id: %s\nname: %s\nsize: %d\nmodified: %s\ncreated: %s\ndir: %t\n",
+					info.ID, info.Name, info.Size, info.Modified.Format(time.RFC3339), info.Ctime.Format(time.RFC3339), info.IsDir)
+				return nil
+			},
+		},
+		&cobra.Command{
+			Use:   "mkdir <dir>",
+			Short: "Create a directory and its parents",
+			Args:  exactArgs(1),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return fsys.Mkdir(cmd.Context(), args[0])
+			},
+		},
+		fsck,
+	)
+
+	err := root.ExecuteContext(context.Background())
+	if err == nil {
+		return exitOK
+	}
+	fmt.Fprintf(stderr, "alist-export: %v\n", err)
+	var ue usageError
+	switch {
+	case errors.As(err, &ue), strings.HasPrefix(err.Error(), "unknown command"):
+		return exitUsage
+	case errs.IsObjectNotFound(err):
+		return exitNotFound
+	default:
+		return exitErr
+	}
+}
+
+func exactArgs(n int) cobra.PositionalArgs {
+	return rangeArgs(n, n)
+}
+
+func rangeArgs(lo, hi int) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, args []string) error {
+		if err := cobra.RangeArgs(lo, hi)(cmd, args); err != nil {
+			return usageError{err}
+		}
+		return nil
+	}
+}
+
+// newFS constructs the driver named driverName with addition
+func newFS(ctx context.Context, driverName, addition string) (export.FileSystem, error) {
+	if driverName == "" {
+		return nil, usageError{errors.New("--driver is required")}
+	}
+	if strings.HasPrefix(addition, "@") {
+		b, err := os.ReadFile(strings.TrimPrefix(addition, "@"))
+		if err != nil {
+			return nil, usageError{errors.WithStack(err)}
+		}
+		addition = string(b)
+	}
+	fsys, err := export.NewByName(ctx, driverName, addition)
+	if err != nil {
+		var ue *export.UnknownDriverError
+		if errors.As(err, &ue) {
+			return nil, usageError{err}
+		}
+		return nil, errors.WithMessage(err, "failed to init the driver")
+	}
+	return fsys, nil
+}
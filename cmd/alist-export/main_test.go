@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alist-org/alist/v3/pkg/utils"
+)
+
+type result struct {
+	code           int
+	stdout, stderr string
+}
+
+func runCLI(t *testing.T, addition, stdin string, args ...string) result {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	args = append([]string{"--driver", "Local", "--addition", addition}, args...)
+	code := run(args, strings.NewReader(stdin), &stdout, &stderr)
+	return result{code: code, stdout: stdout.String(), stderr: stderr.String()}
+}
+
+func TestCLI(t *testing.T) {
+	dir := t.TempDir()
+	additionFile := filepath.Join(t.TempDir(), "addition.json")
+	addition, _ := utils.Json.MarshalToString(map[string]string{"root_folder_path": dir})
+	if err := os.WriteFile(additionFile, []byte(addition), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if r := runCLI(t, addition, "", "mkdir", "a/b"); r.code != exitOK {
+		t.Fatalf("mkdir: %+v", r)
+	}
+	if r := runCLI(t, addition, "0123456789", "put", "a/1.txt"); r.code != exitOK {
+		t.Fatalf("put from stdin: %+v", r)
+	}
+	src := filepath.Join(t.TempDir(), "src")
+	if err := os.WriteFile(src, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if r := runCLI(t, "@"+additionFile, "", "put", "a/2.txt", src); r.code != exitOK {
+		t.Fatalf("put from file: %+v", r)
+	}
+
+	r := runCLI(t, addition, "", "ls", "a")
+	if r.code != exitOK || !strings.Contains(r.stdout, "\t1.txt\n") || !strings.Contains(r.stdout, "\t2.txt\n") || !strings.Contains(r.stdout, "\tb/\n") {
+		t.Fatalf("ls: %+v", r)
+	}
+	if r := runCLI(t, addition, "", "cat", "a/1.txt"); r.code != exitOK || r.stdout != "0123456789" {
+		t.Fatalf("cat: %+v", r)
+	}
+	if r := runCLI(t, addition, "", "cat", "--offset", "2", "--length", "3", "a/1.txt"); r.code != exitOK || r.stdout != "234" {
+		t.Fatalf("cat range: %+v", r)
+	}
+	if r := runCLI(t, addition, "", "stat", "a/2.txt"); r.code != exitOK || !strings.Contains(r.stdout, "size: 5\n") {
+		t.Fatalf("stat: %+v", r)
+	}
+	if r := runCLI(t, addition, "", "rm", "a/2.txt"); r.code != exitOK {
+		t.Fatalf("rm: %+v", r)
+	}
+
+	if r := runCLI(t, addition, "", "dedup-fsck", "--dry-run"); r.code != exitOK || !strings.HasPrefix(r.stdout, "pointers: 0\nblobs: 0\n") {
+		t.Fatalf("dedup-fsck: %+v", r)
+	}
+
+	if r := runCLI(t, addition, "", "stat", "a/2.txt"); r.code != exitNotFound {
+		t.Fatalf("stat removed: %+v", r)
+	}
+	if r := runCLI(t, addition, "", "rm", "a/2.txt"); r.code != exitNotFound {
+		t.Fatalf("rm removed: %+v", r)
+	}
+	if r := runCLI(t, `{"root_folder_path": "/not/exists"}`, "", "ls", "/"); r.code != exitErr {
+		t.Fatalf("bad addition: %+v", r)
+	}
+	if r := runCLI(t, addition, "", "cat"); r.code != exitUsage {
+		t.Fatalf("missing path: %+v", r)
+	}
+	if r := run([]string{"ls", "/"}, nil, &bytes.Buffer{}, &bytes.Buffer{}); r != exitUsage {
+		t.Fatalf("missing driver: %d", r)
+	}
+	var stderr bytes.Buffer
+	if r := run([]string{"--driver", "NoSuchDriver", "ls", "/"}, nil, &bytes.Buffer{}, &stderr); r != exitUsage || !strings.Contains(stderr.String(), "Local") {
+		t.Fatalf("unknown driver: %d %s", r, stderr.String())
+	}
+}
@@ -3,10 +3,15 @@
 
 package export
 
-import _189 "github.com/alist-org/alist/v3/drivers/189"
+import (
+	_189 "github.com/alist-org/alist/v3/drivers/189"
+	"github.com/alist-org/alist/v3/internal/driver"
+)
 
 // usage:
 // {"username": "xxx", "password": "xxx", "root_folder_id": "xxx"}
 func init() {
-	Storage = &_189.Cloud189{}
+	Register("189", func() driver.Driver {
+		return &_189.Cloud189{}
+	})
 }
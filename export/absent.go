@@ -0,0 +1,75 @@
+package export
+
+import (
+	"context"
+	"io"
+	stdpath "path"
+
+	"github.com/alist-org/alist/v3/internal/model"
+	"github.com/pkg/errors"
+)
+
+// PutIfAbsent uploads body to name unless an object exists there, which fails with ErrExist,
+// e.g. to create lock or marker files shared by several writers. The object is looked up
+// bypassing the caches before the upload, a concurrent writer may still create it meanwhile:
+//   - drivers reporting the IDs of the objects created are listed again after the upload. If the
+//     object was replaced, or objects of the same name were created on drivers allowing
+//     duplicates, the put fails with ErrExist, and its object is removed unless its ID is the least
+//   - drivers identifying objects by path and overwriting them can't tell, the last writer wins.
+//     WithAtomicPut narrows the window to the one between the last lookup and the rename
+func (i *Impl) PutIfAbsent(ctx context.Context, name string, body io.Reader) (err error) {
+	ctx, end := i.startOp(ctx, "put", name)
+	defer end(&err)
+	path, err := i.objPath(name)
+	if err != nil {
+		return err
+	}
+	// objects created by other writers aren't seen by the caches
+	i.forgetPath(path)
+	fail := ConflictFail
+	obj, err := i.putFile(ctx, name, body, -1, putOptions{conflict: &fail})
+	if err != nil {
+		return err
+	}
+	return i.checkAbsent(ctx, path, obj)
+}
+
+// forgetPath drops what is cached about the object at path and the listing of its dir
+func (i *Impl) forgetPath(path string) {
+	i.removed(path, false)
+	i.missing.Del(path)
+}
+
+// checkAbsent checks that the object put at path, obj, is the only one there
+func (i *Impl) checkAbsent(ctx context.Context, path string, obj model.Obj) error {
+	id := obj.GetID()
+	if id == "" {
+		return nil
+	}
+	i.forgetPath(path)
+	files, err := i.list(ctx, stdpath.Dir(path), model.ListArgs{})
+	if err != nil {
+		return errors.WithMessagef(err, "failed to check [%s] after the put", path)
+	}
+	var ours model.Obj
+	least := id
+	for _, f := range files {
+		if f.GetName() != stdpath.Base(path) {
+			continue
+		}
+		if f.GetID() == id {
+			ours = f
+		}
+		least = min(least, f.GetID())
+	}
+	if ours == nil {
+		return errors.WithMessagef(ErrExist, "[%s] was replaced by another writer", path)
+	}
+	if least != id {
+		if err := i.remove(ctx, path, ours); err != nil {
+			i.conf.logger.Warn("failed to remove the object put", "path", path, "error", errValue(err))
+		}
+		return errors.WithMessagef(ErrExist, "[%s] was created by another writer", path)
+	}
+	return nil
+}
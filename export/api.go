@@ -5,169 +5,1108 @@ import (
 	"context"
 	"encoding/json"
 	"io"
-	"net/http"
-	"path/filepath"
+	"io/fs"
+	stdpath "path"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/alist-org/alist/v3/drivers/base"
-	"github.com/alist-org/alist/v3/internal/conf"
+	"github.com/Xhofe/go-cache"
 	"github.com/alist-org/alist/v3/internal/driver"
 	"github.com/alist-org/alist/v3/internal/errs"
 	"github.com/alist-org/alist/v3/internal/model"
 	"github.com/alist-org/alist/v3/internal/stream"
-	"github.com/alist-org/alist/v3/pkg/http_range"
+	"github.com/alist-org/alist/v3/pkg/errgroup"
 	"github.com/alist-org/alist/v3/pkg/singleflight"
+	"github.com/alist-org/alist/v3/pkg/utils"
+	"github.com/avast/retry-go"
 	"github.com/pkg/errors"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
 )
 
 const baseDir = "/juicefs"
 const RootName = "root"
 
-var Storage driver.Driver
-
+// FileSystem is the storage of a driver under a base dir. The errors of the operations are
+// *OpError telling the op, name and ErrorKind, which errors.As finds as a *fs.PathError too,
+// a missing object matches both fs.ErrNotExist and errs.ObjectNotFound
 type FileSystem interface {
 	Delete(ctx context.Context, name string) error
 	Read(ctx context.Context, name string, off, limit int64) (io.ReadCloser, error)
 	Put(ctx context.Context, name string, body io.Reader) error
+	PutWithSize(ctx context.Context, name string, body io.Reader, size int64) error
+	PutResult(ctx context.Context, name string, body io.Reader) (ObjInfo, error)
+	PutWithOptions(ctx context.Context, name string, body io.Reader, opts ...PutOption) (ObjInfo, error)
+	PutWithHash(ctx context.Context, name string, size int64, hashes utils.HashInfo, body io.Reader) error
+	ResumePut(ctx context.Context, name string, state []byte, body io.ReadSeeker, opts ...PutOption) error
+	PutIfAbsent(ctx context.Context, name string, body io.Reader) error
+	Touch(ctx context.Context, name string) error
+	WriteAt(ctx context.Context, name string, off int64, data []byte) error
+	Append(ctx context.Context, name string, body io.Reader) error
+	DeleteBatch(ctx context.Context, names []string, parallel int) map[string]error
+	PutBatch(ctx context.Context, items []PutItem, parallel int) []error
+	Create(ctx context.Context, name string) (io.WriteCloser, error)
+	Open(ctx context.Context, name string) (io.ReadSeekCloser, error)
+	OpenReaderAt(ctx context.Context, name string) (io.ReaderAt, io.Closer, error)
+	List(ctx context.Context, dir string, opts ...ListOption) ([]Entry, error)
+	ListIter(ctx context.Context, dir string, fn func(Entry) error, opts ...ListOption) error
+	Walk(ctx context.Context, root string, fn fs.WalkDirFunc) error
+	Glob(ctx context.Context, pattern string) ([]string, error)
+	ListObjects(ctx context.Context, prefix, startAfter string, limit int) ([]Entry, string, error)
+	Usage(ctx context.Context, dir string, opts ...UsageOption) (files, dirs, bytes int64, err error)
+	Snapshot(ctx context.Context, dir string, w io.Writer) error
+	DiffLive(ctx context.Context, dir string, s *SnapshotReader, fn func(DiffEntry) error) error
+	VerifyLocal(ctx context.Context, localDir, remoteDir string, opts VerifyOptions) (Report, error)
+	SyncUp(ctx context.Context, localDir, remoteDir string, opts SyncOptions) (SyncReport, error)
+	DownloadTar(ctx context.Context, dir string, w io.Writer, opts ...TarOption) error
+	UploadArchive(ctx context.Context, dir string, r io.Reader, format ArchiveFormat, opts ...ArchiveOption) error
+	Stat(ctx context.Context, name string) (ObjInfo, error)
+	Hashes(ctx context.Context, name string) (map[*utils.HashType]string, error)
+	Rename(ctx context.Context, name, newName string) error
+	Move(ctx context.Context, src, dstDir string) error
+	Copy(ctx context.Context, src, dstDir string) error
+	Exists(ctx context.Context, name string) (bool, error)
+	Mkdir(ctx context.Context, dir string) error
+	RemoveAll(ctx context.Context, dir string) error
+	ApplyLifecycle(ctx context.Context, rules []LifecycleRule) (LifecycleReport, error)
+	StartLifecycle(rules []LifecycleRule, interval time.Duration) error
+	Restore(ctx context.Context, name string) error
+	EmptyTrash(ctx context.Context, olderThan time.Duration) (int, error)
+	ListVersions(ctx context.Context, name string) ([]Version, error)
+	RestoreVersion(ctx context.Context, name, version string) error
+	Capabilities() Capability
+	Flush()
+	Close() error
+}
+
+var (
+	ErrCrossDirRename = errors.New("rename can't move an object to another directory")
+	ErrDirFallback    = errors.New("directory can't be transferred without driver support")
+	ErrDirNotEmpty    = errors.New("directory not empty")
+	ErrReadOnly       = errors.New("file system is read only")
+	ErrInvalidName    = errors.New("invalid name")
+	ErrInvalidRange   = errors.New("invalid range")
+)
+
+// ObjInfo is the metadata of an object returned by Stat
+type ObjInfo struct {
+	// ID is the identity of the object in the driver, may be empty if the driver identifies objects by path
+	ID       string
+	Name     string
+	Size     int64
+	Modified time.Time
+	Ctime    time.Time
+	IsDir    bool
+	// Hashes are the hashes of the content reported by the driver, e.g. to check it end to end
+	Hashes utils.HashInfo
+}
+
+func newObjInfo(obj model.Obj) ObjInfo {
+	return ObjInfo{
+		ID:       obj.GetID(),
+		Name:     obj.GetName(),
+		Size:     obj.GetSize(),
+		Modified: obj.ModTime(),
+		Ctime:    obj.CreateTime(),
+		IsDir:    obj.IsDir(),
+		Hashes:   obj.GetHash(),
+	}
+}
+
+// Entry is an object in a directory returned by List
+type Entry struct {
+	Name     string
+	Size     int64
+	Modified time.Time
+	IsDir    bool
+	// Hashes are the hashes of the content reported by the driver
+	Hashes utils.HashInfo
 }
 
-type Impl struct{}
+func newEntry(obj model.Obj) Entry {
+	return Entry{
+		Name:     obj.GetName(),
+		Size:     obj.GetSize(),
+		Modified: obj.ModTime(),
+		IsDir:    obj.IsDir(),
+		Hashes:   obj.GetHash(),
+	}
+}
+
+type Impl struct {
+	storage   driver.Driver
+	conf      config
+	missing   cache.ICache[struct{}]
+	listCache *lruCache[[]model.Obj]
+	objCache  *lruCache[model.Obj]
+	linkCache cache.ICache[*model.Link]
+	listG     singleflight.Group[[]model.Obj]
+	mkdirG    singleflight.Group[struct{}]
+
+	metaLimiter *rate.Limiter
+	dataLimiter *rate.Limiter
+	metaSem     *semaphore.Weighted
+	uploadSem   *semaphore.Weighted
+	downloadSem *semaphore.Weighted
+	breaker     *breaker
+	locks       *pathLocks
+	readahead   *readahead
+	diskCache   *diskCache
+	memCache    *memCache
+
+	linkHits   atomic.Uint64
+	linkMisses atomic.Uint64
+	objHits    atomic.Uint64
+	objMisses  atomic.Uint64
+	stats      stats
+
+	// closeMu guards closed and cancels, which stop the goroutines of bg on Close
+	closeMu sync.Mutex
+	closed  bool
+	cancels []context.CancelFunc
+	bg      sync.WaitGroup
+}
+
+func newImpl(storage driver.Driver, opts ...Option) *Impl {
+	i := &Impl{
+		storage:   storage,
+		conf:      defaultConfig(),
+		missing:   cache.NewMemCache(cache.WithShards[struct{}](16)),
+		linkCache: cache.NewMemCache(cache.WithShards[*model.Link](64)),
+	}
+	for _, opt := range opts {
+		opt(&i.conf)
+	}
+	i.listCache = newLRUCache[[]model.Obj](i.conf.listCacheEntries)
+	i.objCache = newLRUCache[model.Obj](i.conf.objCacheEntries)
+	i.metaLimiter = newLimiter(i.conf.metaRate, i.conf.metaBurst)
+	i.dataLimiter = newLimiter(i.conf.dataRate, i.conf.dataBurst)
+	i.metaSem = newSemaphore(i.conf.metaConcurrency)
+	i.uploadSem = newSemaphore(i.conf.uploadConcurrency)
+	i.downloadSem = newSemaphore(i.conf.downloadConcurrency)
+	i.breaker = newBreaker(i.conf.breakerThreshold, i.conf.breakerCooldown, i.conf.breakerOnChange)
+	i.locks = newPathLocks()
+	i.readahead = newReadahead(i)
+	i.memCache = newMemCache(i)
+	return i
+}
+
+// New creates a FileSystem on a new instance of the default driver, which is the first one registered
+func New(ctx context.Context, addition string, opts ...Option) (FileSystem, error) {
+	factory, err := defaultFactory()
+	if err != nil {
+		return nil, err
+	}
+	return newWithAddition(ctx, factory(), addition, opts...)
+}
 
-func New(ctx context.Context, addition string) (FileSystem, error) {
-	conf.Conf = conf.DefaultConfig()
-	base.InitClient()
-	if err := json.Unmarshal([]byte(addition), Storage.GetAddition()); err != nil {
+// newWithAddition parses addition into d and inits d before wrapping it
+func newWithAddition(ctx context.Context, d driver.Driver, addition string, opts ...Option) (FileSystem, error) {
+	i := newImpl(d, opts...)
+	if err := i.conf.validate(); err != nil {
 		return nil, err
 	}
-	if err := Storage.Init(ctx); err != nil {
+	if err := checkStorage(d, i.conf.readOnly); err != nil {
 		return nil, err
 	}
-	i := &Impl{}
-	if err := i.mkdir(ctx, baseDir); err != nil {
+	if err := initGlobals(i.conf); err != nil {
+		return nil, err
+	}
+	var err error
+	if i.diskCache, err = newDiskCache(i); err != nil {
+		return nil, errors.WithMessage(err, "failed to open the disk cache")
+	}
+	// the errors must not leak the credentials in addition
+	if err := json.Unmarshal([]byte(addition), i.storage.GetAddition()); err != nil {
+		return nil, redactErr(errors.WithMessage(err, "failed to parse the addition"), d, addition)
+	}
+	start := time.Now()
+	if err := i.storage.Init(ctx); err != nil {
+		err = redactErr(errors.WithMessage(err, "failed to init the storage"), d, addition)
+		i.conf.logger.Warn("driver init failed", "driver", d.Config().Name, "error", errValue(err))
 		return nil, err
 	}
-	return i, nil
+	i.conf.logger.Info("driver initialized", "driver", d.Config().Name, "duration", time.Since(start))
+	if !i.conf.noAutoMkdir && !i.conf.readOnly {
+		if err := i.mkdir(ctx, i.conf.baseDir); err != nil {
+			return nil, err
+		}
+	}
+	return i.layout(), nil
+}
+
+// NewWithStorage wraps d which has been initialized already, e.g. by the op layer of alist,
+// the addition isn't parsed and Init isn't called
+func NewWithStorage(ctx context.Context, d driver.Driver, opts ...Option) (FileSystem, error) {
+	i := newImpl(d, opts...)
+	if err := i.conf.validate(); err != nil {
+		return nil, err
+	}
+	if err := checkStorage(d, i.conf.readOnly); err != nil {
+		return nil, err
+	}
+	var err error
+	if i.diskCache, err = newDiskCache(i); err != nil {
+		return nil, errors.WithMessage(err, "failed to open the disk cache")
+	}
+	if !i.conf.noAutoMkdir && !i.conf.readOnly {
+		if err := i.mkdir(ctx, i.conf.baseDir); err != nil {
+			return nil, err
+		}
+	}
+	return i.layout(), nil
+}
+
+// checkStorage verifies d implements the interfaces needed to find the root,
+// and the ones needed to write unless readOnly is set
+func checkStorage(d driver.Driver, readOnly bool) error {
+	if d == nil {
+		return errors.New("storage is nil")
+	}
+	if _, ok := d.(driver.GetRooter); !ok {
+		switch d.GetAddition().(type) {
+		case driver.IRootId, driver.IRootPath:
+		default:
+			return errors.Errorf("driver [%s] should implement IRootPath or IRootId or GetRooter", d.Config().Name)
+		}
+	}
+	if missing := CapWrite &^ capabilities(d); !readOnly && missing != 0 {
+		return errors.WithMessagef(errs.NotImplement,
+			"driver [%s] does not support %s; export requires write capability, use WithReadOnly otherwise", d.Config().Name, missing)
+	}
+	return nil
+}
+
+// writable returns ErrReadOnly if the FileSystem is read only
+func (i *Impl) writable() error {
+	if i.conf.readOnly {
+		return errors.WithStack(ErrReadOnly)
+	}
+	return nil
+}
+
+// toSlash replaces the backslashes in name, which may be a path built on Windows,
+// as the paths of the storage are always separated by slashes
+func toSlash(name string) string {
+	return strings.ReplaceAll(name, "\\", "/")
 }
 
-func (i *Impl) Delete(ctx context.Context, name string) error {
-	rawObj, err := i.get(ctx, filepath.Join(baseDir, name))
+// cleanPath returns the path of name in the storage. name is relative to the baseDir even if it
+// starts with a slash, backslashes are taken as slashes, and it's cleaned, so "a//b" is "a/b",
+// "./a" is "a" and "a/" is "a". Names containing NUL or escaping the baseDir like "../a"
+// are refused with ErrInvalidName
+func (i *Impl) cleanPath(name string) (string, error) {
+	if strings.ContainsRune(name, 0) {
+		return "", errors.WithMessagef(ErrInvalidName, "%q contains NUL", name)
+	}
+	p := stdpath.Clean(strings.TrimLeft(toSlash(name), "/"))
+	if p == ".." || strings.HasPrefix(p, "../") {
+		return "", errors.WithMessagef(ErrInvalidName, "[%s] is out of the base dir", name)
+	}
+	return stdpath.Join(i.conf.baseDir, p), nil
+}
+
+// objPath returns the path of name in the storage like cleanPath, which must not be the baseDir
+// itself, so that a name like "", "/" or "a/.." can't remove or move the whole tree
+func (i *Impl) objPath(name string) (string, error) {
+	p, err := i.cleanPath(name)
+	if err != nil {
+		return "", err
+	}
+	if p == i.conf.baseDir {
+		return "", errors.WithMessagef(ErrInvalidName, "[%s] is the base dir", name)
+	}
+	return p, nil
+}
+
+func (i *Impl) Delete(ctx context.Context, name string) (err error) {
+	ctx, end := i.startOp(ctx, "delete", name)
+	defer end(&err)
+	ctx, cancel := withTimeout(ctx, i.conf.writeTimeout)
+	defer cancel()
+	if err := i.writable(); err != nil {
+		return err
+	}
+	path, err := i.objPath(name)
+	if err != nil {
+		return err
+	}
+	rawObj, err := i.get(ctx, path)
 	if err != nil {
 		if errs.IsObjectNotFound(err) {
 			return nil
 		}
 		return errors.WithMessage(err, "failed to get object")
 	}
+	return i.deleteObj(ctx, path, rawObj)
+}
 
-	switch s := Storage.(type) {
-	case driver.Remove:
-		err = s.Remove(ctx, model.UnwrapObj(rawObj))
-	default:
-		err = errs.NotImplement
+// deleteObj removes obj at path unless it's a dir which isn't empty, files go to the trash by WithTrash
+func (i *Impl) deleteObj(ctx context.Context, path string, obj model.Obj) error {
+	if obj.IsDir() {
+		objs, err := i.list(ctx, path, model.ListArgs{})
+		if err != nil {
+			return errors.WithMessage(err, "failed to list dir")
+		}
+		if len(objs) > 0 {
+			return errors.WithStack(ErrDirNotEmpty)
+		}
+	}
+	traceOf(ctx).setSize(obj.GetSize())
+	if !obj.IsDir() && i.canTrash() && !i.isTrash(path) {
+		return i.trashObj(ctx, path, obj)
+	}
+	return i.remove(ctx, path, obj)
+}
+
+// RemoveAll removes dir and everything in it, children are removed before their parents
+func (i *Impl) RemoveAll(ctx context.Context, dir string) (err error) {
+	ctx, end := i.startOp(ctx, "removeall", dir)
+	defer end(&err)
+	ctx, cancel := withTimeout(ctx, i.conf.writeTimeout)
+	defer cancel()
+	if err := i.writable(); err != nil {
+		return err
+	}
+	dir, err = i.objPath(dir)
+	if err != nil {
+		return err
+	}
+	rawObj, err := i.get(ctx, dir)
+	if err != nil {
+		if errs.IsObjectNotFound(err) {
+			return nil
+		}
+		return errors.WithMessage(err, "failed to get object")
+	}
+	return i.removeAll(ctx, dir, rawObj)
+}
+
+func (i *Impl) removeAll(ctx context.Context, path string, obj model.Obj) error {
+	if obj.IsDir() {
+		objs, err := i.list(ctx, path, model.ListArgs{})
+		if err != nil {
+			return errors.WithMessagef(err, "failed to list dir [%s]", path)
+		}
+		g, gCtx := errgroup.NewGroupWithContext(ctx, i.conf.removeParallel,
+			retry.Attempts(1),
+			retry.LastErrorOnly(true))
+		for _, child := range objs {
+			if utils.IsCanceled(gCtx) {
+				break
+			}
+			child := child
+			g.Go(func(ctx context.Context) error {
+				return i.removeAll(ctx, stdpath.Join(path, child.GetName()), child)
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return err
+		}
+	}
+	if err := i.remove(ctx, path, obj); err != nil && !errs.IsObjectNotFound(err) {
+		return errors.WithMessagef(err, "failed to remove [%s]", path)
+	}
+	return nil
+}
+
+func (i *Impl) remove(ctx context.Context, path string, obj model.Obj) error {
+	var err error
+	s, ok := i.storage.(driver.Remove)
+	if !ok {
+		return errs.NotImplement
+	}
+	err = i.retry(ctx, func() error {
+		release, err := i.beginMeta(ctx)
+		if err != nil {
+			return err
+		}
+		defer release()
+		return s.Remove(ctx, model.UnwrapObj(obj))
+	})
+	if err == nil {
+		i.stats.deletes.Add(1)
+		i.removed(path, obj.IsDir())
+		if c, ok := obj.(*chunkedObj); ok {
+			i.removeParts(ctx, c.m.UploadID)
+		}
 	}
 	return err
 }
 
-func (i *Impl) Read(ctx context.Context, name string, off, limit int64) (io.ReadCloser, error) {
-	file, err := i.get(ctx, filepath.Join(baseDir, name))
+// Read opens limit bytes of name from off, the read timeout lasts until the reader is closed.
+// A limit <= 0 reads until EOF and a limit past EOF is clamped, off at or beyond EOF gives
+// an empty reader, and a negative off fails with ErrInvalidRange
+func (i *Impl) Read(ctx context.Context, name string, off, limit int64) (_ io.ReadCloser, err error) {
+	ctx, end := i.startOp(ctx, "read", name)
+	// the read ends with the close of the reader returned
+	open := false
+	defer func() {
+		if !open {
+			end(&err)
+		}
+	}()
+	path, err := i.cleanPath(name)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withTimeout(ctx, i.conf.readTimeout)
+	file, err := i.get(ctx, path)
 	if err != nil {
+		cancel()
 		return nil, errors.WithMessage(err, "failed to get file")
 	}
 	if file.IsDir() {
+		cancel()
 		return nil, errors.WithStack(errs.NotFile)
 	}
+	size := file.GetSize()
+	if off < 0 {
+		cancel()
+		return nil, errors.WithMessagef(ErrInvalidRange, "negative offset %d", off)
+	}
+	// drivers differ on ranges out of the file, some fail with 416, so they are never requested
+	if off >= size {
+		cancel()
+		i.stats.gets.Add(1)
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	if limit <= 0 || limit > size-off {
+		limit = size - off
+	}
 
-	link, err := Storage.Link(ctx, file, model.LinkArgs{Header: http.Header{}})
+	dctx, done := i.startCall(ctx, "Download", path)
+	rc, err := i.memCache.read(dctx, path, file, off, limit)
+	if rc == nil && err == nil {
+		if rc = i.readahead.read(dctx, path, file, off, limit); rc == nil {
+			rc, err = i.rangeRead(dctx, file, off, limit)
+		}
+	}
 	if err != nil {
+		done(0, err)
+		cancel()
 		return nil, err
 	}
-	fs := stream.FileStream{
-		Obj: file,
-		Ctx: ctx,
+	i.stats.gets.Add(1)
+	var r io.Reader = rc
+	var v *verifyingReader
+	if i.conf.verifyRead && off == 0 && limit == size {
+		if v = newVerifyingReader(rc, path, file.GetHash()); v != nil {
+			r = v
+		}
 	}
-	// any link provided is seekable
-	ss, err := stream.NewSeekableStream(fs, link)
+	cr := &countingReader{r: i.downloaded(r)}
+	open = true
+	var once sync.Once
+	return utils.NewReadCloser(cr, func() (err error) {
+		once.Do(func() {
+			defer cancel()
+			if err = rc.Close(); err == nil {
+				err = v.mismatch()
+			}
+			done(cr.n, err)
+			end(&err)
+		})
+		return err
+	}), nil
+}
+
+func (i *Impl) Put(ctx context.Context, name string, body io.Reader) (err error) {
+	ctx, end := i.startOp(ctx, "put", name)
+	defer end(&err)
+	_, err = i.putFile(ctx, name, body, -1, putOptions{})
+	return err
+}
+
+// PutWithSize uploads size bytes of body to name without buffering them,
+// if size is negative, body is spooled first to find out its size
+func (i *Impl) PutWithSize(ctx context.Context, name string, body io.Reader, size int64) (err error) {
+	ctx, end := i.startOp(ctx, "put", name)
+	defer end(&err)
+	_, err = i.putFile(ctx, name, body, size, putOptions{})
+	return err
+}
+
+// PutResult uploads body to name like Put, and returns the object created by the driver.
+// Some drivers may rename or normalize the object, for drivers which don't report
+// the created object, the info is built from the uploaded one
+func (i *Impl) PutResult(ctx context.Context, name string, body io.Reader) (_ ObjInfo, err error) {
+	ctx, end := i.startOp(ctx, "put", name)
+	defer end(&err)
+	obj, err := i.putFile(ctx, name, body, -1, putOptions{})
 	if err != nil {
-		return nil, errors.WithMessagef(err, "failed get [%s] stream", file)
+		return ObjInfo{}, err
 	}
+	return newObjInfo(obj), nil
+}
 
-	reader, err := ss.RangeRead(http_range.Range{Start: off, Length: limit})
+// PutWithOptions uploads body to name like PutResult, configured by opts
+func (i *Impl) PutWithOptions(ctx context.Context, name string, body io.Reader, opts ...PutOption) (_ ObjInfo, err error) {
+	ctx, end := i.startOp(ctx, "put", name)
+	defer end(&err)
+	o := newPutOptions(opts)
+	size := int64(-1)
+	if o.sized {
+		size = o.size
+	}
+	obj, err := i.putFile(ctx, name, body, size, o)
 	if err != nil {
-		return nil, err
+		return ObjInfo{}, err
+	}
+	return newObjInfo(obj), nil
+}
+
+// PutWithHash uploads size bytes of body to name with their known hashes, so drivers supporting
+// rapid upload, like 189, Baidu and 115, can complete it without the transfer if the provider
+// already has the content. body is only read if the driver uploads it, the hashes of
+// WithUploadHashes missing from hashes aren't computed
+func (i *Impl) PutWithHash(ctx context.Context, name string, size int64, hashes utils.HashInfo, body io.Reader) (err error) {
+	ctx, end := i.startOp(ctx, "put", name)
+	defer end(&err)
+	if size < 0 {
+		return errors.Errorf("size of [%s] must be known, got %d", name, size)
 	}
-	return io.NopCloser(reader), nil
+	_, err = i.putFile(ctx, name, body, size, putOptions{hashes: hashes, lazy: true})
+	return err
 }
 
-func (i *Impl) Put(ctx context.Context, name string, body io.Reader) error {
-	data, err := io.ReadAll(body)
+func (i *Impl) putFile(ctx context.Context, name string, body io.Reader, size int64, o putOptions) (model.Obj, error) {
+	ctx, cancel := withTimeout(ctx, i.conf.writeTimeout)
+	defer cancel()
+	if err := i.writable(); err != nil {
+		return nil, err
+	}
+	name, err := i.objPath(name)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	name = filepath.Join(baseDir, name)
-	dir := filepath.Dir(name)
-	realName := filepath.Base(name)
+	// the parts of a chunked object replaced are removed after the upload
+	var old model.Obj
+	policy := i.conflictPolicy(o)
+	if policy != ConflictDriver {
+		if name, old, err = i.resolveConflict(ctx, name, policy); err != nil {
+			return nil, err
+		}
+	} else if i.conf.partSize > 0 {
+		old, _ = i.get(ctx, name)
+	}
+	hashes := o.hashes
+	var missing []*utils.HashType
+	if !o.lazy {
+		missing = i.missingHashes(hashes)
+	}
+	rs, seekable := body.(io.ReadSeeker)
+	if size < 0 || len(missing) > 0 && !seekable {
+		f, n, err := spool(ctx, body, i.conf.spoolThreshold)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to spool body")
+		}
+		defer f.Close()
+		if size >= 0 && n != size {
+			return nil, errors.Errorf("body has %d bytes instead of %d", n, size)
+		}
+		body, rs, size = f, f, n
+	}
+	if len(missing) > 0 {
+		if hashes, err = hashBody(rs, size, missing, hashes); err != nil {
+			return nil, err
+		}
+	}
+	traceOf(ctx).setSize(size)
+	dir := stdpath.Dir(name)
+	realName := stdpath.Base(name)
 
 	obj := model.Object{
 		Name:     realName,
-		Size:     int64(len(data)),
+		Size:     size,
 		Modified: time.Now(),
 		Ctime:    time.Now(),
+		HashInfo: hashes,
 	}
-
-	stream := &stream.FileStream{
-		Obj:    &obj,
-		Reader: bytes.NewReader(data),
+	if !o.modTime.IsZero() {
+		obj.Modified = o.modTime
 	}
 
 	if err := i.mkdir(ctx, dir); err != nil {
-		return errors.WithMessagef(err, "failed to make dir [%s]", baseDir)
+		return nil, errors.WithMessagef(err, "failed to make dir [%s]", dir)
 	}
 
 	parentDir, err := i.get(ctx, dir)
 	if err != nil {
-		return errors.WithMessagef(err, "failed to get dir [%s]", baseDir)
+		return nil, errors.WithMessagef(err, "failed to get dir [%s]", dir)
+	}
+	p := newProgress(o.progress, size)
+	var newObj model.Obj
+	st := o.resume
+	if st == nil && i.chunked(size) {
+		st = newUploadState(name, size, i.conf.partSize)
+	}
+	mode := i.atomicMode()
+	if mode == 0 && o.atomic {
+		mode = i.renameMode()
 	}
-	up := func(p float64) {}
+	// the object replaced is kept as a version, or removed, only once the new one is uploaded
+	version := i.canVersion() && (policy == ConflictDriver || policy == ConflictOverwrite) && !i.isVersion(name)
+	if version && old == nil {
+		old, _ = i.get(ctx, name)
+	}
+	versioned := false
+	replaceOld := func(ctx context.Context, path string, old model.Obj) error {
+		if version {
+			if err := i.keepVersion(ctx, path, old); err != nil {
+				return err
+			}
+			versioned = true
+			return nil
+		}
+		if err := i.remove(ctx, path, model.UnwrapObj(old)); err != nil {
+			return errors.WithMessagef(err, "failed to remove the object replaced [%s]", path)
+		}
+		return nil
+	}
+	replacing := old != nil && !old.IsDir() && (version || policy == ConflictOverwrite)
+	if replacing && st == nil && mode == 0 {
+		// uploaded to a temporary object, so the object replaced stays until the upload succeeds
+		mode = i.renameMode()
+	}
+	if st != nil {
+		var replace func(context.Context) error
+		if replacing {
+			replace = func(ctx context.Context) error { return replaceOld(ctx, name, old) }
+		}
+		if newObj, err = i.putChunked(ctx, parentDir, &obj, body, p, st, replace); err != nil && o.resumeState != nil {
+			o.resumeState(st.marshal())
+		}
+	} else if mode != 0 {
+		var replace func(context.Context, string, model.Obj) error
+		if policy == ConflictDriver || policy == ConflictOverwrite {
+			replace = replaceOld
+		}
+		newObj, err = i.putAtomic(ctx, parentDir, dir, &obj, body, p, mode, replace)
+	} else {
+		// the driver can neither rename nor move, the object replaced has to go first
+		if replacing {
+			if err = replaceOld(ctx, name, old); err != nil {
+				return nil, err
+			}
+		}
+		err = i.retryBody(ctx, body, func() (err error) {
+			newObj, err = i.put(ctx, parentDir, &obj, body, p)
+			return err
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.done()
+	i.created(name, false)
+	if versioned {
+		i.pruneVersions(ctx, name)
+	}
+	// the parts of a version are kept with it
+	if c, ok := old.(*chunkedObj); ok && !versioned {
+		i.removeParts(ctx, c.m.UploadID)
+	}
+	// parts are verified by putChunked
+	if i.conf.verifyPut && st == nil {
+		// put returns obj itself unless the driver reports the created object
+		if err := i.verifyPut(ctx, name, newObj, newObj != model.Obj(&obj), size); err != nil {
+			return nil, err
+		}
+	}
+	return newObj, nil
+}
+
+// put uploads the content of obj read from r into parentDir reporting to p, which may be nil,
+// and returns the created object, or obj if the driver doesn't tell
+func (i *Impl) put(ctx context.Context, parentDir model.Obj, obj *model.Object, r io.Reader, p *progress) (model.Obj, error) {
+	stream := &stream.FileStream{
+		Ctx:    ctx,
+		Obj:    obj,
+		Reader: p.reader(r),
+	}
+	up := func(percent float64) { p.update(percent) }
 
-	switch s := Storage.(type) {
+	release, err := i.beginUpload(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	var newObj model.Obj
+	callCtx, end := i.startCall(ctx, "Put", stdpath.Join(parentDir.GetPath(), obj.GetName()))
+	switch s := i.storage.(type) {
 	case driver.PutResult:
-		_, err = s.Put(ctx, parentDir, stream, up)
+		newObj, err = s.Put(callCtx, parentDir, stream, up)
 	case driver.Put:
-		err = s.Put(ctx, parentDir, stream, up)
+		err = s.Put(callCtx, parentDir, stream, up)
 	default:
-		return errs.NotImplement
+		err = errs.NotImplement
+	}
+	if err != nil {
+		end(0, err)
+		return nil, errors.WithStack(err)
+	}
+	end(obj.GetSize(), nil)
+	i.stats.puts.Add(1)
+	i.uploaded(obj.GetSize())
+	if newObj == nil {
+		return obj, nil
+	}
+	return model.WrapObjName(newObj), nil
+}
+
+// Move moves src into dstDir, dstDir will be created if it doesn't exist
+func (i *Impl) Move(ctx context.Context, src, dstDir string) (err error) {
+	ctx, end := i.startOp(ctx, "move", src)
+	defer end(&err)
+	ctx, cancel := withTimeout(ctx, i.conf.writeTimeout)
+	defer cancel()
+	if err := i.writable(); err != nil {
+		return err
+	}
+	srcPath, err := i.objPath(src)
+	if err != nil {
+		return err
+	}
+	srcRawObj, err := i.get(ctx, srcPath)
+	if err != nil {
+		return errors.WithMessage(err, "failed to get src object")
+	}
+	dstDirPath, err := i.cleanPath(dstDir)
+	if err != nil {
+		return err
+	}
+	return i.moveTo(ctx, srcPath, srcRawObj, dstDirPath)
+}
+
+// moveTo moves srcRawObj at srcPath into the dir at dstDirPath, making it if not found
+func (i *Impl) moveTo(ctx context.Context, srcPath string, srcRawObj model.Obj, dstDirPath string) error {
+	dstDirObj, err := i.dstDir(ctx, dstDirPath)
+	if err != nil {
+		return err
+	}
+
+	release, err := i.beginMeta(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	switch s := i.storage.(type) {
+	case driver.MoveResult:
+		_, err = s.Move(ctx, model.UnwrapObj(srcRawObj), model.UnwrapObj(dstDirObj))
+	case driver.Move:
+		err = s.Move(ctx, model.UnwrapObj(srcRawObj), model.UnwrapObj(dstDirObj))
+	default:
+		// the fallback takes slots of its own calls
+		release()
+		if _, ok := i.storage.(driver.Remove); !ok || !i.conf.moveFallback {
+			return errs.NotImplement
+		}
+		if srcRawObj.IsDir() {
+			return errors.WithStack(ErrDirFallback)
+		}
+		if err = i.copyFile(ctx, srcRawObj, dstDirObj); err != nil {
+			return errors.WithMessage(err, "failed to copy src object")
+		}
+		err = i.remove(ctx, srcPath, srcRawObj)
+	}
+	if err == nil {
+		i.removed(srcPath, srcRawObj.IsDir())
+		i.created(stdpath.Join(dstDirPath, srcRawObj.GetName()), srcRawObj.IsDir())
 	}
 	return errors.WithStack(err)
 }
 
+// Copy copies src into dstDir, dstDir will be created if it doesn't exist. src can't be the
+// base dir, and dstDir can't be src or below it, failing with ErrInvalidName.
+// Without driver support files are streamed into dstDir unless WithoutCopyFallback is set
+func (i *Impl) Copy(ctx context.Context, src, dstDir string) (err error) {
+	ctx, end := i.startOp(ctx, "copy", src)
+	defer end(&err)
+	ctx, cancel := withTimeout(ctx, i.conf.writeTimeout)
+	defer cancel()
+	if err := i.writable(); err != nil {
+		return err
+	}
+	srcPath, err := i.objPath(src)
+	if err != nil {
+		return err
+	}
+	dstDirPath, err := i.cleanPath(dstDir)
+	if err != nil {
+		return err
+	}
+	if dstDirPath == srcPath || strings.HasPrefix(dstDirPath, srcPath+"/") {
+		return errors.WithMessagef(ErrInvalidName, "[%s] can't be copied into itself", src)
+	}
+	srcObj, err := i.get(ctx, srcPath)
+	if err != nil {
+		return errors.WithMessage(err, "failed to get src object")
+	}
+	dstDirObj, err := i.dstDir(ctx, dstDirPath)
+	if err != nil {
+		return err
+	}
+
+	// copied natively, the parts of a chunked object would be shared by both copies
+	if c, ok := srcObj.(*chunkedObj); ok {
+		return i.copyChunked(ctx, c, dstDirObj, stdpath.Join(dstDirPath, srcObj.GetName()))
+	}
+	if i.conf.partSize > 0 && srcObj.IsDir() {
+		return errors.WithMessage(ErrDirFallback, "directories may have chunked objects")
+	}
+
+	release, err := i.beginMeta(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	switch s := i.storage.(type) {
+	case driver.CopyResult:
+		_, err = s.Copy(ctx, model.UnwrapObj(srcObj), model.UnwrapObj(dstDirObj))
+	case driver.Copy:
+		err = s.Copy(ctx, model.UnwrapObj(srcObj), model.UnwrapObj(dstDirObj))
+	default:
+		// the fallback takes slots of its own calls
+		release()
+		if i.conf.noCopyFallback {
+			return errs.NotImplement
+		}
+		if srcObj.IsDir() {
+			return errors.WithStack(ErrDirFallback)
+		}
+		err = i.copyFile(ctx, srcObj, dstDirObj)
+	}
+	if err == nil {
+		i.created(stdpath.Join(dstDirPath, srcObj.GetName()), srcObj.IsDir())
+	}
+	return errors.WithStack(err)
+}
+
+// dstDir gets the destination dir of Move and Copy, making it if not found
+func (i *Impl) dstDir(ctx context.Context, dir string) (model.Obj, error) {
+	if err := i.mkdir(ctx, dir); err != nil {
+		return nil, errors.WithMessagef(err, "failed to make dst dir [%s]", dir)
+	}
+	obj, err := i.get(ctx, dir)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to get dst dir [%s]", dir)
+	}
+	return obj, nil
+}
+
+// copyFile streams file into dstDir keeping its name, size and times
+func (i *Impl) copyFile(ctx context.Context, file, dstDir model.Obj) error {
+	r, err := i.rangeRead(ctx, file, 0, file.GetSize())
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	obj := &model.Object{
+		Name:     file.GetName(),
+		Size:     file.GetSize(),
+		Modified: file.ModTime(),
+		Ctime:    file.CreateTime(),
+		HashInfo: file.GetHash(),
+	}
+	_, err = i.put(ctx, dstDir, obj, r, nil)
+	return err
+}
+
+func (i *Impl) List(ctx context.Context, dir string, opts ...ListOption) (_ []Entry, err error) {
+	ctx, end := i.startOp(ctx, "list", dir)
+	defer end(&err)
+	path, err := i.cleanPath(dir)
+	if err != nil {
+		return nil, err
+	}
+	objs, err := i.list(ctx, path, model.ListArgs{})
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to list dir")
+	}
+	o := newListOptions(opts)
+	entries := make([]Entry, 0, len(objs))
+	for _, obj := range objs {
+		if path == i.conf.baseDir && i.hidden(stdpath.Join(path, obj.GetName())) || !o.keep(obj) {
+			continue
+		}
+		entries = append(entries, newEntry(obj))
+	}
+	o.sort(entries)
+	return entries, nil
+}
+
+// Stat returns the metadata of name without opening it,
+// use errs.IsObjectNotFound to check whether the object doesn't exist
+func (i *Impl) Stat(ctx context.Context, name string) (_ ObjInfo, err error) {
+	ctx, end := i.startOp(ctx, "stat", name)
+	defer end(&err)
+	path, err := i.cleanPath(name)
+	if err != nil {
+		return ObjInfo{}, err
+	}
+	obj, err := i.get(ctx, path)
+	if err != nil {
+		return ObjInfo{}, errors.WithMessage(err, "failed to get object")
+	}
+	i.diskCache.observe(path, obj)
+	return newObjInfo(obj), nil
+}
+
+// Hashes returns the hashes of name reported by the driver by their types,
+// which is empty if the driver reports none
+func (i *Impl) Hashes(ctx context.Context, name string) (_ map[*utils.HashType]string, err error) {
+	ctx, end := i.startOp(ctx, "stat", name)
+	defer end(&err)
+	path, err := i.cleanPath(name)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := i.get(ctx, path)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to get object")
+	}
+	hashes := map[*utils.HashType]string{}
+	for t, v := range obj.GetHash().Export() {
+		if v != "" {
+			hashes[t] = v
+		}
+	}
+	return hashes, nil
+}
+
+// Rename renames name to newName in the same directory,
+// newName is either a bare name or a path sharing the parent of name
+func (i *Impl) Rename(ctx context.Context, name, newName string) (err error) {
+	ctx, end := i.startOp(ctx, "rename", name)
+	defer end(&err)
+	traceOf(ctx).target = newName
+	ctx, cancel := withTimeout(ctx, i.conf.writeTimeout)
+	defer cancel()
+	if err := i.writable(); err != nil {
+		return err
+	}
+	name, err = i.objPath(name)
+	if err != nil {
+		return err
+	}
+	newName = toSlash(newName)
+	dstName := stdpath.Base(newName)
+	if dstName == "." || dstName == ".." || dstName == "/" {
+		return errors.WithMessagef(ErrInvalidName, "[%s] can't be the new name", newName)
+	}
+	newPath, err := i.cleanPath(newName)
+	if err != nil {
+		return err
+	}
+	if newPath != stdpath.Join(stdpath.Dir(name), dstName) && newName != dstName {
+		return errors.WithStack(ErrCrossDirRename)
+	}
+	rawObj, err := i.get(ctx, name)
+	if err != nil {
+		return errors.WithMessage(err, "failed to get object")
+	}
+
+	release, err := i.beginMeta(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err = i.renameObj(ctx, rawObj, dstName); err == nil {
+		i.removed(name, rawObj.IsDir())
+		i.created(stdpath.Join(stdpath.Dir(name), dstName), rawObj.IsDir())
+	}
+	return err
+}
+
+// Exists reports whether name exists, a missing object is remembered for a short while.
+// Errors other than not found are returned so that outages won't be taken as absence
+func (i *Impl) Exists(ctx context.Context, name string) (_ bool, err error) {
+	ctx, end := i.startOp(ctx, "stat", name)
+	defer end(&err)
+	path, err := i.cleanPath(name)
+	if err != nil {
+		return false, err
+	}
+	if _, err := i.get(ctx, path); err != nil {
+		if errs.IsObjectNotFound(err) {
+			return false, nil
+		}
+		return false, errors.WithMessage(err, "failed to get object")
+	}
+	return true, nil
+}
+
+// get resolves the object at path, the object is cached if WithObjCache is set
+// and a missing object is remembered for conf.missingTTL
 func (i *Impl) get(ctx context.Context, path string) (model.Obj, error) {
+	if obj, ok := i.getObj(path); ok {
+		return obj, nil
+	}
+	if i.isMissing(path) {
+		return nil, errors.WithStack(errs.ObjectNotFound)
+	}
+	obj, err := i.resolve(ctx, path)
+	if err == nil {
+		obj, err = i.resolveChunked(ctx, path, obj)
+	}
+	switch {
+	case err == nil:
+		i.setObj(path, obj)
+	case errs.IsObjectNotFound(err):
+		i.setMissing(path)
+	}
+	return obj, err
+}
+
+// resolve gets the object at path, which is a path of the storage already rooted at the base dir,
+// e.g. made by cleanPath
+func (i *Impl) resolve(ctx context.Context, path string) (model.Obj, error) {
+	ctx, cancel := withTimeout(ctx, i.conf.metaTimeout)
+	defer cancel()
 	// get the obj directly without list so that we can reduce the io
-	if g, ok := Storage.(driver.Getter); ok {
-		if path != baseDir {
-			path = filepath.Join(baseDir, path)
+	if g, ok := i.storage.(driver.Getter); ok {
+		release, err := i.beginMeta(ctx)
+		if err != nil {
+			return nil, err
 		}
-		obj, err := g.Get(ctx, path)
+		callCtx, end := i.startCall(ctx, "Get", path)
+		obj, err := g.Get(callCtx, path)
+		end(0, err)
+		release()
 		if err == nil {
 			return model.WrapObjName(obj), nil
 		}
+		// some drivers can't get every object, e.g. the root, look it up in the listing then
+		if !isNotFound(err) {
+			return nil, errors.WithMessagef(err, "failed to get [%s] from the driver", path)
+		}
 	}
 
 	// is root folder
 	if path == "/" {
 		var rootObj model.Obj
-		if getRooter, ok := Storage.(driver.GetRooter); ok {
+		if getRooter, ok := i.storage.(driver.GetRooter); ok {
+			release, err := i.beginMeta(ctx)
+			if err != nil {
+				return nil, err
+			}
 			obj, err := getRooter.GetRoot(ctx)
+			release()
 			if err != nil {
 				return nil, errors.WithMessage(err, "failed get root obj")
 			}
 			rootObj = obj
 		} else {
-			switch r := Storage.GetAddition().(type) {
+			switch r := i.storage.GetAddition().(type) {
 			case driver.IRootId:
 				rootObj = &model.Object{
 					ID:       r.GetRootId(),
 					Name:     RootName,
 					Size:     0,
-					Modified: Storage.GetStorage().Modified,
+					Modified: i.storage.GetStorage().Modified,
 					IsFolder: true,
 				}
 			case driver.IRootPath:
@@ -175,7 +1114,7 @@ func (i *Impl) get(ctx context.Context, path string) (model.Obj, error) {
 					Path:     r.GetRootPath(),
 					Name:     RootName,
 					Size:     0,
-					Modified: Storage.GetStorage().Modified,
+					Modified: i.storage.GetStorage().Modified,
 					IsFolder: true,
 				}
 			default:
@@ -191,58 +1130,120 @@ func (i *Impl) get(ctx context.Context, path string) (model.Obj, error) {
 		}, nil
 	}
 
-	p := filepath.Dir(path)
+	p := stdpath.Dir(path)
 	if p == "." {
 		p = "/"
 	}
 
-	realName := filepath.Base(path)
-	files, err := i.list(ctx, p, model.ListArgs{})
-	if err != nil {
+	// the listing stops at the object
+	realName := stdpath.Base(path)
+	var found model.Obj
+	err := i.iter(ctx, p, func(f model.Obj) error {
+		if f.GetName() != realName {
+			return nil
+		}
+		found = f
+		return ErrStopList
+	})
+	if err != nil && !errors.Is(err, ErrStopList) {
 		return nil, errors.WithMessage(err, "failed get parent list")
 	}
-	for _, f := range files {
-		if f.GetName() == realName {
-			return f, nil
-		}
+	if found == nil {
+		return nil, errors.WithStack(errs.ObjectNotFound)
 	}
-	return nil, errors.WithStack(errs.ObjectNotFound)
+	return found, nil
 }
 
-var listG singleflight.Group[[]model.Obj]
+// Mkdir makes dir and all its missing parents, it's fine if dir already exists
+func (i *Impl) Mkdir(ctx context.Context, dir string) (err error) {
+	ctx, end := i.startOp(ctx, "mkdir", dir)
+	defer end(&err)
+	ctx, cancel := withTimeout(ctx, i.conf.writeTimeout)
+	defer cancel()
+	if err := i.writable(); err != nil {
+		return err
+	}
+	path, err := i.cleanPath(dir)
+	if err != nil {
+		return err
+	}
+	return i.mkdir(ctx, path)
+}
 
 func (i *Impl) mkdir(ctx context.Context, dir string) error {
-	p := filepath.Dir(dir)
+	obj, err := i.get(ctx, dir)
+	if err == nil {
+		if obj.IsDir() {
+			return nil
+		}
+		return errors.WithMessagef(errs.NotFolder, "file exists at [%s]", dir)
+	}
+	if !errs.IsObjectNotFound(err) {
+		return errors.WithMessage(err, "failed to check if dir exists")
+	}
+
+	p := stdpath.Dir(dir)
 	if p == "." {
 		p = "/"
 	}
+	// the root can't be missing, stop here instead of recursing forever
+	if p == dir {
+		return errors.WithMessagef(err, "failed to get root [%s]", dir)
+	}
+	// concurrent calls for the same dir share a single creation
+	_, err, _ = i.mkdirG.Do(dir, func() (struct{}, error) {
+		return struct{}{}, i.makeDir(ctx, p, dir)
+	})
+	return err
+}
 
-	realDir := filepath.Base(dir)
+// makeDir creates dir under its parent p, making the parent first if it's missing
+func (i *Impl) makeDir(ctx context.Context, p, dir string) error {
+	if err := i.mkdir(ctx, p); err != nil {
+		return errors.WithMessagef(err, "failed to make parent dir [%s]", p)
+	}
 	parent, err := i.get(ctx, p)
 	if err != nil {
-		if errs.IsObjectNotFound(err) {
-			if err := i.mkdir(ctx, p); err != nil {
-				return err
-			}
-			if parent, err = i.get(ctx, p); err != nil {
-				return err
-			}
-		} else {
+		return errors.WithMessagef(err, "failed to get parent dir [%s]", p)
+	}
+
+	realDir := stdpath.Base(dir)
+	err = i.retry(ctx, func() error {
+		release, err := i.beginMeta(ctx)
+		if err != nil {
 			return err
 		}
-	}
-	switch s := Storage.(type) {
-	case driver.MkdirResult:
-		_, err = s.MakeDir(ctx, parent, realDir)
-	case driver.Mkdir:
-		err = s.MakeDir(ctx, parent, realDir)
-	default:
-		return errs.NotImplement
+		defer release()
+		switch s := i.storage.(type) {
+		case driver.MkdirResult:
+			_, err := s.MakeDir(ctx, parent, realDir)
+			return err
+		case driver.Mkdir:
+			return s.MakeDir(ctx, parent, realDir)
+		default:
+			return errs.NotImplement
+		}
+	})
+	// the dir may have been made by someone else meanwhile, which is as good as making it
+	i.created(dir, true)
+	if err != nil {
+		if obj, e := i.get(ctx, dir); e == nil && obj.IsDir() {
+			return nil
+		}
 	}
 	return errors.WithStack(err)
 }
 
 func (i *Impl) list(ctx context.Context, dir string, args model.ListArgs) ([]model.Obj, error) {
+	ctx, cancel := withTimeout(ctx, i.conf.metaTimeout)
+	defer cancel()
+	if i.conf.cacheTTL > 0 {
+		objs, ok := i.listCache.Get(dir)
+		i.cacheLookup("list", ok)
+		if ok {
+			return objs, nil
+		}
+	}
 	d, err := i.get(ctx, dir)
 	if err != nil {
 		return nil, err
@@ -250,15 +1251,38 @@ func (i *Impl) list(ctx context.Context, dir string, args model.ListArgs) ([]mod
 	if !d.IsDir() {
 		return nil, errors.WithStack(errs.NotFolder)
 	}
-	objs, err, _ := listG.Do(dir, func() ([]model.Obj, error) {
-		files, err := Storage.List(ctx, d, args)
+	objs, err, _ := i.listG.Do(dir, func() ([]model.Obj, error) {
+		var files []model.Obj
+		err := i.retry(ctx, func() (err error) {
+			release, err := i.beginMeta(ctx)
+			if err != nil {
+				return err
+			}
+			defer release()
+			i.stats.lists.Add(1)
+			ctx, end := i.startCall(ctx, "List", dir)
+			files, err = i.storage.List(ctx, d, args)
+			end(0, err)
+			return err
+		})
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed to list objs")
 		}
 		// warp obj name
 		model.WrapObjsName(files)
+		for k, f := range files {
+			if files[k], err = i.resolveChunked(ctx, stdpath.Join(dir, f.GetName()), f); err != nil {
+				return nil, err
+			}
+		}
+		// the wrapped names are mapped lazily, map them before files are shared by the callers
+		for _, f := range files {
+			i.setObj(stdpath.Join(dir, f.GetName()), f)
+		}
+		if i.conf.cacheTTL > 0 {
+			i.listCache.Set(dir, files, i.conf.cacheTTL)
+		}
 		return files, nil
 	})
 	return objs, err
 }
-
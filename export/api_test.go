@@ -0,0 +1,3594 @@
+package export
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	stdpath "path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alist-org/alist/v3/internal/driver"
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/alist-org/alist/v3/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+func TestList(t *testing.T) {
+	ctx := context.Background()
+	i := newTestFS(t, newMemDriver())
+	if err := i.Put(ctx, "dir/a", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.mkdir(ctx, baseDir+"/empty"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := i.List(ctx, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Name != "dir" || !entries[0].IsDir || entries[1].Name != "empty" {
+		t.Errorf("unexpected root entries: %+v", entries)
+	}
+
+	entries, err = i.List(ctx, "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != "a" || entries[0].Size != 5 || entries[0].IsDir {
+		t.Errorf("unexpected dir entries: %+v", entries)
+	}
+
+	entries, err = i.List(ctx, "empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries == nil || len(entries) != 0 {
+		t.Errorf("expected empty non-nil slice, got %#v", entries)
+	}
+
+	if _, err = i.List(ctx, "dir/a"); !errors.Is(err, errs.NotFolder) {
+		t.Errorf("expected NotFolder, got %v", err)
+	}
+}
+
+func TestStat(t *testing.T) {
+	ctx := context.Background()
+	i := newTestFS(t, newMemDriver())
+	if err := i.Put(ctx, "dir/a", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := i.Stat(ctx, "dir/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "a" || info.Size != 5 || info.IsDir || info.Modified.IsZero() {
+		t.Errorf("unexpected info: %+v", info)
+	}
+
+	info, err = i.Stat(ctx, "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir {
+		t.Errorf("expected dir, got %+v", info)
+	}
+
+	if _, err = i.Stat(ctx, "dir/b"); !errs.IsObjectNotFound(err) {
+		t.Errorf("expected ObjectNotFound, got %v", err)
+	}
+	if _, err = i.Stat(ctx, "missing/b"); !errs.IsObjectNotFound(err) {
+		t.Errorf("expected ObjectNotFound, got %v", err)
+	}
+}
+
+func TestRename(t *testing.T) {
+	ctx := context.Background()
+	d := newMemDriver()
+	i := newTestFS(t, d)
+	if err := i.Put(ctx, "dir/a", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Rename(ctx, "dir/a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Rename(ctx, "dir/b", "dir/c"); err != nil {
+		t.Fatal(err)
+	}
+	if data, ok := d.file(baseDir + "/dir/c"); !ok || string(data) != "hello" {
+		t.Errorf("expected renamed object, got %q %v", data, ok)
+	}
+	if err := i.Rename(ctx, "dir/c", "other/c"); !errors.Is(err, ErrCrossDirRename) {
+		t.Errorf("expected ErrCrossDirRename, got %v", err)
+	}
+	if err := i.Rename(ctx, "dir/missing", "d"); !errs.IsObjectNotFound(err) {
+		t.Errorf("expected ObjectNotFound, got %v", err)
+	}
+}
+
+func TestMove(t *testing.T) {
+	ctx := context.Background()
+	d := newMemDriver()
+	i := newTestFS(t, memMover{d})
+	if err := i.Put(ctx, "dir/a", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Move(ctx, "dir/a", "new/sub"); err != nil {
+		t.Fatal(err)
+	}
+	if data, ok := d.file(baseDir + "/new/sub/a"); !ok || string(data) != "hello" {
+		t.Errorf("expected moved object, got %q %v", data, ok)
+	}
+	if err := i.Move(ctx, "new", "dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.file(baseDir + "/dir/new/sub/a"); !ok {
+		t.Errorf("expected moved dir")
+	}
+}
+
+func TestMoveFallback(t *testing.T) {
+	ctx := context.Background()
+	d := newMemDriver()
+	i := newTestFS(t, d)
+	if err := i.Put(ctx, "dir/a", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Move(ctx, "dir/a", "new"); !errors.Is(err, errs.NotImplement) {
+		t.Errorf("expected NotImplement without fallback, got %v", err)
+	}
+
+	WithMoveFallback()(&i.conf)
+	if err := i.Move(ctx, "dir/a", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if data, ok := d.file(baseDir + "/new/a"); !ok || string(data) != "hello" {
+		t.Errorf("expected copied object, got %q %v", data, ok)
+	}
+	if _, ok := d.file(baseDir + "/dir/a"); ok {
+		t.Errorf("expected source removed")
+	}
+	if err := i.Move(ctx, "new", "dir"); !errors.Is(err, ErrDirFallback) {
+		t.Errorf("expected ErrDirFallback, got %v", err)
+	}
+}
+
+func TestCopyFallback(t *testing.T) {
+	ctx := context.Background()
+	d := newMemDriver()
+	i := newTestFS(t, d)
+	if err := i.Put(ctx, "dir/a", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	src, err := i.Stat(ctx, "dir/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Copy(ctx, "dir/a", "new"); err != nil {
+		t.Fatal(err)
+	}
+	dst, err := i.Stat(ctx, "new/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dst.Size != src.Size || !dst.Modified.Equal(src.Modified) {
+		t.Errorf("expected size and mtime kept, got %+v from %+v", dst, src)
+	}
+	if _, ok := d.file(baseDir + "/dir/a"); !ok {
+		t.Errorf("expected source kept")
+	}
+
+	for _, c := range [][2]string{{"", "x"}, {"/", ""}, {"dir", "dir"}, {"dir", "dir/sub"}} {
+		if err := i.Copy(ctx, c[0], c[1]); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("a copy of %q into %q should fail with ErrInvalidName, got %v", c[0], c[1], err)
+		}
+	}
+	if _, ok := d.file(baseDir + "/x"); ok {
+		t.Error("x shouldn't be made by a copy failed")
+	}
+
+	WithoutCopyFallback()(&i.conf)
+	if err := i.Copy(ctx, "dir/a", "other"); !errors.Is(err, errs.NotImplement) {
+		t.Errorf("expected NotImplement without fallback, got %v", err)
+	}
+}
+
+func TestExists(t *testing.T) {
+	ctx := context.Background()
+	i := newTestFS(t, newMemDriver())
+	ok, err := i.Exists(ctx, "dir/a")
+	if err != nil || ok {
+		t.Fatalf("expected missing, got %v %v", ok, err)
+	}
+	if !i.isMissing(baseDir + "/dir/a") {
+		t.Errorf("expected missing object remembered")
+	}
+	if err := i.Put(ctx, "dir/a", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err = i.Exists(ctx, "dir/a"); err != nil || !ok {
+		t.Errorf("expected existing after put, got %v %v", ok, err)
+	}
+}
+
+func TestMkdir(t *testing.T) {
+	ctx := context.Background()
+	d := newMemDriver()
+	i := newTestFS(t, d)
+	if err := i.Mkdir(ctx, "a/b/c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Mkdir(ctx, "a/b/c"); err != nil {
+		t.Errorf("expected idempotent mkdir, got %v", err)
+	}
+	if info, err := i.Stat(ctx, "a/b"); err != nil || !info.IsDir {
+		t.Errorf("expected parent dir made, got %+v %v", info, err)
+	}
+	if err := i.Put(ctx, "a/f", strings.NewReader("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Put(ctx, "a/g", strings.NewReader("x")); err != nil {
+		t.Errorf("expected put into existing dir, got %v", err)
+	}
+	if err := i.Mkdir(ctx, "a/f"); !errors.Is(err, errs.NotFolder) {
+		t.Errorf("expected NotFolder, got %v", err)
+	}
+}
+
+func TestRemoveAll(t *testing.T) {
+	ctx := context.Background()
+	d := newMemDriver()
+	i := newTestFS(t, d)
+	for _, name := range []string{"dir/a", "dir/b", "dir/sub/c", "dir/sub/deep/d"} {
+		if err := i.Put(ctx, name, strings.NewReader(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := i.Delete(ctx, "dir"); !errors.Is(err, ErrDirNotEmpty) {
+		t.Errorf("expected ErrDirNotEmpty, got %v", err)
+	}
+	if err := i.RemoveAll(ctx, "dir"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := i.Exists(ctx, "dir"); err != nil || ok {
+		t.Errorf("expected dir removed, got %v %v", ok, err)
+	}
+	if err := i.RemoveAll(ctx, "dir"); err != nil {
+		t.Errorf("expected removing missing dir to be a no-op, got %v", err)
+	}
+	if err := i.Mkdir(ctx, "empty"); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Delete(ctx, "empty"); err != nil {
+		t.Errorf("expected empty dir deleted, got %v", err)
+	}
+}
+
+func TestPutWithSize(t *testing.T) {
+	ctx := context.Background()
+	d := newMemDriver()
+	i := newTestFS(t, d)
+	// hide the strings.Reader so that the body can't be sized or seeked
+	body := struct{ io.Reader }{strings.NewReader("hello world")}
+	if err := i.PutWithSize(ctx, "a", body, 11); err != nil {
+		t.Fatal(err)
+	}
+	if data, ok := d.file(baseDir + "/a"); !ok || string(data) != "hello world" {
+		t.Errorf("unexpected content %q %v", data, ok)
+	}
+}
+
+func TestPutSpool(t *testing.T) {
+	ctx := context.Background()
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	d := newMemDriver()
+	i := newTestFS(t, d)
+	WithSpoolThreshold(4)(&i.conf)
+	if err := i.Put(ctx, "small", strings.NewReader("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Put(ctx, "large", strings.NewReader("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := i.Stat(ctx, "large"); err != nil || info.Size != 11 {
+		t.Errorf("unexpected info %+v %v", info, err)
+	}
+	if data, _ := d.file(baseDir + "/large"); string(data) != "hello world" {
+		t.Errorf("unexpected content %q", data)
+	}
+	if files, _ := os.ReadDir(tmp); len(files) != 0 {
+		t.Errorf("expected temp files removed, got %v", files)
+	}
+}
+
+// cancelingReader cancels the context after reading n bytes
+type cancelingReader struct {
+	r      io.Reader
+	n      int
+	cancel context.CancelFunc
+}
+
+func (r *cancelingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p[:min(len(p), 4)])
+	if r.n -= n; r.n <= 0 {
+		r.cancel()
+	}
+	return n, err
+}
+
+func TestPutSpoolRemoved(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	d := &memFlaky{memDriver: newMemDriver(), err: errors.New("status code: 500")}
+	i := newTestFS(t, d)
+	WithSpoolThreshold(4)(&i.conf)
+	d.putFailures.Store(1)
+	if err := i.Put(context.Background(), "a", strings.NewReader("hello world")); err == nil {
+		t.Error("the put should fail")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	body := &cancelingReader{r: strings.NewReader("hello world"), n: 8, cancel: cancel}
+	if err := i.Put(ctx, "b", body); !errors.Is(err, context.Canceled) {
+		t.Errorf("the put should be canceled, got %v", err)
+	}
+	if body.n > 0 {
+		t.Errorf("the body should be read beyond the threshold, %d bytes left", body.n)
+	}
+	if files, _ := os.ReadDir(tmp); len(files) != 0 {
+		t.Errorf("expected temp files removed, got %v", files)
+	}
+}
+
+func TestPooledFile(t *testing.T) {
+	for _, n := range []int{0, 1, 4096, 4097, 1 << 20} {
+		b := getBuf(n)
+		if len(b) != 0 || cap(b) < n || cap(b)&(cap(b)-1) != 0 {
+			t.Errorf("unexpected buffer of %d bytes, len %d cap %d", n, len(b), cap(b))
+		}
+		putBuf(b)
+	}
+	w := newSpoolWriter(1 << 20)
+	for n := 0; n < 3000; n++ {
+		if _, err := io.WriteString(w, "hello"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := w.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil || string(data) != strings.Repeat("hello", 3000) {
+		t.Fatalf("unexpected content of %d bytes %v", len(data), err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// a driver holding the reader can't read the buffer reused
+	if _, err := f.ReadAt(make([]byte, 1), 0); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("the read after close should fail, got %v", err)
+	}
+}
+
+func BenchmarkSpool(b *testing.B) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64<<10)
+	b.Run("ReadAll", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for n := 0; n < b.N; n++ {
+			if _, err := io.ReadAll(io.MultiReader(bytes.NewReader(data))); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for n := 0; n < b.N; n++ {
+			f, _, err := spool(context.Background(), io.MultiReader(bytes.NewReader(data)), int64(len(data)))
+			if err != nil {
+				b.Fatal(err)
+			}
+			f.Close()
+		}
+	})
+}
+
+func TestPutResult(t *testing.T) {
+	ctx := context.Background()
+	i := newTestFS(t, newMemDriver())
+	info, err := i.PutResult(ctx, "A", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "A" || info.Size != 5 {
+		t.Errorf("unexpected synthesized info %+v", info)
+	}
+
+	i = newTestFS(t, memNormalizer{newMemDriver()})
+	info, err = i.PutResult(ctx, "B", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "b" || info.Size != 5 || info.ID != "id-b" {
+		t.Errorf("unexpected driver info %+v", info)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("TMPDIR", t.TempDir())
+	d := newMemDriver()
+	i := newTestFS(t, d)
+	WithSpoolThreshold(4)(&i.conf)
+	w, err := i.Create(ctx, "dir/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"hel", "lo ", "world"} {
+		if _, err := io.WriteString(w, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := d.file(baseDir + "/dir/a"); ok {
+		t.Errorf("expected nothing uploaded before Close")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := d.file(baseDir + "/dir/a"); string(data) != "hello world" {
+		t.Errorf("unexpected content %q", data)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	w, err = i.Create(cctx, "dir/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.WriteString(w, "partial")
+	cancel()
+	if err := w.Close(); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Canceled, got %v", err)
+	}
+	if _, ok := d.file(baseDir + "/dir/b"); ok {
+		t.Errorf("expected nothing uploaded after cancel")
+	}
+}
+
+func TestOpen(t *testing.T) {
+	ctx := context.Background()
+	i := newTestFS(t, newMemDriver())
+	if err := i.Put(ctx, "a", strings.NewReader("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	f, err := i.Open(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(f, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("unexpected read %q %v", buf, err)
+	}
+	if off, err := f.Seek(1, io.SeekCurrent); err != nil || off != 6 {
+		t.Errorf("unexpected seek %d %v", off, err)
+	}
+	if data, err := io.ReadAll(f); err != nil || string(data) != "world" {
+		t.Errorf("unexpected read %q %v", data, err)
+	}
+	if off, err := f.Seek(-5, io.SeekEnd); err != nil || off != 6 {
+		t.Errorf("unexpected seek %d %v", off, err)
+	}
+	if _, err := io.ReadFull(f, buf); err != nil || string(buf) != "world" {
+		t.Errorf("unexpected read %q %v", buf, err)
+	}
+	if _, err := f.Seek(100, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := f.Read(buf); n != 0 || err != io.EOF {
+		t.Errorf("expected EOF past the end, got %d %v", n, err)
+	}
+	if _, err := f.Seek(-1, io.SeekStart); err == nil {
+		t.Errorf("expected negative offset rejected")
+	}
+}
+
+func TestOpenReaderAt(t *testing.T) {
+	ctx := context.Background()
+	i := newTestFS(t, newMemDriver())
+	content := strings.Repeat("0123456789", 100)
+	if err := i.Put(ctx, "a", strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	ra, c, err := i.OpenReaderAt(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for off := 0; off < len(content); off += 100 {
+		off := off
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 100)
+			if n, err := ra.ReadAt(buf, int64(off)); err != nil || n != 100 || string(buf) != content[off:off+100] {
+				t.Errorf("unexpected ReadAt at %d: %d %v", off, n, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	buf := make([]byte, 10)
+	if n, err := ra.ReadAt(buf, int64(len(content)-4)); n != 4 || err != io.EOF {
+		t.Errorf("expected short read with EOF, got %d %v", n, err)
+	}
+}
+
+func TestWithBaseDir(t *testing.T) {
+	ctx := context.Background()
+	d := newMemDriver()
+	prod := newTestFS(t, d, WithBaseDir("/jfs-prod"))
+	dev := newTestFS(t, d, WithBaseDir("/jfs/dev"))
+	if err := prod.Put(ctx, "a", strings.NewReader("prod")); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Put(ctx, "a", strings.NewReader("dev")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := d.file("/jfs-prod/a"); string(data) != "prod" {
+		t.Fatalf("unexpected prod data: %q", data)
+	}
+	if data, _ := d.file("/jfs/dev/a"); string(data) != "dev" {
+		t.Fatalf("unexpected dev data: %q", data)
+	}
+	if _, ok := d.file(baseDir); ok {
+		t.Fatalf("%s should not be created", baseDir)
+	}
+	if err := dev.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := prod.Exists(ctx, "a"); !ok {
+		t.Fatal("prod/a should not be deleted")
+	}
+
+	for _, dir := range []string{"jfs", "/jfs/", "/a/../b", ""} {
+		if _, err := New(ctx, "{}", WithBaseDir(dir)); err == nil {
+			t.Fatalf("base dir %q should be rejected", dir)
+		}
+	}
+}
+
+// noRootDriver is a memDriver which can't tell its root
+type noRootDriver struct {
+	*memDriver
+}
+
+func (d noRootDriver) GetAddition() driver.Additional {
+	return &struct{}{}
+}
+
+func TestNewWithStorage(t *testing.T) {
+	ctx := context.Background()
+	d := newMemDriver()
+	f, err := NewWithStorage(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Put(ctx, "a", strings.NewReader("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.file(baseDir + "/a"); !ok {
+		t.Fatal("a should be put to the given driver")
+	}
+
+	if _, err := NewWithStorage(ctx, noRootDriver{newMemDriver()}); err == nil {
+		t.Fatal("a driver without root should be rejected")
+	}
+}
+
+// readOnlyDriver only exposes the methods of driver.Driver of a memDriver
+type readOnlyDriver struct {
+	driver.Driver
+}
+
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+	d := newMemDriver()
+	f, err := NewWithStorage(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := f.Capabilities(); !c.Has(CapWrite|CapRename) || c.Has(CapMove) {
+		t.Fatalf("unexpected capabilities %s", c)
+	}
+	if err := f.Put(ctx, "a", strings.NewReader("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewWithStorage(ctx, readOnlyDriver{d})
+	if !errors.Is(err, errs.NotImplement) || !strings.Contains(err.Error(), "MakeDir/Put/Remove") {
+		t.Fatalf("a driver which can't write should be rejected, got %v", err)
+	}
+	f, err = NewWithStorage(ctx, readOnlyDriver{d}, WithReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := f.Capabilities(); c.Has(CapPut) || c != 0 {
+		t.Fatalf("unexpected capabilities %s", c)
+	}
+	if _, err := f.Stat(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Put(ctx, "b", strings.NewReader("b")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("put should fail with ErrReadOnly, got %v", err)
+	}
+	if err := f.Delete(ctx, "a"); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("delete should fail with ErrReadOnly, got %v", err)
+	}
+}
+
+func TestGetterPath(t *testing.T) {
+	ctx := context.Background()
+	d := &memGetter{memDriver: newMemDriver()}
+	i := newTestFS(t, d)
+	if err := i.Put(ctx, "a/b", strings.NewReader("b")); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"":    baseDir,
+		"/":   baseDir,
+		"a":   baseDir + "/a",
+		"a/b": baseDir + "/a/b",
+	} {
+		if _, err := i.Stat(ctx, name); err != nil {
+			t.Fatalf("stat [%s]: %v", name, err)
+		}
+		if p := d.lastPath(); p != want {
+			t.Errorf("stat [%s] should get [%s], got [%s]", name, want, p)
+		}
+	}
+}
+
+func TestGetterErrors(t *testing.T) {
+	ctx := context.Background()
+	d := &memGetter{memDriver: newMemDriver()}
+	i := newTestFS(t, d, WithNegativeCache(0))
+	if err := i.Put(ctx, "a", strings.NewReader("a")); err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{errs.ObjectNotFound, &os.PathError{Op: "stat", Path: "a", Err: os.ErrNotExist}} {
+		d.err = err
+		if _, err := i.Stat(ctx, "a"); err != nil {
+			t.Errorf("a not found error of Get should fall back to listing, got %v", err)
+		}
+	}
+	d.err = errs.PermissionDenied
+	_, err := i.Stat(ctx, "a")
+	if !errors.Is(err, errs.PermissionDenied) || errs.IsObjectNotFound(err) || !strings.Contains(err.Error(), baseDir+"/a") {
+		t.Fatalf("other errors of Get should be returned with the path, got %v", err)
+	}
+}
+
+func TestWindowsPaths(t *testing.T) {
+	ctx := context.Background()
+	d := newMemDriver()
+	i := newTestFS(t, d)
+	if err := i.Put(ctx, `dir\sub\a`, strings.NewReader("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.file(baseDir + "/dir/sub/a"); !ok {
+		t.Fatal("backslashes should be taken as separators")
+	}
+	if _, err := i.Stat(ctx, `dir\sub\a`); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Rename(ctx, `dir\sub\a`, `dir\sub\b`); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.file(baseDir + "/dir/sub/b"); !ok {
+		t.Fatal("a should be renamed to b")
+	}
+	if err := i.Delete(ctx, `\dir\sub\b`); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.file(baseDir + "/dir/sub/b"); ok {
+		t.Fatal("b should be deleted")
+	}
+	if err := i.Mkdir(ctx, `x\y`); err != nil {
+		t.Fatal(err)
+	}
+	for p := range d.nodes {
+		if strings.Contains(p, `\`) {
+			t.Fatalf("path [%s] sent to the driver has backslashes", p)
+		}
+	}
+}
+
+func TestMkdirRace(t *testing.T) {
+	ctx := context.Background()
+	d := &memMkdir{memDriver: newMemDriver(), delay: 20 * time.Millisecond}
+	i := newTestFS(t, d)
+	d.mkdirs.Store(0)
+	var wg sync.WaitGroup
+	errc := make(chan error, 8)
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			errc <- i.Put(ctx, fmt.Sprintf("new/sub/%d", n), strings.NewReader("x"))
+		}(n)
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := d.mkdirs.Load(); n != 2 {
+		t.Fatalf("concurrent puts should make each missing dir once, got %d MakeDir calls", n)
+	}
+
+	d.raced.Store(true)
+	if err := i.Mkdir(ctx, "other"); err != nil {
+		t.Fatalf("a dir made by someone else meanwhile should be taken as made, got %v", err)
+	}
+	if info, err := i.Stat(ctx, "other"); err != nil || !info.IsDir {
+		t.Fatalf("other should be a dir, got %v", err)
+	}
+}
+
+func TestDeleteBaseDir(t *testing.T) {
+	ctx := context.Background()
+	d := newMemDriver()
+	i := newTestFS(t, d)
+	if err := i.Put(ctx, "a/b", strings.NewReader("b")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"", "/", ".", "//", "a/..", "./", `\`} {
+		if err := i.Delete(ctx, name); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("delete [%s] should fail with ErrInvalidName, got %v", name, err)
+		}
+		if err := i.RemoveAll(ctx, name); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("remove all [%s] should fail with ErrInvalidName, got %v", name, err)
+		}
+		if err := i.Move(ctx, name, "a"); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("move [%s] should fail with ErrInvalidName, got %v", name, err)
+		}
+		if err := i.Rename(ctx, name, "x"); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("rename [%s] should fail with ErrInvalidName, got %v", name, err)
+		}
+	}
+	for _, newName := range []string{"", ".", ".."} {
+		if err := i.Rename(ctx, "a/b", newName); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("rename to [%s] should fail with ErrInvalidName, got %v", newName, err)
+		}
+	}
+	if _, ok := d.file(baseDir + "/a/b"); !ok {
+		t.Fatal("a/b should be kept")
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	ctx := context.Background()
+	d := newMemDriver()
+	i := newTestFS(t, d)
+	for name, want := range map[string]string{
+		"":        baseDir,
+		"a":       baseDir + "/a",
+		"/a":      baseDir + "/a",
+		"a//b":    baseDir + "/a/b",
+		"./a":     baseDir + "/a",
+		"a/":      baseDir + "/a",
+		"a/./b/":  baseDir + "/a/b",
+		"a/../b":  baseDir + "/b",
+		`a\\b\`:   baseDir + "/a/b",
+		"/../a/b": "",
+		"..":      "",
+		"a/../..": "",
+		"a\x00b":  "",
+	} {
+		p, err := i.cleanPath(name)
+		if want == "" {
+			if !errors.Is(err, ErrInvalidName) {
+				t.Errorf("[%q] should be invalid, got %v", name, err)
+			}
+			continue
+		}
+		if err != nil || p != want {
+			t.Errorf("[%q] should be [%s], got [%s] %v", name, want, p, err)
+		}
+	}
+
+	if err := i.Put(ctx, "../secret", strings.NewReader("x")); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("put out of the base dir should fail with ErrInvalidName, got %v", err)
+	}
+	if _, ok := d.file("/secret"); ok {
+		t.Fatal("nothing should be put out of the base dir")
+	}
+	if _, err := i.Read(ctx, "../secret", 0, -1); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("read out of the base dir should fail with ErrInvalidName, got %v", err)
+	}
+	if err := i.Delete(ctx, "a/../../secret"); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("delete out of the base dir should fail with ErrInvalidName, got %v", err)
+	}
+}
+
+func TestReadRange(t *testing.T) {
+	ctx := context.Background()
+	i := newTestFS(t, newMemDriver())
+	if err := i.Put(ctx, "a", strings.NewReader("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		off, limit int64
+		want       string
+	}{
+		{0, -1, "0123456789"},
+		{0, 0, "0123456789"},
+		{4, -1, "456789"},
+		{4, 3, "456"},
+		{8, 5, "89"},
+		{10, -1, ""},
+		{10, 5, ""},
+		{20, 5, ""},
+	} {
+		rc, err := i.Read(ctx, "a", c.off, c.limit)
+		if err != nil {
+			t.Fatalf("read %d+%d: %v", c.off, c.limit, err)
+		}
+		b, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil || string(b) != c.want {
+			t.Errorf("read %d+%d should be %q, got %q %v", c.off, c.limit, c.want, b, err)
+		}
+	}
+	if _, err := i.Read(ctx, "a", -1, 5); !errors.Is(err, ErrInvalidRange) {
+		t.Fatalf("a negative offset should fail with ErrInvalidRange, got %v", err)
+	}
+}
+
+func TestNotExistErrors(t *testing.T) {
+	ctx := context.Background()
+	i := newTestFS(t, newMemDriver())
+	check := func(op string, err error) {
+		t.Helper()
+		if !errors.Is(err, fs.ErrNotExist) || !errs.IsObjectNotFound(err) {
+			t.Errorf("%s of a missing object should match both fs.ErrNotExist and errs.ObjectNotFound, got %v", op, err)
+		}
+		var pe *fs.PathError
+		if !errors.As(err, &pe) || pe.Op != op || pe.Path != "missing/a" {
+			t.Errorf("%s error should be a *fs.PathError of missing/a, got %#v", op, err)
+		} else if !errors.Is(pe, fs.ErrNotExist) || !errs.IsObjectNotFound(pe) {
+			t.Errorf("the *fs.PathError of %s should keep the not found error, got %v", op, pe)
+		}
+		var oe *OpError
+		if !errors.As(err, &oe) || oe.Op != op || oe.Path != "missing/a" || oe.Kind != KindNotFound {
+			t.Errorf("%s error should be an *OpError of missing/a, got %#v", op, err)
+		}
+	}
+	_, err := i.Read(ctx, "missing/a", 0, -1)
+	check("read", err)
+	_, err = i.Stat(ctx, "missing/a")
+	check("stat", err)
+	check("move", i.Move(ctx, "missing/a", "b"))
+	check("rename", i.Rename(ctx, "missing/a", "b"))
+
+	d := &memFlaky{memDriver: newMemDriver(), err: errs.PermissionDenied}
+	d.putFailures.Store(1)
+	i = newTestFS(t, d)
+	err = i.Put(ctx, "a", strings.NewReader("a"))
+	var pe *fs.PathError
+	if !errors.As(err, &pe) || pe.Op != "put" || pe.Path != "a" || !errors.Is(err, errs.PermissionDenied) {
+		t.Fatalf("put error should be a *fs.PathError keeping the driver error, got %v", err)
+	}
+	var oe *OpError
+	if !errors.As(err, &oe) || oe.Op != "put" || oe.Path != "a" || !errors.Is(err, errs.PermissionDenied) || !errors.Is(err, KindPermissionDenied) {
+		t.Fatalf("put error should be an *OpError keeping the driver error, got %v", err)
+	}
+	if err := i.Put(ctx, "dir/a", strings.NewReader("a")); err != nil {
+		t.Fatal(err)
+	}
+	err = i.Delete(ctx, "dir")
+	if !errors.As(err, &pe) || pe.Op != "delete" || pe.Path != "dir" || !errors.Is(err, ErrDirNotEmpty) {
+		t.Fatalf("delete error should be a *fs.PathError keeping ErrDirNotEmpty, got %v", err)
+	}
+	if !errors.As(err, &oe) || oe.Op != "delete" || oe.Path != "dir" || !errors.Is(err, ErrDirNotEmpty) {
+		t.Fatalf("delete error should be an *OpError keeping ErrDirNotEmpty, got %v", err)
+	}
+}
+
+func TestKindOf(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		kind ErrorKind
+	}{
+		{errors.WithMessage(errs.ObjectNotFound, "failed to get object"), KindNotFound},
+		{os.ErrNotExist, KindNotFound},
+		{errors.WithStack(errs.PermissionDenied), KindPermissionDenied},
+		{errors.New("refresh failed: token expired"), KindPermissionDenied},
+		{errors.New("request failed with status code: 403"), KindPermissionDenied},
+		{errors.New("request failed with status code: 429"), KindRateLimited},
+		{errors.New("Too Many Requests"), KindRateLimited},
+		{errors.New("status 503 Service Unavailable"), KindTemporary},
+		{errors.WithMessage(context.DeadlineExceeded, "failed get parent list"), KindTemporary},
+		{errors.WithStack(ErrStorageUnavailable), KindTemporary},
+		{io.ErrUnexpectedEOF, KindTemporary},
+		{context.Canceled, KindCanceled},
+		{errs.NotImplement, KindUnsupported},
+		{errors.New("file 429.txt is broken"), KindOther},
+	} {
+		if k := KindOf(c.err); k != c.kind {
+			t.Errorf("%q should be %s, got %s", c.err, c.kind, k)
+		}
+	}
+
+	err := error(errors.New("status code: 502"))
+	wrapErr(&err, "read", "a")
+	if !errors.Is(err, KindTemporary) || errors.Is(err, KindNotFound) || !KindOf(err).Retryable() {
+		t.Fatalf("a wrapped 502 should be temporary and retryable, got %v", err)
+	}
+	if err.Error() != "read a: status code: 502" {
+		t.Fatalf("unexpected message %q", err)
+	}
+}
+
+func TestPutProgress(t *testing.T) {
+	ctx := context.Background()
+	d := &memFlaky{memDriver: newMemDriver()}
+	i := newTestFS(t, d, WithRetry(2), WithRetryBackoff(time.Millisecond, 0))
+	content := strings.Repeat("x", 100000)
+	for _, failures := range []int32{0, 1} {
+		d.putFailures.Store(failures)
+		var calls [][2]int64
+		_, err := i.PutWithOptions(ctx, "a", strings.NewReader(content), WithProgress(func(sent, total int64) {
+			calls = append(calls, [2]int64{sent, total})
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(calls) == 0 || calls[len(calls)-1] != [2]int64{100000, 100000} {
+			t.Fatalf("the last call should report completion, got %v", calls)
+		}
+		for n := 1; n < len(calls); n++ {
+			if calls[n][0] <= calls[n-1][0] {
+				t.Fatalf("progress should be monotonic, got %v", calls)
+			}
+		}
+	}
+
+	var calls [][2]int64
+	if _, err := i.PutWithOptions(ctx, "empty", strings.NewReader(""), WithProgress(func(sent, total int64) {
+		calls = append(calls, [2]int64{sent, total})
+	})); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 1 || calls[0] != [2]int64{0, 0} {
+		t.Fatalf("an empty upload should report completion once, got %v", calls)
+	}
+}
+
+func TestStats(t *testing.T) {
+	ctx := context.Background()
+	i := newTestFS(t, newMemDriver())
+	for _, name := range []string{"a", "dir/b"} {
+		if err := i.Put(ctx, name, strings.NewReader("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := i.Stats(); s.Puts != 2 || s.BytesUploaded != 20 || s.Errors != 0 {
+		t.Fatalf("unexpected stats after puts: %+v", s)
+	}
+
+	i.ResetStats()
+	rc, err := i.Read(ctx, "a", 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(rc, make([]byte, 3)); err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+	ra, c, err := i.OpenReaderAt(ctx, "dir/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ra.ReadAt(make([]byte, 4), 8); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	c.Close()
+	if _, err := i.List(ctx, "dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.Stat(ctx, "missing"); err == nil {
+		t.Fatal("missing should not exist")
+	}
+	s := i.Stats()
+	if s.Gets != 2 || s.BytesDownloaded != 5 || s.Deletes != 1 || s.Lists == 0 || s.Errors != 1 || s.Puts != 0 {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+
+	i.ResetStats()
+	if s := i.Stats(); s != (StatsSnapshot{}) {
+		t.Fatalf("stats should be zeroed, got %+v", s)
+	}
+}
+
+func TestUploadHashes(t *testing.T) {
+	ctx := context.Background()
+	d := newMemDriver()
+	fsys, err := newWithAddition(ctx, d, "{}", WithUploadHashes(utils.MD5, utils.SHA1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashOf := func(name string) utils.HashInfo {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.nodes[baseDir+"/"+name].obj.HashInfo
+	}
+
+	// not seekable, it's spooled to be hashed
+	if err := fsys.PutWithSize(ctx, "a", io.MultiReader(strings.NewReader("hello")), 5); err != nil {
+		t.Fatal(err)
+	}
+	h := hashOf("a")
+	if got := h.GetHash(utils.MD5); got != utils.HashData(utils.MD5, []byte("hello")) {
+		t.Errorf("wrong md5 %s", got)
+	}
+	if got := h.GetHash(utils.SHA1); got != utils.HashData(utils.SHA1, []byte("hello")) {
+		t.Errorf("wrong sha1 %s", got)
+	}
+
+	known := utils.NewHashInfo(utils.MD5, "known")
+	if _, err := fsys.PutWithOptions(ctx, "b", strings.NewReader("world"), WithHashes(known)); err != nil {
+		t.Fatal(err)
+	}
+	h = hashOf("b")
+	if got := h.GetHash(utils.MD5); got != "known" {
+		t.Errorf("the given md5 should be kept, got %s", got)
+	}
+	if got := h.GetHash(utils.SHA1); got != utils.HashData(utils.SHA1, []byte("world")) {
+		t.Errorf("wrong sha1 %s", got)
+	}
+	if data, _ := d.file(baseDir + "/b"); string(data) != "world" {
+		t.Errorf("the body should be uploaded whole after hashing, got %q", data)
+	}
+
+	if err := fsys.PutWithSize(ctx, "c", io.MultiReader(strings.NewReader("abc")), 4); err == nil {
+		t.Error("a body shorter than its size should fail")
+	}
+}
+
+// unreadable fails the test reading it
+type unreadable struct {
+	t *testing.T
+}
+
+func (r unreadable) Read(p []byte) (int, error) {
+	r.t.Error("the body shouldn't be read")
+	return 0, io.ErrUnexpectedEOF
+}
+
+func TestPutWithHash(t *testing.T) {
+	ctx := context.Background()
+	d := &memRapid{memDriver: newMemDriver()}
+	fsys, err := newWithAddition(ctx, d, "{}", WithUploadHashes(utils.MD5, utils.SHA1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Put(ctx, "a", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	md5 := utils.NewHashInfo(utils.MD5, utils.HashData(utils.MD5, []byte("hello")))
+	if err := fsys.PutWithHash(ctx, "b", 5, md5, unreadable{t}); err != nil {
+		t.Fatal(err)
+	}
+	if d.rapid.Load() != 1 {
+		t.Fatalf("b should be uploaded rapidly")
+	}
+	if data, _ := d.file(baseDir + "/b"); string(data) != "hello" {
+		t.Errorf("b should have the content of a, got %q", data)
+	}
+
+	// the provider doesn't have it, so it's uploaded
+	other := utils.NewHashInfo(utils.MD5, utils.HashData(utils.MD5, []byte("world")))
+	if err := fsys.PutWithHash(ctx, "c", 5, other, strings.NewReader("world")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := d.file(baseDir + "/c"); string(data) != "world" {
+		t.Errorf("c should be uploaded, got %q", data)
+	}
+	if d.rapid.Load() != 1 {
+		t.Errorf("c shouldn't be uploaded rapidly")
+	}
+}
+
+func TestVerifyPut(t *testing.T) {
+	ctx := context.Background()
+	d := memTruncate{newMemDriver()}
+	fsys, err := newWithAddition(ctx, d, "{}", WithVerifyPut())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Put(ctx, "a", strings.NewReader("hello")); !errors.Is(err, ErrSizeMismatch) {
+		t.Fatalf("a truncated upload should fail with ErrSizeMismatch, got %v", err)
+	}
+	if _, ok := d.file(baseDir + "/a"); ok {
+		t.Error("the truncated object should be removed")
+	}
+
+	fsys, err = newWithAddition(ctx, memNormalizer{newMemDriver()}, "{}", WithVerifyPut())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Put(ctx, "B", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyRead(t *testing.T) {
+	ctx := context.Background()
+	fsys, err := newWithAddition(ctx, newMemDriver(), "{}", WithVerifyRead(), WithUploadHashes(utils.MD5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Put(ctx, "a", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	wrong := utils.HashData(utils.MD5, []byte("world"))
+	if _, err := fsys.PutWithOptions(ctx, "b", strings.NewReader("hello"), WithHashes(utils.NewHashInfo(utils.MD5, wrong))); err != nil {
+		t.Fatal(err)
+	}
+	info, err := fsys.Stat(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := info.Hashes.GetHash(utils.MD5); got != wrong {
+		t.Errorf("the md5 of the driver should be in the stat, got %q", got)
+	}
+
+	read := func(name string, limit int64) (error, error) {
+		rc, err := fsys.Read(ctx, name, 0, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, readErr := io.ReadAll(rc)
+		return readErr, rc.Close()
+	}
+	if readErr, closeErr := read("a", 0); readErr != nil || closeErr != nil {
+		t.Errorf("a should be read, got %v and %v", readErr, closeErr)
+	}
+	if readErr, closeErr := read("b", 0); !errors.Is(readErr, ErrChecksumMismatch) || !errors.Is(closeErr, ErrChecksumMismatch) {
+		t.Errorf("b should fail with ErrChecksumMismatch, got %v and %v", readErr, closeErr)
+	}
+	if readErr, closeErr := read("b", 4); readErr != nil || closeErr != nil {
+		t.Errorf("a part of b shouldn't be checked, got %v and %v", readErr, closeErr)
+	}
+}
+
+func TestHashes(t *testing.T) {
+	ctx := context.Background()
+	fsys, err := newWithAddition(ctx, newMemDriver(), "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Put(ctx, "plain", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	md5 := utils.HashData(utils.MD5, []byte("hello"))
+	if _, err := fsys.PutWithOptions(ctx, "hashed", strings.NewReader("hello"), WithHashes(utils.NewHashInfo(utils.MD5, md5))); err != nil {
+		t.Fatal(err)
+	}
+
+	hashes, err := fsys.Hashes(ctx, "hashed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 1 || hashes[utils.MD5] != md5 {
+		t.Errorf("unexpected hashes %v", hashes)
+	}
+	hashes, err = fsys.Hashes(ctx, "plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashes == nil || len(hashes) != 0 {
+		t.Errorf("a file without hashes should have an empty set, got %v", hashes)
+	}
+
+	entries, err := fsys.List(ctx, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if got, want := e.Hashes.GetHash(utils.MD5), map[string]string{"hashed": md5}[e.Name]; got != want {
+			t.Errorf("%s should have md5 %q in the list, got %q", e.Name, want, got)
+		}
+	}
+}
+
+func TestParallelRead(t *testing.T) {
+	ctx := context.Background()
+	d := &memRanged{memDriver: newMemDriver(), concurrency: 3, failAt: -1, delay: time.Millisecond}
+	fsys, err := newWithAddition(ctx, d, "{}", WithParallelRead(0, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := "0123456789abcdefghij"
+	if err := fsys.Put(ctx, "a", strings.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, fsys, "a", 1, 17); got != body[1:18] {
+		t.Errorf("the sub-ranges should be read in order, got %q", got)
+	}
+	if d.ranges != 5 || d.peak != 3 {
+		t.Errorf("5 sub-ranges should be read 3 at a time, got %d, %d at a time", d.ranges, d.peak)
+	}
+	// a small range is read at once
+	d.ranges = 0
+	if got := readAll(t, fsys, "a", 0, 4); got != body[:4] || d.ranges != 1 {
+		t.Errorf("expected %q by 1 range, got %q by %d", body[:4], got, d.ranges)
+	}
+
+	// the failure cancels the sub-ranges after it
+	d.failAt, d.delay = 8, time.Second
+	start := time.Now()
+	rc, err := fsys.Read(ctx, "a", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(rc); err == nil || !strings.Contains(err.Error(), "range failed") {
+		t.Errorf("the read should fail with the failure of the range, got %v", err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Error(err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("the other sub-ranges should be canceled")
+	}
+}
+
+func TestPutIfAbsent(t *testing.T) {
+	ctx := context.Background()
+	d := newMemDriver()
+	fsys, err := newWithAddition(ctx, d, "{}", WithCacheTTL(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := newWithAddition(ctx, d, "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.PutIfAbsent(ctx, "lock", strings.NewReader("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.PutIfAbsent(ctx, "lock", strings.NewReader("b")); !errors.Is(err, ErrExist) {
+		t.Fatalf("the put should fail with ErrExist, got %v", err)
+	}
+	// the missing object cached isn't trusted
+	if ok, err := fsys.Exists(ctx, "marker"); err != nil || ok {
+		t.Fatalf("marker shouldn't exist, got %v, %v", ok, err)
+	}
+	if err := other.Put(ctx, "marker", strings.NewReader("other")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.PutIfAbsent(ctx, "marker", strings.NewReader("b")); !errors.Is(err, ErrExist) {
+		t.Fatalf("the put should see the other writer, got %v", err)
+	}
+	if data, _ := d.file(baseDir + "/marker"); string(data) != "other" {
+		t.Errorf("the object of the other writer should be kept, got %q", data)
+	}
+
+	r := &memRacing{memDriver: newMemDriver()}
+	if fsys, err = newWithAddition(ctx, r, "{}"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.PutIfAbsent(ctx, "a", strings.NewReader("ours")); err != nil {
+		t.Fatal(err)
+	}
+	r.replaced.Store(true)
+	if err := fsys.PutIfAbsent(ctx, "b", strings.NewReader("ours")); !errors.Is(err, ErrExist) {
+		t.Fatalf("the replaced put should fail with ErrExist, got %v", err)
+	}
+	if data, _ := r.file(baseDir + "/b"); string(data) != "theirs" || r.removes.Load() != 0 {
+		t.Errorf("the object of the other writer should be kept, got %q", data)
+	}
+	r.replaced.Store(false)
+	r.dup.Store(true)
+	if err := fsys.PutIfAbsent(ctx, "c", strings.NewReader("ours")); !errors.Is(err, ErrExist) {
+		t.Fatalf("the duplicated put should fail with ErrExist, got %v", err)
+	}
+	if r.removes.Load() != 1 {
+		t.Errorf("the object put should be removed, got %d removes", r.removes.Load())
+	}
+}
+
+func TestTouch(t *testing.T) {
+	ctx := context.Background()
+	d := newMemDriver()
+	fsys, err := newWithAddition(ctx, d, "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := fsys.Capabilities(); !c.Has(CapEmpty) || c.Has(CapTouch) {
+		t.Fatalf("unexpected capabilities %s", c)
+	}
+	if err := fsys.Touch(ctx, "dir/_SUCCESS"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := fsys.Stat(ctx, "dir/_SUCCESS")
+	if err != nil || info.Size != 0 {
+		t.Fatalf("an empty object should be made, got %+v, %v", info, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := fsys.Touch(ctx, "dir/_SUCCESS"); err != nil {
+		t.Fatal(err)
+	}
+	if touched, err := fsys.Stat(ctx, "dir/_SUCCESS"); err != nil || !touched.Modified.After(info.Modified) {
+		t.Errorf("the empty object should be touched, got %+v, %v", touched, err)
+	}
+	if err := fsys.Put(ctx, "a", strings.NewReader("abc")); err != nil {
+		t.Fatal(err)
+	}
+	// a file isn't uploaded again by a driver which can't set its time alone
+	err = fsys.Touch(ctx, "a")
+	if !errors.Is(err, ErrTouchUnsupported) || !errors.Is(err, KindUnsupported) {
+		t.Errorf("a touch of a file should fail with ErrTouchUnsupported, got %v", err)
+	}
+	if err := fsys.Touch(ctx, "dir"); !errors.Is(err, KindUnsupported) {
+		t.Errorf("a touch of a dir should be unsupported, got %v", err)
+	}
+
+	m := &memModTime{memDriver: newMemDriver()}
+	modTimeSetters["memModTime"] = m.setModTime
+	defer delete(modTimeSetters, "memModTime")
+	if fsys, err = newWithAddition(ctx, m, "{}"); err != nil {
+		t.Fatal(err)
+	}
+	if !fsys.Capabilities().Has(CapTouch) {
+		t.Fatal("a driver setting the modified time alone should have CapTouch")
+	}
+	if err := fsys.Put(ctx, "a", strings.NewReader("abc")); err != nil {
+		t.Fatal(err)
+	}
+	before, err := fsys.Stat(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	puts := m.puts.Load()
+	time.Sleep(10 * time.Millisecond)
+	if err := fsys.Touch(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if touched, err := fsys.Stat(ctx, "a"); err != nil || !touched.Modified.After(before.Modified) {
+		t.Errorf("a should be touched, got %+v, %v", touched, err)
+	}
+	if data, _ := m.file(baseDir + "/a"); string(data) != "abc" || m.puts.Load() != puts {
+		t.Errorf("a should be touched without a put, got %q", data)
+	}
+
+	for _, name := range []string{"BaiduPhoto", "mem"} {
+		if fsys, err = newWithAddition(ctx, memNoEmpty{newMemDriver(), name}, "{}"); err != nil {
+			t.Fatal(err)
+		}
+		if got := fsys.Capabilities().Has(CapEmpty); got != (name == "mem") {
+			t.Errorf("%s shouldn't have CapEmpty unless known", name)
+		}
+		err := fsys.Touch(ctx, "b")
+		if !errors.Is(err, ErrEmptyUnsupported) || !errors.Is(err, KindUnsupported) {
+			t.Errorf("%s should fail with ErrEmptyUnsupported, got %v", name, err)
+		}
+	}
+}
+
+func TestWriteAt(t *testing.T) {
+	ctx := context.Background()
+	d := newMemDriver()
+	fsys, err := newWithAddition(ctx, d, "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.WriteAt(ctx, "a", 0, []byte("a")); !errors.Is(err, KindUnsupported) {
+		t.Fatalf("WriteAt should be disabled, got %v", err)
+	}
+	if fsys, err = newWithAddition(ctx, d, "{}", WithWriteAt(16)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Put(ctx, "a", strings.NewReader("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []struct {
+		name string
+		off  int64
+		data string
+		want string
+	}{
+		{"a", 6, "WORLD", "hello WORLD"},
+		{"a", 0, "H", "Hello WORLD"},
+		{"a", 13, "!", "Hello WORLD\x00\x00!"},
+		{"b", 2, "b", "\x00\x00b"},
+	} {
+		if err := fsys.WriteAt(ctx, w.name, w.off, []byte(w.data)); err != nil {
+			t.Fatal(err)
+		}
+		if data, _ := d.file(baseDir + "/" + w.name); string(data) != w.want {
+			t.Errorf("%s should be %q after writing %q at %d, got %q", w.name, w.want, w.data, w.off, data)
+		}
+	}
+	if err := fsys.WriteAt(ctx, "a", 10, []byte("1234567")); !errors.Is(err, ErrObjectTooLarge) {
+		t.Fatalf("the write should fail with ErrObjectTooLarge, got %v", err)
+	}
+
+	s := &memSlow{memDriver: d, delay: 5 * time.Millisecond}
+	if fsys, err = newWithAddition(ctx, s, "{}", WithWriteAt(16)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Put(ctx, "c", strings.NewReader("........")); err != nil {
+		t.Fatal(err)
+	}
+	s.slow.Store(true)
+	var wg sync.WaitGroup
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			if err := fsys.WriteAt(ctx, "c", int64(n), []byte{byte('0' + n)}); err != nil {
+				t.Error(err)
+			}
+		}(n)
+	}
+	wg.Wait()
+	if data, _ := d.file(baseDir + "/c"); string(data) != "01234567" {
+		t.Errorf("the concurrent writes shouldn't clobber each other, got %q", data)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	ctx := context.Background()
+	d := newMemDriver()
+	fsys, err := newWithAddition(ctx, d, "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Append(ctx, "a", strings.NewReader("a")); !errors.Is(err, KindUnsupported) {
+		t.Fatalf("Append should be disabled, got %v", err)
+	}
+	fsys, err = newWithAddition(ctx, d, "{}", WithAppend(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"abc", "", "def"} {
+		if err := fsys.Append(ctx, "log", strings.NewReader(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if data, _ := d.file(baseDir + "/log"); string(data) != "abcdef" {
+		t.Errorf("the appends should be joined, got %q", data)
+	}
+	if err := fsys.Append(ctx, "log", strings.NewReader("ghi")); !errors.Is(err, ErrObjectTooLarge) {
+		t.Fatalf("the append should fail with ErrObjectTooLarge, got %v", err)
+	}
+
+	s := &memSlow{memDriver: newMemDriver(), delay: 5 * time.Millisecond}
+	if fsys, err = newWithAddition(ctx, s, "{}", WithAppend(8)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Put(ctx, "c", strings.NewReader("")); err != nil {
+		t.Fatal(err)
+	}
+	s.slow.Store(true)
+	var wg sync.WaitGroup
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fsys.Append(ctx, "c", strings.NewReader("x")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if data, _ := s.file(baseDir + "/c"); string(data) != "xxxxxxxx" {
+		t.Errorf("the concurrent appends shouldn't clobber each other, got %q", data)
+	}
+}
+
+func TestDeleteBatch(t *testing.T) {
+	ctx := context.Background()
+	d := &memFlaky{memDriver: newMemDriver()}
+	fsys, err := newWithAddition(ctx, d, "{}", WithCacheTTL(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, dir := range []string{"a", "b", "b/c", "e"} {
+		for n := 0; n < 10; n++ {
+			name := dir + "/" + strconv.Itoa(n)
+			if err := fsys.Put(ctx, name, strings.NewReader(name)); err != nil {
+				t.Fatal(err)
+			}
+			if dir != "e" {
+				names = append(names, name)
+			}
+		}
+	}
+	names = append(names, "b/c", "e", "missing", "a/0", "/")
+	d.lists.Store(0)
+	failed := fsys.DeleteBatch(ctx, names, 4)
+	if len(failed) != 2 || !errors.Is(failed["e"], ErrDirNotEmpty) || !errors.Is(failed["/"], ErrInvalidName) {
+		t.Fatalf("e and / should fail, got %v", failed)
+	}
+	// the dirs are listed once, and b/c and e again to check they are empty
+	if n := d.lists.Load(); n > 8 {
+		t.Errorf("the dirs should be listed once, got %d lists", n)
+	}
+	if paths := d.paths(baseDir); len(paths) != 13 || paths[1] != baseDir+"/b" {
+		t.Errorf("only a, b and e should be left, got %v", paths)
+	}
+	if failed := fsys.DeleteBatch(ctx, []string{"a", "b"}, 0); failed != nil {
+		t.Errorf("nothing should fail, got %v", failed)
+	}
+}
+
+func TestPutBatch(t *testing.T) {
+	ctx := context.Background()
+	d := &memMkdir{memDriver: newMemDriver()}
+	fsys, err := newWithAddition(ctx, d, "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.mkdirs.Store(0)
+	var items []PutItem
+	for n := 0; n < 20; n++ {
+		name := "x/y/" + strconv.Itoa(n)
+		items = append(items, PutItem{Name: name, Size: int64(len(name)), Open: func() (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader(name)), nil
+		}})
+	}
+	items = append(items, PutItem{Name: "z", Size: -1, Open: func() (io.ReadCloser, error) {
+		return nil, errors.New("can't open")
+	}}, PutItem{Name: "/", Size: 0})
+	results := fsys.PutBatch(ctx, items, 4)
+	for n, err := range results[:20] {
+		if err != nil {
+			t.Errorf("item %d failed: %v", n, err)
+		}
+	}
+	if results[20] == nil || !errors.Is(results[21], ErrInvalidName) {
+		t.Errorf("the last items should fail, got %v", results[20:])
+	}
+	if n := d.mkdirs.Load(); n != 2 {
+		t.Errorf("x and y should be made once, got %d mkdirs", n)
+	}
+	if data, _ := d.file(baseDir + "/x/y/7"); string(data) != "x/y/7" {
+		t.Errorf("x/y/7 should be put, got %q", data)
+	}
+
+	s := &memSlow{memDriver: newMemDriver(), delay: 20 * time.Millisecond}
+	if fsys, err = newWithAddition(ctx, s, "{}"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Mkdir(ctx, "dir"); err != nil {
+		t.Fatal(err)
+	}
+	s.slow.Store(true)
+	cctx, cancel := context.WithCancel(ctx)
+	var opened atomic.Int32
+	items = items[:0]
+	for n := 0; n < 8; n++ {
+		items = append(items, PutItem{Name: "dir/" + strconv.Itoa(n), Size: 1, Open: func() (io.ReadCloser, error) {
+			if opened.Add(1) == 2 {
+				cancel()
+			}
+			return io.NopCloser(strings.NewReader("a")), nil
+		}})
+	}
+	results = fsys.PutBatch(cctx, items, 2)
+	cancel()
+	if n := opened.Load(); n > 3 {
+		t.Errorf("no item should be started once canceled, %d have", n)
+	}
+	for n, err := range results[3:] {
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("item %d should be canceled, got %v", n+3, err)
+		}
+	}
+}
+
+func TestListIter(t *testing.T) {
+	ctx := context.Background()
+	d := &memPager{memDriver: newMemDriver(), size: 2, dir: baseDir + "/dir"}
+	for _, drv := range []driver.Driver{d.memDriver, d} {
+		fsys, err := newWithAddition(ctx, drv, "{}")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if drv == d.memDriver {
+			for n := 0; n < 10; n++ {
+				if err := fsys.Put(ctx, "dir/"+strconv.Itoa(n), strings.NewReader("a")); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		var names []string
+		err = fsys.ListIter(ctx, "dir", func(e Entry) error {
+			names = append(names, e.Name)
+			return nil
+		})
+		if err != nil || len(names) != 10 || names[9] != "9" {
+			t.Fatalf("all the entries should be listed in order, got %v, %v", names, err)
+		}
+		names = names[:0]
+		err = fsys.ListIter(ctx, "dir", func(e Entry) error {
+			names = append(names, e.Name)
+			if len(names) == 3 {
+				return ErrStopList
+			}
+			return nil
+		})
+		if err != nil || len(names) != 3 {
+			t.Fatalf("the listing should stop, got %v, %v", names, err)
+		}
+		stop := errors.New("stop")
+		if err := fsys.ListIter(ctx, "dir", func(Entry) error { return stop }); !errors.Is(err, stop) {
+			t.Fatalf("the error of fn should be returned, got %v", err)
+		}
+	}
+	if n := d.pages.Load(); n != 5+2+1 {
+		t.Errorf("the pages should be listed until stopped, got %d", n)
+	}
+
+	// a lookup stops at the page of the object
+	fsys, err := newWithAddition(ctx, d, "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.pages.Store(0)
+	if _, err := fsys.Stat(ctx, "dir/1"); err != nil {
+		t.Fatal(err)
+	}
+	if n := d.pages.Load(); n != 1 {
+		t.Errorf("only the first page should be listed, got %d", n)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	ctx := context.Background()
+	d := memLooping{newMemDriver()}
+	fsys, err := newWithAddition(ctx, d, "{}", WithWalkParallel(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a/b/1", "a/b/2", "a/c/3", "a/d", "e/4", "e/5", "f", "loop/6"} {
+		if err := fsys.Put(ctx, name, strings.NewReader(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	walk := func(root string, skip map[string]error) []string {
+		var paths []string
+		err := fsys.Walk(ctx, root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				paths = append(paths, path+"!")
+				if errors.Is(err, ErrWalkLoop) || errs.IsObjectNotFound(err) {
+					return nil
+				}
+				return err
+			}
+			if d.IsDir() {
+				path += "/"
+			}
+			paths = append(paths, path)
+			return skip[path]
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return paths
+	}
+	got := strings.Join(walk(".", nil), " ")
+	if want := "./ a/ a/b/ a/b/1 a/b/2 a/c/ a/c/3 a/d e/ e/4 e/5 f loop/ loop/6 loop/loop!"; got != want {
+		t.Errorf("the walk should be\n%s\ngot\n%s", want, got)
+	}
+	got = strings.Join(walk("a", map[string]error{"a/b/": fs.SkipDir, "a/c/3": fs.SkipDir}), " ")
+	if want := "a/ a/b/ a/c/ a/c/3 a/d"; got != want {
+		t.Errorf("the walk should skip to\n%s\ngot\n%s", want, got)
+	}
+	got = strings.Join(walk(".", map[string]error{"a/c/3": fs.SkipAll}), " ")
+	if want := "./ a/ a/b/ a/b/1 a/b/2 a/c/ a/c/3"; got != want {
+		t.Errorf("the walk should stop at\n%s\ngot\n%s", want, got)
+	}
+	if got := strings.Join(walk("missing", nil), " "); got != "missing!" {
+		t.Errorf("a missing root should be given to fn, got %s", got)
+	}
+}
+
+func TestGlob(t *testing.T) {
+	ctx := context.Background()
+	d := &memListLog{memDriver: newMemDriver()}
+	fsys, err := newWithAddition(ctx, d, "{}", WithCacheTTL(time.Minute), WithChunkedUpload(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"chunks/a/x.tmp", "chunks/a/y", "chunks/b/x.tmp", "chunks/b/c/z.tmp", "other/d/x.tmp", "t.tmp"} {
+		if err := fsys.Put(ctx, name, strings.NewReader(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fsys.Mkdir(ctx, ".parts/x.tmp"); err != nil {
+		t.Fatal(err)
+	}
+	for pattern, want := range map[string]string{
+		"chunks/*/*.tmp":    "chunks/a/x.tmp chunks/b/x.tmp",
+		"chunks/**/*.tmp":   "chunks/a/x.tmp chunks/b/c/z.tmp chunks/b/x.tmp",
+		"**/x.tmp":          "chunks/a/x.tmp chunks/b/x.tmp other/d/x.tmp",
+		"chunks/b/**":       "chunks/b chunks/b/c chunks/b/c/z.tmp chunks/b/x.tmp",
+		"*.tmp":             "t.tmp",
+		"chunks/a/y":        "chunks/a/y",
+		"chunks/[ab]/\\x.*": "chunks/a/x.tmp chunks/b/x.tmp",
+		"missing/*":         "",
+		".parts/*":          "",
+	} {
+		d.listed = nil
+		names, err := fsys.Glob(ctx, pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(names, " "); got != want {
+			t.Errorf("%s should match %q, got %q", pattern, want, got)
+		}
+		if pattern == "chunks/*/*.tmp" {
+			for _, dir := range d.listed {
+				if strings.HasPrefix(dir, baseDir+"/other") {
+					t.Errorf("%s shouldn't be listed for %s", dir, pattern)
+				}
+			}
+		}
+	}
+	if _, err := fsys.Glob(ctx, "a/[b"); !errors.Is(err, stdpath.ErrBadPattern) {
+		t.Errorf("a bad pattern should fail with path.ErrBadPattern, got %v", err)
+	}
+}
+
+func TestListObjects(t *testing.T) {
+	ctx := context.Background()
+	d := &memListLog{memDriver: newMemDriver()}
+	fsys, err := newWithAddition(ctx, d, "{}", WithChunkedUpload(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{"a-b", "a.txt", "a/x", "a/y/z", "b/c/d", "b/c/e", "b/ca", "c"}
+	for _, key := range []string{"b/c/e", "a/y/z", "a.txt", "c", "a/x", "b/ca", "a-b", "b/c/d"} {
+		if err := fsys.Put(ctx, key, strings.NewReader(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fsys.Mkdir(ctx, "empty"); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	marker, pages := "", 0
+	for {
+		entries, next, err := fsys.ListObjects(ctx, "", marker, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		for _, e := range entries {
+			if e.IsDir || e.Size != int64(len(e.Name)) {
+				t.Errorf("%s is listed as %+v", e.Name, e)
+			}
+			got = append(got, e.Name)
+		}
+		if next == "" {
+			break
+		}
+		if next != got[len(got)-1] {
+			t.Fatalf("the marker should be the last key %s, got %s", got[len(got)-1], next)
+		}
+		marker = next
+	}
+	if strings.Join(got, " ") != strings.Join(keys, " ") || pages != 3 {
+		t.Errorf("the keys should be %v in 3 pages, got %v in %d", keys, got, pages)
+	}
+
+	for _, c := range []struct {
+		prefix, startAfter, want string
+	}{
+		{"a", "", "a-b a.txt a/x a/y/z"},
+		{"a/", "", "a/x a/y/z"},
+		{"b/c", "", "b/c/d b/c/e b/ca"},
+		{"b/c/", "b/c/d", "b/c/e"},
+		{"", "a/y", "a/y/z b/c/d b/c/e b/ca c"},
+		{"", "a~", "b/c/d b/c/e b/ca c"},
+		{"missing/", "", ""},
+		{"c/", "", ""},
+		{".parts/", "", ""},
+	} {
+		d.listed = nil
+		entries, next, err := fsys.ListObjects(ctx, c.prefix, c.startAfter, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name)
+		}
+		if strings.Join(names, " ") != c.want || next != "" {
+			t.Errorf("%q after %q should list %q, got %q and marker %q", c.prefix, c.startAfter, c.want, names, next)
+		}
+		if c.prefix == "b/c/" || c.startAfter == "a~" {
+			for _, dir := range d.listed {
+				if strings.HasPrefix(dir, baseDir+"/a") {
+					t.Errorf("%s shouldn't be listed for %q after %q", dir, c.prefix, c.startAfter)
+				}
+			}
+		}
+	}
+	if _, _, err := fsys.ListObjects(ctx, "../x", "", 0); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("a prefix out of the base dir should fail with ErrInvalidName, got %v", err)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	ctx := context.Background()
+	d := &memSlow{memDriver: newMemDriver(), delay: 10 * time.Millisecond}
+	fsys, err := newWithAddition(ctx, &memVanishing{memDriver: d.memDriver, gone: []string{baseDir + "/chunks/gone"}}, "{}", WithChunkedUpload(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, size := range map[string]int{"chunks/0/a": 3, "chunks/0/b": 4, "chunks/1/c/d": 5, "chunks/gone/e": 6, "f": 7, "big": 250} {
+		if err := fsys.Put(ctx, name, strings.NewReader(strings.Repeat("x", size))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fsys.Mkdir(ctx, "empty"); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]string{}
+	files, dirs, bytes, err := fsys.Usage(ctx, "", WithDirUsage(func(dir string, files, dirs, bytes int64) {
+		got[dir] = fmt.Sprint(files, dirs, bytes)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the parts of big and the dir removed since listed aren't counted
+	if files != 5 || dirs != 5 || bytes != 269 {
+		t.Errorf("Usage should be 5 files, 5 dirs and 269 bytes, got %d, %d and %d", files, dirs, bytes)
+	}
+	want := map[string]string{"": "5 5 269", "chunks": "3 3 12", "chunks/0": "2 0 7", "chunks/1": "1 1 5", "chunks/1/c": "1 0 5", "empty": "0 0 0"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("the dirs should use %v, got %v", want, got)
+	}
+	if files, _, bytes, err := fsys.Usage(ctx, "chunks/1"); err != nil || files != 1 || bytes != 5 {
+		t.Errorf("chunks/1 should have 1 file of 5 bytes, got %d, %d and %v", files, bytes, err)
+	}
+	if _, _, _, err := fsys.Usage(ctx, "missing"); !errs.IsObjectNotFound(err) {
+		t.Errorf("a missing dir should fail with not found, got %v", err)
+	}
+
+	fsys, err = newWithAddition(ctx, d, "{}", WithWalkParallel(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.slow.Store(true)
+	if _, _, _, err := fsys.Usage(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+	if peak := d.peak.Load(); peak != 2 {
+		t.Errorf("2 dirs should be listed at once, got %d", peak)
+	}
+
+	d.delay = time.Hour
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, _, _, err := fsys.Usage(ctx, ""); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Usage should stop with the context, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Usage should stop promptly, took %v", time.Since(start))
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	ctx := context.Background()
+	fsys, err := newWithAddition(ctx, newMemDriver(), "{}", WithUploadHashes(utils.MD5), WithChunkedUpload(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a/b/c", "a/d", "e"} {
+		if err := fsys.Put(ctx, name, strings.NewReader(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fsys.Put(ctx, "big", strings.NewReader(strings.Repeat("x", 250))); err != nil {
+		t.Fatal(err)
+	}
+
+	for dir, want := range map[string]string{
+		"":   "a/ a/b/ a/b/c:5 a/d:3 big:250 e:1",
+		"/a": "b/ b/c:5 d:3",
+	} {
+		var buf bytes.Buffer
+		if err := fsys.Snapshot(ctx, dir, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if n := strings.Count(buf.String(), "\n"); n != strings.Count(want, " ")+2 {
+			t.Errorf("the snapshot of %q should have a line per object and a header, got %d lines", dir, n)
+		}
+		s, err := LoadSnapshot(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wantRoot := strings.TrimPrefix(dir, "/"); s.Root != wantRoot || s.Time.IsZero() {
+			t.Errorf("the snapshot should be of %q with its time, got %q at %v", wantRoot, s.Root, s.Time)
+		}
+		var got []string
+		for {
+			e, err := s.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.IsDir {
+				got = append(got, e.Path+"/")
+				continue
+			}
+			got = append(got, fmt.Sprintf("%s:%d", e.Path, e.Size))
+			if e.Path != "big" && e.Hashes.GetHash(utils.MD5) != utils.HashData(utils.MD5, []byte(stdpath.Join(strings.TrimPrefix(dir, "/"), e.Path))) {
+				t.Errorf("%s should have its md5, got %v", e.Path, e.Hashes)
+			}
+			if e.Modified.IsZero() {
+				t.Errorf("%s should have its mtime", e.Path)
+			}
+		}
+		if strings.Join(got, " ") != want {
+			t.Errorf("the snapshot of %q should have %q, got %q", dir, want, got)
+		}
+	}
+
+	if _, err := LoadSnapshot(strings.NewReader(`{"version":2}` + "\n")); !errors.Is(err, ErrSnapshotVersion) {
+		t.Errorf("a newer snapshot should fail with ErrSnapshotVersion, got %v", err)
+	}
+	s, err := LoadSnapshot(strings.NewReader(`{"version":1}` + "\n" + `{"path":"../x"}` + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Next(); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("a path out of the root should fail with ErrInvalidName, got %v", err)
+	}
+	if err := fsys.Snapshot(ctx, "missing", io.Discard); !errs.IsObjectNotFound(err) {
+		t.Errorf("a missing dir should fail with not found, got %v", err)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	ctx := context.Background()
+	fsys, err := newWithAddition(ctx, newMemDriver(), "{}", WithUploadHashes(utils.MD5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	put := func(name, content string) {
+		if _, err := fsys.PutWithOptions(ctx, name, strings.NewReader(content), WithModTime(t0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"a/b", "a/c", "a.txt", "d/e", "f", "g"} {
+		put(name, name)
+	}
+	snapshot := func() *bytes.Buffer {
+		var buf bytes.Buffer
+		if err := fsys.Snapshot(ctx, "", &buf); err != nil {
+			t.Fatal(err)
+		}
+		return &buf
+	}
+	load := func(buf *bytes.Buffer) *SnapshotReader {
+		s, err := LoadSnapshot(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	before := snapshot()
+
+	put("a/b", "a/x") // same size
+	put("a/c", "longer")
+	if _, err := fsys.PutWithOptions(ctx, "a.txt", strings.NewReader("a.txt"), WithModTime(t0.Add(time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	put("a/a", "new")
+	for _, name := range []string{"f", "d/e"} {
+		if err := fsys.Delete(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("d/e/f", "dir now")
+	put("h", "h")
+	after := snapshot()
+
+	added, removed, changed, err := Diff(load(before), load(after))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(added, removed, changed) != "[a/a d/e/f h] [f] [a/b a/c a.txt d/e]" {
+		t.Errorf("the diff should be [a/a d/e/f h] [f] [a/b a/c a.txt d/e], got %v %v %v", added, removed, changed)
+	}
+
+	want := map[string]Change{"a/b": ChangedHash, "a/c": ChangedSize | ChangedHash, "d/e": ChangedType, "a.txt": ChangedModified}
+	var live []string
+	err = fsys.DiffLive(ctx, "", load(before), func(e DiffEntry) error {
+		live = append(live, e.Path)
+		if e.Kind == DiffChanged && e.Changes != want[e.Path] {
+			t.Errorf("%s should have changes %b, got %b", e.Path, want[e.Path], e.Changes)
+		}
+		if (e.A == nil) != (e.Kind == DiffAdded) || (e.B == nil) != (e.Kind == DiffRemoved) {
+			t.Errorf("%s is %v with %v and %v", e.Path, e.Kind, e.A, e.B)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(live, " "); got != "a/a a/b a/c a.txt d/e d/e/f f h" {
+		t.Errorf("the live diff should be in the order walked, got %s", got)
+	}
+	if err := fsys.DiffLive(ctx, "", load(after), func(e DiffEntry) error {
+		t.Errorf("%s shouldn't differ", e.Path)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := errors.New("stop")
+	n := 0
+	err = fsys.DiffLive(ctx, "", load(before), func(e DiffEntry) error {
+		n++
+		return stop
+	})
+	if !errors.Is(err, stop) || n != 1 {
+		t.Errorf("the diff should stop with fn, got %v after %d", err, n)
+	}
+}
+
+func TestVerifyLocal(t *testing.T) {
+	ctx := context.Background()
+	d := newMemDriver()
+	hashed, err := newWithAddition(ctx, d, "{}", WithUploadHashes(utils.MD5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := newWithAddition(ctx, d, "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := t.TempDir()
+	for name, data := range map[string]string{"a": "abc", "b/c": "hello", "d": "same", "e": "xyz", "f": "", "g": "12345", "h": "abcde"} {
+		p := filepath.Join(local, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, data := range map[string]string{"r/a": "abc", "r/b/c": "hellO", "r/d": "samee", "r/f": ""} {
+		if err := hashed.Put(ctx, name, strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, data := range map[string]string{"r/g": "12345", "r/h": "abcdX"} {
+		if err := fsys.Put(ctx, name, strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := fsys.VerifyLocal(ctx, local, "r", VerifyOptions{MaxDownload: 10, Parallel: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(r.Files, r.Missing, r.SizeMismatch, r.HashMismatch, r.Unverified, r.Downloaded, r.OK()); got != "7 [e] [d] [b/c h] [] 10 false" {
+		t.Errorf("the report should be 7 [e] [d] [b/c h] [] 10 false, got %s", got)
+	}
+	if r, err = fsys.VerifyLocal(ctx, local, "r", VerifyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(r.Unverified, r.Downloaded); got != "[g h] 0" {
+		t.Errorf("g and h should be unverified without a budget, got %s", got)
+	}
+	if r, err = fsys.VerifyLocal(ctx, local, "r", VerifyOptions{Hash: utils.SHA1, MaxDownload: 100}); err != nil {
+		t.Fatal(err)
+	}
+	// the md5s reported aren't compared
+	if got := fmt.Sprint(r.HashMismatch, r.Downloaded); got != "[b/c h] 18" {
+		t.Errorf("the objects should be downloaded to compare their sha1, got %s", got)
+	}
+
+	for _, name := range []string{"e", "d", "b/c", "h"} {
+		if err := os.Remove(filepath.Join(local, filepath.FromSlash(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r, err = fsys.VerifyLocal(ctx, local, "r", VerifyOptions{MaxDownload: 5}); err != nil || !r.OK() {
+		t.Errorf("the rest should be verified, got %+v and %v", r, err)
+	}
+	if _, err := fsys.VerifyLocal(ctx, filepath.Join(local, "missing"), "r", VerifyOptions{}); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("a missing local dir should fail with fs.ErrNotExist, got %v", err)
+	}
+}
+
+func TestSyncUp(t *testing.T) {
+	ctx := context.Background()
+	d := newMemDriver()
+	fsys, err := newWithAddition(ctx, d, "{}", WithUploadHashes(utils.MD5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := t.TempDir()
+	write := func(name, data string, mtime time.Time) {
+		p := filepath.Join(local, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	write("a", "a", t0)
+	write("b/c", "bc", t0)
+	write("b/d", "bd", t0)
+	if err := os.Symlink(filepath.Join(local, "b"), filepath.Join(local, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Put(ctx, "r/old", strings.NewReader("old")); err != nil {
+		t.Fatal(err)
+	}
+	report := func(r SyncReport) string {
+		return fmt.Sprint(r.Uploaded, r.Deleted, r.Unchanged, r.Bytes, len(r.Failed))
+	}
+
+	r, err := fsys.SyncUp(ctx, local, "r", SyncOptions{Delete: true, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := report(r); got != "[a b/c b/d] [old] 0 5 0" {
+		t.Errorf("the dry run should report [a b/c b/d] [old] 0 5 0, got %s", got)
+	}
+	if names := d.paths(baseDir + "/r"); fmt.Sprint(names) != "["+baseDir+"/r/old]" {
+		t.Errorf("the dry run shouldn't change the storage, got %v", names)
+	}
+
+	if r, err = fsys.SyncUp(ctx, local, "r", SyncOptions{Parallel: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if got := report(r); got != "[a b/c b/d] [] 0 5 0" {
+		t.Errorf("the files should be uploaded, got %s", got)
+	}
+	if info, err := fsys.Stat(ctx, "r/b/c"); err != nil || !info.Modified.Equal(t0) {
+		t.Errorf("the mtime should be kept, got %v and %v", info.Modified, err)
+	}
+	if r, err = fsys.SyncUp(ctx, local, "r", SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := report(r); got != "[] [] 3 0 0" {
+		t.Errorf("the files unchanged should be skipped, got %s", got)
+	}
+
+	write("a", "x", t0.Add(time.Hour))
+	write("b/c", "bc", t0.Add(time.Hour))
+	if r, err = fsys.SyncUp(ctx, local, "r", SyncOptions{CompareHash: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got := report(r); got != "[a] [] 2 1 0" {
+		t.Errorf("only a should differ by its hash, got %s", got)
+	}
+	if r, err = fsys.SyncUp(ctx, local, "r", SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := report(r); got != "[b/c] [] 2 2 0" {
+		t.Errorf("b/c should differ by its mtime, got %s", got)
+	}
+	if data, _ := d.file(baseDir + "/r/a"); string(data) != "x" {
+		t.Errorf("a should be replaced, got %q", data)
+	}
+
+	// a link to a parent isn't followed
+	if err := os.Symlink(local, filepath.Join(local, "b", "loop")); err != nil {
+		t.Fatal(err)
+	}
+	if r, err = fsys.SyncUp(ctx, local, "r", SyncOptions{Delete: true, FollowSymlinks: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got := report(r); got != "[link/c link/d] [old] 3 4 0" {
+		t.Errorf("the linked dir should be uploaded and old removed, got %s", got)
+	}
+	if _, err := fsys.Stat(ctx, "r/old"); !errs.IsObjectNotFound(err) {
+		t.Errorf("old should be removed, got %v", err)
+	}
+}
+
+func TestDownloadTar(t *testing.T) {
+	ctx := context.Background()
+	d := &memVanishing{memDriver: newMemDriver(), gone: []string{baseDir + "/t/gone", baseDir + "/t/b/lost"}}
+	fsys, err := newWithAddition(ctx, d, "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, name := range []string{"t/a", "t/b/c", "t/b/lost", "t/gone/d", "t/" + strings.Repeat("e", 120), "u"} {
+		if _, err := fsys.PutWithOptions(ctx, name, strings.NewReader(name), WithModTime(t0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, prefetch := range []int{0, 1, 3} {
+		var buf bytes.Buffer
+		var skipped []string
+		err := fsys.DownloadTar(ctx, "t", &buf, WithTarPrefetch(prefetch), WithTarSkipped(func(name string, err error) {
+			skipped = append(skipped, name)
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		tr := tar.NewReader(&buf)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !h.ModTime.Equal(t0) && h.Typeflag == tar.TypeReg {
+				t.Errorf("%s should have its mtime, got %v", h.Name, h.ModTime)
+			}
+			if h.Typeflag == tar.TypeReg && string(data) != "t/"+h.Name {
+				t.Errorf("%s has %q", h.Name, data)
+			}
+			got = append(got, h.Name)
+		}
+		want := "a b/ b/c " + strings.Repeat("e", 120) + " gone/"
+		if strings.Join(got, " ") != want || fmt.Sprint(skipped) != "[b/lost gone]" {
+			t.Errorf("the archive with %d prefetched should have %s without [b/lost gone], got %v without %v", prefetch, want, got, skipped)
+		}
+	}
+	if err := fsys.DownloadTar(ctx, "missing", io.Discard); !errs.IsObjectNotFound(err) {
+		t.Errorf("a missing dir should fail with not found, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := fsys.DownloadTar(ctx, "t", io.Discard, WithTarPrefetch(2)); !errors.Is(err, context.Canceled) {
+		t.Errorf("the archive should stop with the context, got %v", err)
+	}
+}
+
+func TestUploadArchive(t *testing.T) {
+	ctx := context.Background()
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	files := []struct {
+		name, data string
+	}{{"a/b", "ab"}, {"a/c/d", "acd"}, {"e", "e"}, {"f", "f"}, {"../evil", "x"}}
+
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	for _, h := range []*tar.Header{{Name: "./", Typeflag: tar.TypeDir}, {Name: "a/", Typeflag: tar.TypeDir}, {Name: "empty/", Typeflag: tar.TypeDir}, {Name: "link", Typeflag: tar.TypeSymlink, Linkname: "e"}} {
+		h.Mode, h.ModTime = 0o755, t0
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var zipBuf bytes.Buffer
+	zw := zip.NewWriter(&zipBuf)
+	if _, err := zw.Create("empty/"); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(f.data)), ModTime: t0}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.data)); err != nil {
+			t.Fatal(err)
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: zip.Deflate, Modified: t0})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(f.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for format, archive := range map[ArchiveFormat][]byte{ArchiveTar: tarBuf.Bytes(), ArchiveZip: zipBuf.Bytes()} {
+		d := &memSlow{memDriver: newMemDriver(), delay: 10 * time.Millisecond}
+		fsys, err := newWithAddition(ctx, d, "{}")
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.slow.Store(true)
+		err = fsys.UploadArchive(ctx, "x", bytes.NewReader(archive), format, WithArchiveParallel(2))
+		var ae *ArchiveError
+		if !errors.As(err, &ae) || len(ae.Failed) != 1 || !errors.Is(ae.Failed["../evil"], ErrInvalidName) {
+			t.Fatalf("../evil should fail with ErrInvalidName, got %v", err)
+		}
+		d.slow.Store(false)
+		if peak := d.peak.Load(); peak != 2 {
+			t.Errorf("2 entries should be put at once, got %d", peak)
+		}
+		for _, f := range files[:4] {
+			if data, _ := d.file(baseDir + "/x/" + f.name); string(data) != f.data {
+				t.Errorf("%s should have %q, got %q", f.name, f.data, data)
+			}
+			if info, err := fsys.Stat(ctx, "x/"+f.name); err != nil || !info.Modified.Equal(t0) {
+				t.Errorf("%s should have its mtime, got %v and %v", f.name, info.Modified, err)
+			}
+		}
+		if info, err := fsys.Stat(ctx, "x/empty"); err != nil || !info.IsDir {
+			t.Errorf("empty should be made, got %+v and %v", info, err)
+		}
+		if ok, _ := fsys.Exists(ctx, "evil"); ok {
+			t.Error("evil shouldn't be put out of the dir")
+		}
+	}
+}
+
+func TestCopyBetween(t *testing.T) {
+	ctx := context.Background()
+	src, err := newWithAddition(ctx, newMemDriver(), "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := newWithAddition(ctx, newMemDriver(), "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, name := range []string{"t/a", "t/b/c", "t/b/d"} {
+		if _, err := src.PutWithOptions(ctx, name, strings.NewReader(name), WithModTime(t0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := src.Mkdir(ctx, "t/empty"); err != nil {
+		t.Fatal(err)
+	}
+
+	var sent, total int64
+	err = CopyBetween(ctx, src, dst, "t/a", WithProgress(func(s, n int64) { sent, total = s, n }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := dst.Stat(ctx, "t/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 3 || !info.Modified.Equal(t0) {
+		t.Errorf("t/a should be copied with its size and mtime, got %d %v", info.Size, info.Modified)
+	}
+	if sent != 3 || total != 3 {
+		t.Errorf("the progress should end at 3 of 3, got %d of %d", sent, total)
+	}
+	if err := CopyBetween(ctx, src, dst, "t/b"); !errors.Is(err, errs.NotFile) {
+		t.Errorf("copying a dir should fail with NotFile, got %v", err)
+	}
+
+	failed, err := CopyTreeBetween(ctx, src, dst, "t", 2)
+	if err != nil || len(failed) > 0 {
+		t.Fatal(failed, err)
+	}
+	for _, name := range []string{"t/b/c", "t/b/d"} {
+		if got := readAll(t, dst, name, 0, 0); got != name {
+			t.Errorf("%s should be copied, got %q", name, got)
+		}
+	}
+	if info, err := dst.Stat(ctx, "t/empty"); err != nil || !info.IsDir {
+		t.Errorf("the empty dir should be made, got %v", err)
+	}
+}
+
+func TestSync(t *testing.T) {
+	ctx := context.Background()
+	src, err := newWithAddition(ctx, newMemDriver(), "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := newWithAddition(ctx, newMemDriver(), "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	put := func(fsys FileSystem, name, data string, mtime time.Time) {
+		t.Helper()
+		if _, err := fsys.PutWithOptions(ctx, name, strings.NewReader(data), WithModTime(mtime)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(src, "t/a", "a", t0)
+	put(src, "t/b/c", "bc", t0)
+	if err := src.Mkdir(ctx, "t/empty"); err != nil {
+		t.Fatal(err)
+	}
+	put(dst, "t/a", "old", t0)
+	put(dst, "t/x", "x", t0)
+	report := func(r SyncReport) string {
+		return fmt.Sprint(r.Uploaded, r.Deleted, r.Conflicts, r.Unchanged, r.Bytes, len(r.Failed))
+	}
+
+	r, err := Sync(ctx, src, dst, "t", SyncOptions{Delete: true, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := report(r); got != "[a b/c] [x] [] 0 3 0" {
+		t.Errorf("the dry run should report [a b/c] [x] [] 0 3 0, got %s", got)
+	}
+	if ok, _ := dst.Exists(ctx, "t/b/c"); ok {
+		t.Error("the dry run shouldn't copy")
+	}
+
+	r, err = Sync(ctx, src, dst, "t", SyncOptions{Delete: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := report(r); got != "[a b/c] [x] [] 0 3 0" {
+		t.Errorf("the sync should report [a b/c] [x] [] 0 3 0, got %s", got)
+	}
+	for name, want := range map[string]string{"t/a": "a", "t/b/c": "bc"} {
+		if got := readAll(t, dst, name, 0, 0); got != want {
+			t.Errorf("%s should be %q, got %q", name, want, got)
+		}
+	}
+	if ok, _ := dst.Exists(ctx, "t/x"); ok {
+		t.Error("t/x should be removed")
+	}
+	if info, err := dst.Stat(ctx, "t/empty"); err != nil || !info.IsDir {
+		t.Errorf("the empty dir should be made, got %v", err)
+	}
+
+	r, err = Sync(ctx, src, dst, "t", SyncOptions{Delete: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := report(r); got != "[] [] [] 2 0 0" {
+		t.Errorf("a sync again should transfer nothing, got %s", got)
+	}
+
+	// dst modified since it was put isn't overwritten
+	put(dst, "t/a", "theirs", t0.Add(time.Hour))
+	put(src, "t/a", "ours", t0.Add(2*time.Hour))
+	r, err = Sync(ctx, src, dst, "t", SyncOptions{Delete: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := report(r); got != "[] [] [a] 1 0 0" {
+		t.Errorf("the object modified in dst should conflict, got %s", got)
+	}
+	if got := readAll(t, dst, "t/a", 0, 0); got != "theirs" {
+		t.Errorf("the object modified in dst should be kept, got %q", got)
+	}
+
+	// dst modified as it's put
+	put(src, "t/b/c", "new", t0.Add(time.Hour))
+	r, err = Sync(ctx, src, &statOverwritten{FileSystem: dst, name: "t/b/c", data: "concurrent"}, "t", SyncOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := report(r); got != "[] [] [a b/c] 0 0 0" {
+		t.Errorf("the object modified as it's put should conflict, got %s", got)
+	}
+	r, err = Sync(ctx, src, dst, "t", SyncOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := report(r); got != "[] [] [a b/c] 0 0 0" {
+		t.Errorf("the object modified as it's put should still conflict, got %s", got)
+	}
+	if got := readAll(t, dst, "t/b/c", 0, 0); got != "concurrent" {
+		t.Errorf("the object of the other writer should be kept, got %q", got)
+	}
+}
+
+func TestUnion(t *testing.T) {
+	ctx := context.Background()
+	upper, err := newWithAddition(ctx, newMemDriver(), "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lower, err := newWithAddition(ctx, newMemDriver(), "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for fsys, files := range map[FileSystem][]string{upper: {"a", "d/x"}, lower: {"a", "b", "d/y"}} {
+		for _, name := range files {
+			data := name
+			if fsys == lower {
+				data = "lower " + name
+			}
+			if err := fsys.Put(ctx, name, strings.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := NewUnion(); err == nil {
+		t.Fatal("a union without layers should fail")
+	}
+	u, err := NewUnion(upper, lower)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"a": "a", "b": "lower b", "d/y": "lower d/y"} {
+		if got := readAll(t, u, name, 0, 0); got != want {
+			t.Errorf("%s should be %q, got %q", name, want, got)
+		}
+	}
+	names := func(dir string, opts ...ListOption) string {
+		t.Helper()
+		entries, err := u.List(ctx, dir, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var l []string
+		for _, e := range entries {
+			l = append(l, e.Name)
+		}
+		return fmt.Sprint(l)
+	}
+	if got := names("", WithSort(SortName, false)); got != "[a b d]" {
+		t.Errorf("the root should be merged as [a b d], got %s", got)
+	}
+	if got := names("d", WithSort(SortName, true)); got != "[y x]" {
+		t.Errorf("d should be merged as [y x], got %s", got)
+	}
+	if got := names("", WithDirsFirst()); got != "[d a b]" {
+		t.Errorf("the root should be merged as [d a b], got %s", got)
+	}
+	var first []string
+	err = u.ListIter(ctx, "", func(e Entry) error {
+		first = append(first, e.Name)
+		return ErrStopList
+	})
+	if err != nil || fmt.Sprint(first) != "[a]" {
+		t.Errorf("the listing should stop at a, got %v %v", first, err)
+	}
+	// the upper a is filtered out, not replaced by the lower one
+	if got := names("", WithMinSize(2), WithSort(SortName, false)); got != "[b d]" {
+		t.Errorf("the filter should keep [b d], got %s", got)
+	}
+	var walked []string
+	err = u.Walk(ctx, "", func(name string, d fs.DirEntry, err error) error {
+		walked = append(walked, name)
+		return err
+	})
+	if err != nil || fmt.Sprint(walked) != "[ a b d d/x d/y]" {
+		t.Errorf("the merged tree should be walked, got %v %v", walked, err)
+	}
+	if _, err := u.Stat(ctx, "missing"); !errs.IsObjectNotFound(err) {
+		t.Errorf("an object missing in all the layers should be not found, got %v", err)
+	}
+
+	if err := u.Put(ctx, "c", strings.NewReader("c")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := upper.Exists(ctx, "c"); !ok {
+		t.Error("c should be put to the first layer")
+	}
+	written, err := NewUnion(upper, WriteLayer(lower))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := written.Put(ctx, "e", strings.NewReader("e")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := lower.Exists(ctx, "e"); !ok {
+		t.Error("e should be put to the write layer")
+	}
+
+	boom := errors.New("boom")
+	if u, err = NewUnion(upper, &failingReads{FileSystem: lower, err: boom}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := u.Stat(ctx, "b"); !errors.Is(err, boom) {
+		t.Errorf("a miss of the upper layer shouldn't hide the error of the lower one, got %v", err)
+	}
+	if got := readAll(t, u, "a", 0, 0); got != "a" {
+		t.Errorf("a should be read from the upper layer, got %q", got)
+	}
+	if _, err := u.List(ctx, ""); !errors.Is(err, boom) {
+		t.Errorf("the list should fail with the lower layer, got %v", err)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	ctx := context.Background()
+	newFS := func() FileSystem {
+		t.Helper()
+		fsys, err := newWithAddition(ctx, newMemDriver(), "{}")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fsys
+	}
+	for _, concurrent := range []bool{false, true} {
+		primary, secondary := newFS(), newFS()
+		var repairs []string
+		opts := MirrorOptions{Concurrent: concurrent, Repair: func(r MirrorRepair) {
+			repairs = append(repairs, r.Op+" "+r.Name)
+		}}
+		m := NewMirror(ctx, primary, secondary, opts)
+		if err := m.Put(ctx, "a", strings.NewReader("hello")); err != nil {
+			t.Fatal(err)
+		}
+		for _, fsys := range []FileSystem{primary, secondary} {
+			if got := readAll(t, fsys, "a", 0, 0); got != "hello" {
+				t.Errorf("concurrent %v: a should be put to both, got %q", concurrent, got)
+			}
+		}
+		if err := m.Delete(ctx, "a"); err != nil {
+			t.Fatal(err)
+		}
+		if ok, _ := secondary.Exists(ctx, "a"); ok {
+			t.Errorf("concurrent %v: a should be deleted from both", concurrent)
+		}
+
+		// the secondary failing is repaired later
+		boom := errors.New("boom")
+		m = NewMirror(ctx, primary, &failingPuts{FileSystem: secondary, err: boom}, opts)
+		if err := m.Put(ctx, "b", strings.NewReader("bb")); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(repairs) != "[put b]" {
+			t.Errorf("concurrent %v: b should be repaired, got %v", concurrent, repairs)
+		}
+		if err := ReconcileMirror(ctx, primary, secondary, MirrorRepair{Name: "b"}); err != nil {
+			t.Fatal(err)
+		}
+		if got := readAll(t, secondary, "b", 0, 0); got != "bb" {
+			t.Errorf("concurrent %v: b should be reconciled, got %q", concurrent, got)
+		}
+		// the primary failing fails the put
+		m = NewMirror(ctx, &failingPuts{FileSystem: primary, err: boom}, secondary, opts)
+		if err := m.Put(ctx, "c", strings.NewReader("c")); !errors.Is(err, boom) {
+			t.Errorf("concurrent %v: the primary failing should fail the put, got %v", concurrent, err)
+		}
+	}
+
+	primary, secondary := newFS(), newFS()
+	m := NewMirror(ctx, &failingReads{FileSystem: primary, err: ErrStorageUnavailable}, secondary, MirrorOptions{})
+	if err := secondary.Put(ctx, "a", strings.NewReader("a")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, m, "a", 0, 0); got != "a" {
+		t.Errorf("the read should fail over to the secondary, got %q", got)
+	}
+	boom := errors.New("boom")
+	m = NewMirror(ctx, &failingReads{FileSystem: primary, err: boom}, secondary, MirrorOptions{})
+	if _, err := m.Read(ctx, "a", 0, 0); !errors.Is(err, boom) {
+		t.Errorf("the read shouldn't fail over on an error not retryable, got %v", err)
+	}
+}
+
+func TestReadPolicy(t *testing.T) {
+	ctx := context.Background()
+	newFS := func() *countingReads {
+		t.Helper()
+		fsys, err := newWithAddition(ctx, newMemDriver(), "{}")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fsys.Put(ctx, "a", strings.NewReader("hello")); err != nil {
+			t.Fatal(err)
+		}
+		return &countingReads{FileSystem: fsys}
+	}
+
+	primary, secondary := newFS(), newFS()
+	m := NewMirror(ctx, primary, secondary, MirrorOptions{ReadPolicy: RoundRobin()})
+	for n := 0; n < 4; n++ {
+		if got := readAll(t, m, "a", 0, 0); got != "hello" {
+			t.Fatalf("a should be read, got %q", got)
+		}
+	}
+	if primary.reads.Load() != 2 || secondary.reads.Load() != 2 {
+		t.Errorf("the reads should be spread 2 and 2, got %d and %d", primary.reads.Load(), secondary.reads.Load())
+	}
+
+	primary, secondary = newFS(), newFS()
+	m = NewMirror(ctx, primary, secondary, MirrorOptions{ReadPolicy: LeastInFlight()})
+	open, err := m.Read(ctx, "a", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, m, "a", 0, 0); got != "hello" {
+		t.Fatalf("a should be read, got %q", got)
+	}
+	if primary.reads.Load() != 1 || secondary.reads.Load() != 1 {
+		t.Errorf("the read should go to the replica without one open, got %d and %d", primary.reads.Load(), secondary.reads.Load())
+	}
+	open.Close()
+
+	// the primary is ejected after 2 failures and its reads fail over
+	primary, secondary = newFS(), newFS()
+	primary.err = ErrStorageUnavailable
+	m = NewMirror(ctx, primary, secondary, MirrorOptions{ReadPolicy: LeastInFlight(), EjectAfter: 2, EjectFor: time.Hour})
+	for n := 0; n < 4; n++ {
+		if got := readAll(t, m, "a", 0, 0); got != "hello" {
+			t.Fatalf("a should be read from the secondary, got %q", got)
+		}
+	}
+	if primary.reads.Load() != 2 || secondary.reads.Load() != 4 {
+		t.Errorf("the primary should be tried twice, got %d and %d", primary.reads.Load(), secondary.reads.Load())
+	}
+}
+
+func TestEncrypted(t *testing.T) {
+	ctx := context.Background()
+	inner, err := newWithAddition(ctx, newMemDriver(), "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := bytes.Repeat([]byte{1}, 32)
+	if _, err := NewEncrypted(inner, nil, CryptOptions{}); err == nil {
+		t.Error("the encryption without key should fail")
+	}
+	e, err := NewEncrypted(inner, key, CryptOptions{ChunkSize: 16, EncryptNames: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := strings.Repeat("0123456789", 10)
+	for name, data := range map[string]string{"d/a": body, "d/empty": "", "d/even": body[:32]} {
+		if err := e.PutWithSize(ctx, name, strings.NewReader(data), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+		info, err := e.Stat(ctx, name)
+		if err != nil || info.Size != int64(len(data)) {
+			t.Errorf("%s should have %d bytes, got %d %v", name, len(data), info.Size, err)
+		}
+		if got := readAll(t, e, name, 0, 0); got != data {
+			t.Errorf("%s should be decrypted, got %q", name, got)
+		}
+	}
+	for _, r := range [][2]int64{{0, 1}, {15, 2}, {16, 16}, {17, 40}, {90, 0}, {99, 5}, {100, 1}} {
+		want := body[min(r[0], 100):]
+		if r[1] > 0 {
+			want = want[:min(r[1], int64(len(want)))]
+		}
+		if got := readAll(t, e, "d/a", r[0], r[1]); got != want {
+			t.Errorf("the range %v should be %q, got %q", r, want, got)
+		}
+	}
+	f, err := e.Open(ctx, "d/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(-10, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(f); err != nil || string(b) != body[90:] {
+		t.Errorf("the seek should read the last 10 bytes, got %q %v", b, err)
+	}
+	f.Close()
+
+	// the names and content are hidden from inner
+	raw, err := inner.List(ctx, "")
+	if err != nil || len(raw) != 1 || raw[0].Name == "d" {
+		t.Fatalf("the dir name should be encrypted, got %v %v", raw, err)
+	}
+	entries, err := e.List(ctx, "d", WithSort(SortName, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%d %s %d", len(entries), entries[0].Name, entries[0].Size) != "3 a 100" {
+		t.Errorf("d should list a with 100 bytes first, got %v", entries)
+	}
+	var walked []string
+	err = e.Walk(ctx, "d", func(name string, d fs.DirEntry, err error) error {
+		walked = append(walked, name)
+		return err
+	})
+	if err != nil || fmt.Sprint(walked) != "[d d/a d/empty d/even]" {
+		t.Errorf("d should be walked by the plain names, got %v %v", walked, err)
+	}
+	p := raw[0].Name + "/" + e.(*encrypted).encryptName("a")
+	stored := readAll(t, inner, p, 0, 0)
+	if strings.Contains(stored, "0123456789") || int64(len(stored)) != cipherSize(100, 16) {
+		t.Errorf("the object stored should be encrypted with %d bytes, got %d", cipherSize(100, 16), len(stored))
+	}
+
+	defaultChunk, err := NewEncrypted(inner, key, CryptOptions{EncryptNames: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := defaultChunk.Stat(ctx, "d/a"); err != nil || info.Size != 100 {
+		t.Errorf("the size should be read by the chunk size of the header, got %d %v", info.Size, err)
+	}
+	other, err := NewEncrypted(inner, bytes.Repeat([]byte{2}, 32), CryptOptions{ChunkSize: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Read(ctx, p, 0, 0); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("the read with another key should fail with ErrWrongKey, got %v", err)
+	}
+	plainNames, err := NewEncrypted(inner, key, CryptOptions{ChunkSize: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := []byte(stored)
+	modified[len(modified)-20] ^= 1
+	if err := inner.Put(ctx, p, bytes.NewReader(modified)); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := plainNames.Read(ctx, p, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(rc); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("a modified object should fail with ErrCorrupted, got %v", err)
+	}
+	rc.Close()
+}
+
+func TestCompressed(t *testing.T) {
+	ctx := context.Background()
+	inner, err := newWithAddition(ctx, newMemDriver(), "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := strings.Repeat("0123456789", 100)
+	for _, codec := range []Codec{CodecZstd, CodecGzip} {
+		c, err := NewCompressed(inner, CompressOptions{Codec: codec, FrameSize: 256, MinSize: 16})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, data := range map[string]string{"a.txt": body, "small": "tiny", "b.png": body, "empty": ""} {
+			if err := c.Put(ctx, name, strings.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+			info, err := c.Stat(ctx, name)
+			if err != nil || info.Size != int64(len(data)) {
+				t.Errorf("%s should have %d bytes, got %d %v", name, len(data), info.Size, err)
+			}
+			if got := readAll(t, c, name, 0, 0); got != data {
+				t.Errorf("%s should be decompressed, got %q", name, got)
+			}
+		}
+		for _, r := range [][2]int64{{0, 1}, {255, 2}, {256, 256}, {100, 600}, {990, 0}, {999, 5}, {1000, 1}} {
+			want := body[min(r[0], 1000):]
+			if r[1] > 0 {
+				want = want[:min(r[1], int64(len(want)))]
+			}
+			if got := readAll(t, c, "a.txt", r[0], r[1]); got != want {
+				t.Errorf("the range %v should be %q, got %q", r, want, got)
+			}
+		}
+		if stored := readAll(t, inner, "a.txt", 0, 0); len(stored) >= len(body) {
+			t.Errorf("a.txt should be stored compressed, got %d bytes", len(stored))
+		}
+		for _, name := range []string{"small", "b.png"} {
+			data := map[string]string{"small": "tiny", "b.png": body}[name]
+			if stored := readAll(t, inner, name, 0, 0); !strings.HasPrefix(stored, data[:4]) || len(stored) <= len(data) {
+				t.Errorf("%s should be stored uncompressed with a footer, got %d bytes", name, len(stored))
+			}
+		}
+		entries, err := c.List(ctx, "", WithSort(SortName, false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprintf("%d %s %d", len(entries), entries[0].Name, entries[0].Size) != "4 a.txt 1000" {
+			t.Errorf("the root should list a.txt with 1000 bytes first, got %v", entries)
+		}
+		f, err := c.Open(ctx, "a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Seek(-10, io.SeekEnd); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := io.ReadAll(f); err != nil || string(b) != body[990:] {
+			t.Errorf("the seek should read the last 10 bytes, got %q %v", b, err)
+		}
+		f.Close()
+	}
+
+	// an object put around the layer is read as is
+	c, err := NewCompressed(inner, CompressOptions{FrameSize: 256, MinSize: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inner.Put(ctx, "raw", strings.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, c, "raw", 10, 5); got != body[10:15] {
+		t.Errorf("raw should be read as is, got %q", got)
+	}
+
+	// an object stored by the layer put through it again is read back as put, not decompressed
+	defaults, err := NewCompressed(inner, CompressOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := strings.Repeat("some text ", 2400)
+	if err := defaults.Put(ctx, "text", strings.NewReader(text)); err != nil {
+		t.Fatal(err)
+	}
+	backup := readAll(t, inner, "text", 0, 0)
+	if len(backup) >= defaultCompressMin {
+		t.Fatalf("text should be stored below MinSize, got %d bytes", len(backup))
+	}
+	if err := defaults.Put(ctx, "backup.bin", strings.NewReader(backup)); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, defaults, "backup.bin", 0, 0); got != backup {
+		t.Errorf("backup.bin should be read back with %d bytes, got %d", len(backup), len(got))
+	}
+	if info, err := defaults.Stat(ctx, "backup.bin"); err != nil || info.Size != int64(len(backup)) {
+		t.Errorf("backup.bin should have %d bytes, got %d %v", len(backup), info.Size, err)
+	}
+	items := []PutItem{{Name: "batch", Size: int64(len(backup)), Open: func() (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(backup)), nil
+	}}}
+	if results := defaults.PutBatch(ctx, items, 0); results[0] != nil {
+		t.Fatal(results[0])
+	}
+	if got := readAll(t, defaults, "batch", 0, 0); got != backup {
+		t.Errorf("batch should be read back with %d bytes, got %d", len(backup), len(got))
+	}
+
+	stored := []byte(readAll(t, inner, "a.txt", 0, 0))
+	stored[0] ^= 0xff
+	if err := inner.Put(ctx, "a.txt", bytes.NewReader(stored)); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := c.Read(ctx, "a.txt", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(rc); !errors.Is(err, ErrCorruptFrame) {
+		t.Errorf("a modified frame should fail with ErrCorruptFrame, got %v", err)
+	}
+	rc.Close()
+}
+
+func TestDedup(t *testing.T) {
+	ctx := context.Background()
+	inner, err := newWithAddition(ctx, newMemDriver(), "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDedup(inner, DedupOptions{CompactEvery: 3})
+	body := strings.Repeat("0123456789", 10)
+	for _, name := range []string{"a", "dir/b", "dir/c"} {
+		if err := d.Put(ctx, name, strings.NewReader(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Put(ctx, "other", strings.NewReader("other")); err != nil {
+		t.Fatal(err)
+	}
+	blobs, err := inner.List(ctx, dedupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored []string
+	for _, e := range blobs {
+		if !strings.HasPrefix(e.Name, ".") {
+			stored = append(stored, e.Name)
+		}
+	}
+	if len(stored) != 2 {
+		t.Fatalf("the content should be stored once, got blobs %v", stored)
+	}
+	info, err := d.Stat(ctx, "dir/b")
+	if err != nil || info.Size != 100 || info.Hashes.GetHash(utils.SHA256) == "" {
+		t.Errorf("dir/b should have 100 bytes and a SHA-256, got %+v %v", info, err)
+	}
+	if got := readAll(t, d, "dir/c", 10, 5); got != body[10:15] {
+		t.Errorf("dir/c should be read through its pointer, got %q", got)
+	}
+	entries, err := d.List(ctx, "", WithSort(SortName, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%d %s %d", len(entries), entries[0].Name, entries[0].Size) != "3 a 100" {
+		t.Errorf("the root should list a with 100 bytes first without the blobs, got %v", entries)
+	}
+	// .a is listed before the blobs, which are skipped a page at a time
+	if err := d.Put(ctx, ".a", strings.NewReader("x")); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	marker := ""
+	for {
+		page, next, err := d.ListObjects(ctx, "", marker, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range page {
+			keys = append(keys, fmt.Sprintf("%s:%d", e.Name, e.Size))
+		}
+		if next == "" {
+			break
+		}
+		marker = next
+	}
+	if fmt.Sprint(keys) != "[.a:1 a:100 dir/b:100 dir/c:100 other:5]" {
+		t.Errorf("the objects should be listed by the sizes of their content without the blobs, got %v", keys)
+	}
+	if page, _, err := d.ListObjects(ctx, dedupDir+"/", "", 0); err != nil || len(page) != 0 {
+		t.Errorf("the blobs shouldn't be listed, got %v %v", page, err)
+	}
+	if err := d.Delete(ctx, ".a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the blob is removed with its last reference, and overwriting drops the old one
+	hash := info.Hashes.GetHash(utils.SHA256)
+	for _, name := range []string{"a", "dir/b"} {
+		if err := d.Delete(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := inner.Stat(ctx, blobName(hash)); err != nil {
+		t.Fatalf("the blob should be kept for dir/c, got %v", err)
+	}
+	if err := d.Put(ctx, "dir/c", strings.NewReader("new")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inner.Stat(ctx, blobName(hash)); !errs.IsObjectNotFound(err) {
+		t.Fatalf("the blob should be removed with its last reference, got %v", err)
+	}
+	if err := d.PutIfAbsent(ctx, "dir/c", strings.NewReader("x")); !errors.Is(err, ErrExist) {
+		t.Errorf("PutIfAbsent should fail with ErrExist, got %v", err)
+	}
+
+	// a ledger reloaded from the log and the compacted ledger counts the same
+	reopened := NewDedup(inner, DedupOptions{CompactEvery: 3})
+	if err := reopened.Put(ctx, "dir/d", strings.NewReader("other")); err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Delete(ctx, "other"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, reopened, "dir/d", 0, 0); got != "other" {
+		t.Errorf("dir/d should keep its blob, got %q", got)
+	}
+
+	// fsck fixes the counts and removes the blobs leaked by a crash
+	if err := inner.Put(ctx, blobName(strings.Repeat("0", 64)), strings.NewReader("leaked")); err != nil {
+		t.Fatal(err)
+	}
+	if err := putJSON(ctx, inner, dedupLedgerName, dedupLedger{Seq: 1 << 20, Refs: map[string]int64{}}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := FsckDedup(ctx, inner, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Pointers != 2 || r.Blobs != 2 || len(r.Fixed) != 2 || len(r.Orphans) != 1 || len(r.Missing) != 0 {
+		t.Errorf("fsck should count 2 pointers and fix 2 blobs and an orphan, got %+v", r)
+	}
+	if _, err := inner.Stat(ctx, blobName(strings.Repeat("0", 64))); !errs.IsObjectNotFound(err) {
+		t.Errorf("the orphan should be removed, got %v", err)
+	}
+	if r, err := FsckDedup(ctx, inner, true); err != nil || len(r.Fixed)+len(r.Orphans) != 0 {
+		t.Errorf("the ledger rebuilt should be right, got %+v %v", r, err)
+	}
+}
+
+func TestPacked(t *testing.T) {
+	ctx := context.Background()
+	inner, err := newWithAddition(ctx, newMemDriver(), "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := PackOptions{MaxObject: 16, FlushDelay: 10 * time.Millisecond, CheckpointEvery: 2}
+	p := NewPacked(inner, opts)
+	for name, data := range map[string]string{"d/a": "small a", "d/b": "small b", "d/big": strings.Repeat("x", 100)} {
+		if err := p.Put(ctx, name, strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		if got := readAll(t, p, name, 0, 0); got != data {
+			t.Errorf("%s should be %q, got %q", name, data, got)
+		}
+	}
+	if got := readAll(t, p, "d/a", 2, 3); got != "all" {
+		t.Errorf("the range of d/a should be read from its pack, got %q", got)
+	}
+	entries, err := p.List(ctx, "d", WithSort(SortName, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%d %s %d %s %d", len(entries), entries[0].Name, entries[0].Size, entries[2].Name, entries[2].Size) != "3 a 7 big 100" {
+		t.Errorf("d should list the objects packed and the big one, got %v", entries)
+	}
+	raw, err := inner.List(ctx, "d")
+	if err != nil || len(raw) != 1 {
+		t.Errorf("only the big object should be put as is, got %v %v", raw, err)
+	}
+	if err := p.Rename(ctx, "d/b", "d/c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Delete(ctx, "d/a"); err != nil {
+		t.Fatal(err)
+	}
+	var walked []string
+	err = p.Walk(ctx, "", func(name string, d fs.DirEntry, err error) error {
+		walked = append(walked, name)
+		return err
+	})
+	if err != nil || fmt.Sprint(walked) != "[ d d/big d/c]" {
+		t.Errorf("the tree should be walked without the packs, got %v %v", walked, err)
+	}
+
+	// a FileSystem made again replays the packs written after the checkpoint, and a pack
+	// written partly is ignored
+	if err := inner.Put(ctx, packName(1000), strings.NewReader("partly written")); err != nil {
+		t.Fatal(err)
+	}
+	reopened := NewPacked(inner, opts)
+	if got := readAll(t, reopened, "d/c", 0, 0); got != "small b" {
+		t.Errorf("d/c should be replayed, got %q", got)
+	}
+	if ok, err := reopened.Exists(ctx, "d/a"); err != nil || ok {
+		t.Errorf("the delete of d/a should be replayed, got %v %v", ok, err)
+	}
+	if err := reopened.Put(ctx, "d/e", strings.NewReader("after")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inner.Stat(ctx, packName(1001)); err != nil {
+		t.Errorf("the next pack should follow the one written partly, got %v", err)
+	}
+
+	// the puts of concurrent writers are batched in packs
+	before, err := inner.List(ctx, packDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for n := 0; n < 20; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			if err := reopened.Put(ctx, fmt.Sprintf("c/%02d", n), strings.NewReader(strconv.Itoa(n))); err != nil {
+				t.Error(err)
+			}
+		}(n)
+	}
+	wg.Wait()
+	after, err := inner.List(ctx, packDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packs := len(after) - len(before); packs >= 10 {
+		t.Errorf("20 concurrent puts should be written in a few packs, got %d", packs)
+	}
+	for n := 0; n < 20; n++ {
+		if got := readAll(t, reopened, fmt.Sprintf("c/%02d", n), 0, 0); got != strconv.Itoa(n) {
+			t.Errorf("c/%02d should be %d, got %q", n, n, got)
+		}
+	}
+
+	// the compaction merges the packs, whose objects are read from the new ones
+	r, err := CompactPacks(ctx, reopened, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Written != 1 || r.Rewritten < 3 {
+		t.Errorf("the small packs should be rewritten into one, got %+v", r)
+	}
+	packs, err := inner.List(ctx, packDir)
+	if err != nil || len(packs) != 2 {
+		t.Errorf("one pack and the index should be left, got %v %v", packs, err)
+	}
+	for _, fsys := range []FileSystem{reopened, NewPacked(inner, opts)} {
+		if got := readAll(t, fsys, "c/07", 0, 0); got != "7" {
+			t.Errorf("c/07 should be read from the pack compacted, got %q", got)
+		}
+		if got := readAll(t, fsys, "d/c", 0, 0); got != "small b" {
+			t.Errorf("d/c should be read from the pack compacted, got %q", got)
+		}
+	}
+	if _, err := CompactPacks(ctx, p.(*packed).FileSystem, 0.5); !errors.Is(err, errs.NotSupport) {
+		t.Errorf("the compaction of another FileSystem should fail with errs.NotSupport, got %v", err)
+	}
+}
+
+func TestShardedLayout(t *testing.T) {
+	ctx := context.Background()
+	d := memMover{newMemDriver()}
+	flat, err := newWithAddition(ctx, d, "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"flat/x1", "flat/x2"} {
+		if err := flat.Put(ctx, name, strings.NewReader(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := newWithAddition(ctx, d, "{}", WithShardedLayout(3, 20)); err == nil {
+		t.Error("a layout of more digits than SHA-1 should fail")
+	}
+	s, err := newWithAddition(ctx, d, "{}", WithShardedLayout(2, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(ctx, "flat/y", strings.NewReader("flat/y")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"flat/x1", "flat/y"} {
+		if got := readAll(t, s, name, 0, 0); got != name {
+			t.Errorf("%s should be %q, got %q", name, name, got)
+		}
+	}
+	if err := s.Put(ctx, "flat/.sab/z", strings.NewReader("z")); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("a dir named like a shard should fail with ErrInvalidName, got %v", err)
+	}
+	// the keys of JuiceFS have dirs of hex digits, which aren't shards
+	for _, name := range []string{"chunks/0/12/12345_0_4194304", "chunks/0/12/12346_0_4194304", "vol/ab/x"} {
+		if err := s.Put(ctx, name, strings.NewReader(name)); err != nil {
+			t.Fatal(err)
+		}
+		if got := readAll(t, s, name, 0, 0); got != name {
+			t.Errorf("%s should be %q, got %q", name, name, got)
+		}
+	}
+	if entries, err := s.List(ctx, "chunks/0/12"); err != nil || len(entries) != 2 || entries[0].Name != "12345_0_4194304" {
+		t.Errorf("chunks/0/12 should list its 2 chunks, got %v %v", entries, err)
+	}
+	if entries, err := s.List(ctx, "vol"); err != nil || len(entries) != 1 || entries[0].Name != "ab" || !entries[0].IsDir {
+		t.Errorf("vol should list the dir ab, got %v %v", entries, err)
+	}
+	listed := func() string {
+		entries, err := s.List(ctx, "flat")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name)
+		}
+		return strings.Join(names, " ")
+	}
+	if got := listed(); got != "x1 x2 y" {
+		t.Errorf("flat should list the files of its shards and the ones put before, got %q", got)
+	}
+	r, err := MigrateSharded(ctx, s, "flat", 2)
+	if err != nil || len(r.Moved) != 2 || len(r.Failed) != 0 {
+		t.Fatalf("the 2 files put before should be moved, got %+v %v", r, err)
+	}
+	raw, err := flat.List(ctx, "flat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range raw {
+		if !e.IsDir || !strings.HasPrefix(e.Name, shardPrefix) || len(e.Name) != 4 {
+			t.Errorf("flat should hold only shards once migrated, got %v", e)
+		}
+	}
+	if err := s.Rename(ctx, "flat/y", "flat/z"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, "flat/x2"); err != nil {
+		t.Fatal(err)
+	}
+	if got := listed(); got != "x1 z" {
+		t.Errorf("flat should list the files renamed and left, got %q", got)
+	}
+	if got := readAll(t, s, "flat/z", 0, 0); got != "flat/y" {
+		t.Errorf("flat/z should be read from its new shard, got %q", got)
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	ctx := context.Background()
+	i := newTestFS(t, newMemDriver())
+	old := time.Now().Add(-time.Hour)
+	for name, modified := range map[string]time.Time{"tmp/a.csv": old, "tmp/b.log": old, "tmp/c.csv": time.Now(), "keep/d.csv": old} {
+		if _, err := i.PutWithOptions(ctx, name, strings.NewReader(name), WithModTime(modified)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := i.ApplyLifecycle(ctx, []LifecycleRule{{Prefix: "tmp/"}}); err == nil {
+		t.Error("a rule without a max age should fail")
+	}
+	rule := LifecycleRule{Prefix: "tmp/", MaxAge: time.Minute, Glob: "*.csv", DryRun: true}
+	r, err := i.ApplyLifecycle(ctx, []LifecycleRule{rule})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Scanned != 3 || fmt.Sprint(r.Expired) != "[tmp/a.csv]" {
+		t.Errorf("only tmp/a.csv should expire of the 3 objects under tmp, got %+v", r)
+	}
+	if ok, _ := i.Exists(ctx, "tmp/a.csv"); !ok {
+		t.Error("a dry run shouldn't delete tmp/a.csv")
+	}
+	rule.DryRun = false
+	if r, err = i.ApplyLifecycle(ctx, []LifecycleRule{rule}); err != nil || len(r.Failed) != 0 {
+		t.Fatalf("tmp/a.csv should be deleted, got %+v %v", r, err)
+	}
+	if ok, _ := i.Exists(ctx, "tmp/a.csv"); ok {
+		t.Error("tmp/a.csv should be deleted")
+	}
+
+	if err := i.StartLifecycle([]LifecycleRule{{Prefix: "tmp/", MaxAge: time.Minute}}, 5*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for ok := true; ok && time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		ok, _ = i.Exists(ctx, "tmp/b.log")
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"tmp/b.log": false, "tmp/c.csv": true, "keep/d.csv": true} {
+		if ok, _ := i.Exists(ctx, name); ok != want {
+			t.Errorf("%s should exist %v after the lifecycle ran, got %v", name, want, ok)
+		}
+	}
+	if err := i.StartLifecycle(nil, time.Second); !errors.Is(err, ErrClosed) {
+		t.Errorf("a lifecycle started once closed should fail with ErrClosed, got %v", err)
+	}
+
+	// a layer returned as a FileSystem runs and stops its lifecycle too
+	s, err := newWithAddition(ctx, newMemDriver(), "{}", WithShardedLayout(1, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.PutWithOptions(ctx, "tmp/e", strings.NewReader("e"), WithModTime(old)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StartLifecycle([]LifecycleRule{{Prefix: "tmp/", MaxAge: time.Minute}}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := s.ApplyLifecycle(ctx, []LifecycleRule{{Prefix: "tmp/", MaxAge: time.Minute}}); err != nil || len(r.Expired) != 1 {
+		t.Errorf("tmp/e should expire from its shard, got %+v %v", r, err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewPacked(s, PackOptions{}).StartLifecycle(nil, time.Second); !errors.Is(err, errs.NotSupport) {
+		t.Errorf("a packed FileSystem shouldn't run a lifecycle, got %v", err)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	ctx := context.Background()
+	i := newTestFS(t, memMover{newMemDriver()}, WithTrash("", time.Hour))
+	if !i.Capabilities().Has(CapTrash) {
+		t.Fatal("a driver which can move should have CapTrash")
+	}
+	for _, data := range []string{"v1", "v2"} {
+		if err := i.Put(ctx, "a/b.txt", strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		if err := i.Delete(ctx, "a/b.txt"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ok, _ := i.Exists(ctx, "a/b.txt"); ok {
+		t.Error("a/b.txt should be deleted")
+	}
+	entries, err := i.List(ctx, "")
+	if err != nil || len(entries) != 1 || entries[0].Name != "a" {
+		t.Errorf("the trash shouldn't be listed, got %v %v", entries, err)
+	}
+	if err := i.Restore(ctx, "a/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, i, "a/b.txt", 0, 0); got != "v2" {
+		t.Errorf("the last deleted a/b.txt should be restored, got %q", got)
+	}
+	if err := i.Restore(ctx, "a/b.txt"); !errors.Is(err, ErrExist) {
+		t.Errorf("restoring over a/b.txt should fail with ErrExist, got %v", err)
+	}
+	if err := i.Restore(ctx, "a/c.txt"); !errs.IsObjectNotFound(err) {
+		t.Errorf("restoring a name not in the trash should fail with not found, got %v", err)
+	}
+	if n, err := i.EmptyTrash(ctx, 0); err != nil || n != 0 {
+		t.Errorf("no batch should be older than the retention, got %d %v", n, err)
+	}
+	if n, err := i.EmptyTrash(ctx, time.Nanosecond); err != nil || n == 0 {
+		t.Errorf("the batches should be removed, got %d %v", n, err)
+	}
+	if err := i.Delete(ctx, "a/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.EmptyTrash(ctx, time.Nanosecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Restore(ctx, "a/b.txt"); !errs.IsObjectNotFound(err) {
+		t.Errorf("a/b.txt shouldn't be restored once the trash is emptied, got %v", err)
+	}
+
+	hard := newTestFS(t, newMemDriver(), WithTrash("", time.Hour))
+	if hard.Capabilities().Has(CapTrash) {
+		t.Error("a driver which can't move shouldn't have CapTrash")
+	}
+	if err := hard.Put(ctx, "a", strings.NewReader("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := hard.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := hard.Restore(ctx, "a"); !errs.IsObjectNotFound(err) {
+		t.Errorf("a removed without the trash shouldn't be restored, got %v", err)
+	}
+}
+
+func TestVersioning(t *testing.T) {
+	ctx := context.Background()
+	i := newTestFS(t, memMover{newMemDriver()}, WithVersioning(2, 0))
+	if !i.Capabilities().Has(CapVersions) {
+		t.Fatal("a driver which can move and rename should have CapVersions")
+	}
+	for _, data := range []string{"v1", "v2", "v3", "v4"} {
+		if err := i.Put(ctx, "a/b.txt", strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readAll(t, i, "a/b.txt", 0, 0); got != "v4" {
+		t.Errorf("a/b.txt should be the last put, got %q", got)
+	}
+	versions, err := i.ListVersions(ctx, "a/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("the 2 last versions should be kept, got %+v", versions)
+	}
+	if _, err := i.PutWithOptions(ctx, "a/b.txt", strings.NewReader("v5"), WithConflict(ConflictKeepBoth)); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := i.ListVersions(ctx, "a/b.txt"); len(after) != 2 || after[0].ID != versions[0].ID {
+		t.Errorf("a put keeping both shouldn't make a version, got %+v", after)
+	}
+	entries, err := i.List(ctx, "")
+	if err != nil || len(entries) != 1 || entries[0].Name != "a" {
+		t.Errorf("the versions shouldn't be listed, got %v %v", entries, err)
+	}
+	if err := i.RestoreVersion(ctx, "a/b.txt", versions[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, i, "a/b.txt", 0, 0); got != "v2" {
+		t.Errorf("the version restored should be v2, got %q", got)
+	}
+	versions, err = i.ListVersions(ctx, "a/b.txt")
+	if err != nil || len(versions) != 2 || versions[0].Size != 2 {
+		t.Fatalf("v4 should be kept as the last version, got %+v %v", versions, err)
+	}
+	if got := readAll(t, i, stdpath.Join(versionsDir, "a/b.txt", versions[0].ID), 0, 0); got != "v4" {
+		t.Errorf("the last version should be v4, got %q", got)
+	}
+	if err := i.RestoreVersion(ctx, "a/b.txt", "20000101T000000.000000000Z"); !errs.IsObjectNotFound(err) {
+		t.Errorf("restoring a version not kept should fail with not found, got %v", err)
+	}
+
+	plain := newTestFS(t, newMemDriver(), WithVersioning(0, 0))
+	if plain.Capabilities().Has(CapVersions) {
+		t.Error("a driver which can't move shouldn't have CapVersions")
+	}
+	for _, data := range []string{"v1", "v2"} {
+		if err := plain.Put(ctx, "a", strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if versions, err := plain.ListVersions(ctx, "a"); err != nil || len(versions) != 0 {
+		t.Errorf("a is replaced without versions, got %+v %v", versions, err)
+	}
+
+	d := memFlakyMover{&memFlaky{memDriver: newMemDriver(), err: errs.PermissionDenied}}
+	flaky := newTestFS(t, d, WithVersioning(0, 0))
+	if err := flaky.Put(ctx, "a", strings.NewReader("v1")); err != nil {
+		t.Fatal(err)
+	}
+	d.putFailures.Store(1)
+	if err := flaky.Put(ctx, "a", strings.NewReader("v2")); err == nil {
+		t.Fatal("the put should fail")
+	}
+	if got := readAll(t, flaky, "a", 0, 0); got != "v1" {
+		t.Errorf("a failed put should leave a as it was, got %q", got)
+	}
+	if versions, err := flaky.ListVersions(ctx, "a"); err != nil || len(versions) != 0 {
+		t.Errorf("a failed put shouldn't make a version, got %+v %v", versions, err)
+	}
+}
+
+func TestTrashLayers(t *testing.T) {
+	ctx := context.Background()
+	inner := newTestFS(t, memMover{newMemDriver()}, WithTrash("", time.Hour))
+	encrypted, err := NewEncrypted(inner, []byte("key"), CryptOptions{EncryptNames: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers := map[string]FileSystem{
+		"encrypted": encrypted,
+		"sharded":   &sharded{FileSystem: inner, depth: 1, width: 2},
+	}
+	for kind, fsys := range layers {
+		name := kind + "/a"
+		if err := fsys.Put(ctx, name, strings.NewReader(kind)); err != nil {
+			t.Fatal(err)
+		}
+		if err := fsys.Delete(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+		if err := fsys.Restore(ctx, name); err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+		if got := readAll(t, fsys, name, 0, 0); got != kind {
+			t.Errorf("%s should be restored through the %s layer, got %q", name, kind, got)
+		}
+	}
+	if err := NewDedup(inner, DedupOptions{}).Restore(ctx, "a"); !errors.Is(err, errs.NotSupport) {
+		t.Errorf("a dedup FileSystem shouldn't restore, got %v", err)
+	}
+}
+
+func TestVersioningLayers(t *testing.T) {
+	ctx := context.Background()
+	inner := newTestFS(t, memMover{newMemDriver()}, WithVersioning(0, 0))
+	encrypted, err := NewEncrypted(inner, []byte("key"), CryptOptions{EncryptNames: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers := map[string]FileSystem{
+		"encrypted": encrypted,
+		"sharded":   &sharded{FileSystem: inner, depth: 1, width: 2},
+	}
+	for kind, fsys := range layers {
+		name := kind + "/a"
+		for _, data := range []string{"v1", "v2"} {
+			if err := fsys.Put(ctx, name, strings.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		versions, err := fsys.ListVersions(ctx, name)
+		if err != nil || len(versions) != 1 || versions[0].Size != 2 {
+			t.Fatalf("%s should have v1 as a version, got %+v %v", kind, versions, err)
+		}
+		if err := fsys.RestoreVersion(ctx, name, versions[0].ID); err != nil {
+			t.Fatal(err)
+		}
+		if got := readAll(t, fsys, name, 0, 0); got != "v1" {
+			t.Errorf("v1 should be restored through the %s layer, got %q", kind, got)
+		}
+	}
+	if _, err := NewPacked(inner, PackOptions{}).ListVersions(ctx, "a"); !errors.Is(err, errs.NotSupport) {
+		t.Errorf("a packed FileSystem shouldn't list versions, got %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	stdpath "path"
+	"time"
+
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/alist-org/alist/v3/internal/model"
+	"github.com/pkg/errors"
+)
+
+// WithAppend enables Append, which rewrites the objects up to maxSize bytes after the append,
+// as the drivers can't append
+func WithAppend(maxSize int64) Option {
+	return func(c *config) {
+		c.appendMax = maxSize
+	}
+}
+
+// Append appends body to name, which is made if missing. A chunked object has its last part put
+// again with the start of body, then the parts after it and its manifest, so only the last part
+// is read. Other objects are read and put again with body, atomically if the driver can rename
+// or move, which is O(size of the object) and fails with ErrObjectTooLarge beyond the size given
+// to WithAppend. The appends to the same name are serialized
+func (i *Impl) Append(ctx context.Context, name string, body io.Reader) (err error) {
+	ctx, end := i.startOp(ctx, "append", name)
+	defer end(&err)
+	if i.conf.appendMax <= 0 {
+		return errors.WithMessage(errs.NotImplement, "Append needs WithAppend")
+	}
+	if err := i.writable(); err != nil {
+		return err
+	}
+	path, err := i.objPath(name)
+	if err != nil {
+		return err
+	}
+	unlock, err := i.locks.lock(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	file, err := i.get(ctx, path)
+	if errs.IsObjectNotFound(err) {
+		_, err = i.putFile(ctx, name, body, -1, putOptions{})
+		return err
+	}
+	if err != nil {
+		return errors.WithMessage(err, "failed to get file")
+	}
+	if file.IsDir() {
+		return errors.WithStack(errs.NotFile)
+	}
+	f, n, err := spool(ctx, body, i.conf.spoolThreshold)
+	if err != nil {
+		return errors.WithMessage(err, "failed to spool body")
+	}
+	defer f.Close()
+	if n == 0 {
+		return nil
+	}
+	traceOf(ctx).setSize(n)
+	if c, ok := file.(*chunkedObj); ok {
+		return i.appendChunked(ctx, path, c, f, n)
+	}
+
+	size := file.GetSize()
+	if size+n > i.conf.appendMax {
+		return errors.WithMessagef(ErrObjectTooLarge, "[%s] would have %d bytes, more than %d", path, size+n, i.conf.appendMax)
+	}
+	buf := getBuf(int(size + n))[:size+n]
+	defer putBuf(buf)
+	if err := i.readFull(ctx, file, 0, buf[:size]); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(f, buf[size:]); err != nil {
+		return errors.WithMessage(err, "failed to read body")
+	}
+	_, err = i.putFile(ctx, name, bytes.NewReader(buf), size+n, putOptions{atomic: true})
+	return err
+}
+
+// appendChunked appends the n bytes of body to c at path by putting its last part again with the
+// start of body, the parts after it, and then its manifest. The last part put starts with the
+// bytes it had, so the manifest replaced still reads the same
+func (i *Impl) appendChunked(ctx context.Context, path string, c *chunkedObj, body io.Reader, n int64) error {
+	m := c.m
+	first := int(m.Size / m.PartSize)
+	tailOff := int64(first) * m.PartSize
+	rc := i.readChunked(ctx, c, tailOff, m.Size-tailOff)
+	tail, err := io.ReadAll(rc)
+	_ = rc.Close()
+	if err != nil {
+		return errors.WithMessagef(err, "failed to read the last part of [%s]", path)
+	}
+	m.Size += n
+	m.Hashes = ""
+	dir := i.partsPath(m.UploadID)
+	partsObj, err := i.get(ctx, dir)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to get dir [%s]", dir)
+	}
+	r := io.MultiReader(bytes.NewReader(tail), body)
+	for k := first; k < m.parts(); k++ {
+		if err := i.putPart(ctx, partsObj, dir, r, nil, 0, m, k, sha256.New()); err != nil {
+			return errors.WithMessagef(err, "failed to upload part %d of [%s]", k, path)
+		}
+	}
+	i.created(dir, true)
+
+	parentDir, err := i.get(ctx, stdpath.Dir(path))
+	if err != nil {
+		return errors.WithMessagef(err, "failed to get dir [%s]", stdpath.Dir(path))
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	mObj := &model.Object{Name: c.GetName(), Size: int64(len(data)), Modified: time.Now(), Ctime: c.CreateTime()}
+	err = i.retryBody(ctx, bytes.NewReader(data), func() error {
+		_, err := i.put(ctx, parentDir, mObj, bytes.NewReader(data), nil)
+		return err
+	})
+	if err != nil {
+		return errors.WithMessagef(err, "failed to put the manifest of [%s]", path)
+	}
+	i.created(path, false)
+	return nil
+}
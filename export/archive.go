@@ -0,0 +1,233 @@
+package export
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	stdpath "path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ArchiveFormat is the format of the archive expanded by UploadArchive
+type ArchiveFormat int
+
+const (
+	ArchiveTar ArchiveFormat = iota
+	ArchiveZip
+)
+
+// ArchiveOption configures a single UploadArchive
+type ArchiveOption func(*archiveOptions)
+
+type archiveOptions struct {
+	parallel int
+}
+
+// WithArchiveParallel sets how many entries UploadArchive puts at once, the default is 4
+func WithArchiveParallel(n int) ArchiveOption {
+	return func(o *archiveOptions) {
+		o.parallel = n
+	}
+}
+
+// ArchiveError is the error of UploadArchive with the entries which failed by their names,
+// the other ones have been put
+type ArchiveError struct {
+	Failed map[string]error
+}
+
+func (e *ArchiveError) Error() string {
+	names := make([]string, 0, len(e.Failed))
+	for name := range e.Failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) == 1 {
+		return fmt.Sprintf("failed to put [%s]: %v", names[0], e.Failed[names[0]])
+	}
+	return fmt.Sprintf("failed to put %d entries: [%s]: %v", len(names), names[0], e.Failed[names[0]])
+}
+
+// UploadArchive expands the tar or zip archive read from r under dir: the dirs are made and
+// the files put like Put does with their mtime, up to WithArchiveParallel at once. A tar is read
+// as the entries are put, each one being spooled, a zip is spooled first to read its directory.
+// The entries other than files and dirs are skipped. Once an entry fails, the others are still
+// put and an *ArchiveError with the failed ones is returned
+func (i *Impl) UploadArchive(ctx context.Context, dir string, r io.Reader, format ArchiveFormat, opts ...ArchiveOption) (err error) {
+	ctx, end := i.startOp(ctx, "unarchive", dir)
+	defer end(&err)
+	root, err := i.cleanPath(dir)
+	if err != nil {
+		return err
+	}
+	if err := i.writable(); err != nil {
+		return err
+	}
+	o := archiveOptions{parallel: defaultPutParallel}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	u := &unarchiver{
+		i:      i,
+		dir:    strings.TrimPrefix(strings.TrimPrefix(root, i.conf.baseDir), "/"),
+		sem:    make(chan struct{}, max(o.parallel, 1)),
+		failed: map[string]error{},
+	}
+	switch format {
+	case ArchiveTar:
+		err = u.tar(ctx, r)
+	case ArchiveZip:
+		err = u.zip(ctx, r)
+	default:
+		err = errors.Errorf("unknown archive format %d", format)
+	}
+	u.wg.Wait()
+	if err != nil {
+		return err
+	}
+	if len(u.failed) > 0 {
+		return errors.WithStack(&ArchiveError{Failed: u.failed})
+	}
+	return nil
+}
+
+type unarchiver struct {
+	i   *Impl
+	dir string
+	sem chan struct{}
+	wg  sync.WaitGroup
+
+	mu     sync.Mutex
+	failed map[string]error
+}
+
+func (u *unarchiver) tar(ctx context.Context, r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.WithMessage(err, "failed to read tar")
+		}
+		switch h.Typeflag {
+		case tar.TypeDir:
+			u.mkdir(ctx, h.Name)
+		case tar.TypeReg:
+			if err := u.acquire(ctx); err != nil {
+				return err
+			}
+			// the entry is read before the next one
+			f, n, err := spool(ctx, tr, u.i.conf.spoolThreshold)
+			if err != nil {
+				<-u.sem
+				return errors.WithMessagef(err, "failed to read [%s]", h.Name)
+			}
+			u.put(ctx, h.Name, f, n, h.ModTime)
+		}
+	}
+}
+
+func (u *unarchiver) zip(ctx context.Context, r io.Reader) error {
+	f, n, err := spool(ctx, r, u.i.conf.spoolThreshold)
+	if err != nil {
+		return errors.WithMessage(err, "failed to read zip")
+	}
+	defer f.Close()
+	zr, err := zip.NewReader(f, n)
+	if err != nil {
+		return errors.WithMessage(err, "failed to read zip")
+	}
+	for _, e := range zr.File {
+		mode := e.Mode()
+		switch {
+		case mode.IsDir():
+			u.mkdir(ctx, e.Name)
+		case mode.IsRegular():
+			if err := u.acquire(ctx); err != nil {
+				return err
+			}
+			rc, err := e.Open()
+			if err != nil {
+				<-u.sem
+				u.fail(e.Name, errors.WithStack(err))
+				continue
+			}
+			u.put(ctx, e.Name, rc, int64(e.UncompressedSize64), e.Modified)
+		}
+	}
+	// the spooled zip is read until the puts are done
+	u.wg.Wait()
+	return nil
+}
+
+// name returns the path of the entry named name relative to the base dir, which must be under dir
+func (u *unarchiver) name(name string) (string, error) {
+	p := stdpath.Clean(strings.TrimLeft(toSlash(name), "/"))
+	if !fs.ValidPath(p) || p == "." {
+		return "", errors.WithMessagef(ErrInvalidName, "[%s] is out of the dir", name)
+	}
+	return stdpath.Join(u.dir, p), nil
+}
+
+func (u *unarchiver) mkdir(ctx context.Context, name string) {
+	// the dir itself, like "./"
+	if stdpath.Clean(strings.TrimLeft(toSlash(name), "/")) == "." {
+		return
+	}
+	p, err := u.name(name)
+	if err == nil {
+		err = u.i.mkdir(ctx, stdpath.Join(u.i.conf.baseDir, p))
+	}
+	if err != nil {
+		u.fail(name, err)
+	}
+}
+
+func (u *unarchiver) acquire(ctx context.Context) error {
+	select {
+	case u.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return errors.WithStack(ctx.Err())
+	}
+}
+
+// put puts the size bytes of body as the entry name in the background once acquired,
+// body is closed once put
+func (u *unarchiver) put(ctx context.Context, name string, body io.ReadCloser, size int64, modTime time.Time) {
+	u.wg.Add(1)
+	go func() {
+		defer func() {
+			<-u.sem
+			u.wg.Done()
+		}()
+		defer body.Close()
+		p, err := u.name(name)
+		if err != nil {
+			u.fail(name, err)
+			return
+		}
+		ctx, end := u.i.startOp(ctx, "put", p)
+		_, err = u.i.putFile(ctx, p, body, size, putOptions{modTime: modTime})
+		end(&err)
+		if err != nil {
+			u.fail(name, err)
+		}
+	}()
+}
+
+func (u *unarchiver) fail(name string, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failed[name] = err
+}
@@ -0,0 +1,156 @@
+package export
+
+import (
+	"context"
+	"io"
+	stdpath "path"
+
+	"github.com/alist-org/alist/v3/internal/driver"
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/alist-org/alist/v3/internal/model"
+	"github.com/pkg/errors"
+)
+
+// WithAtomicPut uploads to a temporary object first, which is renamed to the name put only once
+// the upload has succeeded, so that an interrupted upload never leaves a partial object under the
+// name, and is removed if the upload fails. The temporary object is <name>.tmp.<random> if the
+// driver can rename, or <name> in the dir .tmp.<random> next to it if it can only move. The
+// object replaced is removed just before the rename. The puts are direct if the driver can do
+// neither, Capabilities tells by CapAtomicPut. The uploads of WithChunkedUpload aren't affected
+func WithAtomicPut() Option {
+	return func(c *config) {
+		c.atomicPut = true
+	}
+}
+
+// atomicMode returns how the puts are made atomic, by CapRename or CapMove, or 0 if they aren't
+func (i *Impl) atomicMode() Capability {
+	if !i.conf.atomicPut {
+		return 0
+	}
+	return i.renameMode()
+}
+
+// renameMode returns how the driver can rename a temporary object, by CapRename or CapMove, or 0
+func (i *Impl) renameMode() Capability {
+	switch c := capabilities(i.storage); {
+	case c.Has(CapRename):
+		return CapRename
+	case c.Has(CapMove):
+		return CapMove
+	}
+	return 0
+}
+
+// putAtomic uploads obj to a temporary object in parentDir at dir and renames it to obj by mode,
+// an object existing at obj by then is given to replace to move it away, or the put fails with
+// ErrExist if replace is nil
+func (i *Impl) putAtomic(ctx context.Context, parentDir model.Obj, dir string, obj *model.Object, body io.Reader, p *progress, mode Capability, replace func(ctx context.Context, path string, old model.Obj) error) (model.Obj, error) {
+	name := obj.Name
+	defer func() { obj.Name = name }()
+	id := newUploadID()
+	tmpDir, tmpPath := parentDir, stdpath.Join(dir, name+".tmp."+id)
+	// the temp object is removed even if the put is canceled
+	cleanCtx := context.WithoutCancel(ctx)
+	if mode == CapMove {
+		tmpDirPath := stdpath.Join(dir, ".tmp."+id)
+		if err := i.mkdir(ctx, tmpDirPath); err != nil {
+			return nil, errors.WithMessagef(err, "failed to make temp dir [%s]", tmpDirPath)
+		}
+		defer i.removeTemp(cleanCtx, tmpDirPath)
+		var err error
+		if tmpDir, err = i.get(ctx, tmpDirPath); err != nil {
+			return nil, errors.WithMessagef(err, "failed to get temp dir [%s]", tmpDirPath)
+		}
+		tmpPath = stdpath.Join(tmpDirPath, name)
+	} else {
+		obj.Name = stdpath.Base(tmpPath)
+	}
+
+	err := i.retryBody(ctx, body, func() error {
+		_, err := i.put(ctx, tmpDir, obj, body, p)
+		return err
+	})
+	i.created(tmpPath, false)
+	if err != nil {
+		if mode == CapRename {
+			i.removeTemp(cleanCtx, tmpPath)
+		}
+		return nil, err
+	}
+	tmp, err := i.get(ctx, tmpPath)
+	if err != nil {
+		i.removeTemp(cleanCtx, tmpPath)
+		return nil, errors.WithMessagef(err, "failed to get temp object [%s]", tmpPath)
+	}
+	path := stdpath.Join(dir, name)
+	if old, err := i.get(ctx, path); err == nil {
+		if replace == nil {
+			i.removeTemp(cleanCtx, tmpPath)
+			return nil, errors.WithMessagef(ErrExist, "[%s] was created meanwhile", path)
+		}
+		if old.IsDir() {
+			i.removeTemp(cleanCtx, tmpPath)
+			return nil, errors.WithMessagef(errs.NotFile, "[%s] is a dir", path)
+		}
+		// the parts of a chunked object are removed by putFile
+		if err := replace(ctx, path, old); err != nil {
+			i.removeTemp(cleanCtx, tmpPath)
+			return nil, err
+		}
+	}
+
+	release, err := i.beginMeta(ctx)
+	if err != nil {
+		i.removeTemp(cleanCtx, tmpPath)
+		return nil, err
+	}
+	if mode == CapMove {
+		err = i.moveObj(ctx, tmp, parentDir)
+	} else {
+		err = i.renameObj(ctx, tmp, name)
+	}
+	release()
+	if err != nil {
+		i.removeTemp(cleanCtx, tmpPath)
+		return nil, errors.WithMessagef(err, "failed to rename [%s] to [%s]", tmpPath, name)
+	}
+	i.removed(tmpPath, false)
+	obj.Name = name
+	return obj, nil
+}
+
+// removeTemp removes the temporary object at path, a failure is only logged
+func (i *Impl) removeTemp(ctx context.Context, path string) {
+	obj, err := i.get(ctx, path)
+	if err == nil {
+		err = i.removeAll(ctx, path, obj)
+	}
+	if err != nil && !errs.IsObjectNotFound(err) {
+		i.conf.logger.Warn("failed to remove temp object", "path", path, "error", errValue(err))
+	}
+}
+
+// renameObj renames obj to newName in its dir by the driver
+func (i *Impl) renameObj(ctx context.Context, obj model.Obj, newName string) error {
+	switch s := i.storage.(type) {
+	case driver.RenameResult:
+		_, err := s.Rename(ctx, model.UnwrapObj(obj), newName)
+		return errors.WithStack(err)
+	case driver.Rename:
+		return errors.WithStack(s.Rename(ctx, model.UnwrapObj(obj), newName))
+	}
+	return errs.NotImplement
+}
+
+// moveObj moves obj into dstDir by the driver
+func (i *Impl) moveObj(ctx context.Context, obj, dstDir model.Obj) error {
+	switch s := i.storage.(type) {
+	case driver.MoveResult:
+		_, err := s.Move(ctx, model.UnwrapObj(obj), model.UnwrapObj(dstDir))
+		return errors.WithStack(err)
+	case driver.Move:
+		return errors.WithStack(s.Move(ctx, model.UnwrapObj(obj), model.UnwrapObj(dstDir)))
+	}
+	return errs.NotImplement
+}
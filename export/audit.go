@@ -0,0 +1,243 @@
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AuditEvent is the record of a mutating operation, written once it has completed
+type AuditEvent struct {
+	Time time.Time `json:"time"`
+	// Op is "put", "delete", "mkdir", "rename" or "touch"
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	// Target is the new name of a rename
+	Target string `json:"target,omitempty"`
+	// Size is the size of the object put or deleted
+	Size int64 `json:"size"`
+	// Result is "ok", or the kind of the error
+	Result    string `json:"result"`
+	Error     string `json:"error,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// AuditSink records the events of Put, Delete, Mkdir, Rename and Touch, which includes the uploads
+// of Create, whether they succeeded or not. Audit is called synchronously by the operation,
+// its error is logged and doesn't fail the operation
+type AuditSink interface {
+	Audit(e AuditEvent) error
+}
+
+// WithAuditSink records the mutating operations to s
+func WithAuditSink(s AuditSink) Option {
+	return func(c *config) {
+		c.audit = s
+	}
+}
+
+type requestIDKey struct{}
+
+// ContextWithRequestID returns a copy of ctx carrying the request ID of the caller,
+// which is recorded with the audit events of the operations made with it
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID carried by ctx, or "" if there is none
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// auditOps are the audited operations by the names of startOp,
+// the close of a writer made by Create is a put
+var auditOps = map[string]string{
+	"put":    "put",
+	"close":  "put",
+	"delete": "delete",
+	"mkdir":  "mkdir",
+	"rename": "rename",
+	"touch":  "touch",
+	// WriteAt and Append put the object again
+	"writeat": "put",
+	"append":  "put",
+}
+
+func (i *Impl) audit(ctx context.Context, op, name string, t *opTrace, err error) {
+	e := AuditEvent{
+		Time:      time.Now(),
+		Op:        op,
+		Path:      name,
+		Target:    t.target,
+		Size:      t.size,
+		Result:    "ok",
+		RequestID: RequestIDFromContext(ctx),
+	}
+	if err != nil {
+		e.Result = KindOf(err).String()
+		e.Error = err.Error()
+	}
+	if err := i.conf.audit.Audit(e); err != nil {
+		i.conf.logger.Warn("audit failed", "op", op, "path", name, "error", errValue(err))
+	}
+}
+
+// FileAuditSink writes the events as JSON lines to a file, each line has the sha256 of the
+// previous one in "prev", so that a line removed or changed breaks the chain, see VerifyAuditLog.
+// Once the file would grow beyond maxSize, it's renamed with the time as suffix, like
+// audit.log.20060102T150405.000000000, and a new one is started continuing the chain
+type FileAuditSink struct {
+	path    string
+	maxSize int64
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+	prev string
+}
+
+// NewFileAuditSink appends the events to the file at path, made if missing,
+// maxSize <= 0 never rotates it
+func NewFileAuditSink(path string, maxSize int64) (*FileAuditSink, error) {
+	s := &FileAuditSink{path: path, maxSize: maxSize}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// open opens the file at s.path and continues the chain of its last line
+func (s *FileAuditSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	last, n, err := lastLine(f)
+	if err != nil {
+		_ = f.Close()
+		return errors.WithMessagef(err, "failed to read [%s]", s.path)
+	}
+	s.f, s.size = f, n
+	if last != nil {
+		s.prev = lineHash(last)
+	}
+	return nil
+}
+
+// lastLine returns the last line of r and the bytes of r
+func lastLine(r io.Reader) ([]byte, int64, error) {
+	br := bufio.NewReader(r)
+	var last []byte
+	var n int64
+	for {
+		line, err := br.ReadBytes('\n')
+		n += int64(len(line))
+		if line = bytes.TrimSuffix(line, []byte("\n")); len(line) > 0 {
+			last = line
+		}
+		if err == io.EOF {
+			return last, n, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+func lineHash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+type auditLine struct {
+	AuditEvent
+	Prev string `json:"prev"`
+}
+
+func (s *FileAuditSink) Audit(e AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return errors.WithStack(os.ErrClosed)
+	}
+	line, err := json.Marshal(auditLine{AuditEvent: e, Prev: s.prev})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line))+1 > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.f.Write(append(line, '\n'))
+	s.size += int64(n)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	s.prev = lineHash(line)
+	return nil
+}
+
+func (s *FileAuditSink) rotate() error {
+	if err := s.f.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	s.f = nil
+	if err := os.Rename(s.path, s.path+"."+time.Now().UTC().Format("20060102T150405.000000000")); err != nil {
+		return errors.WithStack(err)
+	}
+	prev := s.prev
+	if err := s.open(); err != nil {
+		return err
+	}
+	s.prev = prev
+	return nil
+}
+
+// Close closes the file, the events audited afterwards fail with os.ErrClosed
+func (s *FileAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return errors.WithStack(err)
+}
+
+// VerifyAuditLog checks the chain of the lines written by FileAuditSink to r starting
+// from prev, which is "" for the first file, and returns the hash to verify the next
+// file rotated with
+func VerifyAuditLog(r io.Reader, prev string) (string, error) {
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if line = bytes.TrimSuffix(line, []byte("\n")); len(line) > 0 {
+			var l auditLine
+			if err := json.Unmarshal(line, &l); err != nil {
+				return "", errors.WithMessagef(err, "line %d isn't an event", n)
+			}
+			if l.Prev != prev {
+				return "", errors.Errorf("line %d doesn't follow the previous one", n)
+			}
+			prev = lineHash(line)
+		}
+		if err == io.EOF {
+			return prev, nil
+		}
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/pkg/errors"
+)
+
+// auditRecorder keeps the events audited
+type auditRecorder struct {
+	events []AuditEvent
+}
+
+func (r *auditRecorder) Audit(e AuditEvent) error {
+	r.events = append(r.events, e)
+	return nil
+}
+
+func TestWithAuditSink(t *testing.T) {
+	ctx := ContextWithRequestID(context.Background(), "req-1")
+	r := &auditRecorder{}
+	d := &memFlaky{memDriver: newMemDriver(), err: errs.NotImplement}
+	fsys, err := newWithAddition(ctx, d, "{}", WithAuditSink(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Put(ctx, "a/b", strings.NewReader("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Rename(ctx, "a/b", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsys.Stat(ctx, "a/c"); err != nil {
+		t.Fatal(err)
+	}
+	d.putFailures.Store(1)
+	if err := fsys.Put(ctx, "d", strings.NewReader("d")); !errors.Is(err, errs.NotImplement) {
+		t.Fatalf("the put should fail with not implement, got %v", err)
+	}
+	if err := fsys.Delete(ctx, "a/c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Mkdir(context.Background(), "e"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []AuditEvent{
+		{Op: "put", Path: "a/b", Size: 3, Result: "ok", RequestID: "req-1"},
+		{Op: "rename", Path: "a/b", Target: "c", Result: "ok", RequestID: "req-1"},
+		{Op: "put", Path: "d", Size: 1, Result: "unsupported", RequestID: "req-1"},
+		{Op: "delete", Path: "a/c", Size: 3, Result: "ok", RequestID: "req-1"},
+		{Op: "mkdir", Path: "e", Result: "ok"},
+	}
+	if len(r.events) != len(want) {
+		t.Fatalf("%d events should be audited, got %+v", len(want), r.events)
+	}
+	for n, e := range r.events {
+		if e.Time.IsZero() {
+			t.Errorf("event %d has no time", n)
+		}
+		if (e.Error != "") != (e.Result != "ok") {
+			t.Errorf("event %d has result %s and error %q", n, e.Result, e.Error)
+		}
+		e.Time, e.Error = want[n].Time, ""
+		if e != want[n] {
+			t.Errorf("event %d should be %+v, got %+v", n, want[n], e)
+		}
+	}
+}
+
+func TestFileAuditSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	s, err := NewFileAuditSink(path, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < 4; n++ {
+		if err := s.Audit(AuditEvent{Op: "put", Path: strings.Repeat("a", 100), Result: "ok"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// reopened, the chain goes on
+	if s, err = NewFileAuditSink(path, 500); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Audit(AuditEvent{Op: "delete", Path: "b", Result: "ok"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) == 0 {
+		t.Fatal("the log should be rotated")
+	}
+	var prev string
+	lines := 0
+	for _, p := range append(rotated, path) {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) > 500 {
+			t.Errorf("%s has %d bytes", p, len(b))
+		}
+		lines += bytes.Count(b, []byte("\n"))
+		if prev, err = VerifyAuditLog(bytes.NewReader(b), prev); err != nil {
+			t.Fatalf("%s: %v", p, err)
+		}
+	}
+	if lines != 5 {
+		t.Errorf("5 events should be written, got %d", lines)
+	}
+
+	b, err := os.ReadFile(rotated[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _, _ := bytes.Cut(b, []byte("\n"))
+	var l auditLine
+	if err := json.Unmarshal(first, &l); err != nil {
+		t.Fatal(err)
+	}
+	l.Path = "c"
+	tampered, err := json.Marshal(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = bytes.Replace(b, first, tampered, 1)
+	if _, err := VerifyAuditLog(bytes.NewReader(b), ""); err == nil {
+		t.Error("a changed line should break the chain")
+	}
+}
@@ -0,0 +1,287 @@
+package export
+
+import (
+	"context"
+	"io"
+	stdpath "path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/alist-org/alist/v3/internal/model"
+	"github.com/pkg/errors"
+)
+
+// batchTarget is a name of a batch and the object found at it
+type batchTarget struct {
+	name string
+	path string
+	obj  model.Obj
+	err  error
+}
+
+// DeleteBatch deletes names like Delete does with up to parallel removals at once, the default
+// of WithRemoveParallel if it's <= 0. The dirs of names are listed once for the whole batch
+// to find the objects, and dirs are deleted after the names in them. The errors are returned
+// by name, a name missing is no error, failed is nil if all have been deleted
+func (i *Impl) DeleteBatch(ctx context.Context, names []string, parallel int) (failed map[string]error) {
+	if parallel <= 0 {
+		parallel = i.conf.removeParallel
+	}
+	var mu sync.Mutex
+	run := func(t *batchTarget, f func(ctx context.Context) error) {
+		ctx, end := i.startOp(ctx, "delete", t.name)
+		ctx, cancel := withTimeout(ctx, i.conf.writeTimeout)
+		defer cancel()
+		err := f(ctx)
+		end(&err)
+		if err != nil {
+			mu.Lock()
+			defer mu.Unlock()
+			if failed == nil {
+				failed = map[string]error{}
+			}
+			failed[t.name] = err
+		}
+	}
+
+	var targets []*batchTarget
+	byDir := map[string][]*batchTarget{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		t := &batchTarget{name: name}
+		if t.path, t.err = i.objPath(name); t.err == nil {
+			t.err = i.writable()
+		}
+		if t.err != nil {
+			run(t, func(context.Context) error { return t.err })
+			continue
+		}
+		if seen[t.path] {
+			continue
+		}
+		seen[t.path] = true
+		targets = append(targets, t)
+		dir := stdpath.Dir(t.path)
+		byDir[dir] = append(byDir[dir], t)
+	}
+
+	// the objects are found in the listings of their dirs instead of one by one
+	dirs := make([]string, 0, len(byDir))
+	for dir := range byDir {
+		dirs = append(dirs, dir)
+	}
+	forEach(ctx, parallel, len(dirs), func(n int) {
+		dir := dirs[n]
+		objs, err := i.list(ctx, dir, model.ListArgs{})
+		if err != nil && !errs.IsObjectNotFound(err) {
+			err = errors.WithMessagef(err, "failed to list dir [%s]", dir)
+			for _, t := range byDir[dir] {
+				t.err = err
+			}
+			return
+		}
+		found := make(map[string]model.Obj, len(objs))
+		for _, obj := range objs {
+			found[obj.GetName()] = obj
+		}
+		for _, t := range byDir[dir] {
+			t.obj = found[stdpath.Base(t.path)]
+		}
+	})
+
+	// files go first, then dirs from the deepest
+	sort.SliceStable(targets, func(a, b int) bool {
+		return depth(targets[a]) > depth(targets[b])
+	})
+	for start := 0; start < len(targets); {
+		end := start + 1
+		for end < len(targets) && depth(targets[end]) == depth(targets[start]) {
+			end++
+		}
+		wave := targets[start:end]
+		forEach(ctx, parallel, len(wave), func(n int) {
+			t := wave[n]
+			run(t, func(ctx context.Context) error {
+				if t.err != nil || t.obj == nil {
+					return t.err
+				}
+				return i.deleteObj(ctx, t.path, t.obj)
+			})
+		})
+		start = end
+	}
+	return failed
+}
+
+// PutItem is an object put by PutBatch. Open opens its content of Size bytes, a negative Size
+// spools it first like Put does, the content is closed once put
+type PutItem struct {
+	Name string
+	Size int64
+	Open func() (io.ReadCloser, error)
+	// Opts are the options of its put, like those of PutWithOptions
+	Opts []PutOption
+}
+
+// defaultPutParallel is how many items PutBatch puts at once by default
+const defaultPutParallel = 4
+
+// PutBatch puts items like PutWithSize does with up to parallel puts at once, 4 if it's <= 0,
+// which are still capped by WithMaxUploadConcurrency. The dirs of the items are made and looked up once for
+// the whole batch. The errors are returned in the order of items, nil if the item was put.
+// Once ctx is done, the items not started yet fail with its error, the ones started abort
+func (i *Impl) PutBatch(ctx context.Context, items []PutItem, parallel int) []error {
+	if parallel <= 0 {
+		parallel = defaultPutParallel
+	}
+	results := make([]error, len(items))
+	run := func(n int, f func(ctx context.Context) error) {
+		ctx, end := i.startOp(ctx, "put", items[n].Name)
+		err := f(ctx)
+		end(&err)
+		results[n] = err
+	}
+
+	paths := make([]string, len(items))
+	byDir := map[string][]int{}
+	for n, item := range items {
+		path, err := i.objPath(item.Name)
+		if err == nil {
+			err = i.writable()
+		}
+		if err != nil {
+			run(n, func(context.Context) error { return err })
+			continue
+		}
+		paths[n] = path
+		dir := stdpath.Dir(path)
+		byDir[dir] = append(byDir[dir], n)
+	}
+	dirs := make([]string, 0, len(byDir))
+	for dir := range byDir {
+		dirs = append(dirs, dir)
+	}
+	dirErrs := make(map[string]error, len(dirs))
+	var mu sync.Mutex
+	forEach(ctx, parallel, len(dirs), func(n int) {
+		ctx, cancel := withTimeout(ctx, i.conf.writeTimeout)
+		defer cancel()
+		if err := i.mkdir(ctx, dirs[n]); err != nil {
+			mu.Lock()
+			defer mu.Unlock()
+			dirErrs[dirs[n]] = errors.WithMessagef(err, "failed to make dir [%s]", dirs[n])
+		}
+	})
+
+	started := make([]bool, len(items))
+	forEach(ctx, parallel, len(items), func(n int) {
+		started[n] = true
+		if paths[n] == "" {
+			return
+		}
+		run(n, func(ctx context.Context) error {
+			if err := dirErrs[stdpath.Dir(paths[n])]; err != nil {
+				return err
+			}
+			body, err := items[n].Open()
+			if err != nil {
+				return errors.WithMessage(err, "failed to open the content")
+			}
+			defer body.Close()
+			_, err = i.putFile(ctx, items[n].Name, body, items[n].Size, newPutOptions(items[n].Opts))
+			return err
+		})
+	})
+	for n := range items {
+		if !started[n] && paths[n] != "" {
+			run(n, func(ctx context.Context) error { return errors.WithStack(ctx.Err()) })
+		}
+	}
+	return results
+}
+
+// depth orders the targets of DeleteBatch, files are deeper than any dir
+func depth(t *batchTarget) int {
+	if t.obj == nil || !t.obj.IsDir() {
+		return int(^uint(0) >> 1)
+	}
+	return strings.Count(t.path, "/")
+}
+
+// forEach calls f with 0 to n-1 from up to parallel goroutines, the rest isn't called once ctx is done
+func forEach(ctx context.Context, parallel, n int, f func(n int)) {
+	sem := make(chan struct{}, max(parallel, 1))
+	var wg sync.WaitGroup
+	for k := 0; k < n; k++ {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(k int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			f(k)
+		}(k)
+	}
+	wg.Wait()
+}
+
+// putEach puts items by put with up to parallel at once, defaultPutParallel if <= 0, for the
+// layers over a FileSystem. The items not started once ctx is done fail with its error
+func putEach(ctx context.Context, items []PutItem, parallel int,
+	put func(ctx context.Context, name string, body io.Reader, opts ...PutOption) (ObjInfo, error)) []error {
+	if parallel <= 0 {
+		parallel = defaultPutParallel
+	}
+	results := make([]error, len(items))
+	started := make([]bool, len(items))
+	forEach(ctx, parallel, len(items), func(n int) {
+		started[n] = true
+		body, err := items[n].Open()
+		if err != nil {
+			results[n] = errors.WithMessage(err, "failed to open the content")
+			return
+		}
+		defer body.Close()
+		_, results[n] = put(ctx, items[n].Name, body, items[n].Opts...)
+	})
+	for n := range items {
+		if !started[n] {
+			results[n] = errors.WithStack(ctx.Err())
+		}
+	}
+	return results
+}
+
+// deleteEach deletes names by del with up to parallel at once, defaultPutParallel if <= 0, for
+// the layers over a FileSystem. The names not started once ctx is done fail with its error
+func deleteEach(ctx context.Context, names []string, parallel int, del func(ctx context.Context, name string) error) map[string]error {
+	if parallel <= 0 {
+		parallel = defaultPutParallel
+	}
+	var mu sync.Mutex
+	failed := map[string]error{}
+	started := make([]bool, len(names))
+	forEach(ctx, parallel, len(names), func(n int) {
+		started[n] = true
+		if err := del(ctx, names[n]); err != nil {
+			mu.Lock()
+			defer mu.Unlock()
+			failed[names[n]] = err
+		}
+	})
+	for n, name := range names {
+		if !started[n] {
+			failed[name] = errors.WithStack(ctx.Err())
+		}
+	}
+	return failed
+}
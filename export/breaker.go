@@ -0,0 +1,132 @@
+package export
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrStorageUnavailable is returned without calling the driver while the circuit breaker is open
+var ErrStorageUnavailable = errors.New("storage is unavailable")
+
+// BreakerState is the state of the circuit breaker
+type BreakerState int
+
+const (
+	// BreakerClosed lets all calls through
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails all calls fast until the cooldown has passed
+	BreakerOpen
+	// BreakerHalfOpen lets one probe call through, which closes the breaker if it succeeds
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// breaker opens after threshold consecutive retryable failures of the driver
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	onChange  func(from, to BreakerState)
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newBreaker(threshold int, cooldown time.Duration, onChange func(from, to BreakerState)) *breaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &breaker{threshold: threshold, cooldown: cooldown, onChange: onChange}
+}
+
+// setState must be called with mu held, it returns the callback to run after mu is released
+func (b *breaker) setState(to BreakerState) func() {
+	from := b.state
+	b.state = to
+	if from == to || b.onChange == nil {
+		return func() {}
+	}
+	return func() { b.onChange(from, to) }
+}
+
+// allow reports whether a call may go to the driver, done must be called with its result if so
+func (b *breaker) allow() error {
+	b.mu.Lock()
+	notify := func() {}
+	defer func() {
+		b.mu.Unlock()
+		notify()
+	}()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return errors.WithStack(ErrStorageUnavailable)
+		}
+		notify = b.setState(BreakerHalfOpen)
+		b.probing = true
+		return nil
+	case BreakerHalfOpen:
+		if b.probing {
+			return errors.WithStack(ErrStorageUnavailable)
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// done records the result of a call, only failures worth retrying and timeouts count
+func (b *breaker) done(err error) {
+	b.mu.Lock()
+	notify := func() {}
+	defer func() {
+		b.mu.Unlock()
+		notify()
+	}()
+	b.probing = false
+	switch {
+	case errors.Is(err, context.Canceled):
+		// the caller gave up, which tells nothing about the storage
+		return
+	case errors.Is(err, context.DeadlineExceeded):
+		// a stalled storage, unlike the other permanent errors
+	case err == nil || permanent(err):
+		b.failures = 0
+		notify = b.setState(BreakerClosed)
+		return
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		notify = b.setState(BreakerOpen)
+	}
+}
+
+// call calls f unless the breaker is open
+func (i *Impl) call(f func() error) error {
+	if i.breaker == nil {
+		return f()
+	}
+	if err := i.breaker.allow(); err != nil {
+		return err
+	}
+	err := f()
+	i.breaker.done(err)
+	return err
+}
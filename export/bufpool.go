@@ -0,0 +1,101 @@
+package export
+
+import (
+	"bytes"
+	"io"
+	"math/bits"
+	"os"
+	"sync"
+)
+
+// the buffers pooled are of the sizes of powers of two from 1<<minBufShift to 1<<maxBufShift
+const (
+	minBufShift = 12
+	maxBufShift = 26
+)
+
+var bufPools [maxBufShift - minBufShift + 1]sync.Pool
+
+// bufClass returns the pool of the buffers of at least n bytes, or -1 if they are too large
+func bufClass(n int) int {
+	if n <= 1<<minBufShift {
+		return 0
+	}
+	c := bits.Len(uint(n-1)) - minBufShift
+	if c >= len(bufPools) {
+		return -1
+	}
+	return c
+}
+
+// getBuf returns an empty buffer with a capacity of at least n from the pools
+func getBuf(n int) []byte {
+	c := bufClass(n)
+	if c < 0 {
+		return make([]byte, 0, n)
+	}
+	if b, ok := bufPools[c].Get().(*[]byte); ok {
+		return (*b)[:0]
+	}
+	return make([]byte, 0, 1<<(c+minBufShift))
+}
+
+// putBuf puts b got by getBuf back into the pools, b mustn't be used afterwards
+func putBuf(b []byte) {
+	c := bufClass(cap(b))
+	if c < 0 || cap(b) != 1<<(c+minBufShift) {
+		return
+	}
+	bufPools[c].Put(&b)
+}
+
+// pooledFile reads a buffer got by getBuf, which is put back once the file is closed. The reads
+// after that fail, which keeps a driver still holding the reader from reading the buffer reused
+type pooledFile struct {
+	mu  sync.Mutex
+	buf []byte
+	r   *bytes.Reader
+}
+
+func newPooledFile(buf []byte) *pooledFile {
+	return &pooledFile{buf: buf, r: bytes.NewReader(buf)}
+}
+
+func (f *pooledFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.r == nil {
+		return 0, os.ErrClosed
+	}
+	return f.r.Read(p)
+}
+
+func (f *pooledFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.r == nil {
+		return 0, os.ErrClosed
+	}
+	return f.r.ReadAt(p, off)
+}
+
+func (f *pooledFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.r == nil {
+		return 0, os.ErrClosed
+	}
+	return f.r.Seek(offset, whence)
+}
+
+func (f *pooledFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.r != nil {
+		putBuf(f.buf)
+		f.buf, f.r = nil, nil
+	}
+	return nil
+}
+
+var _ io.ReadSeekCloser = (*pooledFile)(nil)
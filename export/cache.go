@@ -0,0 +1,153 @@
+package export
+
+import (
+	"context"
+	"fmt"
+	stdpath "path"
+	"time"
+
+	"github.com/Xhofe/go-cache"
+	"github.com/alist-org/alist/v3/internal/model"
+)
+
+// how long a missing object is remembered by default
+const missingExpiration = 3 * time.Second
+
+func (i *Impl) setMissing(path string) {
+	if i.conf.missingTTL > 0 {
+		i.missing.Set(path, struct{}{}, cache.WithEx[struct{}](i.conf.missingTTL))
+	}
+}
+
+func (i *Impl) isMissing(path string) bool {
+	_, ok := i.missing.Get(path)
+	return ok
+}
+
+// created forgets the missing records covered by the new object at path,
+// objects may be created anywhere below a new dir, so all records are dropped
+func (i *Impl) created(path string, isDir bool) {
+	i.conf.logger.Debug("cache invalidated", "path", path, "dir", isDir, "reason", "created")
+	i.listCache.Del(stdpath.Dir(path))
+	i.objCache.DelTree(path)
+	i.readahead.forget(path)
+	i.diskCache.forget(path)
+	i.memCache.forget(path)
+	if isDir {
+		i.missing.Clear()
+		return
+	}
+	i.missing.Del(path)
+}
+
+// removed forgets the listings changed by removing the object at path,
+// which are the listings of its parent and of the dirs below it, and the objects below it
+func (i *Impl) removed(path string, isDir bool) {
+	i.conf.logger.Debug("cache invalidated", "path", path, "dir", isDir, "reason", "removed")
+	i.objCache.DelTree(path)
+	i.readahead.forget(path)
+	i.diskCache.forget(path)
+	i.memCache.forget(path)
+	if isDir {
+		i.listCache.DelTree(path)
+	}
+	i.listCache.Del(stdpath.Dir(path))
+}
+
+// Flush drops all listings, links and missing records cached by the FileSystem,
+// which is needed when the storage is changed by others
+func (i *Impl) Flush() {
+	i.conf.logger.Info("caches flushed")
+	i.listCache.Clear()
+	i.objCache.Clear()
+	i.linkCache.Clear()
+	i.missing.Clear()
+	i.readahead.forget("/")
+	i.memCache.forget("/")
+}
+
+// CacheStats counts the lookups of a cache
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// ObjCacheStats returns the lookups of the object cache enabled by WithObjCache
+func (i *Impl) ObjCacheStats() CacheStats {
+	return CacheStats{Hits: i.objHits.Load(), Misses: i.objMisses.Load()}
+}
+
+func (i *Impl) getObj(path string) (model.Obj, bool) {
+	if i.conf.objTTL <= 0 {
+		return nil, false
+	}
+	obj, ok := i.objCache.Get(path)
+	if ok {
+		i.objHits.Add(1)
+	} else {
+		i.objMisses.Add(1)
+	}
+	i.cacheLookup("obj", ok)
+	return obj, ok
+}
+
+// setObj caches obj at path, the name of obj is mapped first since it's mapped lazily
+// and obj is shared by the callers
+func (i *Impl) setObj(path string, obj model.Obj) {
+	obj.GetName()
+	if i.conf.objTTL > 0 {
+		i.objCache.Set(path, obj, i.conf.objTTL)
+	}
+}
+
+// LinkCacheStats returns the lookups of the link cache enabled by WithLinkCache
+func (i *Impl) LinkCacheStats() CacheStats {
+	return CacheStats{Hits: i.linkHits.Load(), Misses: i.linkMisses.Load()}
+}
+
+// linkKey identifies the content of file, or is empty if file can't be identified
+func linkKey(file model.Obj) string {
+	if file.GetID() == "" && file.GetPath() == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s\x00%s\x00%d\x00%d", file.GetID(), file.GetPath(), file.GetSize(), file.ModTime().UnixNano())
+}
+
+// cachedLink gets the link of file from the link cache, or from the driver on a miss.
+// Only URL links are cached since the other ones hold resources released after one read
+func (i *Impl) cachedLink(ctx context.Context, file model.Obj) (*model.Link, error) {
+	key := linkKey(file)
+	if i.conf.linkTTL <= 0 || key == "" {
+		return i.link(ctx, file)
+	}
+	if link, ok := i.linkCache.Get(key); ok {
+		i.linkHits.Add(1)
+		i.cacheLookup("link", true)
+		return link, nil
+	}
+	i.linkMisses.Add(1)
+	i.cacheLookup("link", false)
+	link, err := i.link(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	if link.URL == "" || link.MFile != nil || link.RangeReadCloser != nil {
+		return link, nil
+	}
+	ttl := i.conf.linkTTL
+	if link.Expiration != nil {
+		ttl = *link.Expiration
+	}
+	if ttl > 0 {
+		i.linkCache.Set(key, link, cache.WithEx[*model.Link](ttl))
+	}
+	return link, nil
+}
+
+// forgetLink drops the cached link of file, which may have been revoked or expired
+func (i *Impl) forgetLink(file model.Obj) {
+	if key := linkKey(file); key != "" {
+		i.linkCache.Del(key)
+		i.conf.logger.Debug("link forgotten", "path", file.GetPath())
+	}
+}
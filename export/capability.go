@@ -0,0 +1,123 @@
+package export
+
+import (
+	"strings"
+
+	"github.com/alist-org/alist/v3/internal/driver"
+)
+
+// Capability is a set of the optional operations supported by a driver
+type Capability uint
+
+const (
+	CapGet Capability = 1 << iota
+	CapMkdir
+	CapPut
+	CapRemove
+	CapRename
+	CapMove
+	CapCopy
+	// CapAtomicPut is set if the puts are atomic by WithAtomicPut
+	CapAtomicPut
+	// CapTouch is set if Touch sets the modified time of files without putting them again
+	CapTouch
+	// CapEmpty is set unless the driver is known to reject empty objects
+	CapEmpty
+	// CapTrash is set if Delete moves the files to the trash by WithTrash, deleted files are
+	// removed without it
+	CapTrash
+	// CapVersions is set if the puts keep the files replaced as versions by WithVersioning
+	CapVersions
+)
+
+// CapWrite is what a driver must support unless the FileSystem is read only
+const CapWrite = CapMkdir | CapPut | CapRemove
+
+var capNames = []struct {
+	c    Capability
+	name string
+}{
+	{CapGet, "Get"},
+	{CapMkdir, "MakeDir"},
+	{CapPut, "Put"},
+	{CapRemove, "Remove"},
+	{CapRename, "Rename"},
+	{CapMove, "Move"},
+	{CapCopy, "Copy"},
+	{CapAtomicPut, "AtomicPut"},
+	{CapTouch, "Touch"},
+	{CapEmpty, "Empty"},
+	{CapTrash, "Trash"},
+	{CapVersions, "Versions"},
+}
+
+// Has reports whether all of c are supported
+func (c Capability) Has(want Capability) bool {
+	return c&want == want
+}
+
+// String returns the names of the operations joined by /
+func (c Capability) String() string {
+	var names []string
+	for _, n := range capNames {
+		if c.Has(n.c) {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, "/")
+}
+
+// capabilities inspects the interfaces implemented by d
+func capabilities(d driver.Driver) Capability {
+	var c Capability
+	if _, ok := d.(driver.Getter); ok {
+		c |= CapGet
+	}
+	switch d.(type) {
+	case driver.Mkdir, driver.MkdirResult:
+		c |= CapMkdir
+	}
+	switch d.(type) {
+	case driver.Put, driver.PutResult:
+		c |= CapPut
+	}
+	if _, ok := d.(driver.Remove); ok {
+		c |= CapRemove
+	}
+	switch d.(type) {
+	case driver.Rename, driver.RenameResult:
+		c |= CapRename
+	}
+	switch d.(type) {
+	case driver.Move, driver.MoveResult:
+		c |= CapMove
+	}
+	switch d.(type) {
+	case driver.Copy, driver.CopyResult:
+		c |= CapCopy
+	}
+	if modTimeSetters[d.Config().Name] != nil {
+		c |= CapTouch
+	}
+	if c.Has(CapPut) && !emptyUnsupported[d.Config().Name] {
+		c |= CapEmpty
+	}
+	return c
+}
+
+// Capabilities returns the optional operations supported by the wrapped driver,
+// with CapAtomicPut if the puts are made atomic, CapTrash if the deletes go to the trash and
+// CapVersions if the files replaced are kept
+func (i *Impl) Capabilities() Capability {
+	c := capabilities(i.storage)
+	if i.atomicMode() != 0 {
+		c |= CapAtomicPut
+	}
+	if i.canTrash() {
+		c |= CapTrash
+	}
+	if i.canVersion() {
+		c |= CapVersions
+	}
+	return c
+}
@@ -0,0 +1,426 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	stdpath "path"
+	"strings"
+	"time"
+
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/alist-org/alist/v3/internal/model"
+	"github.com/alist-org/alist/v3/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+const (
+	// partsDir is the hidden dir under the base dir keeping the parts of chunked uploads
+	partsDir = ".parts"
+	// doneMarker is put in the dir of an upload once all of its parts are uploaded
+	doneMarker = "done"
+	// manifestMagic starts every manifest and maxManifestSize bounds it, only the small files
+	// are read to find manifests
+	manifestMagic   = `{"alist_export_chunked":`
+	maxManifestSize = 1024
+)
+
+// WithChunkedUpload uploads the objects larger than partSize in parts of partSize, which are put
+// under .parts of the base dir and read through a manifest put in place of the object, as the
+// drivers can't join objects. Manifests are found by reading the
+// files up to 1KiB on lookups, parts of uploads which didn't complete are removed by CollectParts
+func WithChunkedUpload(partSize int64) Option {
+	return func(c *config) {
+		c.partSize = partSize
+	}
+}
+
+// manifest is put in place of a chunked object joining its parts
+type manifest struct {
+	Version  int    `json:"alist_export_chunked"`
+	UploadID string `json:"upload_id"`
+	Size     int64  `json:"size"`
+	PartSize int64  `json:"part_size"`
+	Hashes   string `json:"hashes,omitempty"`
+}
+
+func (m manifest) parts() int {
+	return int((m.Size + m.PartSize - 1) / m.PartSize)
+}
+
+// chunkedObj is the manifest obj of a chunked object, reporting the size and hashes of the object
+type chunkedObj struct {
+	model.Obj
+	m manifest
+}
+
+func (c *chunkedObj) GetSize() int64 {
+	return c.m.Size
+}
+
+func (c *chunkedObj) GetHash() utils.HashInfo {
+	if c.m.Hashes == "" {
+		return utils.NewHashInfo(nil, "")
+	}
+	return utils.FromString(c.m.Hashes)
+}
+
+func (c *chunkedObj) Unwrap() model.Obj {
+	return model.UnwrapObj(c.Obj)
+}
+
+func newUploadID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func partName(n int) string {
+	return fmt.Sprintf("%06d", n)
+}
+
+func (i *Impl) partsPath(uploadID string) string {
+	return stdpath.Join(i.conf.baseDir, partsDir, uploadID)
+}
+
+func (i *Impl) isPart(path string) bool {
+	root := stdpath.Join(i.conf.baseDir, partsDir)
+	return path == root || strings.HasPrefix(path, root+"/")
+}
+
+// chunked reports whether an object of size is uploaded in parts
+func (i *Impl) chunked(size int64) bool {
+	return i.conf.partSize > 0 && size > i.conf.partSize
+}
+
+// resolveChunked returns obj at path as a chunkedObj if it's a manifest
+func (i *Impl) resolveChunked(ctx context.Context, path string, obj model.Obj) (model.Obj, error) {
+	if i.conf.partSize <= 0 || obj.IsDir() || i.isPart(path) {
+		return obj, nil
+	}
+	if _, ok := obj.(*chunkedObj); ok {
+		return obj, nil
+	}
+	if size := obj.GetSize(); size < int64(len(manifestMagic)) || size > maxManifestSize {
+		return obj, nil
+	}
+	rc, err := i.rangeRead(ctx, obj, 0, obj.GetSize())
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to read [%s] for a manifest", path)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to read [%s] for a manifest", path)
+	}
+	if !bytes.HasPrefix(data, []byte(manifestMagic)) {
+		return obj, nil
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil || m.UploadID == "" || m.PartSize <= 0 {
+		return obj, nil
+	}
+	return &chunkedObj{Obj: obj, m: m}, nil
+}
+
+// putChunked uploads body as the parts of obj from the ones completed in st, each part is retried
+// on its own, and joins them into obj in parentDir. st is updated with the parts completed
+func (i *Impl) putChunked(ctx context.Context, parentDir model.Obj, obj *model.Object, body io.Reader, p *progress, st *uploadState, replace func(context.Context) error) (model.Obj, error) {
+	m := manifest{Version: 1, UploadID: st.UploadID, Size: st.Size, PartSize: st.PartSize}
+	if len(obj.HashInfo.Export()) > 0 {
+		m.Hashes = obj.HashInfo.String()
+	}
+	dir := i.partsPath(m.UploadID)
+	if err := i.mkdir(ctx, dir); err != nil {
+		return nil, errors.WithMessagef(err, "failed to make dir [%s]", dir)
+	}
+	partsObj, err := i.get(ctx, dir)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to get dir [%s]", dir)
+	}
+	// a body which can be read at random is read by sections from where it is
+	var ra io.ReaderAt
+	var base int64
+	if s, ok := body.(io.ReadSeeker); ok {
+		if r, ok := body.(io.ReaderAt); ok {
+			if base, err = s.Seek(0, io.SeekCurrent); err == nil {
+				ra = r
+			}
+		}
+	}
+	prefix := sha256.New()
+	if err := i.checkResumed(ctx, dir, body, ra, base, m, st, prefix); err != nil {
+		return nil, err
+	}
+	p.report(min(int64(len(st.Parts))*m.PartSize, m.Size))
+	for n := len(st.Parts); n < m.parts(); n++ {
+		if err := i.putPart(ctx, partsObj, dir, body, ra, base, m, n, prefix); err != nil {
+			return nil, errors.WithMessagef(err, "failed to upload part %d of [%s]", n, obj.Name)
+		}
+		st.Parts = append(st.Parts, n)
+		st.PrefixSHA256 = hex.EncodeToString(prefix.Sum(nil))
+		p.report(min(int64(n+1)*m.PartSize, m.Size))
+	}
+	i.created(dir, true)
+	// the object replaced goes only once the parts are uploaded
+	if replace != nil {
+		if err := replace(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	// the upload is marked done first, parts of a manifest lost are left rather than a manifest
+	// without parts, which CollectParts could make
+	if err := i.putSmall(ctx, partsObj, doneMarker, []byte(obj.Name)); err != nil {
+		return nil, errors.WithMessage(err, "failed to mark the parts done")
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	mObj := &model.Object{Name: obj.Name, Size: int64(len(data)), Modified: obj.Modified, Ctime: obj.Ctime}
+	var newObj model.Obj
+	err = i.retryBody(ctx, bytes.NewReader(data), func() (err error) {
+		newObj, err = i.put(ctx, parentDir, mObj, bytes.NewReader(data), nil)
+		return err
+	})
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to put the manifest of [%s]", obj.Name)
+	}
+	return &chunkedObj{Obj: newObj, m: m}, nil
+}
+
+// putPart uploads part n of m into dir, read from ra at base if it's not nil, or from body
+// spooled to retry otherwise, the part uploaded is written to prefix
+func (i *Impl) putPart(ctx context.Context, partsObj model.Obj, dir string, body io.Reader, ra io.ReaderAt, base int64, m manifest, n int, prefix hash.Hash) error {
+	off := int64(n) * m.PartSize
+	size := min(m.PartSize, m.Size-off)
+	var r io.ReadSeeker
+	if ra != nil {
+		r = io.NewSectionReader(ra, base+off, size)
+	} else {
+		f, got, err := spool(ctx, io.LimitReader(body, size), i.conf.spoolThreshold)
+		if err != nil {
+			return errors.WithMessage(err, "failed to spool part")
+		}
+		defer f.Close()
+		if got != size {
+			return errors.Errorf("body has %d bytes instead of %d", off+got, m.Size)
+		}
+		r = f
+	}
+	obj := &model.Object{Name: partName(n), Size: size, Modified: time.Now(), Ctime: time.Now()}
+	var part model.Obj
+	err := i.retryBody(ctx, r, func() (err error) {
+		part, err = i.put(ctx, partsObj, obj, r, nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if i.conf.verifyPut {
+		path := stdpath.Join(dir, obj.Name)
+		i.created(path, false)
+		if err := i.verifyPut(ctx, path, part, part != model.Obj(obj), size); err != nil {
+			return err
+		}
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := io.Copy(prefix, r); err != nil {
+		return errors.WithMessage(err, "failed to hash part")
+	}
+	return nil
+}
+
+// putSmall puts data as name into dir
+func (i *Impl) putSmall(ctx context.Context, dir model.Obj, name string, data []byte) error {
+	obj := &model.Object{Name: name, Size: int64(len(data)), Modified: time.Now(), Ctime: time.Now()}
+	return i.retryBody(ctx, bytes.NewReader(data), func() error {
+		_, err := i.put(ctx, dir, obj, bytes.NewReader(data), nil)
+		return err
+	})
+}
+
+// removeParts removes the parts of an upload, failures are only logged since the object is gone
+func (i *Impl) removeParts(ctx context.Context, uploadID string) {
+	dir := i.partsPath(uploadID)
+	obj, err := i.get(ctx, dir)
+	if err == nil {
+		err = i.removeAll(ctx, dir, obj)
+	}
+	if err != nil && !errs.IsObjectNotFound(err) {
+		i.conf.logger.Warn("failed to remove parts", "upload", uploadID, "error", errValue(err))
+	}
+}
+
+// CollectParts removes the parts of the chunked uploads which didn't complete, e.g. since the
+// uploader crashed, written last more than olderThan ago, and returns how many uploads are
+// removed. olderThan should be longer than a part takes to upload
+func (i *Impl) CollectParts(ctx context.Context, olderThan time.Duration) (n int, err error) {
+	ctx, end := i.startOp(ctx, "collectparts", partsDir)
+	defer end(&err)
+	if err := i.writable(); err != nil {
+		return 0, err
+	}
+	root := stdpath.Join(i.conf.baseDir, partsDir)
+	uploads, err := i.list(ctx, root, model.ListArgs{})
+	if err != nil {
+		if errs.IsObjectNotFound(err) {
+			return 0, nil
+		}
+		return 0, errors.WithMessage(err, "failed to list parts")
+	}
+	for _, u := range uploads {
+		if !u.IsDir() {
+			continue
+		}
+		dir := stdpath.Join(root, u.GetName())
+		parts, err := i.list(ctx, dir, model.ListArgs{})
+		if err != nil {
+			return n, errors.WithMessagef(err, "failed to list dir [%s]", dir)
+		}
+		last, done := u.ModTime(), false
+		for _, p := range parts {
+			done = done || p.GetName() == doneMarker
+			if p.ModTime().After(last) {
+				last = p.ModTime()
+			}
+		}
+		if done || time.Since(last) <= olderThan {
+			continue
+		}
+		if err := i.removeAll(ctx, dir, u); err != nil {
+			return n, err
+		}
+		i.conf.logger.Info("parts collected", "upload", u.GetName(), "parts", len(parts))
+		n++
+	}
+	return n, nil
+}
+
+// chunkedReader reads the range [off, end) of a chunked object part by part
+type chunkedReader struct {
+	ctx context.Context
+	i   *Impl
+	c   *chunkedObj
+	off int64
+	end int64
+	// cur reads the current part until partEnd
+	cur     io.ReadCloser
+	partEnd int64
+}
+
+func (i *Impl) readChunked(ctx context.Context, c *chunkedObj, off, limit int64) io.ReadCloser {
+	return &chunkedReader{ctx: ctx, i: i, c: c, off: off, end: min(off+limit, c.m.Size)}
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	for {
+		if r.off >= r.end {
+			return 0, io.EOF
+		}
+		if r.cur == nil {
+			if err := r.open(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := r.cur.Read(p)
+		r.off += int64(n)
+		if err == io.EOF {
+			_ = r.cur.Close()
+			r.cur = nil
+			if r.off < r.partEnd {
+				return n, errors.WithStack(io.ErrUnexpectedEOF)
+			}
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// open opens the part holding r.off
+func (r *chunkedReader) open() error {
+	m := r.c.m
+	n := int(r.off / m.PartSize)
+	start := int64(n) * m.PartSize
+	r.partEnd = min(start+m.PartSize, r.end)
+	path := stdpath.Join(r.i.partsPath(m.UploadID), partName(n))
+	part, err := r.i.get(r.ctx, path)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to get part %d", n)
+	}
+	rc, err := r.i.rangeRead(r.ctx, part, r.off-start, r.partEnd-r.off)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to read part %d", n)
+	}
+	r.cur = rc
+	return nil
+}
+
+func (r *chunkedReader) Close() error {
+	if r.cur == nil {
+		return nil
+	}
+	err := r.cur.Close()
+	r.cur = nil
+	return err
+}
+
+// chunkedReaderAt reads a chunked object at random by ranges of its parts
+type chunkedReaderAt struct {
+	ctx context.Context
+	i   *Impl
+	c   *chunkedObj
+}
+
+func (ra *chunkedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= ra.c.m.Size {
+		return 0, io.EOF
+	}
+	r := ra.i.readChunked(ra.ctx, ra.c, off, int64(len(p)))
+	defer r.Close()
+	n, err := io.ReadFull(r, p)
+	ra.i.downloadedBytes(n)
+	if err == io.ErrUnexpectedEOF && off+int64(n) == ra.c.m.Size {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (ra *chunkedReaderAt) Close() error {
+	return nil
+}
+
+// copyChunked copies c to dstPath in dstDir by reading it, in parts if it's still large enough
+func (i *Impl) copyChunked(ctx context.Context, c *chunkedObj, dstDir model.Obj, dstPath string) error {
+	r := i.readChunked(ctx, c, 0, c.m.Size)
+	defer r.Close()
+	obj := &model.Object{
+		Name:     c.GetName(),
+		Size:     c.m.Size,
+		Modified: c.ModTime(),
+		Ctime:    c.CreateTime(),
+		HashInfo: c.GetHash(),
+	}
+	var err error
+	if i.chunked(obj.Size) {
+		_, err = i.putChunked(ctx, dstDir, obj, r, nil, newUploadState(dstPath, obj.Size, i.conf.partSize), nil)
+	} else {
+		_, err = i.put(ctx, dstDir, obj, r, nil)
+	}
+	if err == nil {
+		i.created(dstPath, false)
+	}
+	return err
+}
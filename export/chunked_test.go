@@ -0,0 +1,288 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alist-org/alist/v3/internal/model"
+	"github.com/alist-org/alist/v3/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+// uploads returns the ids of the uploads with parts in d
+func uploads(d *memDriver) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var ids []string
+	for p, n := range d.nodes {
+		if path.Dir(p) == baseDir+"/"+partsDir && n.obj.IsFolder {
+			ids = append(ids, path.Base(p))
+		}
+	}
+	return ids
+}
+
+func readAll(t *testing.T, fsys FileSystem, name string, off, limit int64) string {
+	t.Helper()
+	rc, err := fsys.Read(context.Background(), name, off, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestChunkedUpload(t *testing.T) {
+	ctx := context.Background()
+	d := newMemDriver()
+	fsys, err := newWithAddition(ctx, d, "{}", WithChunkedUpload(4), WithUploadHashes(utils.MD5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := "0123456789"
+	if err := fsys.Put(ctx, "dir/a", strings.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+	if raw, _ := d.file(baseDir + "/dir/a"); !bytes.HasPrefix(raw, []byte(manifestMagic)) {
+		t.Fatalf("a manifest should be put, got %q", raw)
+	}
+	ids := uploads(d)
+	if len(ids) != 1 {
+		t.Fatalf("one upload should have parts, got %v", ids)
+	}
+	for _, name := range []string{"000000", "000001", "000002", doneMarker} {
+		if _, ok := d.file(path.Join(baseDir, partsDir, ids[0], name)); !ok {
+			t.Errorf("%s of the upload is missing", name)
+		}
+	}
+
+	for _, c := range []struct {
+		off, limit int64
+		want       string
+	}{{0, 0, body}, {3, 5, "34567"}, {8, 0, "89"}, {4, 4, "4567"}} {
+		if got := readAll(t, fsys, "dir/a", c.off, c.limit); got != c.want {
+			t.Errorf("read %d+%d should be %q, got %q", c.off, c.limit, c.want, got)
+		}
+	}
+	info, err := fsys.Stat(ctx, "dir/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 10 || info.Hashes.GetHash(utils.MD5) != utils.HashData(utils.MD5, []byte(body)) {
+		t.Errorf("the stat should be of the object, got %+v", info)
+	}
+	entries, err := fsys.List(ctx, "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Size != 10 {
+		t.Errorf("the list should have the size of the object, got %+v", entries)
+	}
+	entries, err = fsys.List(ctx, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name == partsDir {
+			t.Error("the parts should be hidden")
+		}
+	}
+
+	f, err := fsys.Open(ctx, "dir/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(5, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(f); err != nil || string(data) != "56789" {
+		t.Errorf("read after seek should be 56789, got %q, %v", data, err)
+	}
+	_ = f.Close()
+	ra, closer, err := fsys.OpenReaderAt(ctx, "dir/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 4)
+	if n, err := ra.ReadAt(p, 2); err != nil || string(p[:n]) != "2345" {
+		t.Errorf("ReadAt 2 should be 2345, got %q, %v", p[:n], err)
+	}
+	if n, err := ra.ReadAt(p, 8); err != io.EOF || string(p[:n]) != "89" {
+		t.Errorf("ReadAt 8 should be 89 and EOF, got %q, %v", p[:n], err)
+	}
+	_ = closer.Close()
+
+	// a copy has parts of its own
+	if err := fsys.Copy(ctx, "dir/a", "/"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, fsys, "a", 0, 0); got != body {
+		t.Errorf("the copy should be %q, got %q", body, got)
+	}
+	if ids := uploads(d); len(ids) != 2 {
+		t.Fatalf("the copy should have its parts, got %v", ids)
+	}
+	if err := fsys.Delete(ctx, "dir/a"); err != nil {
+		t.Fatal(err)
+	}
+	if ids := uploads(d); len(ids) != 1 {
+		t.Errorf("the parts should be removed with the object, got %v", ids)
+	}
+	if got := readAll(t, fsys, "a", 0, 0); got != body {
+		t.Errorf("the copy should be intact, got %q", got)
+	}
+	// replaced by a small file
+	if err := fsys.Put(ctx, "a", strings.NewReader("x")); err != nil {
+		t.Fatal(err)
+	}
+	if ids := uploads(d); len(ids) != 0 {
+		t.Errorf("the parts should be removed with the object replaced, got %v", ids)
+	}
+	if got := readAll(t, fsys, "a", 0, 0); got != "x" {
+		t.Errorf("a should be replaced, got %q", got)
+	}
+}
+
+func TestChunkedUploadResume(t *testing.T) {
+	ctx := context.Background()
+	d := &memFailPart{memDriver: newMemDriver(), name: "000001", puts: map[string]int{}}
+	fsys, err := newWithAddition(ctx, d, "{}", WithChunkedUpload(4), WithRetry(2), WithRetryBackoff(time.Millisecond, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := "0123456789"
+	// not seekable, the parts are spooled to be retried
+	if err := fsys.PutWithSize(ctx, "a", io.MultiReader(strings.NewReader(body)), 10); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]int{"000000": 1, "000001": 2, "000002": 1, "a": 1} {
+		if got := d.puts[name]; got != want {
+			t.Errorf("%s should be put %d times, got %d", name, want, got)
+		}
+	}
+	if got := readAll(t, fsys, "a", 0, 0); got != body {
+		t.Errorf("a should be %q, got %q", body, got)
+	}
+}
+
+func TestResumePut(t *testing.T) {
+	ctx := context.Background()
+	d := &memFailPart{memDriver: newMemDriver(), name: "000001", puts: map[string]int{}}
+	fsys, err := newWithAddition(ctx, d, "{}", WithChunkedUpload(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := "0123456789"
+	var state []byte
+	if _, err := fsys.PutWithOptions(ctx, "a", strings.NewReader(body), WithResumeState(func(s []byte) { state = s })); err == nil {
+		t.Fatal("the put should fail")
+	}
+	if state == nil {
+		t.Fatal("the state of the upload should be given")
+	}
+	for _, changed := range []string{"x123456789", "0123"} {
+		if err := fsys.ResumePut(ctx, "a", state, strings.NewReader(changed)); !errors.Is(err, ErrSourceChanged) {
+			t.Errorf("resuming with %q should fail as the source changed, got %v", changed, err)
+		}
+	}
+	if err := fsys.ResumePut(ctx, "b", state, strings.NewReader(body)); !errors.Is(err, ErrInvalidUploadState) {
+		t.Errorf("resuming to another name should fail, got %v", err)
+	}
+	if err := fsys.ResumePut(ctx, "a", state, strings.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]int{"000000": 1, "000001": 2, "000002": 1, "a": 1} {
+		if got := d.puts[name]; got != want {
+			t.Errorf("%s should be put %d times, got %d", name, want, got)
+		}
+	}
+	if got := readAll(t, fsys, "a", 0, 0); got != body {
+		t.Errorf("a should be %q, got %q", body, got)
+	}
+}
+
+func TestCollectParts(t *testing.T) {
+	ctx := context.Background()
+	d := newMemDriver()
+	i := newTestFS(t, d, WithChunkedUpload(4))
+	if err := i.Put(ctx, "a", strings.NewReader("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	done := uploads(d)[0]
+	// uploads which crashed an hour ago and just now
+	old := time.Now().Add(-time.Hour)
+	d.mu.Lock()
+	for id, modified := range map[string]time.Time{"old": old, "new": time.Now()} {
+		p := path.Join(baseDir, partsDir, id)
+		d.nodes[p] = &memNode{obj: model.Object{Path: p, Name: id, IsFolder: true, Modified: modified}}
+		d.nodes[p+"/000000"] = &memNode{obj: model.Object{Path: p + "/000000", Name: "000000", Size: 4, Modified: modified}, data: []byte("0123")}
+	}
+	d.mu.Unlock()
+
+	n, err := i.CollectParts(ctx, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("one upload should be collected, got %d", n)
+	}
+	ids := map[string]bool{}
+	for _, id := range uploads(d) {
+		ids[id] = true
+	}
+	if ids["old"] || !ids["new"] || !ids[done] {
+		t.Errorf("only the old upload should be collected, got %v", ids)
+	}
+	if got := readAll(t, i, "a", 0, 0); got != "0123456789" {
+		t.Errorf("a should be intact, got %q", got)
+	}
+}
+
+func TestAppendChunked(t *testing.T) {
+	ctx := context.Background()
+	d := &memFailPart{memDriver: newMemDriver(), puts: map[string]int{}}
+	fsys, err := newWithAddition(ctx, d, "{}", WithChunkedUpload(4), WithAppend(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Put(ctx, "log", strings.NewReader("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := fsys.Read(ctx, "log", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Append(ctx, "log", strings.NewReader("abcdef")); err != nil {
+		t.Fatal(err)
+	}
+	// the reader opened before reads the object as it was
+	if data, err := io.ReadAll(rc); err != nil || string(data) != "0123456789" {
+		t.Errorf("the reader opened before should read the object appended to, got %q, %v", data, err)
+	}
+	rc.Close()
+	for _, s := range []string{"gh", "ij"} {
+		if err := fsys.Append(ctx, "log", strings.NewReader(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rc, err = fsys.Read(ctx, "log", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if data, err := io.ReadAll(rc); err != nil || string(data) != "0123456789abcdefghij" {
+		t.Fatalf("the object should be appended, got %q, %v", data, err)
+	}
+	if d.puts[partName(0)] != 1 || d.puts[partName(1)] != 1 {
+		t.Errorf("the full parts shouldn't be put again, got %v", d.puts)
+	}
+}
@@ -0,0 +1,810 @@
+package export
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	stdpath "path"
+	"strings"
+	"time"
+
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/alist-org/alist/v3/pkg/utils"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// Codec is the compression of the frames of NewCompressed
+type Codec uint8
+
+const (
+	CodecZstd Codec = iota + 1
+	CodecGzip
+)
+
+// CompressOptions configures NewCompressed
+type CompressOptions struct {
+	// Codec compresses the objects put, CodecZstd if 0. An object is read with the codec it was
+	// written with
+	Codec Codec
+	// FrameSize is the size of the content of each frame, 1MiB if <= 0. A Read decompresses the
+	// frames of its range only, so it's read ahead by up to FrameSize
+	FrameSize int
+	// MinSize is the size below which an object is stored uncompressed, 4KiB if <= 0
+	MinSize int
+	// SkipTypes are the prefixes of the content types stored uncompressed, sniffed from the content and
+	// guessed from the extension of the name. nil skips the media and the archives, an empty
+	// slice skips none
+	SkipTypes []string
+}
+
+// ErrCorruptFrame is the error of reading a compressed object whose frames were modified or truncated
+var ErrCorruptFrame = errors.New("compressed frame corrupted")
+
+const (
+	defaultFrameSize    = 1 << 20
+	defaultCompressMin  = 4 << 10
+	frameMagic          = "ALXCMP"
+	frameVersion        = 1
+	frameRaw            = 1 << 31
+	frameIndexTTL       = time.Hour
+	frameTailRead       = 4 << 10
+	frameTrailerSize    = 4 + 4 + 8 + 1 + len(frameMagic) + 2
+	maxFrameSize        = 1 << 30
+	defaultFrameIndexes = 1024
+)
+
+var defaultSkipTypes = []string{
+	"image/", "video/", "audio/", "font/woff",
+	"application/zip", "application/x-gzip", "application/gzip", "application/x-rar-compressed",
+	"application/x-7z-compressed", "application/x-xz", "application/zstd", "application/x-bzip2",
+}
+
+// NewCompressed returns a FileSystem compressing the content of the objects of inner. The content
+// is compressed in frames of opts.FrameSize decodable on their own, followed by a footer indexing
+// them, so Read decompresses the frames of its range only. The frames which don't get smaller are
+// kept as they are, and so are all the frames of the objects below opts.MinSize or of
+// opts.SkipTypes, so every object put has a footer and whatever its content is, it's read back as
+// put. The objects of inner put around it are read as is, unless they end with a valid footer.
+// Stat, List and Walk report the size of the content, read from the footer, and no hashes.
+//
+// ListObjects, Snapshot, DiffLive, VerifyLocal, SyncUp, DownloadTar, WriteAt, Append and ResumePut
+// fail with errs.NotSupport. The other ops go to inner, Usage reports the sizes stored. It fails
+// if the zstd codec can't be set up
+func NewCompressed(inner FileSystem, opts CompressOptions) (FileSystem, error) {
+	if opts.Codec == 0 {
+		opts.Codec = CodecZstd
+	}
+	if opts.FrameSize <= 0 {
+		opts.FrameSize = defaultFrameSize
+	}
+	opts.FrameSize = min(opts.FrameSize, maxFrameSize)
+	if opts.MinSize <= 0 {
+		opts.MinSize = defaultCompressMin
+	}
+	if opts.SkipTypes == nil {
+		opts.SkipTypes = defaultSkipTypes
+	}
+	// EncodeAll and DecodeAll may be called concurrently
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to set up the zstd encoder")
+	}
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecodeAllCapLimit(true))
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to set up the zstd decoder")
+	}
+	return &compressed{
+		FileSystem: inner,
+		opts:       opts,
+		zenc:       enc,
+		zdec:       dec,
+		indexes:    newLRUCache[*frameIndex](defaultFrameIndexes),
+	}, nil
+}
+
+// compressed is the FileSystem of NewCompressed, the ops not overridden are of inner
+type compressed struct {
+	FileSystem
+	opts CompressOptions
+	zenc *zstd.Encoder
+	zdec *zstd.Decoder
+	// indexes are the indexes of the objects read, by name
+	indexes *lruCache[*frameIndex]
+}
+
+func notCompressed(op string) error {
+	return errors.WithMessagef(errs.NotSupport, "%s of a compressed FileSystem", op)
+}
+
+// frameIndex locates the frames of an object
+type frameIndex struct {
+	// stored and modified are those of the object indexed
+	stored   int64
+	modified time.Time
+	// framed is unset for an object of inner without footer, read as is
+	framed bool
+	codec  Codec
+	frame  int64
+	size   int64
+	// offsets are those of the frames in the object and of the footer, raw marks the frames
+	// kept as they are
+	offsets []int64
+	raw     []bool
+}
+
+// frameLen is the size of the content of frame n
+func (x *frameIndex) frameLen(n int) int64 {
+	return min(x.frame, x.size-int64(n)*x.frame)
+}
+
+// parseFrameIndex parses the footer ending tail, the object is of stored bytes. It returns
+// the number of bytes of footer needed if tail is too short, nil if there's no valid footer
+func parseFrameIndex(tail []byte, stored int64) (*frameIndex, int) {
+	if len(tail) < frameTrailerSize {
+		return nil, 0
+	}
+	t := tail[len(tail)-frameTrailerSize:]
+	if string(t[17:17+len(frameMagic)]) != frameMagic || t[17+len(frameMagic)] != frameVersion {
+		return nil, 0
+	}
+	x := &frameIndex{
+		framed: true,
+		frame:  int64(binary.BigEndian.Uint32(t[4:8])),
+		size:   int64(binary.BigEndian.Uint64(t[8:16])),
+		codec:  Codec(t[16]),
+	}
+	count := int64(binary.BigEndian.Uint32(t[0:4]))
+	if x.frame <= 0 || x.size < 0 || count != (x.size+x.frame-1)/x.frame ||
+		(x.codec != CodecZstd && x.codec != CodecGzip) {
+		return nil, 0
+	}
+	need := int64(frameTrailerSize) + 4*count
+	if need > stored {
+		return nil, 0
+	}
+	if need > int64(len(tail)) {
+		return nil, int(need)
+	}
+	lens := tail[int64(len(tail))-need:]
+	x.offsets = make([]int64, count+1)
+	x.raw = make([]bool, count)
+	for n := range x.raw {
+		l := binary.BigEndian.Uint32(lens[4*n:])
+		x.raw[n] = l&frameRaw != 0
+		x.offsets[n+1] = x.offsets[n] + int64(l&^frameRaw)
+	}
+	if x.offsets[count]+need != stored {
+		return nil, 0
+	}
+	return x, 0
+}
+
+// index returns the index of the object name of inner, of stored bytes modified at modified
+func (c *compressed) index(ctx context.Context, name string, stored int64, modified time.Time) (*frameIndex, error) {
+	if x, ok := c.indexes.Get(name); ok && x.stored == stored && x.modified.Equal(modified) {
+		return x, nil
+	}
+	x := &frameIndex{size: stored}
+	if stored >= int64(frameTrailerSize) {
+		tail, err := c.readTail(ctx, name, stored, min(stored, frameTailRead))
+		if err != nil {
+			return nil, err
+		}
+		framed, need := parseFrameIndex(tail, stored)
+		if need > 0 {
+			if tail, err = c.readTail(ctx, name, stored, int64(need)); err != nil {
+				return nil, err
+			}
+			framed, _ = parseFrameIndex(tail, stored)
+		}
+		if framed != nil {
+			x = framed
+		}
+	}
+	x.stored, x.modified = stored, modified
+	c.indexes.Set(name, x, frameIndexTTL)
+	return x, nil
+}
+
+func (c *compressed) readTail(ctx context.Context, name string, stored, n int64) ([]byte, error) {
+	rc, err := c.FileSystem.Read(ctx, name, stored-n, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	tail := make([]byte, n)
+	if _, err := io.ReadFull(rc, tail); err != nil {
+		return nil, errors.WithMessagef(err, "failed to read the footer of [%s]", name)
+	}
+	return tail, nil
+}
+
+// stat returns the info of name with the size of its content and its index
+func (c *compressed) stat(ctx context.Context, name string) (ObjInfo, *frameIndex, error) {
+	info, err := c.FileSystem.Stat(ctx, name)
+	if err != nil || info.IsDir {
+		return info, nil, err
+	}
+	x, err := c.index(ctx, name, info.Size, info.Modified)
+	if err != nil {
+		return ObjInfo{}, nil, err
+	}
+	return c.info(info, x), x, nil
+}
+
+func (c *compressed) info(info ObjInfo, x *frameIndex) ObjInfo {
+	if x.framed {
+		info.Size = x.size
+		info.Hashes = utils.NewHashInfo(nil, "")
+	}
+	return info
+}
+
+// skipped reports whether the object name whose content starts with head is stored as is
+func (c *compressed) skipped(name string, head []byte) bool {
+	types := []string{http.DetectContentType(head)}
+	if t := mime.TypeByExtension(stdpath.Ext(name)); t != "" {
+		types = append(types, t)
+	}
+	for _, t := range types {
+		for _, prefix := range c.opts.SkipTypes {
+			if strings.HasPrefix(t, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// encode returns the frames of body and their footer, the frames are kept as they are if body
+// is below opts.MinSize or of opts.SkipTypes
+func (c *compressed) encode(name string, body io.Reader) (*frameEncoder, error) {
+	head := make([]byte, c.opts.MinSize)
+	n, err := io.ReadFull(body, head)
+	small := err == io.EOF || err == io.ErrUnexpectedEOF
+	if err != nil && !small {
+		return nil, err
+	}
+	enc := &frameEncoder{c: c, r: io.MultiReader(bytes.NewReader(head[:n]), body), buf: make([]byte, c.opts.FrameSize)}
+	enc.raw = small || c.skipped(name, head)
+	return enc, nil
+}
+
+// rawStoredSize is the size stored for a content of size bytes whose frames are kept as they are
+func (c *compressed) rawStoredSize(size int64) int64 {
+	count := (size + int64(c.opts.FrameSize) - 1) / int64(c.opts.FrameSize)
+	return size + 4*count + int64(frameTrailerSize)
+}
+
+// frameEncoder reads the frames of r then the footer
+type frameEncoder struct {
+	c    *compressed
+	r    io.Reader
+	buf  []byte
+	out  []byte
+	lens []uint32
+	gz   *gzip.Writer
+	// raw keeps the frames as they are
+	raw bool
+	// size is the size of the content read
+	size int64
+	done bool
+}
+
+func (f *frameEncoder) Read(p []byte) (int, error) {
+	for len(f.out) == 0 {
+		if f.done {
+			return 0, io.EOF
+		}
+		if err := f.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, f.out)
+	f.out = f.out[n:]
+	return n, nil
+}
+
+// next compresses the next frame into out, the footer too once r is read
+func (f *frameEncoder) next() error {
+	n, err := io.ReadFull(f.r, f.buf)
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		f.done = true
+	default:
+		return err
+	}
+	f.out = f.out[:0]
+	if n > 0 {
+		frame := f.buf[:n]
+		var packed []byte
+		if !f.raw {
+			var err error
+			if packed, err = f.pack(frame); err != nil {
+				return err
+			}
+		}
+		if !f.raw && len(packed) < n {
+			f.out = append(f.out, packed...)
+			f.lens = append(f.lens, uint32(len(packed)))
+		} else {
+			f.out = append(f.out, frame...)
+			f.lens = append(f.lens, uint32(n)|frameRaw)
+		}
+		f.size += int64(n)
+	}
+	if f.done {
+		for _, l := range f.lens {
+			f.out = binary.BigEndian.AppendUint32(f.out, l)
+		}
+		f.out = binary.BigEndian.AppendUint32(f.out, uint32(len(f.lens)))
+		f.out = binary.BigEndian.AppendUint32(f.out, uint32(len(f.buf)))
+		f.out = binary.BigEndian.AppendUint64(f.out, uint64(f.size))
+		f.out = append(f.out, byte(f.c.opts.Codec))
+		f.out = append(f.out, frameMagic...)
+		f.out = append(f.out, frameVersion, 0)
+	}
+	return nil
+}
+
+func (f *frameEncoder) pack(frame []byte) ([]byte, error) {
+	if f.c.opts.Codec == CodecZstd {
+		return f.c.zenc.EncodeAll(frame, nil), nil
+	}
+	var b bytes.Buffer
+	if f.gz == nil {
+		f.gz = gzip.NewWriter(&b)
+	} else {
+		f.gz.Reset(&b)
+	}
+	if _, err := f.gz.Write(frame); err != nil {
+		return nil, err
+	}
+	if err := f.gz.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// frameDecoder reads the content of the frames read from r, starting at frame n
+type frameDecoder struct {
+	r    io.ReadCloser
+	c    *compressed
+	x    *frameIndex
+	name string
+	n    int
+	skip int64
+	left int64
+	buf  []byte
+	out  []byte
+	gz   *gzip.Reader
+}
+
+func (d *frameDecoder) Read(p []byte) (int, error) {
+	if d.left == 0 {
+		return 0, io.EOF
+	}
+	for len(d.out) == 0 {
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.out[:min(int64(len(d.out)), d.left)])
+	d.out = d.out[n:]
+	d.left -= int64(n)
+	return n, nil
+}
+
+// next decompresses frame n into out
+func (d *frameDecoder) next() error {
+	stored := d.x.offsets[d.n+1] - d.x.offsets[d.n]
+	if int64(cap(d.buf)) < stored {
+		d.buf = make([]byte, stored)
+	}
+	buf := d.buf[:stored]
+	if _, err := io.ReadFull(d.r, buf); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errors.WithMessagef(ErrCorruptFrame, "frame %d of [%s] truncated", d.n, d.name)
+		}
+		return err
+	}
+	want := d.x.frameLen(d.n)
+	plain := buf
+	if !d.x.raw[d.n] {
+		var err error
+		if plain, err = d.unpack(buf, want); err != nil {
+			return errors.WithMessagef(ErrCorruptFrame, "frame %d of [%s]: %v", d.n, d.name, err)
+		}
+	}
+	if int64(len(plain)) != want {
+		return errors.WithMessagef(ErrCorruptFrame, "frame %d of [%s] is of %d bytes", d.n, d.name, len(plain))
+	}
+	d.out = plain[d.skip:]
+	d.skip = 0
+	d.n++
+	return nil
+}
+
+func (d *frameDecoder) unpack(packed []byte, want int64) ([]byte, error) {
+	if d.x.codec == CodecZstd {
+		// the cap limits what's decoded, against the frames claiming more
+		return d.c.zdec.DecodeAll(packed, make([]byte, 0, want))
+	}
+	var err error
+	if d.gz == nil {
+		d.gz, err = gzip.NewReader(bytes.NewReader(packed))
+	} else {
+		err = d.gz.Reset(bytes.NewReader(packed))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(io.LimitReader(d.gz, want+1))
+}
+
+func (d *frameDecoder) Close() error {
+	return d.r.Close()
+}
+
+func (c *compressed) Read(ctx context.Context, name string, off, limit int64) (io.ReadCloser, error) {
+	if off < 0 {
+		return nil, errors.WithMessagef(ErrInvalidRange, "negative offset %d", off)
+	}
+	info, x, err := c.stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir {
+		return nil, errors.WithStack(errs.NotFile)
+	}
+	if !x.framed {
+		return c.FileSystem.Read(ctx, name, off, limit)
+	}
+	if off >= x.size {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	if limit <= 0 || limit > x.size-off {
+		limit = x.size - off
+	}
+	first := int(off / x.frame)
+	last := int((off + limit - 1) / x.frame)
+	start := x.offsets[first]
+	rc, err := c.FileSystem.Read(ctx, name, start, x.offsets[last+1]-start)
+	if err != nil {
+		return nil, err
+	}
+	return &frameDecoder{
+		r:    rc,
+		c:    c,
+		x:    x,
+		name: name,
+		n:    first,
+		skip: off - int64(first)*x.frame,
+		left: limit,
+	}, nil
+}
+
+func (c *compressed) Open(ctx context.Context, name string) (io.ReadSeekCloser, error) {
+	info, x, err := c.stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir {
+		return nil, errors.WithStack(errs.NotFile)
+	}
+	if !x.framed {
+		return c.FileSystem.Open(ctx, name)
+	}
+	return &rangeFile{ctx: ctx, fsys: c, name: name, size: info.Size}, nil
+}
+
+func (c *compressed) OpenReaderAt(ctx context.Context, name string) (io.ReaderAt, io.Closer, error) {
+	info, x, err := c.stat(ctx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.IsDir {
+		return nil, nil, errors.WithStack(errs.NotFile)
+	}
+	if !x.framed {
+		return c.FileSystem.OpenReaderAt(ctx, name)
+	}
+	return &rangeReaderAt{ctx: ctx, fsys: c, name: name, size: info.Size}, io.NopCloser(nil), nil
+}
+
+func (c *compressed) Put(ctx context.Context, name string, body io.Reader) error {
+	_, err := c.PutWithOptions(ctx, name, body)
+	return err
+}
+
+func (c *compressed) PutWithSize(ctx context.Context, name string, body io.Reader, size int64) error {
+	_, err := c.PutWithOptions(ctx, name, body, WithSize(size))
+	return err
+}
+
+func (c *compressed) PutResult(ctx context.Context, name string, body io.Reader) (ObjInfo, error) {
+	return c.PutWithOptions(ctx, name, body)
+}
+
+// PutWithHash drops hashes, they aren't those of the object stored
+func (c *compressed) PutWithHash(ctx context.Context, name string, size int64, hashes utils.HashInfo, body io.Reader) error {
+	_, err := c.PutWithOptions(ctx, name, body, WithSize(size), WithHashes(hashes))
+	return err
+}
+
+// putCompressedOptions returns opts for an object of stored bytes, -1 if unknown, and drops the
+// hashes of the content
+func putCompressedOptions(opts []PutOption, stored int64) []PutOption {
+	o := newPutOptions(opts)
+	o.size, o.sized = stored, stored >= 0
+	if !o.sized {
+		o.size = 0
+	}
+	o.hashes = utils.HashInfo{}
+	return []PutOption{func(p *putOptions) { *p = o }}
+}
+
+func (c *compressed) PutWithOptions(ctx context.Context, name string, body io.Reader, opts ...PutOption) (ObjInfo, error) {
+	enc, err := c.encode(name, body)
+	if err != nil {
+		return ObjInfo{}, err
+	}
+	stored := int64(-1)
+	if o := newPutOptions(opts); enc.raw && o.sized {
+		stored = c.rawStoredSize(o.size)
+	}
+	info, err := c.FileSystem.PutWithOptions(ctx, name, enc, putCompressedOptions(opts, stored)...)
+	c.indexes.Del(name)
+	if err != nil {
+		return ObjInfo{}, err
+	}
+	info.Size = enc.size
+	info.Hashes = utils.NewHashInfo(nil, "")
+	return info, nil
+}
+
+func (c *compressed) PutIfAbsent(ctx context.Context, name string, body io.Reader) error {
+	enc, err := c.encode(name, body)
+	if err != nil {
+		return err
+	}
+	defer c.indexes.Del(name)
+	return c.FileSystem.PutIfAbsent(ctx, name, enc)
+}
+
+// PutBatch puts the items below opts.MinSize with the sizes they're stored with, the others with
+// none as it's known once they're opened only
+func (c *compressed) PutBatch(ctx context.Context, items []PutItem, parallel int) []error {
+	inner := make([]PutItem, len(items))
+	for n, item := range items {
+		c.indexes.Del(item.Name)
+		stored := int64(-1)
+		if item.Size >= 0 && item.Size < int64(c.opts.MinSize) {
+			stored = c.rawStoredSize(item.Size)
+		}
+		open, name := item.Open, item.Name
+		inner[n] = PutItem{
+			Name: name,
+			Size: stored,
+			Open: func() (io.ReadCloser, error) {
+				rc, err := open()
+				if err != nil {
+					return nil, err
+				}
+				enc, err := c.encode(name, rc)
+				if err != nil {
+					_ = rc.Close()
+					return nil, err
+				}
+				return struct {
+					io.Reader
+					io.Closer
+				}{enc, rc}, nil
+			},
+			Opts: putCompressedOptions(item.Opts, stored),
+		}
+	}
+	defer func() {
+		for _, item := range items {
+			c.indexes.Del(item.Name)
+		}
+	}()
+	return c.FileSystem.PutBatch(ctx, inner, parallel)
+}
+
+func (c *compressed) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	w, err := c.FileSystem.Create(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	c.indexes.Del(name)
+	pr, pw := io.Pipe()
+	cw := &pipeWriter{pw: pw, w: w, done: make(chan error, 1)}
+	go func() {
+		enc, err := c.encode(name, pr)
+		if err == nil {
+			_, err = io.Copy(w, enc)
+		}
+		pr.CloseWithError(err)
+		cw.done <- err
+	}()
+	return cw, nil
+}
+
+func (c *compressed) Stat(ctx context.Context, name string) (ObjInfo, error) {
+	info, _, err := c.stat(ctx, name)
+	return info, err
+}
+
+// Hashes reports none for an object compressed, those of inner are of the object stored
+func (c *compressed) Hashes(ctx context.Context, name string) (map[*utils.HashType]string, error) {
+	info, x, err := c.stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir || !x.framed {
+		return c.FileSystem.Hashes(ctx, name)
+	}
+	return map[*utils.HashType]string{}, nil
+}
+
+func (c *compressed) List(ctx context.Context, dir string, opts ...ListOption) ([]Entry, error) {
+	var entries []Entry
+	err := c.ListIter(ctx, dir, func(e Entry) error {
+		entries = append(entries, e)
+		return nil
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// ListIter applies the filters to the sizes of the content, reading the footer of each file
+// whose index isn't cached: that's a ranged read of up to 4KiB per file, so the first listing
+// of a dir of many files costs as many reads. A file gone since listed is left out
+func (c *compressed) ListIter(ctx context.Context, dir string, fn func(Entry) error, opts ...ListOption) error {
+	o := newListOptions(opts)
+	var (
+		held    []Entry
+		stopped error
+	)
+	err := c.FileSystem.ListIter(ctx, dir, func(e Entry) error {
+		if !e.IsDir {
+			x, err := c.index(ctx, stdpath.Join(dir, e.Name), e.Size, e.Modified)
+			if errs.IsObjectNotFound(err) {
+				return nil
+			}
+			if err != nil {
+				stopped = err
+				return err
+			}
+			if x.framed {
+				e.Size = x.size
+				e.Hashes = utils.NewHashInfo(nil, "")
+			}
+		}
+		if !o.keepEntry(e.IsDir, e.Size, e.Modified) {
+			return nil
+		}
+		if o.sorted() {
+			held = append(held, e)
+			return nil
+		}
+		if err := fn(e); err != nil {
+			stopped = err
+			return err
+		}
+		return nil
+	})
+	if stopped != nil {
+		return stopped
+	}
+	if err != nil {
+		return err
+	}
+	o.sort(held)
+	for _, e := range held {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *compressed) Walk(ctx context.Context, root string, fn fs.WalkDirFunc) error {
+	return c.FileSystem.Walk(ctx, root, func(p string, d fs.DirEntry, err error) error {
+		if d == nil || d.IsDir() {
+			return fn(p, d, err)
+		}
+		info, ierr := d.Info()
+		if ierr != nil {
+			return fn(p, d, ierr)
+		}
+		x, ierr := c.index(ctx, p, info.Size(), info.ModTime())
+		if ierr != nil {
+			return fn(p, d, ierr)
+		}
+		if !x.framed {
+			return fn(p, d, err)
+		}
+		return fn(p, fs.FileInfoToDirEntry(newFileInfo(p, x.size, info.ModTime(), false)), err)
+	})
+}
+
+func (c *compressed) Delete(ctx context.Context, name string) error {
+	defer c.indexes.Del(name)
+	return c.FileSystem.Delete(ctx, name)
+}
+
+func (c *compressed) DeleteBatch(ctx context.Context, names []string, parallel int) map[string]error {
+	defer func() {
+		for _, name := range names {
+			c.indexes.Del(name)
+		}
+	}()
+	return c.FileSystem.DeleteBatch(ctx, names, parallel)
+}
+
+func (c *compressed) RemoveAll(ctx context.Context, dir string) error {
+	defer c.indexes.DelTree(dir)
+	return c.FileSystem.RemoveAll(ctx, dir)
+}
+
+func (c *compressed) Rename(ctx context.Context, name, newName string) error {
+	defer c.indexes.DelTree(name)
+	return c.FileSystem.Rename(ctx, name, newName)
+}
+
+func (c *compressed) Move(ctx context.Context, src, dstDir string) error {
+	defer c.indexes.DelTree(src)
+	return c.FileSystem.Move(ctx, src, dstDir)
+}
+
+func (c *compressed) RestoreVersion(ctx context.Context, name, version string) error {
+	defer c.indexes.Del(name)
+	return c.FileSystem.RestoreVersion(ctx, name, version)
+}
+
+func (c *compressed) ListObjects(context.Context, string, string, int) ([]Entry, string, error) {
+	return nil, "", notCompressed("list objects")
+}
+
+func (c *compressed) Snapshot(context.Context, string, io.Writer) error {
+	return notCompressed("snapshot")
+}
+
+func (c *compressed) DiffLive(context.Context, string, *SnapshotReader, func(DiffEntry) error) error {
+	return notCompressed("diff")
+}
+
+func (c *compressed) VerifyLocal(context.Context, string, string, VerifyOptions) (Report, error) {
+	return Report{}, notCompressed("verify")
+}
+
+func (c *compressed) SyncUp(context.Context, string, string, SyncOptions) (SyncReport, error) {
+	return SyncReport{}, notCompressed("syncup")
+}
+
+func (c *compressed) DownloadTar(context.Context, string, io.Writer, ...TarOption) error {
+	return notCompressed("tar")
+}
+
+func (c *compressed) WriteAt(context.Context, string, int64, []byte) error {
+	return notCompressed("writeat")
+}
+
+func (c *compressed) Append(context.Context, string, io.Reader) error {
+	return notCompressed("append")
+}
+
+func (c *compressed) ResumePut(context.Context, string, []byte, io.ReadSeeker, ...PutOption) error {
+	return notCompressed("resume")
+}
@@ -0,0 +1,102 @@
+package export
+
+import (
+	"context"
+	"io/fs"
+	stdpath "path"
+	"strconv"
+	"strings"
+
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/alist-org/alist/v3/internal/model"
+	"github.com/pkg/errors"
+)
+
+// ErrExist is returned by the puts failing by ConflictFail, it matches fs.ErrExist
+var ErrExist = errors.WithMessage(fs.ErrExist, "object exists")
+
+// ConflictPolicy tells what a put does when an object exists at its name
+type ConflictPolicy int
+
+const (
+	// ConflictDriver leaves it to the driver, which may overwrite the object,
+	// create a duplicate or fail
+	ConflictDriver ConflictPolicy = iota
+	// ConflictOverwrite replaces the object. The upload goes to a temporary object like by
+	// WithAtomicPut, or to its parts, and the object is removed only once it succeeded, before
+	// the upload only if the driver can neither rename nor move
+	ConflictOverwrite
+	// ConflictFail fails the put with ErrExist before any of the body is read
+	ConflictFail
+	// ConflictKeepBoth puts to the name with the first free suffix, like "a (1).txt",
+	// the name used is reported by PutResult and PutWithOptions
+	ConflictKeepBoth
+)
+
+// maxConflictSuffix is the largest suffix tried by ConflictKeepBoth
+const maxConflictSuffix = 1000
+
+// WithConflictPolicy sets what the puts do when an object exists at their names, which can be
+// set for a single put by WithConflict. The objects are looked up through the cache, so the
+// common case of a new name costs no more than a lookup of the dir listed. The default is ConflictDriver
+func WithConflictPolicy(p ConflictPolicy) Option {
+	return func(c *config) {
+		c.conflict = p
+	}
+}
+
+// WithConflict sets what the put does when an object exists at its name instead of WithConflictPolicy
+func WithConflict(p ConflictPolicy) PutOption {
+	return func(o *putOptions) {
+		o.conflict = &p
+	}
+}
+
+// conflictPolicy returns the policy of a put with o
+func (i *Impl) conflictPolicy(o putOptions) ConflictPolicy {
+	if o.conflict != nil {
+		return *o.conflict
+	}
+	return i.conf.conflict
+}
+
+// resolveConflict returns the path to put to by p instead of path, and the object existing at it
+// which is replaced, if any
+func (i *Impl) resolveConflict(ctx context.Context, path string, p ConflictPolicy) (string, model.Obj, error) {
+	old, err := i.get(ctx, path)
+	if errs.IsObjectNotFound(err) {
+		return path, nil, nil
+	}
+	if err != nil {
+		return "", nil, errors.WithMessagef(err, "failed to check [%s]", path)
+	}
+	switch p {
+	case ConflictFail:
+		return "", nil, errors.WithMessagef(ErrExist, "[%s]", path)
+	case ConflictKeepBoth:
+		for n := 1; n <= maxConflictSuffix; n++ {
+			p := conflictName(path, n)
+			if _, err := i.get(ctx, p); errs.IsObjectNotFound(err) {
+				return p, nil, nil
+			} else if err != nil {
+				return "", nil, errors.WithMessagef(err, "failed to check [%s]", p)
+			}
+		}
+		return "", nil, errors.WithMessagef(ErrExist, "[%s] and its %d suffixes", path, maxConflictSuffix)
+	}
+	if old.IsDir() {
+		return "", nil, errors.WithMessagef(errs.NotFile, "[%s] is a dir", path)
+	}
+	return path, old, nil
+}
+
+// conflictName returns path with the suffix n before its extension
+func conflictName(path string, n int) string {
+	dir, name := stdpath.Split(path)
+	ext := stdpath.Ext(name)
+	// a leading dot starts the name, not the extension
+	if ext == name {
+		ext = ""
+	}
+	return dir + strings.TrimSuffix(name, ext) + " (" + strconv.Itoa(n) + ")" + ext
+}
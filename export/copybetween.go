@@ -0,0 +1,88 @@
+package export
+
+import (
+	"context"
+	"io/fs"
+	"sync"
+
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/pkg/errors"
+)
+
+// CopyBetween copies the file name of src to the same name in dst: src.Read is piped into
+// dst.PutWithOptions with the size, mtime and hashes of the file, so it's never buffered unless
+// dst has to hash it. opts are given to the put, and each side retries as it's configured to.
+// The size of the object put is verified afterwards and ErrSizeMismatch is returned if it differs
+func CopyBetween(ctx context.Context, src, dst FileSystem, name string, opts ...PutOption) error {
+	_, err := copyBetween(ctx, src, dst, name, opts...)
+	return err
+}
+
+// copyBetween is CopyBetween returning the object put
+func copyBetween(ctx context.Context, src, dst FileSystem, name string, opts ...PutOption) (ObjInfo, error) {
+	info, err := src.Stat(ctx, name)
+	if err != nil {
+		return ObjInfo{}, err
+	}
+	if info.IsDir {
+		return ObjInfo{}, errors.WithMessagef(errs.NotFile, "failed to copy [%s]", name)
+	}
+	rc, err := src.Read(ctx, name, 0, 0)
+	if err != nil {
+		return ObjInfo{}, err
+	}
+	defer rc.Close()
+	put := append([]PutOption{WithSize(info.Size), WithModTime(info.Modified), WithHashes(info.Hashes)}, opts...)
+	out, err := dst.PutWithOptions(ctx, name, rc, put...)
+	if err != nil {
+		return ObjInfo{}, err
+	}
+	if err := rc.Close(); err != nil {
+		return ObjInfo{}, errors.WithMessagef(err, "failed to read [%s]", name)
+	}
+	if out.Size != info.Size {
+		return ObjInfo{}, errors.WithMessagef(ErrSizeMismatch, "[%s] has %d bytes instead of %d", name, out.Size, info.Size)
+	}
+	return out, nil
+}
+
+// CopyTreeBetween copies the tree at dir of src to the same dir in dst by CopyBetween, up to
+// parallel files at once, the dirs being made as they're walked so the empty ones are kept.
+// The objects removed while walked and the dirs walked again are skipped. It returns the errors
+// of the objects which failed by their names, and the error of walking src
+func CopyTreeBetween(ctx context.Context, src, dst FileSystem, dir string, parallel int, opts ...PutOption) (map[string]error, error) {
+	if parallel <= 0 {
+		parallel = defaultPutParallel
+	}
+	failed := map[string]error{}
+	var files []string
+	err := src.Walk(ctx, dir, func(name string, d fs.DirEntry, err error) error {
+		if errors.Is(err, ErrWalkLoop) || err != nil && d != nil && errs.IsObjectNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			files = append(files, name)
+			return nil
+		}
+		if err := dst.Mkdir(ctx, name); err != nil {
+			failed[name] = err
+			return fs.SkipDir
+		}
+		return nil
+	})
+	var mu sync.Mutex
+	forEach(ctx, parallel, len(files), func(n int) {
+		if err := CopyBetween(ctx, src, dst, files[n], opts...); err != nil {
+			mu.Lock()
+			defer mu.Unlock()
+			failed[files[n]] = err
+		}
+	})
+	if err == nil {
+		err = errors.WithStack(ctx.Err())
+	}
+	return failed, err
+}
@@ -0,0 +1,972 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	stdpath "path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/alist-org/alist/v3/internal/stream"
+	"github.com/alist-org/alist/v3/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+// DedupOptions configures NewDedup
+type DedupOptions struct {
+	// CompactEvery is how many records the log of the ledger holds before they're folded into
+	// the ledger, 256 if <= 0
+	CompactEvery int
+}
+
+// ErrCorruptLedger is the error of loading a dedup ledger which can't be parsed, FsckDedup
+// rebuilds it from the pointers
+var ErrCorruptLedger = errors.New("dedup ledger corrupted")
+
+const (
+	// dedupDir holds the blobs, the ledger and its log in inner, it's hidden by NewDedup
+	dedupDir          = ".blobs"
+	dedupLedgerName   = dedupDir + "/.ledger"
+	dedupLogDir       = dedupDir + "/.log"
+	dedupPointerMagic = "alist-dedup 1 "
+	// maxPointerSize bounds the objects read to tell whether they're pointers
+	maxPointerSize      = 128
+	defaultCompactEvery = 256
+	pointerTTL          = time.Hour
+	defaultPointers     = 1024
+)
+
+// NewDedup returns a FileSystem storing each content once in inner: a put hashes the body by
+// SHA-256, spooling it, puts it to .blobs/<hash> unless the blob exists and puts a pointer of
+// a few bytes at the name. Read, Open and OpenReaderAt follow the pointer, Stat, List and Walk
+// report the size of the content and its SHA-256, and .blobs is hidden from the root. The
+// objects of inner put around it are read as is.
+//
+// The references of the blobs are counted by a ledger in .blobs: each change is put as a record
+// of an append-only log, which is folded into the ledger every opts.CompactEvery records, so a
+// crash leaves the log to replay. A blob is removed once its count drops to zero. The count is
+// raised before a pointer is put and dropped after it's gone, so a crash leaks blobs rather
+// than losing one, FsckDedup rebuilds the ledger from the pointers and removes the leaks. The
+// ledger is kept in memory, so a single FileSystem must write inner at a time.
+//
+// The puts overwrite the pointer unless a ConflictPolicy is given by WithConflict. ListObjects
+// lists the pointers by the sizes of their content and hides .blobs, so s3gw serves a dedup
+// FileSystem. Snapshot, DiffLive and VerifyLocal would see the pointers rather than the content,
+// SyncUp, WriteAt, Append and ResumePut would write inner around the ledger, DownloadTar would
+// pack the pointers, and Restore, ListVersions and RestoreVersion would bring back pointers
+// whose blobs may be gone, so they fail with errs.NotSupport, as do ApplyLifecycle and
+// StartLifecycle. The other ops go to inner, Usage reports the sizes stored
+func NewDedup(inner FileSystem, opts DedupOptions) FileSystem {
+	if opts.CompactEvery <= 0 {
+		opts.CompactEvery = defaultCompactEvery
+	}
+	return &dedup{
+		FileSystem: inner,
+		opts:       opts,
+		locks:      newPathLocks(),
+		pointers:   newLRUCache[*dedupPointer](defaultPointers),
+	}
+}
+
+// dedup is the FileSystem of NewDedup, the ops not overridden are of inner
+type dedup struct {
+	FileSystem
+	opts DedupOptions
+	// locks serialize the puts and deletes by name, then by blob
+	locks *pathLocks
+	// pointers are the pointers of the objects read, by name
+	pointers *lruCache[*dedupPointer]
+
+	// mu guards the ledger, the log is written under it
+	mu     sync.Mutex
+	loaded bool
+	ledger dedupLedger
+	// logged are the names of the records not folded into the ledger yet
+	logged []string
+}
+
+// dedupLedger is the reference counts of the blobs by hash, with the seq of the last record folded
+type dedupLedger struct {
+	Seq  uint64           `json:"seq"`
+	Refs map[string]int64 `json:"refs"`
+}
+
+// dedupRecord is a change of the count of a blob in the log
+type dedupRecord struct {
+	Blob  string `json:"blob"`
+	Delta int64  `json:"delta"`
+}
+
+// dedupPointer is what an object of inner points to
+type dedupPointer struct {
+	// stored and modified are those of the object of inner
+	stored   int64
+	modified time.Time
+	// blob is empty for an object stored as is
+	blob string
+	size int64
+}
+
+func notDeduped(op string) error {
+	return errors.WithMessagef(errs.NotSupport, "%s of a dedup FileSystem", op)
+}
+
+func blobName(hash string) string {
+	return stdpath.Join(dedupDir, hash)
+}
+
+func logName(seq uint64) string {
+	return stdpath.Join(dedupLogDir, fmt.Sprintf("%020d", seq))
+}
+
+// reservedIn reports whether name is dir of the root or in it, dir being kept by a layer
+func reservedIn(name, dir string) bool {
+	p := stdpath.Clean(strings.TrimLeft(toSlash(name), "/"))
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+func dedupHidden(name string) bool {
+	return reservedIn(name, dedupDir)
+}
+
+func formatPointer(hash string, size int64) []byte {
+	return []byte(dedupPointerMagic + hash + " " + strconv.FormatInt(size, 10) + "\n")
+}
+
+// parsePointer returns the blob and size of the pointer b, ok is unset if b isn't one
+func parsePointer(b []byte) (hash string, size int64, ok bool) {
+	s, found := strings.CutPrefix(string(b), dedupPointerMagic)
+	if !found || !strings.HasSuffix(s, "\n") {
+		return "", 0, false
+	}
+	hash, sizeStr, found := strings.Cut(strings.TrimSuffix(s, "\n"), " ")
+	if !found || len(hash) != sha256.Size*2 {
+		return "", 0, false
+	}
+	if _, err := hex.DecodeString(hash); err != nil {
+		return "", 0, false
+	}
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
+	if err != nil || size < 0 {
+		return "", 0, false
+	}
+	return hash, size, true
+}
+
+// readPointer reads the object name of fsys of stored bytes if it may be a pointer
+func readPointer(ctx context.Context, fsys FileSystem, name string, stored int64) (hash string, size int64, ok bool, err error) {
+	if stored > maxPointerSize || stored < int64(len(dedupPointerMagic)) {
+		return "", 0, false, nil
+	}
+	rc, err := fsys.Read(ctx, name, 0, stored)
+	if err != nil {
+		return "", 0, false, err
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		return "", 0, false, err
+	}
+	hash, size, ok = parsePointer(b)
+	return hash, size, ok, nil
+}
+
+// pointer returns the pointer of the object name of inner, of stored bytes modified at modified
+func (d *dedup) pointer(ctx context.Context, name string, stored int64, modified time.Time) (*dedupPointer, error) {
+	if p, ok := d.pointers.Get(name); ok && p.stored == stored && p.modified.Equal(modified) {
+		return p, nil
+	}
+	hash, size, ok, err := readPointer(ctx, d.FileSystem, name, stored)
+	if err != nil {
+		return nil, err
+	}
+	p := &dedupPointer{stored: stored, modified: modified, size: stored}
+	if ok {
+		p.blob, p.size = hash, size
+	}
+	d.pointers.Set(name, p, pointerTTL)
+	return p, nil
+}
+
+// stat returns the info of name with the size of its content and its pointer
+func (d *dedup) stat(ctx context.Context, name string) (ObjInfo, *dedupPointer, error) {
+	if dedupHidden(name) {
+		return ObjInfo{}, nil, errors.WithStack(errs.ObjectNotFound)
+	}
+	info, err := d.FileSystem.Stat(ctx, name)
+	if err != nil || info.IsDir {
+		return info, nil, err
+	}
+	p, err := d.pointer(ctx, name, info.Size, info.Modified)
+	if err != nil {
+		return ObjInfo{}, nil, err
+	}
+	return p.info(info), p, nil
+}
+
+func (p *dedupPointer) info(info ObjInfo) ObjInfo {
+	if p.blob != "" {
+		info.Size = p.size
+		info.Hashes = utils.NewHashInfo(utils.SHA256, p.blob)
+	}
+	return info
+}
+
+// load reads the ledger and replays the log after it, d.mu must be held
+func (d *dedup) load(ctx context.Context) error {
+	if d.loaded {
+		return nil
+	}
+	ledger, logged, err := loadDedupLedger(ctx, d.FileSystem)
+	if err != nil {
+		return err
+	}
+	d.ledger, d.logged, d.loaded = ledger, logged, true
+	return nil
+}
+
+// loadDedupLedger reads the ledger of fsys and applies the records of the log after it, logged
+// are the names of all the records
+func loadDedupLedger(ctx context.Context, fsys FileSystem) (ledger dedupLedger, logged []string, err error) {
+	ledger.Refs = map[string]int64{}
+	if err := readJSON(ctx, fsys, dedupLedgerName, &ledger, ErrCorruptLedger); err != nil && !errs.IsObjectNotFound(err) {
+		return dedupLedger{}, nil, err
+	}
+	if ledger.Refs == nil {
+		ledger.Refs = map[string]int64{}
+	}
+	entries, err := fsys.List(ctx, dedupLogDir)
+	if err != nil && !errs.IsObjectNotFound(err) {
+		return dedupLedger{}, nil, err
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].Name < entries[b].Name })
+	for _, e := range entries {
+		seq, perr := strconv.ParseUint(e.Name, 10, 64)
+		if e.IsDir || perr != nil {
+			continue
+		}
+		name := stdpath.Join(dedupLogDir, e.Name)
+		logged = append(logged, name)
+		if seq <= ledger.Seq {
+			// folded already, the compaction was interrupted before removing it
+			continue
+		}
+		var r dedupRecord
+		if err := readJSON(ctx, fsys, name, &r, ErrCorruptLedger); err != nil {
+			return dedupLedger{}, nil, err
+		}
+		ledger.apply(r)
+		ledger.Seq = seq
+	}
+	return ledger, logged, nil
+}
+
+// readJSON reads the object name of fsys into v, failing with corrupt if it can't be parsed
+func readJSON(ctx context.Context, fsys FileSystem, name string, v any, corrupt error) error {
+	rc, err := fsys.Read(ctx, name, 0, 0)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return errors.WithMessagef(corrupt, "[%s]: %v", name, err)
+	}
+	return nil
+}
+
+func putJSON(ctx context.Context, fsys FileSystem, name string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = fsys.PutWithOptions(ctx, name, bytes.NewReader(b), WithSize(int64(len(b))), WithConflict(ConflictOverwrite))
+	return err
+}
+
+func (l *dedupLedger) apply(r dedupRecord) {
+	if l.Refs[r.Blob] += r.Delta; l.Refs[r.Blob] <= 0 {
+		delete(l.Refs, r.Blob)
+	}
+}
+
+// ref adds delta to the count of the blob hash, and returns the count
+func (d *dedup) ref(ctx context.Context, hash string, delta int64) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.load(ctx); err != nil {
+		return 0, err
+	}
+	r := dedupRecord{Blob: hash, Delta: delta}
+	seq := d.ledger.Seq + 1
+	name := logName(seq)
+	if err := putJSON(ctx, d.FileSystem, name, r); err != nil {
+		return 0, errors.WithMessage(err, "failed to log the dedup ledger")
+	}
+	d.ledger.apply(r)
+	d.ledger.Seq = seq
+	d.logged = append(d.logged, name)
+	if len(d.logged) >= d.opts.CompactEvery {
+		// the records are replayed until compacted, so a failure is left to the next record
+		_ = d.compact(ctx)
+	}
+	return d.ledger.Refs[hash], nil
+}
+
+// compact folds the log into the ledger, d.mu must be held
+func (d *dedup) compact(ctx context.Context) error {
+	if err := putJSON(ctx, d.FileSystem, dedupLedgerName, d.ledger); err != nil {
+		return errors.WithMessage(err, "failed to write the dedup ledger")
+	}
+	d.FileSystem.DeleteBatch(ctx, d.logged, 0)
+	d.logged = nil
+	return nil
+}
+
+// putBlob spools body to hash it, puts the blob unless it exists and counts a reference,
+// which is to be dropped by unref if the pointer isn't put
+func (d *dedup) putBlob(ctx context.Context, body io.Reader) (hash string, size int64, err error) {
+	h := sha256.New()
+	f, size, err := spool(ctx, io.TeeReader(body, h), stream.InMemoryBufMaxSizeBytes)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	hash = hex.EncodeToString(h.Sum(nil))
+	unlock, err := d.locks.lock(ctx, blobName(hash))
+	if err != nil {
+		return "", 0, err
+	}
+	defer unlock()
+	info, err := d.FileSystem.Stat(ctx, blobName(hash))
+	if errs.IsObjectNotFound(err) || err == nil && info.Size != size {
+		_, err = d.FileSystem.PutWithOptions(ctx, blobName(hash), f, WithSize(size), WithConflict(ConflictOverwrite))
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err := d.ref(ctx, hash, 1); err != nil {
+		return "", 0, err
+	}
+	return hash, size, nil
+}
+
+// unref drops a reference of the blob hash, removing it at zero
+func (d *dedup) unref(ctx context.Context, hash string) error {
+	unlock, err := d.locks.lock(ctx, blobName(hash))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	refs, err := d.ref(ctx, hash, -1)
+	if err != nil || refs > 0 {
+		return err
+	}
+	return d.FileSystem.Delete(ctx, blobName(hash))
+}
+
+// lockName serializes the puts and deletes of name
+func (d *dedup) lockName(ctx context.Context, name string) (func(), error) {
+	return d.locks.lock(ctx, stdpath.Join("/", stdpath.Clean(strings.TrimLeft(toSlash(name), "/"))))
+}
+
+// current returns the blob pointed to by the object name of inner, empty if there's none
+func (d *dedup) current(ctx context.Context, name string) (string, error) {
+	info, p, err := d.stat(ctx, name)
+	if errs.IsObjectNotFound(err) || err == nil && info.IsDir {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return p.blob, nil
+}
+
+func (d *dedup) PutWithOptions(ctx context.Context, name string, body io.Reader, opts ...PutOption) (ObjInfo, error) {
+	if dedupHidden(name) {
+		return ObjInfo{}, errors.WithMessagef(ErrInvalidName, "[%s] is reserved by dedup", name)
+	}
+	unlock, err := d.lockName(ctx, name)
+	if err != nil {
+		return ObjInfo{}, err
+	}
+	defer unlock()
+	o := newPutOptions(opts)
+	if o.conflict == nil {
+		o.conflict = new(ConflictPolicy)
+		*o.conflict = ConflictOverwrite
+	}
+	if *o.conflict == ConflictFail {
+		// fails before the body is spooled, like the puts of Impl
+		if ok, err := d.FileSystem.Exists(ctx, name); err != nil || ok {
+			if err == nil {
+				err = errors.WithMessagef(ErrExist, "[%s]", name)
+			}
+			return ObjInfo{}, err
+		}
+	}
+	old, err := d.current(ctx, name)
+	if err != nil {
+		return ObjInfo{}, err
+	}
+	hash, size, err := d.putBlob(ctx, body)
+	if err != nil {
+		return ObjInfo{}, err
+	}
+	pointer := formatPointer(hash, size)
+	o.size, o.sized = int64(len(pointer)), true
+	o.hashes = utils.HashInfo{}
+	info, err := d.FileSystem.PutWithOptions(ctx, name, bytes.NewReader(pointer), func(p *putOptions) { *p = o })
+	d.pointers.Del(name)
+	if err != nil {
+		if uerr := d.unref(context.WithoutCancel(ctx), hash); uerr != nil {
+			return ObjInfo{}, errors.WithMessagef(err, "and failed to unref the blob: %v", uerr)
+		}
+		return ObjInfo{}, err
+	}
+	// the old pointer is left by ConflictKeepBoth
+	if old != "" && (info.Name == "" || info.Name == stdpath.Base(name)) {
+		if err := d.unref(ctx, old); err != nil {
+			return ObjInfo{}, err
+		}
+	}
+	info.Size = size
+	info.Hashes = utils.NewHashInfo(utils.SHA256, hash)
+	return info, nil
+}
+
+func (d *dedup) Put(ctx context.Context, name string, body io.Reader) error {
+	_, err := d.PutWithOptions(ctx, name, body)
+	return err
+}
+
+func (d *dedup) PutWithSize(ctx context.Context, name string, body io.Reader, size int64) error {
+	_, err := d.PutWithOptions(ctx, name, body)
+	return err
+}
+
+func (d *dedup) PutResult(ctx context.Context, name string, body io.Reader) (ObjInfo, error) {
+	return d.PutWithOptions(ctx, name, body)
+}
+
+// PutWithHash drops hashes, the content is hashed by SHA-256 anyway
+func (d *dedup) PutWithHash(ctx context.Context, name string, size int64, hashes utils.HashInfo, body io.Reader) error {
+	_, err := d.PutWithOptions(ctx, name, body)
+	return err
+}
+
+func (d *dedup) PutIfAbsent(ctx context.Context, name string, body io.Reader) error {
+	_, err := d.PutWithOptions(ctx, name, body, WithConflict(ConflictFail))
+	return err
+}
+
+// PutBatch puts up to parallel items at once, defaultPutParallel if <= 0
+func (d *dedup) PutBatch(ctx context.Context, items []PutItem, parallel int) []error {
+	return putEach(ctx, items, parallel, d.PutWithOptions)
+}
+
+func (d *dedup) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	if dedupHidden(name) {
+		return nil, errors.WithMessagef(ErrInvalidName, "[%s] is reserved by dedup", name)
+	}
+	pr, pw := io.Pipe()
+	cw := &pipeWriter{pw: pw, w: nopWriteCloser{}, done: make(chan error, 1)}
+	go func() {
+		_, err := d.PutWithOptions(ctx, name, pr)
+		pr.CloseWithError(err)
+		cw.done <- err
+	}()
+	return cw, nil
+}
+
+// nopWriteCloser is the writer of a pipeWriter whose reader puts the content itself
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func (d *dedup) Read(ctx context.Context, name string, off, limit int64) (io.ReadCloser, error) {
+	info, p, err := d.stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir || p.blob == "" {
+		return d.FileSystem.Read(ctx, name, off, limit)
+	}
+	return d.FileSystem.Read(ctx, blobName(p.blob), off, limit)
+}
+
+func (d *dedup) Open(ctx context.Context, name string) (io.ReadSeekCloser, error) {
+	info, p, err := d.stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir || p.blob == "" {
+		return d.FileSystem.Open(ctx, name)
+	}
+	return d.FileSystem.Open(ctx, blobName(p.blob))
+}
+
+func (d *dedup) OpenReaderAt(ctx context.Context, name string) (io.ReaderAt, io.Closer, error) {
+	info, p, err := d.stat(ctx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.IsDir || p.blob == "" {
+		return d.FileSystem.OpenReaderAt(ctx, name)
+	}
+	return d.FileSystem.OpenReaderAt(ctx, blobName(p.blob))
+}
+
+func (d *dedup) Stat(ctx context.Context, name string) (ObjInfo, error) {
+	info, _, err := d.stat(ctx, name)
+	return info, err
+}
+
+// Hashes reports the SHA-256 of the content of a pointer
+func (d *dedup) Hashes(ctx context.Context, name string) (map[*utils.HashType]string, error) {
+	info, p, err := d.stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir || p.blob == "" {
+		return d.FileSystem.Hashes(ctx, name)
+	}
+	return map[*utils.HashType]string{utils.SHA256: p.blob}, nil
+}
+
+func (d *dedup) Exists(ctx context.Context, name string) (bool, error) {
+	if dedupHidden(name) {
+		return false, nil
+	}
+	return d.FileSystem.Exists(ctx, name)
+}
+
+func (d *dedup) List(ctx context.Context, dir string, opts ...ListOption) ([]Entry, error) {
+	var entries []Entry
+	err := d.ListIter(ctx, dir, func(e Entry) error {
+		entries = append(entries, e)
+		return nil
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// ListIter applies the filters to the sizes of the content, reading the pointer of each small
+// file not read yet. A file gone since listed is left out
+func (d *dedup) ListIter(ctx context.Context, dir string, fn func(Entry) error, opts ...ListOption) error {
+	if dedupHidden(dir) {
+		return errors.WithStack(errs.ObjectNotFound)
+	}
+	o := newListOptions(opts)
+	var (
+		held    []Entry
+		stopped error
+	)
+	err := d.FileSystem.ListIter(ctx, dir, func(e Entry) error {
+		if dedupHidden(stdpath.Join(dir, e.Name)) {
+			return nil
+		}
+		if !e.IsDir {
+			p, err := d.pointer(ctx, stdpath.Join(dir, e.Name), e.Size, e.Modified)
+			if errs.IsObjectNotFound(err) {
+				return nil
+			}
+			if err != nil {
+				stopped = err
+				return err
+			}
+			if p.blob != "" {
+				e.Size = p.size
+				e.Hashes = utils.NewHashInfo(utils.SHA256, p.blob)
+			}
+		}
+		if !o.keepEntry(e.IsDir, e.Size, e.Modified) {
+			return nil
+		}
+		if o.sorted() {
+			held = append(held, e)
+			return nil
+		}
+		if err := fn(e); err != nil {
+			stopped = err
+			return err
+		}
+		return nil
+	})
+	if stopped != nil {
+		return stopped
+	}
+	if err != nil {
+		return err
+	}
+	o.sort(held)
+	for _, e := range held {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *dedup) Walk(ctx context.Context, root string, fn fs.WalkDirFunc) error {
+	if dedupHidden(root) {
+		return fn(root, nil, errors.WithStack(errs.ObjectNotFound))
+	}
+	return d.FileSystem.Walk(ctx, root, func(p string, de fs.DirEntry, err error) error {
+		if dedupHidden(p) {
+			return fs.SkipDir
+		}
+		if de == nil || de.IsDir() {
+			return fn(p, de, err)
+		}
+		info, ierr := de.Info()
+		if ierr != nil {
+			return fn(p, de, ierr)
+		}
+		ptr, ierr := d.pointer(ctx, p, info.Size(), info.ModTime())
+		if ierr != nil {
+			return fn(p, de, ierr)
+		}
+		if ptr.blob == "" {
+			return fn(p, de, err)
+		}
+		return fn(p, fs.FileInfoToDirEntry(newFileInfo(p, ptr.size, info.ModTime(), false)), err)
+	})
+}
+
+func (d *dedup) Glob(ctx context.Context, pattern string) ([]string, error) {
+	matches, err := d.FileSystem.Glob(ctx, pattern)
+	if err != nil {
+		return nil, err
+	}
+	kept := matches[:0]
+	for _, m := range matches {
+		if !dedupHidden(m) {
+			kept = append(kept, m)
+		}
+	}
+	return kept, nil
+}
+
+// Delete removes the pointer name then drops the reference of its blob
+func (d *dedup) Delete(ctx context.Context, name string) error {
+	if dedupHidden(name) {
+		return nil
+	}
+	unlock, err := d.lockName(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	hash, err := d.current(ctx, name)
+	if err != nil {
+		return err
+	}
+	err = d.FileSystem.Delete(ctx, name)
+	d.pointers.Del(name)
+	if err != nil || hash == "" {
+		return err
+	}
+	return d.unref(ctx, hash)
+}
+
+func (d *dedup) DeleteBatch(ctx context.Context, names []string, parallel int) map[string]error {
+	return deleteEach(ctx, names, parallel, d.Delete)
+}
+
+// RemoveAll deletes the files of dir one by one so that their blobs are unreferenced, then
+// removes what's left
+func (d *dedup) RemoveAll(ctx context.Context, dir string) error {
+	if dedupHidden(dir) {
+		return nil
+	}
+	var files []string
+	err := d.Walk(ctx, dir, func(p string, de fs.DirEntry, err error) error {
+		if errs.IsObjectNotFound(err) && de == nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !de.IsDir() {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for name, err := range d.DeleteBatch(ctx, files, 0) {
+		return errors.WithMessagef(err, "failed to delete %d files, like [%s]", len(files), name)
+	}
+	defer d.pointers.DelTree(dir)
+	return d.FileSystem.RemoveAll(ctx, dir)
+}
+
+func (d *dedup) Rename(ctx context.Context, name, newName string) error {
+	if dedupHidden(name) || dedupHidden(newName) {
+		return errors.WithMessagef(ErrInvalidName, "[%s] is reserved by dedup", dedupDir)
+	}
+	defer d.pointers.DelTree(name)
+	return d.FileSystem.Rename(ctx, name, newName)
+}
+
+func (d *dedup) Move(ctx context.Context, src, dstDir string) error {
+	if dedupHidden(src) || dedupHidden(dstDir) {
+		return errors.WithMessagef(ErrInvalidName, "[%s] is reserved by dedup", dedupDir)
+	}
+	defer d.pointers.DelTree(src)
+	return d.FileSystem.Move(ctx, src, dstDir)
+}
+
+// Copy counts a reference for each pointer copied before copying, a copy failed leaks them
+// until FsckDedup
+func (d *dedup) Copy(ctx context.Context, src, dstDir string) error {
+	if dedupHidden(src) || dedupHidden(dstDir) {
+		return errors.WithMessagef(ErrInvalidName, "[%s] is reserved by dedup", dedupDir)
+	}
+	var blobs []string
+	err := d.Walk(ctx, src, func(p string, de fs.DirEntry, err error) error {
+		if err != nil || de.IsDir() {
+			return err
+		}
+		hash, err := d.current(ctx, p)
+		if hash != "" {
+			blobs = append(blobs, hash)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, hash := range blobs {
+		if _, err := d.ref(ctx, hash, 1); err != nil {
+			return err
+		}
+	}
+	return d.FileSystem.Copy(ctx, src, dstDir)
+}
+
+// Restore fails, the content of an object deleted isn't kept
+func (d *dedup) Restore(context.Context, string) error {
+	return notDeduped("restore")
+}
+
+// ListVersions fails, the content of an object replaced isn't kept
+func (d *dedup) ListVersions(context.Context, string) ([]Version, error) {
+	return nil, notDeduped("versions")
+}
+
+func (d *dedup) RestoreVersion(context.Context, string, string) error {
+	return notDeduped("versions")
+}
+
+func (d *dedup) ApplyLifecycle(context.Context, []LifecycleRule) (LifecycleReport, error) {
+	return LifecycleReport{}, notDeduped("lifecycle")
+}
+
+func (d *dedup) StartLifecycle([]LifecycleRule, time.Duration) error {
+	return notDeduped("lifecycle")
+}
+
+// ListObjects lists the objects of inner by the sizes of their content, skipping the keys of
+// .blobs. A page of inner full of them is followed by the next one, past .blobs at once
+func (d *dedup) ListObjects(ctx context.Context, prefix, startAfter string, limit int) ([]Entry, string, error) {
+	if strings.HasPrefix(strings.TrimLeft(toSlash(prefix), "/"), dedupDir+"/") {
+		return nil, "", nil
+	}
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+	var entries []Entry
+	marker := startAfter
+	for {
+		page, next, err := d.FileSystem.ListObjects(ctx, prefix, marker, limit-len(entries))
+		if err != nil {
+			return nil, "", err
+		}
+		for _, e := range page {
+			if dedupHidden(e.Name) {
+				continue
+			}
+			p, err := d.pointer(ctx, e.Name, e.Size, e.Modified)
+			if errs.IsObjectNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return nil, "", err
+			}
+			if p.blob != "" {
+				e.Size = p.size
+				e.Hashes = utils.NewHashInfo(utils.SHA256, p.blob)
+			}
+			entries = append(entries, e)
+		}
+		if next == "" {
+			return entries, "", nil
+		}
+		if len(entries) == limit {
+			return entries, entries[len(entries)-1].Name, nil
+		}
+		marker = next
+		if dedupHidden(marker) {
+			// the keys of .blobs are before any key after it
+			marker = dedupDir + "/\xff"
+		}
+	}
+}
+
+func (d *dedup) Snapshot(context.Context, string, io.Writer) error {
+	return notDeduped("snapshot")
+}
+
+func (d *dedup) DiffLive(context.Context, string, *SnapshotReader, func(DiffEntry) error) error {
+	return notDeduped("diff")
+}
+
+func (d *dedup) VerifyLocal(context.Context, string, string, VerifyOptions) (Report, error) {
+	return Report{}, notDeduped("verify")
+}
+
+func (d *dedup) SyncUp(context.Context, string, string, SyncOptions) (SyncReport, error) {
+	return SyncReport{}, notDeduped("syncup")
+}
+
+func (d *dedup) DownloadTar(context.Context, string, io.Writer, ...TarOption) error {
+	return notDeduped("tar")
+}
+
+func (d *dedup) WriteAt(context.Context, string, int64, []byte) error {
+	return notDeduped("writeat")
+}
+
+func (d *dedup) Append(context.Context, string, io.Reader) error {
+	return notDeduped("append")
+}
+
+func (d *dedup) ResumePut(context.Context, string, []byte, io.ReadSeeker, ...PutOption) error {
+	return notDeduped("resume")
+}
+
+// DedupReport is the result of FsckDedup
+type DedupReport struct {
+	// Pointers is how many pointers reference the Blobs
+	Pointers int
+	Blobs    int
+	// Fixed are the blobs whose count in the ledger was wrong
+	Fixed []string
+	// Orphans are the blobs no pointer references, removed unless the fsck was a dry run
+	Orphans []string
+	// Missing are the pointers whose blob is missing
+	Missing []string
+}
+
+// FsckDedup rebuilds the ledger of NewDedup in inner by counting the pointers of the whole tree,
+// reporting the counts it fixed. The blobs no pointer references are removed unless dryRun,
+// in which case nothing is written. No dedup FileSystem may write inner meanwhile, and those
+// open keep their ledger in memory, so they must be made again afterwards
+func FsckDedup(ctx context.Context, inner FileSystem, dryRun bool) (DedupReport, error) {
+	var r DedupReport
+	old, logged, err := loadDedupLedger(ctx, inner)
+	if errors.Is(err, ErrCorruptLedger) {
+		old = dedupLedger{Refs: map[string]int64{}}
+		logged = nil
+	} else if err != nil {
+		return r, err
+	}
+	ledger := dedupLedger{Seq: old.Seq, Refs: map[string]int64{}}
+	// pointers are the blobs of the pointers by name
+	pointers := map[string]string{}
+	err = inner.Walk(ctx, "", func(p string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if dedupHidden(p) {
+			return fs.SkipDir
+		}
+		if de.IsDir() {
+			return nil
+		}
+		info, err := de.Info()
+		if err != nil {
+			return err
+		}
+		hash, _, ok, err := readPointer(ctx, inner, p, info.Size())
+		if ok {
+			ledger.Refs[hash]++
+			pointers[p] = hash
+		}
+		return err
+	})
+	if err != nil {
+		return r, err
+	}
+	r.Pointers = len(pointers)
+	blobs, err := inner.List(ctx, dedupDir)
+	if err != nil && !errs.IsObjectNotFound(err) {
+		return r, err
+	}
+	stored := map[string]bool{}
+	for _, e := range blobs {
+		if e.IsDir || strings.HasPrefix(e.Name, ".") {
+			continue
+		}
+		stored[e.Name] = true
+		if ledger.Refs[e.Name] == 0 {
+			r.Orphans = append(r.Orphans, e.Name)
+		}
+	}
+	r.Blobs = len(stored) - len(r.Orphans)
+	for hash, refs := range ledger.Refs {
+		if old.Refs[hash] != refs {
+			r.Fixed = append(r.Fixed, hash)
+		}
+	}
+	for hash := range old.Refs {
+		if _, ok := ledger.Refs[hash]; !ok {
+			r.Fixed = append(r.Fixed, hash)
+		}
+	}
+	for p, hash := range pointers {
+		if !stored[hash] {
+			r.Missing = append(r.Missing, p)
+		}
+	}
+	sort.Strings(r.Fixed)
+	sort.Strings(r.Missing)
+	sort.Strings(r.Orphans)
+	if dryRun {
+		return r, nil
+	}
+	if err := putJSON(ctx, inner, dedupLedgerName, ledger); err != nil {
+		return r, errors.WithMessage(err, "failed to write the dedup ledger")
+	}
+	inner.DeleteBatch(ctx, logged, 0)
+	orphans := make([]string, len(r.Orphans))
+	for n, hash := range r.Orphans {
+		orphans[n] = blobName(hash)
+	}
+	for name, err := range inner.DeleteBatch(ctx, orphans, 0) {
+		return r, errors.WithMessagef(err, "failed to remove the orphan blob [%s]", name)
+	}
+	return r, nil
+}
@@ -0,0 +1,211 @@
+package export
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DiffKind is how an object differs between two trees
+type DiffKind int
+
+const (
+	DiffAdded DiffKind = iota
+	DiffRemoved
+	DiffChanged
+)
+
+// Change is what changed of an object found in both trees
+type Change int
+
+const (
+	// ChangedType is a file which became a dir or the other way round
+	ChangedType Change = 1 << iota
+	ChangedSize
+	ChangedModified
+	// ChangedHash is a file whose hashes of a type known in both trees differ
+	ChangedHash
+)
+
+// DiffEntry is an object which differs between the trees a and b
+type DiffEntry struct {
+	Path string
+	Kind DiffKind
+	// Changes are set for DiffChanged
+	Changes Change
+	// A and B are the object in each tree, nil if it's missing there
+	A, B *SnapshotEntry
+}
+
+// Diff returns the paths of the objects of b missing in a, of a missing in b, and found in both
+// but changed, see DiffSnapshots
+func Diff(a, b *SnapshotReader) (added, removed, changed []string, err error) {
+	err = DiffSnapshots(a, b, func(e DiffEntry) error {
+		switch e.Kind {
+		case DiffAdded:
+			added = append(added, e.Path)
+		case DiffRemoved:
+			removed = append(removed, e.Path)
+		case DiffChanged:
+			changed = append(changed, e.Path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return added, removed, changed, nil
+}
+
+// DiffSnapshots calls fn with the objects which differ between the snapshots a and b in the order
+// walked, until fn returns an error, which is returned. Both are read as fn is called, so a tree
+// is never held. The dirs differ only by their type, the files by their size, mtime and hashes,
+// so ChangedModified alone may be ignored for a storage which doesn't keep the mtime put
+func DiffSnapshots(a, b *SnapshotReader, fn func(DiffEntry) error) error {
+	return diffEntries(a.Next, b.Next, fn)
+}
+
+// DiffLive is DiffSnapshots between the snapshot s and the tree at dir, which is walked like
+// Snapshot does, as s is read. dir is usually s.Root, or the same dir in another FileSystem
+// the tree has been copied to
+func (i *Impl) DiffLive(ctx context.Context, dir string, s *SnapshotReader, fn func(DiffEntry) error) (err error) {
+	ctx, end := i.startOp(ctx, "diff", dir)
+	defer end(&err)
+	path, err := i.cleanPath(dir)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	entries := make(chan SnapshotEntry)
+	walked := make(chan error, 1)
+	go func() {
+		defer close(entries)
+		walked <- i.walkSnapshot(ctx, path, func(e SnapshotEntry) error {
+			select {
+			case entries <- e:
+				return nil
+			case <-ctx.Done():
+				return errors.WithStack(ctx.Err())
+			}
+		})
+	}()
+	defer func() {
+		cancel()
+		for range entries {
+		}
+	}()
+	return diffEntries(s.Next, func() (SnapshotEntry, error) {
+		if e, ok := <-entries; ok {
+			return e, nil
+		}
+		if err := <-walked; err != nil {
+			return SnapshotEntry{}, err
+		}
+		return SnapshotEntry{}, io.EOF
+	}, fn)
+}
+
+// diffEntries merges the objects of a and b, read until io.EOF in the order walked
+func diffEntries(a, b func() (SnapshotEntry, error), fn func(DiffEntry) error) error {
+	next := func(read func() (SnapshotEntry, error)) (*SnapshotEntry, error) {
+		e, err := read()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &e, nil
+	}
+	x, err := next(a)
+	if err != nil {
+		return err
+	}
+	y, err := next(b)
+	if err != nil {
+		return err
+	}
+	for x != nil || y != nil {
+		c := 0
+		switch {
+		case x == nil:
+			c = 1
+		case y == nil:
+			c = -1
+		default:
+			c = compareWalked(x.Path, y.Path)
+		}
+		switch {
+		case c < 0:
+			err = fn(DiffEntry{Path: x.Path, Kind: DiffRemoved, A: x})
+		case c > 0:
+			err = fn(DiffEntry{Path: y.Path, Kind: DiffAdded, B: y})
+		default:
+			if changes := changesOf(x, y); changes != 0 {
+				err = fn(DiffEntry{Path: x.Path, Kind: DiffChanged, Changes: changes, A: x, B: y})
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if c <= 0 {
+			if x, err = next(a); err != nil {
+				return err
+			}
+		}
+		if c >= 0 {
+			if y, err = next(b); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// compareWalked compares the paths x and y by the order they're walked, a dir is followed by its
+// objects before the names after it, so "a/b" comes before "a.txt"
+func compareWalked(x, y string) int {
+	for k := 0; k < len(x) && k < len(y); k++ {
+		cx, cy := x[k], y[k]
+		if cx == cy {
+			continue
+		}
+		if cx == '/' {
+			return -1
+		}
+		if cy == '/' {
+			return 1
+		}
+		if cx < cy {
+			return -1
+		}
+		return 1
+	}
+	return compareInt64(int64(len(x)), int64(len(y)))
+}
+
+// changesOf returns what changed from x to y
+func changesOf(x, y *SnapshotEntry) Change {
+	if x.IsDir != y.IsDir {
+		return ChangedType
+	}
+	if x.IsDir {
+		return 0
+	}
+	var c Change
+	if x.Size != y.Size {
+		c |= ChangedSize
+	}
+	if !x.Modified.Equal(y.Modified) {
+		c |= ChangedModified
+	}
+	for t, v := range x.Hashes.Export() {
+		if w := y.Hashes.GetHash(t); v != "" && w != "" && !strings.EqualFold(v, w) {
+			c |= ChangedHash
+		}
+	}
+	return c
+}
@@ -0,0 +1,321 @@
+package export
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/alist-org/alist/v3/internal/model"
+	"github.com/alist-org/alist/v3/pkg/singleflight"
+	"github.com/pkg/errors"
+)
+
+// diskCacheChunkSize is the size of the chunks cached by WithDiskCache, ranges are read by
+// whole chunks from the driver to cache them
+const diskCacheChunkSize = 1 << 20
+
+// WithDiskCache keeps the chunks of objects read in files of dir, which is made if missing,
+// so that they are read from the disk again even after a restart instead of the driver.
+// The chunks take at most maxBytes, the least recently used ones are removed first. A chunk is
+// of a version of the object by its size and modified time, the chunks of other versions are
+// removed once the object is seen changed by Stat or Read
+func WithDiskCache(dir string, maxBytes int64) Option {
+	return func(c *config) {
+		c.diskCacheDir = dir
+		c.diskCacheBytes = maxBytes
+	}
+}
+
+// diskCache keeps chunks in files named <path hash>-<version hash>-<chunk index>,
+// each file has the crc32 of the chunk after it
+type diskCache struct {
+	i         *Impl
+	dir       string
+	maxBytes  int64
+	chunkSize int64
+
+	mu   sync.Mutex
+	used int64
+	// ll has the most recently used entries at the front
+	ll      *list.List
+	entries map[string]*list.Element
+	// versions are the version hashes read of the objects by path hash
+	versions map[string]string
+	loadG    singleflight.Group[[]byte]
+}
+
+type diskEntry struct {
+	name, path, version string
+	size                int64
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// newDiskCache opens the cache in WithDiskCache, or returns nil if there is none. The files left
+// by writes interrupted are removed, the others are used from the most recently modified
+func newDiskCache(i *Impl) (*diskCache, error) {
+	if i.conf.diskCacheDir == "" || i.conf.diskCacheBytes <= 0 {
+		return nil, nil
+	}
+	c := &diskCache{
+		i:         i,
+		dir:       i.conf.diskCacheDir,
+		maxBytes:  i.conf.diskCacheBytes,
+		chunkSize: diskCacheChunkSize,
+		ll:        list.New(),
+		entries:   map[string]*list.Element{},
+		versions:  map[string]string{},
+	}
+	if err := os.MkdirAll(c.dir, 0o700); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	des, err := os.ReadDir(c.dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var infos []os.FileInfo
+	for _, de := range des {
+		if strings.HasSuffix(de.Name(), ".tmp") {
+			_ = os.Remove(filepath.Join(c.dir, de.Name()))
+			continue
+		}
+		if info, err := de.Info(); err == nil && info.Mode().IsRegular() {
+			infos = append(infos, info)
+		}
+	}
+	sort.Slice(infos, func(a, b int) bool { return infos[a].ModTime().Before(infos[b].ModTime()) })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, info := range infos {
+		path, version, ok := parseChunkName(info.Name())
+		if !ok {
+			continue
+		}
+		c.add(&diskEntry{name: info.Name(), path: path, version: version, size: info.Size()})
+	}
+	return c, nil
+}
+
+// keyHash hashes s into n bytes in hex
+func keyHash(s string, n int) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:n])
+}
+
+func objVersion(file model.Obj) string {
+	return keyHash(strconv.FormatInt(file.GetSize(), 10)+"|"+strconv.FormatInt(file.ModTime().UnixNano(), 10), 8)
+}
+
+func parseChunkName(name string) (path, version string, ok bool) {
+	parts := strings.Split(name, "-")
+	if len(parts) != 3 {
+		return "", "", false
+	}
+	if _, err := strconv.ParseInt(parts[2], 10, 64); err != nil {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// add makes e the most recently used entry and evicts the least recently used ones beyond maxBytes
+func (c *diskCache) add(e *diskEntry) {
+	if el, ok := c.entries[e.name]; ok {
+		c.used -= el.Value.(*diskEntry).size
+		c.ll.Remove(el)
+	}
+	c.entries[e.name] = c.ll.PushFront(e)
+	c.used += e.size
+	for c.used > c.maxBytes && c.ll.Len() > 1 {
+		c.remove(c.ll.Back().Value.(*diskEntry))
+	}
+}
+
+// remove drops e and removes its file
+func (c *diskCache) remove(e *diskEntry) {
+	el, ok := c.entries[e.name]
+	if !ok {
+		return
+	}
+	c.ll.Remove(el)
+	delete(c.entries, e.name)
+	c.used -= e.size
+	if err := os.Remove(filepath.Join(c.dir, e.name)); err != nil && !os.IsNotExist(err) {
+		c.i.conf.logger.Warn("failed to remove cached chunk", "file", e.name, "error", errValue(err))
+	}
+}
+
+// removeIf removes the entries of the objects at path hash p for which f holds
+func (c *diskCache) removeIf(p string, f func(e *diskEntry) bool) {
+	for _, el := range c.entries {
+		if e := el.Value.(*diskEntry); e.path == p && f(e) {
+			c.remove(e)
+		}
+	}
+}
+
+// observe removes the chunks of other versions than the one of file at path
+func (c *diskCache) observe(path string, file model.Obj) {
+	if c == nil || file.IsDir() {
+		return
+	}
+	p, v := keyHash(path, 16), objVersion(file)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.versions[p] == v {
+		return
+	}
+	c.versions[p] = v
+	c.removeIf(p, func(e *diskEntry) bool { return e.version != v })
+}
+
+// forget removes the chunks of the object at path, which has changed
+func (c *diskCache) forget(path string) {
+	if c == nil {
+		return
+	}
+	p := keyHash(path, 16)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.versions, p)
+	c.removeIf(p, func(*diskEntry) bool { return true })
+}
+
+// read returns limit bytes of file at path from off read by chunks from the cache, the chunks
+// missing are read by fetch and cached
+func (c *diskCache) read(ctx context.Context, path string, file model.Obj, off, limit int64, fetch func(ctx context.Context, off, limit int64) (io.ReadCloser, error)) io.ReadCloser {
+	c.observe(path, file)
+	return &diskCacheReader{ctx: ctx, c: c, file: file, prefix: keyHash(path, 16) + "-" + objVersion(file) + "-", off: off, end: off + limit, fetch: fetch}
+}
+
+// chunk returns the chunk k of file from the cache, or reads it by fetch and caches it
+func (c *diskCache) chunk(ctx context.Context, file model.Obj, prefix string, k int64, fetch func(ctx context.Context, off, limit int64) (io.ReadCloser, error)) ([]byte, error) {
+	name := prefix + strconv.FormatInt(k, 10)
+	size := min(c.chunkSize, file.GetSize()-k*c.chunkSize)
+	data, err, _ := c.loadG.Do(name, func() ([]byte, error) {
+		if data, ok := c.load(name, size); ok {
+			return data, nil
+		}
+		rc, err := fetch(ctx, k*c.chunkSize, size)
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		data := make([]byte, size)
+		if _, err := io.ReadFull(rc, data); err != nil {
+			return nil, errors.WithMessagef(err, "failed to read chunk %d", k)
+		}
+		if err := c.store(name, data); err != nil {
+			c.i.conf.logger.Warn("failed to cache chunk", "path", file.GetPath(), "chunk", k, "error", errValue(err))
+		}
+		return data, nil
+	})
+	return data, err
+}
+
+// load reads the chunk in file name of size, the file is removed if it's corrupted
+func (c *diskCache) load(name string, size int64) ([]byte, bool) {
+	c.mu.Lock()
+	el, ok := c.entries[name]
+	if ok {
+		c.ll.MoveToFront(el)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	b, err := os.ReadFile(filepath.Join(c.dir, name))
+	if err == nil && int64(len(b)) == size+4 && crc32.Checksum(b[:size], crcTable) == binary.BigEndian.Uint32(b[size:]) {
+		return b[:size], true
+	}
+	c.i.conf.logger.Warn("cached chunk corrupted", "file", name, "size", len(b), "error", errValue(err))
+	c.mu.Lock()
+	if el, ok := c.entries[name]; ok {
+		c.remove(el.Value.(*diskEntry))
+	}
+	c.mu.Unlock()
+	return nil, false
+}
+
+// store writes data to the file name, a file is renamed to name only once it's written completely
+func (c *diskCache) store(name string, data []byte) error {
+	if int64(len(data))+4 > c.maxBytes {
+		return nil
+	}
+	f, err := os.CreateTemp(c.dir, name+".*.tmp")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.Checksum(data, crcTable))
+	if _, err = f.Write(data); err == nil {
+		_, err = f.Write(sum[:])
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(c.dir, name))
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return errors.WithStack(err)
+	}
+	path, version, _ := parseChunkName(name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.add(&diskEntry{name: name, path: path, version: version, size: int64(len(data)) + 4})
+	return nil
+}
+
+// diskCacheReader reads the range of file from off to end chunk by chunk
+type diskCacheReader struct {
+	ctx    context.Context
+	c      *diskCache
+	file   model.Obj
+	prefix string
+	off    int64
+	end    int64
+	fetch  func(ctx context.Context, off, limit int64) (io.ReadCloser, error)
+	// buf is the rest of the chunk at off
+	buf    []byte
+	closed bool
+}
+
+func (r *diskCacheReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, os.ErrClosed
+	}
+	if r.off >= r.end {
+		return 0, io.EOF
+	}
+	if len(r.buf) == 0 {
+		k := r.off / r.c.chunkSize
+		data, err := r.c.chunk(r.ctx, r.file, r.prefix, k, r.fetch)
+		if err != nil {
+			return 0, err
+		}
+		r.buf = data[r.off-k*r.c.chunkSize:]
+	}
+	n := copy(p[:min(int64(len(p)), r.end-r.off)], r.buf)
+	r.buf = r.buf[n:]
+	r.off += int64(n)
+	return n, nil
+}
+
+func (r *diskCacheReader) Close() error {
+	r.closed = true
+	return nil
+}
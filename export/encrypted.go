@@ -0,0 +1,906 @@
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"os"
+	stdpath "path"
+	"strings"
+	"time"
+
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/alist-org/alist/v3/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+// CryptOptions configures NewEncrypted
+type CryptOptions struct {
+	// ChunkSize is the size of the chunks encrypted, 64KiB if <= 0. An object is read, and its
+	// size reported by Stat, with the chunk size of its header, which it was written with, but
+	// List, Walk and ListVersions report its size by this one rather than read every header
+	ChunkSize int
+	// EncryptNames encrypts the name of each object and dir too, deterministically so that they
+	// can still be looked up and listed. An encrypted name is about 1.6 times as long plus 26 chars
+	EncryptNames bool
+}
+
+var (
+	// ErrWrongKey is the error of reading an object encrypted with another key
+	ErrWrongKey = errors.New("wrong encryption key")
+	// ErrCorrupted is the error of reading an encrypted object which was modified or truncated
+	ErrCorrupted = errors.New("encrypted object corrupted")
+)
+
+const (
+	defaultCryptChunkSize = 64 << 10
+	cryptMagic            = "ALXENC"
+	cryptVersion          = 1
+	// cryptHeaderSize is the size of the header: the magic, the version, a reserved byte,
+	// the chunk size, the salt and the key check
+	cryptHeaderSize = len(cryptMagic) + 2 + 4 + cryptSaltSize + cryptCheckSize
+	cryptSaltSize   = 16
+	cryptCheckSize  = 16
+	cryptTagSize    = 16
+	cryptIVSize     = 16
+)
+
+// nameEncoding is base32 with lower case letters, so the names survive the storages which ignore case
+var nameEncoding = base32.NewEncoding("0123456789abcdefghijklmnopqrstuv").WithPadding(base32.NoPadding)
+
+// NewEncrypted returns a FileSystem encrypting the content of the objects of inner with AES-GCM
+// under key, which should be 32 random bytes. The content is sealed in chunks after a header
+// with a random salt, the key of each object being derived from key and its salt, so Read decrypts
+// the chunks of its range only and a truncated or modified object fails with ErrCorrupted, an
+// object of another key with ErrWrongKey. Stat and List report the size of the content and no hashes.
+//
+// Glob, ListObjects, Usage, Snapshot, DiffLive, VerifyLocal, SyncUp, DownloadTar, UploadArchive,
+// WriteAt, Append and ResumePut fail with errs.NotSupport, and so do ApplyLifecycle and
+// StartLifecycle with opts.EncryptNames. The other ops go to inner with the names encrypted by
+// opts.EncryptNames, the objects whose names can't be decrypted are left out of List and Walk.
+// It fails with an empty key
+func NewEncrypted(inner FileSystem, key []byte, opts CryptOptions) (FileSystem, error) {
+	if len(key) == 0 {
+		return nil, errors.New("encryption without key")
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = defaultCryptChunkSize
+	}
+	return &encrypted{
+		FileSystem: inner,
+		opts:       opts,
+		contentKey: hmacSum(key, "alist content"),
+		nameKey:    hmacSum(key, "alist name"),
+		nameMAC:    hmacSum(key, "alist name mac"),
+	}, nil
+}
+
+// encrypted is the FileSystem of NewEncrypted, the ops not overridden are of inner
+type encrypted struct {
+	FileSystem
+	opts       CryptOptions
+	contentKey []byte
+	nameKey    []byte
+	nameMAC    []byte
+}
+
+func hmacSum(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func notEncrypted(op string) error {
+	return errors.WithMessagef(errs.NotSupport, "%s of an encrypted FileSystem", op)
+}
+
+// cipherSize is the size of the object of size bytes of content in chunks of chunk bytes,
+// there's always a chunk so that the end of an object is authenticated
+func cipherSize(size int64, chunk int) int64 {
+	chunks := max((size+int64(chunk)-1)/int64(chunk), 1)
+	return int64(cryptHeaderSize) + size + chunks*cryptTagSize
+}
+
+// plainSize is the size of the content of the object of size bytes, 0 if it can't be one
+func plainSize(size int64, chunk int) int64 {
+	body := size - int64(cryptHeaderSize)
+	if body < cryptTagSize {
+		return 0
+	}
+	chunks := (body + int64(chunk) + cryptTagSize - 1) / int64(chunk+cryptTagSize)
+	return body - chunks*cryptTagSize
+}
+
+// objectAEAD returns the AEAD of the object with salt and its key check
+func (e *encrypted) objectAEAD(salt []byte) (cipher.AEAD, []byte, error) {
+	h := hmac.New(sha256.New, e.contentKey)
+	h.Write(salt)
+	key := h.Sum(nil)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	return aead, hmacSum(key, "check")[:cryptCheckSize], nil
+}
+
+// chunkNonce returns the nonce and additional data of chunk n, final for the last one
+func chunkNonce(n uint64, final bool) (nonce, ad []byte) {
+	nonce = make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], n)
+	ad = make([]byte, 9)
+	binary.BigEndian.PutUint64(ad, n)
+	if final {
+		ad[8] = 1
+	}
+	return nonce, ad
+}
+
+// encryptName encrypts the name elem by AES-CTR with the IV of its HMAC, so it's deterministic
+func (e *encrypted) encryptName(elem string) string {
+	h := hmac.New(sha256.New, e.nameMAC)
+	h.Write([]byte(elem))
+	iv := h.Sum(nil)[:cryptIVSize]
+	block, _ := aes.NewCipher(e.nameKey)
+	out := make([]byte, cryptIVSize+len(elem))
+	copy(out, iv)
+	cipher.NewCTR(block, iv).XORKeyStream(out[cryptIVSize:], []byte(elem))
+	return nameEncoding.EncodeToString(out)
+}
+
+// decryptName is the reverse of encryptName, it fails for a name not encrypted with the key
+func (e *encrypted) decryptName(name string) (string, error) {
+	b, err := nameEncoding.DecodeString(name)
+	if err != nil || len(b) < cryptIVSize {
+		return "", errors.WithMessagef(ErrInvalidName, "[%s] isn't encrypted", name)
+	}
+	block, _ := aes.NewCipher(e.nameKey)
+	iv, elem := b[:cryptIVSize], make([]byte, len(b)-cryptIVSize)
+	cipher.NewCTR(block, iv).XORKeyStream(elem, b[cryptIVSize:])
+	h := hmac.New(sha256.New, e.nameMAC)
+	h.Write(elem)
+	if !hmac.Equal(h.Sum(nil)[:cryptIVSize], iv) {
+		return "", errors.WithMessagef(ErrWrongKey, "name [%s]", name)
+	}
+	return string(elem), nil
+}
+
+// path returns the name of inner for name
+func (e *encrypted) path(name string) string {
+	if !e.opts.EncryptNames {
+		return name
+	}
+	elems := strings.Split(toSlash(name), "/")
+	for n, elem := range elems {
+		if elem != "" && elem != "." && elem != ".." {
+			elems[n] = e.encryptName(elem)
+		}
+	}
+	return strings.Join(elems, "/")
+}
+
+// plainPath is the reverse of path for the relative path p
+func (e *encrypted) plainPath(p string) (string, error) {
+	if !e.opts.EncryptNames || p == "" {
+		return p, nil
+	}
+	elems := strings.Split(p, "/")
+	for n, elem := range elems {
+		plain, err := e.decryptName(elem)
+		if err != nil {
+			return "", err
+		}
+		elems[n] = plain
+	}
+	return strings.Join(elems, "/"), nil
+}
+
+// info converts the info of the object name of inner
+func (e *encrypted) info(name string, info ObjInfo) ObjInfo {
+	if e.opts.EncryptNames && info.Name != "" {
+		// the name put may differ from name, e.g. by ConflictKeepBoth
+		if plain, err := e.decryptName(info.Name); err == nil {
+			info.Name = plain
+		} else {
+			info.Name = stdpath.Base(toSlash(name))
+		}
+	}
+	if !info.IsDir {
+		info.Size = plainSize(info.Size, e.opts.ChunkSize)
+	}
+	info.Hashes = utils.NewHashInfo(nil, "")
+	return info
+}
+
+// encReader encrypts the content read from src
+type encReader struct {
+	src   *bufio.Reader
+	aead  cipher.AEAD
+	chunk int
+	n     uint64
+	plain []byte
+	out   []byte
+	buf   []byte
+	done  bool
+}
+
+func (e *encrypted) encrypt(src io.Reader) (io.Reader, error) {
+	salt := make([]byte, cryptSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	aead, check, err := e.objectAEAD(salt)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, cryptHeaderSize)
+	header = append(header, cryptMagic...)
+	header = append(header, cryptVersion, 0)
+	header = binary.BigEndian.AppendUint32(header, uint32(e.opts.ChunkSize))
+	header = append(header, salt...)
+	header = append(header, check...)
+	return &encReader{
+		src:   bufio.NewReader(src),
+		aead:  aead,
+		chunk: e.opts.ChunkSize,
+		plain: make([]byte, e.opts.ChunkSize),
+		buf:   make([]byte, 0, e.opts.ChunkSize+cryptTagSize),
+		out:   header,
+	}, nil
+}
+
+func (r *encReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(r.src, r.plain)
+		final := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !final {
+			return 0, err
+		}
+		if !final {
+			// the chunk is the last one if nothing follows it
+			if _, err := r.src.Peek(1); err == io.EOF {
+				final = true
+			} else if err != nil {
+				return 0, err
+			}
+		}
+		nonce, ad := chunkNonce(r.n, final)
+		r.out = r.aead.Seal(r.buf[:0], nonce, r.plain[:n], ad)
+		r.n++
+		r.done = final
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// header reads the header of the object at the head of r and returns its AEAD and chunk size
+func (e *encrypted) header(r io.Reader) (cipher.AEAD, int, error) {
+	h := make([]byte, cryptHeaderSize)
+	if _, err := io.ReadFull(r, h); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, 0, errors.WithMessage(ErrCorrupted, "truncated header")
+		}
+		return nil, 0, errors.WithStack(err)
+	}
+	chunk, err := headerChunk(h)
+	if err != nil {
+		return nil, 0, err
+	}
+	h = h[len(cryptMagic):]
+	salt, check := h[6:6+cryptSaltSize], h[6+cryptSaltSize:]
+	aead, want, err := e.objectAEAD(salt)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !hmac.Equal(check, want) {
+		return nil, 0, errors.WithStack(ErrWrongKey)
+	}
+	return aead, chunk, nil
+}
+
+// headerChunk checks the header h and returns the chunk size it tells
+func headerChunk(h []byte) (int, error) {
+	if string(h[:len(cryptMagic)]) != cryptMagic {
+		return 0, errors.WithMessage(ErrCorrupted, "not encrypted")
+	}
+	h = h[len(cryptMagic):]
+	if h[0] != cryptVersion {
+		return 0, errors.WithMessagef(ErrCorrupted, "unknown version %d", h[0])
+	}
+	chunk := int(binary.BigEndian.Uint32(h[2:]))
+	if chunk <= 0 {
+		return 0, errors.WithMessagef(ErrCorrupted, "chunk size %d", chunk)
+	}
+	return chunk, nil
+}
+
+// decReader decrypts the chunks read from r, from chunk n of the object of size bytes of content,
+// skipping skip bytes of the first one and returning left bytes
+type decReader struct {
+	r     io.ReadCloser
+	aead  cipher.AEAD
+	chunk int
+	size  int64
+	n     uint64
+	skip  int
+	left  int64
+	buf   []byte
+	plain []byte
+}
+
+func (r *decReader) Read(p []byte) (int, error) {
+	if r.left == 0 {
+		return 0, io.EOF
+	}
+	for len(r.plain) == 0 {
+		plainLen := min(int64(r.chunk), r.size-int64(r.n)*int64(r.chunk))
+		final := (int64(r.n)+1)*int64(r.chunk) >= r.size
+		c := r.buf[:plainLen+cryptTagSize]
+		if _, err := io.ReadFull(r.r, c); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return 0, errors.WithMessagef(ErrCorrupted, "chunk %d truncated", r.n)
+			}
+			return 0, err
+		}
+		nonce, ad := chunkNonce(r.n, final)
+		plain, err := r.aead.Open(c[:0], nonce, c, ad)
+		if err != nil {
+			return 0, errors.WithMessagef(ErrCorrupted, "chunk %d", r.n)
+		}
+		r.plain = plain[r.skip:]
+		r.skip = 0
+		r.n++
+	}
+	n := copy(p[:min(int64(len(p)), r.left)], r.plain)
+	r.plain = r.plain[n:]
+	r.left -= int64(n)
+	return n, nil
+}
+
+func (r *decReader) Close() error {
+	return r.r.Close()
+}
+
+func (e *encrypted) Read(ctx context.Context, name string, off, limit int64) (io.ReadCloser, error) {
+	if off < 0 {
+		return nil, errors.WithMessagef(ErrInvalidRange, "negative offset %d", off)
+	}
+	path := e.path(name)
+	info, err := e.FileSystem.Stat(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir {
+		return nil, errors.WithStack(errs.NotFile)
+	}
+	rc, err := e.FileSystem.Read(ctx, path, 0, int64(cryptHeaderSize))
+	if err != nil {
+		return nil, err
+	}
+	aead, chunk, err := e.header(rc)
+	_ = rc.Close()
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to read [%s]", name)
+	}
+	size := plainSize(info.Size, chunk)
+	if off >= size {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	if limit <= 0 || limit > size-off {
+		limit = size - off
+	}
+	first := off / int64(chunk)
+	last := (off + limit - 1) / int64(chunk)
+	start := int64(cryptHeaderSize) + first*int64(chunk+cryptTagSize)
+	end := min(int64(cryptHeaderSize)+(last+1)*int64(chunk+cryptTagSize), info.Size)
+	rc, err = e.FileSystem.Read(ctx, path, start, end-start)
+	if err != nil {
+		return nil, err
+	}
+	return &decReader{
+		r:     rc,
+		aead:  aead,
+		chunk: chunk,
+		size:  size,
+		n:     uint64(first),
+		skip:  int(off - first*int64(chunk)),
+		left:  limit,
+		buf:   make([]byte, chunk+cryptTagSize),
+	}, nil
+}
+
+func (e *encrypted) Open(ctx context.Context, name string) (io.ReadSeekCloser, error) {
+	info, err := e.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir {
+		return nil, errors.WithStack(errs.NotFile)
+	}
+	return &rangeFile{ctx: ctx, fsys: e, name: name, size: info.Size}, nil
+}
+
+// rangeFile reads its object by Read of fsys from the offset sought
+type rangeFile struct {
+	ctx  context.Context
+	fsys FileSystem
+	name string
+	size int64
+	off  int64
+	rc   io.ReadCloser
+}
+
+func (f *rangeFile) Read(p []byte) (int, error) {
+	if f.rc == nil {
+		rc, err := f.fsys.Read(f.ctx, f.name, f.off, 0)
+		if err != nil {
+			return 0, err
+		}
+		f.rc = rc
+	}
+	n, err := f.rc.Read(p)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *rangeFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return 0, errors.WithMessagef(ErrInvalidRange, "negative offset %d", offset)
+	}
+	if offset != f.off && f.rc != nil {
+		_ = f.rc.Close()
+		f.rc = nil
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *rangeFile) Close() error {
+	if f.rc == nil {
+		return nil
+	}
+	return f.rc.Close()
+}
+
+func (e *encrypted) OpenReaderAt(ctx context.Context, name string) (io.ReaderAt, io.Closer, error) {
+	info, err := e.Stat(ctx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.IsDir {
+		return nil, nil, errors.WithStack(errs.NotFile)
+	}
+	return &rangeReaderAt{ctx: ctx, fsys: e, name: name, size: info.Size}, io.NopCloser(nil), nil
+}
+
+// rangeReaderAt reads the range of each ReadAt by Read of fsys
+type rangeReaderAt struct {
+	ctx  context.Context
+	fsys FileSystem
+	name string
+	size int64
+}
+
+func (r *rangeReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	rc, err := r.fsys.Read(r.ctx, r.name, off, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	n, err := io.ReadFull(rc, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (e *encrypted) Put(ctx context.Context, name string, body io.Reader) error {
+	_, err := e.PutWithOptions(ctx, name, body)
+	return err
+}
+
+func (e *encrypted) PutWithSize(ctx context.Context, name string, body io.Reader, size int64) error {
+	_, err := e.PutWithOptions(ctx, name, body, WithSize(size))
+	return err
+}
+
+func (e *encrypted) PutResult(ctx context.Context, name string, body io.Reader) (ObjInfo, error) {
+	return e.PutWithOptions(ctx, name, body)
+}
+
+// PutWithHash drops the hashes, which aren't those of the object stored
+func (e *encrypted) PutWithHash(ctx context.Context, name string, size int64, _ utils.HashInfo, body io.Reader) error {
+	return e.PutWithSize(ctx, name, body, size)
+}
+
+// putOptions returns opts for the object of inner: the size is the one stored
+// and the hashes of the content are dropped
+func (e *encrypted) putOptions(opts []PutOption) []PutOption {
+	o := newPutOptions(opts)
+	if o.sized {
+		o.size = cipherSize(o.size, e.opts.ChunkSize)
+	}
+	o.hashes = utils.HashInfo{}
+	return []PutOption{func(p *putOptions) { *p = o }}
+}
+
+func (e *encrypted) PutWithOptions(ctx context.Context, name string, body io.Reader, opts ...PutOption) (ObjInfo, error) {
+	r, err := e.encrypt(body)
+	if err != nil {
+		return ObjInfo{}, err
+	}
+	info, err := e.FileSystem.PutWithOptions(ctx, e.path(name), r, e.putOptions(opts)...)
+	if err != nil {
+		return ObjInfo{}, err
+	}
+	return e.info(name, info), nil
+}
+
+func (e *encrypted) PutIfAbsent(ctx context.Context, name string, body io.Reader) error {
+	r, err := e.encrypt(body)
+	if err != nil {
+		return err
+	}
+	return e.FileSystem.PutIfAbsent(ctx, e.path(name), r)
+}
+
+func (e *encrypted) PutBatch(ctx context.Context, items []PutItem, parallel int) []error {
+	inner := make([]PutItem, len(items))
+	for n, item := range items {
+		open := item.Open
+		inner[n] = PutItem{
+			Name: e.path(item.Name),
+			Size: cipherSize(item.Size, e.opts.ChunkSize),
+			Open: func() (io.ReadCloser, error) {
+				rc, err := open()
+				if err != nil {
+					return nil, err
+				}
+				r, err := e.encrypt(rc)
+				if err != nil {
+					_ = rc.Close()
+					return nil, err
+				}
+				return struct {
+					io.Reader
+					io.Closer
+				}{r, rc}, nil
+			},
+			Opts: e.putOptions(item.Opts),
+		}
+	}
+	return e.FileSystem.PutBatch(ctx, inner, parallel)
+}
+
+// Touch puts an empty object if name is missing, an empty object isn't empty once encrypted
+func (e *encrypted) Touch(ctx context.Context, name string) error {
+	ok, err := e.FileSystem.Exists(ctx, e.path(name))
+	if err != nil {
+		return err
+	}
+	if ok {
+		return e.FileSystem.Touch(ctx, e.path(name))
+	}
+	return e.PutWithSize(ctx, name, bytes.NewReader(nil), 0)
+}
+
+func (e *encrypted) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	w, err := e.FileSystem.Create(ctx, e.path(name))
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	r, err := e.encrypt(pr)
+	if err != nil {
+		return nil, err
+	}
+	cw := &pipeWriter{pw: pw, w: w, done: make(chan error, 1)}
+	go func() {
+		_, err := io.Copy(w, r)
+		pr.CloseWithError(err)
+		cw.done <- err
+	}()
+	return cw, nil
+}
+
+// pipeWriter writes to w what's read from the pipe pw writes to, done is the result of the copy
+type pipeWriter struct {
+	pw     *io.PipeWriter
+	w      io.WriteCloser
+	done   chan error
+	closed bool
+}
+
+func (w *pipeWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	return w.pw.Write(p)
+}
+
+func (w *pipeWriter) Close() error {
+	if w.closed {
+		return os.ErrClosed
+	}
+	w.closed = true
+	_ = w.pw.Close()
+	if err := <-w.done; err != nil {
+		_ = w.w.Close()
+		return err
+	}
+	return w.w.Close()
+}
+
+// Stat reports the size of the content by the chunk size in the header of the object
+func (e *encrypted) Stat(ctx context.Context, name string) (ObjInfo, error) {
+	info, err := e.FileSystem.Stat(ctx, e.path(name))
+	if err != nil {
+		return ObjInfo{}, err
+	}
+	size := info.Size
+	info = e.info(name, info)
+	if info.IsDir || size < int64(cryptHeaderSize+cryptTagSize) {
+		return info, nil
+	}
+	rc, err := e.FileSystem.Read(ctx, e.path(name), 0, int64(cryptHeaderSize))
+	if err != nil {
+		return ObjInfo{}, err
+	}
+	defer rc.Close()
+	h := make([]byte, cryptHeaderSize)
+	if _, err := io.ReadFull(rc, h); err != nil {
+		return ObjInfo{}, errors.WithMessage(err, "failed to read header")
+	}
+	chunk, err := headerChunk(h)
+	if err != nil {
+		return ObjInfo{}, err
+	}
+	info.Size = plainSize(size, chunk)
+	return info, nil
+}
+
+// Hashes reports none, those of inner are of the objects stored
+func (e *encrypted) Hashes(ctx context.Context, name string) (map[*utils.HashType]string, error) {
+	if _, err := e.FileSystem.Stat(ctx, e.path(name)); err != nil {
+		return nil, err
+	}
+	return map[*utils.HashType]string{}, nil
+}
+
+func (e *encrypted) Exists(ctx context.Context, name string) (bool, error) {
+	return e.FileSystem.Exists(ctx, e.path(name))
+}
+
+func (e *encrypted) List(ctx context.Context, dir string, opts ...ListOption) ([]Entry, error) {
+	var entries []Entry
+	err := e.ListIter(ctx, dir, func(en Entry) error {
+		entries = append(entries, en)
+		return nil
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// ListIter applies the filters to the entries decrypted, as those of inner have the sizes stored
+func (e *encrypted) ListIter(ctx context.Context, dir string, fn func(Entry) error, opts ...ListOption) error {
+	o := newListOptions(opts)
+	var (
+		held    []Entry
+		stopped error
+	)
+	err := e.FileSystem.ListIter(ctx, e.path(dir), func(en Entry) error {
+		name, err := e.plainPath(en.Name)
+		if err != nil {
+			return nil
+		}
+		en.Name = name
+		if !en.IsDir {
+			en.Size = plainSize(en.Size, e.opts.ChunkSize)
+		}
+		en.Hashes = utils.NewHashInfo(nil, "")
+		if !o.keepEntry(en.IsDir, en.Size, en.Modified) {
+			return nil
+		}
+		if o.sorted() {
+			held = append(held, en)
+			return nil
+		}
+		if err := fn(en); err != nil {
+			stopped = err
+			return err
+		}
+		return nil
+	})
+	if stopped != nil {
+		return stopped
+	}
+	if err != nil {
+		return err
+	}
+	o.sort(held)
+	for _, en := range held {
+		if err := fn(en); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *encrypted) Walk(ctx context.Context, root string, fn fs.WalkDirFunc) error {
+	path := e.path(root)
+	return e.FileSystem.Walk(ctx, path, func(p string, d fs.DirEntry, err error) error {
+		rel, perr := e.plainPath(strings.TrimPrefix(strings.TrimPrefix(p, path), "/"))
+		if perr != nil {
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		name := stdpath.Join(root, rel)
+		if rel == "" {
+			name = root
+		}
+		if d == nil {
+			return fn(name, nil, err)
+		}
+		info, ierr := d.Info()
+		if ierr != nil {
+			return fn(name, d, ierr)
+		}
+		size := info.Size()
+		if !d.IsDir() {
+			size = plainSize(size, e.opts.ChunkSize)
+		}
+		return fn(name, fs.FileInfoToDirEntry(newFileInfo(name, size, info.ModTime(), d.IsDir())), err)
+	})
+}
+
+func (e *encrypted) Delete(ctx context.Context, name string) error {
+	return e.FileSystem.Delete(ctx, e.path(name))
+}
+
+func (e *encrypted) DeleteBatch(ctx context.Context, names []string, parallel int) map[string]error {
+	paths := make([]string, len(names))
+	byPath := make(map[string]string, len(names))
+	for n, name := range names {
+		paths[n] = e.path(name)
+		byPath[paths[n]] = name
+	}
+	var failed map[string]error
+	for p, err := range e.FileSystem.DeleteBatch(ctx, paths, parallel) {
+		if failed == nil {
+			failed = map[string]error{}
+		}
+		failed[byPath[p]] = err
+	}
+	return failed
+}
+
+func (e *encrypted) RemoveAll(ctx context.Context, dir string) error {
+	return e.FileSystem.RemoveAll(ctx, e.path(dir))
+}
+
+func (e *encrypted) Mkdir(ctx context.Context, dir string) error {
+	return e.FileSystem.Mkdir(ctx, e.path(dir))
+}
+
+func (e *encrypted) Rename(ctx context.Context, name, newName string) error {
+	return e.FileSystem.Rename(ctx, e.path(name), e.path(newName))
+}
+
+func (e *encrypted) Move(ctx context.Context, src, dstDir string) error {
+	return e.FileSystem.Move(ctx, e.path(src), e.path(dstDir))
+}
+
+func (e *encrypted) Copy(ctx context.Context, src, dstDir string) error {
+	return e.FileSystem.Copy(ctx, e.path(src), e.path(dstDir))
+}
+
+func (e *encrypted) Glob(context.Context, string) ([]string, error) {
+	return nil, notEncrypted("glob")
+}
+
+func (e *encrypted) ListObjects(context.Context, string, string, int) ([]Entry, string, error) {
+	return nil, "", notEncrypted("list objects")
+}
+
+func (e *encrypted) Usage(context.Context, string, ...UsageOption) (int64, int64, int64, error) {
+	return 0, 0, 0, notEncrypted("usage")
+}
+
+func (e *encrypted) Snapshot(context.Context, string, io.Writer) error {
+	return notEncrypted("snapshot")
+}
+
+func (e *encrypted) DiffLive(context.Context, string, *SnapshotReader, func(DiffEntry) error) error {
+	return notEncrypted("diff")
+}
+
+func (e *encrypted) VerifyLocal(context.Context, string, string, VerifyOptions) (Report, error) {
+	return Report{}, notEncrypted("verify")
+}
+
+func (e *encrypted) SyncUp(context.Context, string, string, SyncOptions) (SyncReport, error) {
+	return SyncReport{}, notEncrypted("syncup")
+}
+
+func (e *encrypted) DownloadTar(context.Context, string, io.Writer, ...TarOption) error {
+	return notEncrypted("tar")
+}
+
+func (e *encrypted) UploadArchive(context.Context, string, io.Reader, ArchiveFormat, ...ArchiveOption) error {
+	return notEncrypted("unarchive")
+}
+
+// ApplyLifecycle goes to inner unless the names are encrypted, which the prefixes and globs of
+// the rules couldn't match
+func (e *encrypted) ApplyLifecycle(ctx context.Context, rules []LifecycleRule) (LifecycleReport, error) {
+	if e.opts.EncryptNames {
+		return LifecycleReport{}, notEncrypted("lifecycle")
+	}
+	return e.FileSystem.ApplyLifecycle(ctx, rules)
+}
+
+func (e *encrypted) StartLifecycle(rules []LifecycleRule, interval time.Duration) error {
+	if e.opts.EncryptNames {
+		return notEncrypted("lifecycle")
+	}
+	return e.FileSystem.StartLifecycle(rules, interval)
+}
+
+// Restore restores the object of name from the trash of inner
+func (e *encrypted) Restore(ctx context.Context, name string) error {
+	return e.FileSystem.Restore(ctx, e.path(name))
+}
+
+// ListVersions lists the versions of the object of name of inner with the sizes of their content
+func (e *encrypted) ListVersions(ctx context.Context, name string) ([]Version, error) {
+	versions, err := e.FileSystem.ListVersions(ctx, e.path(name))
+	for n := range versions {
+		versions[n].Size = plainSize(versions[n].Size, e.opts.ChunkSize)
+	}
+	return versions, err
+}
+
+func (e *encrypted) RestoreVersion(ctx context.Context, name, version string) error {
+	return e.FileSystem.RestoreVersion(ctx, e.path(name), version)
+}
+
+func (e *encrypted) WriteAt(context.Context, string, int64, []byte) error {
+	return notEncrypted("writeat")
+}
+
+func (e *encrypted) Append(context.Context, string, io.Reader) error {
+	return notEncrypted("append")
+}
+
+func (e *encrypted) ResumePut(context.Context, string, []byte, io.ReadSeeker, ...PutOption) error {
+	return notEncrypted("resume")
+}
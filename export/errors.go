@@ -0,0 +1,200 @@
+package export
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/pkg/errors"
+)
+
+// ErrorKind tells how an operation failed, it matches the errors of its kind with errors.Is,
+// e.g. errors.Is(err, KindRateLimited)
+type ErrorKind int
+
+const (
+	// KindOther is an error not known to be of the other kinds
+	KindOther ErrorKind = iota
+	KindNotFound
+	KindPermissionDenied
+	KindRateLimited
+	// KindTemporary is an error likely to go away by trying again, like a timeout or a 5xx
+	KindTemporary
+	KindCanceled
+	KindUnsupported
+)
+
+var kindNames = [...]string{"other", "not found", "permission denied", "rate limited", "temporary", "canceled", "unsupported"}
+
+func (k ErrorKind) String() string {
+	if k < 0 || int(k) >= len(kindNames) {
+		return "kind(" + strconv.Itoa(int(k)) + ")"
+	}
+	return kindNames[k]
+}
+
+func (k ErrorKind) Error() string {
+	return k.String()
+}
+
+// Retryable reports whether the errors of kind k are worth trying again
+func (k ErrorKind) Retryable() bool {
+	return k == KindTemporary || k == KindRateLimited
+}
+
+// OpError is the error of an operation of the FileSystem on Path
+type OpError struct {
+	Op   string
+	Path string
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *OpError) Error() string {
+	return e.Op + " " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches the kind of e, and the errors of fs for not found and permission denied
+func (e *OpError) Is(target error) bool {
+	switch target {
+	case fs.ErrNotExist:
+		return e.Kind == KindNotFound
+	case fs.ErrPermission:
+		return e.Kind == KindPermissionDenied
+	}
+	k, ok := target.(ErrorKind)
+	return ok && k == e.Kind
+}
+
+// As matches a target *fs.PathError with the op, path and error of e, so the errors still work
+// with the code expecting the *fs.PathError of the operations, whose error matches fs.ErrNotExist
+// for not found errors
+func (e *OpError) As(target any) bool {
+	pe, ok := target.(**fs.PathError)
+	if !ok {
+		return false
+	}
+	err := e.Err
+	if e.Kind == KindNotFound && !errors.Is(err, fs.ErrNotExist) {
+		err = notExist{err: err}
+	}
+	*pe = &fs.PathError{Op: e.Op, Path: e.Path, Err: err}
+	return true
+}
+
+// notExist is a not found error of the driver which matches fs.ErrNotExist too
+type notExist struct {
+	err error
+}
+
+func (e notExist) Error() string {
+	return e.err.Error()
+}
+
+func (e notExist) Unwrap() error {
+	return e.err
+}
+
+func (e notExist) Is(target error) bool {
+	return target == fs.ErrNotExist
+}
+
+// wrapErr wraps *err in *OpError telling op, name and the kind of the error, so that the
+// failed object shows up in logs and errors.Is(err, fs.ErrNotExist) holds for not found errors,
+// errs.IsObjectNotFound and the other sentinels still work through the chain
+func wrapErr(err *error, op, name string) {
+	if *err == nil {
+		return
+	}
+	// already wrapped by a public method called inside
+	if _, ok := (*err).(*OpError); ok {
+		return
+	}
+	*err = &OpError{Op: op, Path: name, Kind: KindOf(*err), Err: *err}
+}
+
+var (
+	// statusPattern finds the HTTP status in the messages of drivers, like "status code: 429"
+	statusPattern       = regexp.MustCompile(`(?i)\bstatus(?: code)?\W{0,3}(\d{3})\b`)
+	rateLimitedMessages = []string{"too many requests", "rate limit", "throttl"}
+	permissionMessages  = []string{"unauthorized", "forbidden", "invalid token", "token expired", "access denied"}
+	temporaryMessages   = []string{"internal server error", "bad gateway", "service unavailable", "gateway timeout",
+		"connection reset", "connection refused", "broken pipe", "timeout", "temporarily"}
+)
+
+// KindOf classifies err by the sentinels of errs, fs and context, and the statuses and messages
+// drivers commonly return, the kind of an *OpError in the chain is taken as is
+func KindOf(err error) ErrorKind {
+	var oe *OpError
+	if errors.As(err, &oe) {
+		return oe.Kind
+	}
+	switch {
+	case err == nil:
+		return KindOther
+	case errors.Is(err, context.Canceled):
+		return KindCanceled
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, ErrStorageUnavailable):
+		return KindTemporary
+	case isNotFound(err):
+		return KindNotFound
+	case isAny(err, errs.PermissionDenied, errs.EmptyToken, fs.ErrPermission, ErrReadOnly):
+		return KindPermissionDenied
+	case isAny(err, errs.NotImplement, errs.NotSupport, errs.UploadNotSupported, ErrCrossDirRename, ErrDirFallback, ErrEmptyUnsupported, ErrTouchUnsupported):
+		return KindUnsupported
+	case isAny(err, io.ErrUnexpectedEOF, syscall.ECONNRESET, syscall.ECONNREFUSED, syscall.EPIPE):
+		return KindTemporary
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return KindTemporary
+	}
+
+	msg := strings.ToLower(err.Error())
+	if m := statusPattern.FindStringSubmatch(msg); m != nil {
+		switch code, _ := strconv.Atoi(m[1]); {
+		case code == 429:
+			return KindRateLimited
+		case code == 401, code == 403:
+			return KindPermissionDenied
+		case code == 404:
+			return KindNotFound
+		case code >= 500:
+			return KindTemporary
+		}
+	}
+	for _, kind := range []struct {
+		k    ErrorKind
+		msgs []string
+	}{
+		{KindRateLimited, rateLimitedMessages},
+		{KindPermissionDenied, permissionMessages},
+		{KindTemporary, temporaryMessages},
+	} {
+		for _, m := range kind.msgs {
+			if strings.Contains(msg, m) {
+				return kind.k
+			}
+		}
+	}
+	return KindOther
+}
+
+func isAny(err error, targets ...error) bool {
+	for _, t := range targets {
+		if errors.Is(err, t) {
+			return true
+		}
+	}
+	return false
+}
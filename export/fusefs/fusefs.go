@@ -0,0 +1,460 @@
+// Package fusefs mounts export.FileSystem with FUSE
+package fusefs
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/alist-org/alist/v3/export"
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/alist-org/alist/v3/pkg/utils"
+	"github.com/pkg/errors"
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+type MountOptions struct {
+	// Options are passed to the FUSE library, e.g. []string{"-o", "allow_other"}
+	Options []string
+	// CacheDir keeps the files being written until they are uploaded, os.TempDir if empty
+	CacheDir string
+	// Uid and Gid own all the files in the mount
+	Uid uint32
+	Gid uint32
+}
+
+// Mount serves fsys at mountpoint until it's unmounted, files are written back when they're
+// released or synced since most drivers can't write partially, the files created show up in
+// their directories meanwhile. Files still dirty at unmount are uploaded before Mount returns,
+// and an error is returned if any of the uploads failed
+func Mount(mountpoint string, fsys export.FileSystem, opts MountOptions) error {
+	f := newFS(fsys, opts)
+	host := fuse.NewFileSystemHost(f)
+	if !host.Mount(mountpoint, opts.Options) {
+		return errors.Errorf("failed to mount [%s]", mountpoint)
+	}
+	return f.flushErr()
+}
+
+type fs struct {
+	fuse.FileSystemBase
+	fsys export.FileSystem
+	opts MountOptions
+
+	mu      sync.Mutex
+	nextFh  uint64
+	handles map[uint64]*handle
+	// writers are the latest handles opened for writing by path, used to report the size
+	writers map[string]*handle
+	errs    []error
+}
+
+func newFS(fsys export.FileSystem, opts MountOptions) *fs {
+	return &fs{
+		fsys:    fsys,
+		opts:    opts,
+		handles: map[uint64]*handle{},
+		writers: map[string]*handle{},
+	}
+}
+
+// handle is an opened file, r is set for reading and tmp for writing
+type handle struct {
+	path  string
+	mu    sync.Mutex
+	r     io.ReaderAt
+	rc    io.Closer
+	tmp   *os.File
+	dirty bool
+}
+
+// errno maps err to a negative errno returned to the kernel
+func errno(err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case errs.IsObjectNotFound(err):
+		return -fuse.ENOENT
+	case errors.Is(err, export.ErrDirNotEmpty):
+		return -fuse.ENOTEMPTY
+	case errors.Is(err, errs.NotFolder):
+		return -fuse.ENOTDIR
+	case errors.Is(err, errs.NotFile):
+		return -fuse.EISDIR
+	case errors.Is(err, export.KindPermissionDenied):
+		return -fuse.EACCES
+	case errors.Is(err, export.ErrInvalidName):
+		return -fuse.EINVAL
+	case errors.Is(err, export.ErrCrossDirRename), errors.Is(err, errs.NotSupport), errors.Is(err, errs.NotImplement):
+		return -fuse.ENOSYS
+	default:
+		utils.Log.Errorf("[fusefs] %+v", err)
+		return -fuse.EIO
+	}
+}
+
+func (f *fs) fillStat(stat *fuse.Stat_t, size int64, modified time.Time, isDir bool) {
+	*stat = fuse.Stat_t{
+		Size:  size,
+		Mtim:  fuse.NewTimespec(modified),
+		Ctim:  fuse.NewTimespec(modified),
+		Atim:  fuse.NewTimespec(modified),
+		Nlink: 1,
+		Uid:   f.opts.Uid,
+		Gid:   f.opts.Gid,
+	}
+	if isDir {
+		stat.Mode = fuse.S_IFDIR | 0755
+		stat.Nlink = 2
+	} else {
+		stat.Mode = fuse.S_IFREG | 0644
+	}
+}
+
+func (f *fs) Getattr(p string, stat *fuse.Stat_t, fh uint64) int {
+	f.mu.Lock()
+	h := f.writers[p]
+	f.mu.Unlock()
+	if h != nil {
+		h.mu.Lock()
+		fi, err := h.tmp.Stat()
+		h.mu.Unlock()
+		if err == nil {
+			f.fillStat(stat, fi.Size(), fi.ModTime(), false)
+			return 0
+		}
+	}
+	info, err := f.fsys.Stat(context.Background(), p)
+	if err != nil {
+		return errno(err)
+	}
+	f.fillStat(stat, info.Size, info.Modified, info.IsDir)
+	return 0
+}
+
+func (f *fs) Readdir(p string, fill func(name string, stat *fuse.Stat_t, ofst int64) bool, ofst int64, fh uint64) int {
+	entries, err := f.fsys.List(context.Background(), p)
+	if err != nil {
+		return errno(err)
+	}
+	fill(".", nil, 0)
+	fill("..", nil, 0)
+	listed := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		listed[e.Name] = true
+		var stat fuse.Stat_t
+		f.fillStat(&stat, e.Size, e.Modified, e.IsDir)
+		if !fill(e.Name, &stat, 0) {
+			return 0
+		}
+	}
+	// the files created aren't uploaded until they're released
+	for name, h := range f.writing(p) {
+		if listed[name] {
+			continue
+		}
+		h.mu.Lock()
+		fi, err := h.tmp.Stat()
+		h.mu.Unlock()
+		if err != nil {
+			continue
+		}
+		var stat fuse.Stat_t
+		f.fillStat(&stat, fi.Size(), fi.ModTime(), false)
+		if !fill(name, &stat, 0) {
+			break
+		}
+	}
+	return 0
+}
+
+// writing returns the handles opened for writing in dir by name
+func (f *fs) writing(dir string) map[string]*handle {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	found := map[string]*handle{}
+	for p, h := range f.writers {
+		if path.Dir(p) == path.Clean(dir) {
+			found[path.Base(p)] = h
+		}
+	}
+	return found
+}
+
+func (f *fs) Mkdir(p string, mode uint32) int {
+	return errno(f.fsys.Mkdir(context.Background(), p))
+}
+
+func (f *fs) Unlink(p string) int {
+	ctx := context.Background()
+	if _, err := f.fsys.Stat(ctx, p); err != nil {
+		return errno(err)
+	}
+	return errno(f.fsys.Delete(ctx, p))
+}
+
+func (f *fs) Rmdir(p string) int {
+	return f.Unlink(p)
+}
+
+// Rename uses Rename within a directory, Move between directories and both of them
+// if the name changes too
+func (f *fs) Rename(oldpath string, newpath string) int {
+	ctx := context.Background()
+	srcDir, srcName := path.Split(oldpath)
+	dstDir, dstName := path.Split(newpath)
+	var err error
+	switch {
+	case srcDir == dstDir:
+		err = f.fsys.Rename(ctx, oldpath, dstName)
+	case srcName == dstName:
+		err = f.fsys.Move(ctx, oldpath, dstDir)
+	default:
+		err = f.fsys.Move(ctx, oldpath, dstDir)
+		if err == nil {
+			err = f.fsys.Rename(ctx, path.Join(dstDir, srcName), dstName)
+		}
+	}
+	return errno(err)
+}
+
+// Utimens is accepted but ignored as the modified time can't be set on drivers
+func (f *fs) Utimens(p string, tmsp []fuse.Timespec) int {
+	return 0
+}
+
+func (f *fs) Chmod(p string, mode uint32) int {
+	return 0
+}
+
+func (f *fs) add(h *handle) uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextFh++
+	f.handles[f.nextFh] = h
+	if h.tmp != nil {
+		f.writers[h.path] = h
+	}
+	return f.nextFh
+}
+
+func (f *fs) handle(fh uint64) *handle {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.handles[fh]
+}
+
+func (f *fs) Create(p string, flags int, mode uint32) (int, uint64) {
+	tmp, err := os.CreateTemp(f.opts.CacheDir, "fusefs-*")
+	if err != nil {
+		return errno(err), ^uint64(0)
+	}
+	// uploaded on release, empty if nothing is written
+	return 0, f.add(&handle{path: p, tmp: tmp, dirty: true})
+}
+
+func (f *fs) Open(p string, flags int) (int, uint64) {
+	ctx := context.Background()
+	if flags&fuse.O_ACCMODE == fuse.O_RDONLY {
+		r, c, err := f.fsys.OpenReaderAt(ctx, p)
+		if err != nil {
+			return errno(err), ^uint64(0)
+		}
+		return 0, f.add(&handle{path: p, r: r, rc: c})
+	}
+	tmp, err := os.CreateTemp(f.opts.CacheDir, "fusefs-*")
+	if err != nil {
+		return errno(err), ^uint64(0)
+	}
+	h := &handle{path: p, tmp: tmp}
+	if flags&fuse.O_TRUNC != 0 {
+		h.dirty = true
+	} else if err := f.download(ctx, h); err != nil {
+		f.closeTmp(h)
+		return errno(err), ^uint64(0)
+	}
+	return 0, f.add(h)
+}
+
+// download fills the temp file of h with the current content for partial writes
+func (f *fs) download(ctx context.Context, h *handle) error {
+	info, err := f.fsys.Stat(ctx, h.path)
+	if err != nil {
+		return err
+	}
+	if info.Size == 0 {
+		return nil
+	}
+	rc, err := f.fsys.Read(ctx, h.path, 0, info.Size)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(h.tmp, rc)
+	return errors.WithStack(err)
+}
+
+func (f *fs) Read(p string, buff []byte, ofst int64, fh uint64) int {
+	h := f.handle(fh)
+	if h == nil {
+		return -fuse.EBADF
+	}
+	var n int
+	var err error
+	if h.r != nil {
+		n, err = h.r.ReadAt(buff, ofst)
+	} else {
+		h.mu.Lock()
+		n, err = h.tmp.ReadAt(buff, ofst)
+		h.mu.Unlock()
+	}
+	if err != nil && err != io.EOF {
+		return errno(err)
+	}
+	return n
+}
+
+func (f *fs) Write(p string, buff []byte, ofst int64, fh uint64) int {
+	h := f.handle(fh)
+	if h == nil || h.tmp == nil {
+		return -fuse.EBADF
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n, err := h.tmp.WriteAt(buff, ofst)
+	if err != nil {
+		return errno(err)
+	}
+	h.dirty = true
+	return n
+}
+
+func (f *fs) Truncate(p string, size int64, fh uint64) int {
+	if h := f.handle(fh); h != nil && h.tmp != nil {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if err := h.tmp.Truncate(size); err != nil {
+			return errno(err)
+		}
+		h.dirty = true
+		return 0
+	}
+	// truncate without an opened handle, e.g. truncate(1)
+	code, fh := f.Open(p, fuse.O_RDWR)
+	if code != 0 {
+		return code
+	}
+	defer f.Release(p, fh)
+	return f.Truncate(p, size, fh)
+}
+
+// upload puts the temp file of h if it's dirty, h.mu must be held
+func (f *fs) upload(h *handle) error {
+	if !h.dirty {
+		return nil
+	}
+	fi, err := h.tmp.Stat()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := h.tmp.Seek(0, io.SeekStart); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := f.fsys.PutWithSize(context.Background(), h.path, h.tmp, fi.Size()); err != nil {
+		return errors.WithMessagef(err, "failed to upload [%s]", h.path)
+	}
+	h.dirty = false
+	return nil
+}
+
+// Flush doesn't upload, closing a file duplicated would upload it once per descriptor
+func (f *fs) Flush(p string, fh uint64) int {
+	return 0
+}
+
+// Fsync uploads the file if it's dirty, which is otherwise left to Release
+func (f *fs) Fsync(p string, datasync bool, fh uint64) int {
+	h := f.handle(fh)
+	if h == nil || h.tmp == nil {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return errno(f.upload(h))
+}
+
+func (f *fs) closeTmp(h *handle) {
+	_ = h.tmp.Close()
+	_ = os.Remove(h.tmp.Name())
+}
+
+func (f *fs) Release(p string, fh uint64) int {
+	f.mu.Lock()
+	h := f.handles[fh]
+	delete(f.handles, fh)
+	if h != nil && f.writers[h.path] == h {
+		delete(f.writers, h.path)
+	}
+	f.mu.Unlock()
+	if h == nil {
+		return -fuse.EBADF
+	}
+	if h.rc != nil {
+		_ = h.rc.Close()
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	err := f.upload(h)
+	f.closeTmp(h)
+	if err != nil {
+		f.addErr(err)
+	}
+	return errno(err)
+}
+
+func (f *fs) addErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errs = append(f.errs, err)
+}
+
+// Destroy uploads the files still dirty at unmount
+func (f *fs) Destroy() {
+	f.mu.Lock()
+	handles := f.handles
+	f.handles = map[uint64]*handle{}
+	f.writers = map[string]*handle{}
+	f.mu.Unlock()
+	for _, h := range handles {
+		if h.rc != nil {
+			_ = h.rc.Close()
+			continue
+		}
+		h.mu.Lock()
+		err := f.upload(h)
+		f.closeTmp(h)
+		h.mu.Unlock()
+		if err != nil {
+			utils.Log.Errorf("[fusefs] %+v", err)
+			f.addErr(err)
+		}
+	}
+}
+
+// flushErr returns the uploads failed on release or unmount
+func (f *fs) flushErr() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.errs) == 0 {
+		return nil
+	}
+	err := f.errs[0]
+	if len(f.errs) > 1 {
+		err = errors.WithMessagef(err, "%d uploads failed, the first one", len(f.errs))
+	}
+	return err
+}
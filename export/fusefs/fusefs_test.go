@@ -0,0 +1,180 @@
+package fusefs
+
+import (
+	"context"
+	"io"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alist-org/alist/v3/export"
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/pkg/errors"
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// fakeFS keeps the files put in memory, the puts fail with putErr if it's set
+type fakeFS struct {
+	export.FileSystem
+	mu     sync.Mutex
+	files  map[string][]byte
+	puts   int
+	putErr error
+}
+
+func newFakeFS() *fakeFS {
+	return &fakeFS{files: map[string][]byte{}}
+}
+
+func (f *fakeFS) PutWithSize(ctx context.Context, name string, body io.Reader, size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.putErr != nil {
+		return f.putErr
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	f.files[name] = b
+	f.puts++
+	return nil
+}
+
+func (f *fakeFS) Stat(ctx context.Context, name string) (export.ObjInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, ok := f.files[name]
+	if !ok {
+		return export.ObjInfo{}, errors.WithStack(errs.ObjectNotFound)
+	}
+	return export.ObjInfo{Name: path.Base(name), Size: int64(len(b)), Modified: time.Now()}, nil
+}
+
+func (f *fakeFS) List(ctx context.Context, dir string, opts ...export.ListOption) ([]export.Entry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var entries []export.Entry
+	for name, b := range f.files {
+		if path.Dir(name) == dir {
+			entries = append(entries, export.Entry{Name: path.Base(name), Size: int64(len(b))})
+		}
+	}
+	return entries, nil
+}
+
+func (f *fakeFS) file(name string) ([]byte, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.files[name], f.puts
+}
+
+func TestCreateUploadsOnRelease(t *testing.T) {
+	fsys := newFakeFS()
+	f := newFS(fsys, MountOptions{CacheDir: t.TempDir()})
+	code, fh := f.Create("/a", fuse.O_WRONLY, 0644)
+	if code != 0 {
+		t.Fatalf("create failed with %d", code)
+	}
+	if _, puts := fsys.file("/a"); puts != 0 {
+		t.Fatal("create shouldn't upload")
+	}
+	var stat fuse.Stat_t
+	if code := f.Getattr("/a", &stat, fh); code != 0 || stat.Mode&fuse.S_IFREG == 0 {
+		t.Fatalf("the file created should be found, got %d", code)
+	}
+	var names []string
+	f.Readdir("/", func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		names = append(names, name)
+		return true
+	}, 0, 0)
+	if len(names) != 3 || names[2] != "a" {
+		t.Errorf("the file created should be listed, got %v", names)
+	}
+	if n := f.Write("/a", []byte("hello"), 0, fh); n != 5 {
+		t.Fatalf("write failed with %d", n)
+	}
+	if code := f.Flush("/a", fh); code != 0 {
+		t.Fatalf("flush failed with %d", code)
+	}
+	if _, puts := fsys.file("/a"); puts != 0 {
+		t.Fatal("flush shouldn't upload")
+	}
+	if code := f.Release("/a", fh); code != 0 {
+		t.Fatalf("release failed with %d", code)
+	}
+	if b, puts := fsys.file("/a"); string(b) != "hello" || puts != 1 {
+		t.Errorf("release should upload the file once, got %q in %d puts", b, puts)
+	}
+
+	code, fh = f.Create("/empty", fuse.O_WRONLY, 0644)
+	if code != 0 {
+		t.Fatalf("create failed with %d", code)
+	}
+	f.Release("/empty", fh)
+	if b, puts := fsys.file("/empty"); puts != 2 || len(b) != 0 {
+		t.Errorf("an empty file should be uploaded on release, got %q in %d puts", b, puts)
+	}
+	if err := f.flushErr(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDestroyUploadsDirty(t *testing.T) {
+	fsys := newFakeFS()
+	f := newFS(fsys, MountOptions{CacheDir: t.TempDir()})
+	for _, p := range []string{"/a", "/b"} {
+		code, fh := f.Create(p, fuse.O_WRONLY, 0644)
+		if code != 0 {
+			t.Fatalf("create failed with %d", code)
+		}
+		f.Write(p, []byte(p), 0, fh)
+	}
+	f.Destroy()
+	for _, p := range []string{"/a", "/b"} {
+		if b, _ := fsys.file(p); string(b) != p {
+			t.Errorf("%s should be uploaded at unmount, got %q", p, b)
+		}
+	}
+	if err := f.flushErr(); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys.putErr = errors.New("connection lost")
+	code, fh := f.Create("/c", fuse.O_WRONLY, 0644)
+	if code != 0 {
+		t.Fatalf("create failed with %d", code)
+	}
+	f.Write("/c", []byte("c"), 0, fh)
+	f.Destroy()
+	if err := f.flushErr(); err == nil {
+		t.Fatal("the upload failed at unmount should be reported")
+	}
+}
+
+func TestReleaseErrno(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want int
+	}{
+		{&export.OpError{Op: "put", Path: "/a", Kind: export.KindPermissionDenied, Err: errs.PermissionDenied}, -fuse.EACCES},
+		{errors.WithStack(errs.NotSupport), -fuse.ENOSYS},
+		{errors.WithStack(errs.NotFile), -fuse.EISDIR},
+		{errors.New("connection lost"), -fuse.EIO},
+	} {
+		fsys := newFakeFS()
+		fsys.putErr = c.err
+		f := newFS(fsys, MountOptions{CacheDir: t.TempDir()})
+		code, fh := f.Create("/a", fuse.O_WRONLY, 0644)
+		if code != 0 {
+			t.Fatalf("create failed with %d", code)
+		}
+		if got := f.Release("/a", fh); got != c.want {
+			t.Errorf("a release failing by %v should return %d, got %d", c.err, c.want, got)
+		}
+		if err := f.flushErr(); !errors.Is(err, c.err) {
+			t.Errorf("the upload failed should be reported, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package export
+
+import (
+	"context"
+	stdpath "path"
+	"sort"
+	"strings"
+
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/alist-org/alist/v3/internal/model"
+	"github.com/pkg/errors"
+)
+
+// Glob returns the names relative to the base dir matching pattern, sorted. pattern has the
+// syntax of path.Match, a backslash escapes, and a "**" element matches any number of dirs,
+// including none, so "a/**/*.tmp" matches "a/x.tmp" and "a/b/c/x.tmp". Only the dirs which
+// may match are listed, the literal elements are looked up without listing their dirs
+func (i *Impl) Glob(ctx context.Context, pattern string) (_ []string, err error) {
+	ctx, end := i.startOp(ctx, "glob", pattern)
+	defer end(&err)
+	var elems []string
+	for _, e := range strings.Split(strings.Trim(pattern, "/"), "/") {
+		if e == ".." {
+			return nil, errors.WithMessagef(ErrInvalidName, "[%s] is out of the base dir", pattern)
+		}
+		if _, err := stdpath.Match(e, ""); err != nil {
+			return nil, errors.WithMessagef(err, "bad pattern [%s]", pattern)
+		}
+		if e != "" && e != "." {
+			elems = append(elems, e)
+		}
+	}
+	if len(elems) == 0 {
+		return nil, nil
+	}
+	found := map[string]bool{}
+	if err := i.glob(ctx, "", elems, found); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// glob adds the names under the dir named dir matching elems to found
+func (i *Impl) glob(ctx context.Context, dir string, elems []string, found map[string]bool) error {
+	elem, rest := elems[0], elems[1:]
+	if elem != "**" && !hasMeta(elem) {
+		name := stdpath.Join(dir, elem)
+		obj, err := i.get(ctx, stdpath.Join(i.conf.baseDir, name))
+		if errs.IsObjectNotFound(err) || i.hidden(stdpath.Join(i.conf.baseDir, name)) {
+			return nil
+		}
+		if err != nil {
+			return errors.WithMessagef(err, "failed to get [%s]", name)
+		}
+		if len(rest) == 0 {
+			found[name] = true
+			return nil
+		}
+		if !obj.IsDir() {
+			return nil
+		}
+		return i.glob(ctx, name, rest, found)
+	}
+
+	objs, err := i.globList(ctx, dir)
+	if err != nil {
+		return err
+	}
+	if elem == "**" {
+		// none of the dirs
+		if len(rest) == 0 {
+			if dir != "" {
+				found[dir] = true
+			}
+		} else if err := i.glob(ctx, dir, rest, found); err != nil {
+			return err
+		}
+	}
+	for _, obj := range objs {
+		name := stdpath.Join(dir, obj.GetName())
+		if elem == "**" {
+			if obj.IsDir() {
+				if err := i.glob(ctx, name, elems, found); err != nil {
+					return err
+				}
+			} else if len(rest) == 0 {
+				found[name] = true
+			}
+			continue
+		}
+		if ok, _ := stdpath.Match(elem, obj.GetName()); !ok {
+			continue
+		}
+		if len(rest) == 0 {
+			found[name] = true
+		} else if obj.IsDir() {
+			if err := i.glob(ctx, name, rest, found); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// globList lists the dir named dir, a missing dir or a file has no objects
+func (i *Impl) globList(ctx context.Context, dir string) ([]model.Obj, error) {
+	path := stdpath.Join(i.conf.baseDir, dir)
+	objs, err := i.list(ctx, path, model.ListArgs{})
+	if errs.IsObjectNotFound(err) || errors.Is(err, errs.NotFolder) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to list dir [%s]", dir)
+	}
+	if path != i.conf.baseDir {
+		return objs, nil
+	}
+	kept := make([]model.Obj, 0, len(objs))
+	for _, obj := range objs {
+		if !i.hidden(stdpath.Join(path, obj.GetName())) {
+			kept = append(kept, obj)
+		}
+	}
+	return kept, nil
+}
+
+// hidden reports whether path is under the parts of chunked uploads, the trash or the versions,
+// which aren't listed
+func (i *Impl) hidden(path string) bool {
+	return i.conf.partSize > 0 && i.isPart(path) || i.isTrash(path) || i.isVersion(path)
+}
+
+// hasMeta reports whether elem has the special chars of path.Match
+func hasMeta(elem string) bool {
+	return strings.ContainsAny(elem, `*?[\`)
+}
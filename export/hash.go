@@ -0,0 +1,59 @@
+package export
+
+import (
+	"io"
+
+	"github.com/alist-org/alist/v3/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+// WithUploadHashes computes the hashes of types, like utils.MD5 and utils.SHA1, of the uploaded
+// content and gives them to the driver, which is needed by drivers like 189 and Baidu. A body
+// which isn't an io.ReadSeeker is spooled first to hash it, unless its hashes are given by WithHashes
+func WithUploadHashes(types ...*utils.HashType) Option {
+	return func(c *config) {
+		c.uploadHashes = types
+	}
+}
+
+// WithHashes gives the known hashes of the content put, which aren't computed again
+func WithHashes(hashes utils.HashInfo) PutOption {
+	return func(o *putOptions) {
+		o.hashes = hashes
+	}
+}
+
+// missingHashes returns the types of WithUploadHashes not in known
+func (i *Impl) missingHashes(known utils.HashInfo) []*utils.HashType {
+	var types []*utils.HashType
+	for _, t := range i.conf.uploadHashes {
+		if known.GetHash(t) == "" {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+// hashBody adds the hashes of types of the size bytes of body to known,
+// and seeks body back to where it was
+func hashBody(body io.ReadSeeker, size int64, types []*utils.HashType, known utils.HashInfo) (utils.HashInfo, error) {
+	off, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return known, errors.WithStack(err)
+	}
+	h := utils.NewMultiHasher(types)
+	if _, err := io.CopyN(h, body, size); err != nil {
+		return known, errors.WithMessage(err, "failed to hash body")
+	}
+	if _, err := body.Seek(off, io.SeekStart); err != nil {
+		return known, errors.WithStack(err)
+	}
+	hashes := map[*utils.HashType]string{}
+	for t, v := range known.Export() {
+		hashes[t] = v
+	}
+	for t, v := range h.GetHashInfo().Export() {
+		hashes[t] = v
+	}
+	return utils.NewHashInfoByMap(hashes), nil
+}
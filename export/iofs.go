@@ -0,0 +1,175 @@
+package export
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/pkg/errors"
+)
+
+// AsFS adapts f to fs.FS, the returned value implements fs.ReadDirFS and fs.StatFS too
+func AsFS(f FileSystem) fs.FS {
+	return &ioFS{f: f}
+}
+
+type ioFS struct {
+	f FileSystem
+}
+
+var (
+	_ fs.ReadDirFS = (*ioFS)(nil)
+	_ fs.StatFS    = (*ioFS)(nil)
+)
+
+// toFSErr wraps err in *fs.PathError with the errors of fs where possible
+func toFSErr(op, name string, err error) error {
+	// a FileSystem may have wrapped it already, with its own op and path
+	var oe *OpError
+	if errors.As(err, &oe) {
+		err = oe.Err
+	}
+	switch {
+	case errs.IsObjectNotFound(err):
+		err = fs.ErrNotExist
+	case errors.Is(err, errs.NotFolder), errors.Is(err, errs.NotFile):
+		err = errors.Cause(err)
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+func (ifs *ioFS) Open(name string) (fs.File, error) {
+	if !validPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	ctx := context.Background()
+	info, err := ifs.f.Stat(ctx, name)
+	if err != nil {
+		return nil, toFSErr("open", name, err)
+	}
+	fi := newFileInfo(name, info.Size, info.Modified, info.IsDir)
+	if info.IsDir {
+		return &ioDir{ifs: ifs, name: name, info: fi}, nil
+	}
+	r, err := ifs.f.Open(ctx, name)
+	if err != nil {
+		return nil, toFSErr("open", name, err)
+	}
+	return &ioFile{ReadSeekCloser: r, info: fi}, nil
+}
+
+func (ifs *ioFS) Stat(name string) (fs.FileInfo, error) {
+	if !validPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	info, err := ifs.f.Stat(context.Background(), name)
+	if err != nil {
+		return nil, toFSErr("stat", name, err)
+	}
+	return newFileInfo(name, info.Size, info.Modified, info.IsDir), nil
+}
+
+// ReadDir reads the dir sorted by filename as fs.ReadDirFS requires
+func (ifs *ioFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !validPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	entries, err := ifs.f.List(context.Background(), name)
+	if err != nil {
+		return nil, toFSErr("readdir", name, err)
+	}
+	dirEntries := make([]fs.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		dirEntries = append(dirEntries, fs.FileInfoToDirEntry(newFileInfo(e.Name, e.Size, e.Modified, e.IsDir)))
+	}
+	sort.Slice(dirEntries, func(i, j int) bool {
+		return dirEntries[i].Name() < dirEntries[j].Name()
+	})
+	return dirEntries, nil
+}
+
+type fileInfo struct {
+	name     string
+	size     int64
+	modified time.Time
+	isDir    bool
+}
+
+func newFileInfo(name string, size int64, modified time.Time, isDir bool) *fileInfo {
+	return &fileInfo{name: path.Base(name), size: size, modified: modified, isDir: isDir}
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) ModTime() time.Time { return fi.modified }
+func (fi *fileInfo) IsDir() bool        { return fi.isDir }
+func (fi *fileInfo) Sys() any           { return nil }
+func (fi *fileInfo) Mode() fs.FileMode {
+	if fi.isDir {
+		return fs.ModeDir | 0o555
+	}
+	return 0o444
+}
+
+type ioFile struct {
+	io.ReadSeekCloser
+	info *fileInfo
+}
+
+func (f *ioFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+type ioDir struct {
+	ifs     *ioFS
+	name    string
+	info    *fileInfo
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *ioDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *ioDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *ioDir) Close() error {
+	return nil
+}
+
+// ReadDir lists the dir on the first call, and returns the entries in order after that
+func (d *ioDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.ifs.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.read = entries, true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+// validPath reports whether name is valid for fs.FS, names with backslashes are rejected
+// as the FileSystem takes them as separators
+func validPath(name string) bool {
+	return fs.ValidPath(name) && !strings.Contains(name, `\`)
+}
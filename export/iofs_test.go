@@ -0,0 +1,31 @@
+package export
+
+import (
+	"context"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/pkg/errors"
+)
+
+func TestAsFS(t *testing.T) {
+	ctx := context.Background()
+	i := newTestFS(t, newMemDriver())
+	for _, name := range []string{"a", "dir/b", "dir/sub/c"} {
+		if err := i.Put(ctx, name, strings.NewReader("content of "+name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fsys := AsFS(i)
+	if err := fstest.TestFS(fsys, "a", "dir/b", "dir/sub/c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(fsys, "missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+	if _, err := fs.ReadFile(fsys, "/a"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("expected ErrInvalid, got %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package export
+
+import (
+	"context"
+	stdpath "path"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrClosed is returned by StartLifecycle once the FileSystem is closed by Close
+var ErrClosed = errors.New("file system closed")
+
+// LifecycleRule expires the objects under a prefix once they're old enough
+type LifecycleRule struct {
+	// Prefix is the key prefix of the objects like ListObjects takes, "" for all of them
+	Prefix string
+	// MaxAge is how long ago an object must have been modified last to expire
+	MaxAge time.Duration
+	// Glob only expires the objects whose base names match it by path.Match, if set
+	Glob string
+	// DryRun only reports the objects expired, without deleting them
+	DryRun bool
+}
+
+// check fails if r would expire every object as soon as it's put, or can't match
+func (r LifecycleRule) check() error {
+	if r.MaxAge <= 0 {
+		return errors.Errorf("lifecycle rule of [%s] must have a max age > 0, got %s", r.Prefix, r.MaxAge)
+	}
+	if _, err := stdpath.Match(r.Glob, ""); err != nil {
+		return errors.WithMessagef(err, "lifecycle rule of [%s] with the glob [%s]", r.Prefix, r.Glob)
+	}
+	return nil
+}
+
+// matches reports whether the object e expires by r at now
+func (r LifecycleRule) matches(e Entry, now time.Time) bool {
+	if now.Sub(e.Modified) <= r.MaxAge {
+		return false
+	}
+	if r.Glob == "" {
+		return true
+	}
+	ok, _ := stdpath.Match(r.Glob, stdpath.Base(e.Name))
+	return ok
+}
+
+// LifecycleReport is the result of ApplyLifecycle
+type LifecycleReport struct {
+	// Scanned is how many objects have been checked against the rules
+	Scanned int
+	// Expired are the keys of the objects deleted, or which would be by a rule with DryRun
+	Expired []string
+	// Failed are the errors of the objects which couldn't be deleted, by key
+	Failed map[string]error
+}
+
+// ApplyLifecycle deletes the files expired by rules, listing them by ListObjects a page at a time
+// and deleting each page like DeleteBatch does, with up to WithRemoveParallel removals at once.
+// The failures of single objects are in the report and don't stop the run, the error is of
+// listing them or of the rules. Dirs are kept even if they're left empty
+func (i *Impl) ApplyLifecycle(ctx context.Context, rules []LifecycleRule) (r LifecycleReport, err error) {
+	ctx, end := i.startOp(ctx, "lifecycle", "")
+	defer end(&err)
+	for _, rule := range rules {
+		if err := rule.check(); err != nil {
+			return r, err
+		}
+	}
+	now := time.Now()
+	r.Failed = map[string]error{}
+	expired := map[string]bool{}
+	for _, rule := range rules {
+		if !rule.DryRun {
+			if err := i.writable(); err != nil {
+				return r, err
+			}
+		}
+		marker := ""
+		for {
+			entries, next, err := i.ListObjects(ctx, rule.Prefix, marker, 0)
+			if err != nil {
+				return r, errors.WithMessagef(err, "failed to list objects of [%s]", rule.Prefix)
+			}
+			var names []string
+			for _, e := range entries {
+				r.Scanned++
+				// expired by an earlier rule
+				if expired[e.Name] || !rule.matches(e, now) {
+					continue
+				}
+				expired[e.Name] = true
+				r.Expired = append(r.Expired, e.Name)
+				names = append(names, e.Name)
+			}
+			if !rule.DryRun && len(names) > 0 {
+				for name, err := range i.DeleteBatch(ctx, names, 0) {
+					r.Failed[name] = err
+				}
+			}
+			if next == "" {
+				break
+			}
+			marker = next
+		}
+	}
+	if len(r.Failed) > 0 {
+		kept := r.Expired[:0]
+		for _, name := range r.Expired {
+			if r.Failed[name] == nil {
+				kept = append(kept, name)
+			}
+		}
+		r.Expired = kept
+	}
+	return r, nil
+}
+
+// StartLifecycle applies rules by ApplyLifecycle every interval in the background until Close is
+// called, logging each run which expired or failed to delete objects. The rules are checked first
+func (i *Impl) StartLifecycle(rules []LifecycleRule, interval time.Duration) error {
+	if interval <= 0 {
+		return errors.Errorf("lifecycle interval must be > 0, got %s", interval)
+	}
+	for _, rule := range rules {
+		if err := rule.check(); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if !i.background(cancel) {
+		cancel()
+		return errors.WithStack(ErrClosed)
+	}
+	go func() {
+		defer i.bg.Done()
+		defer cancel()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			r, err := i.ApplyLifecycle(ctx, rules)
+			if ctx.Err() != nil {
+				return
+			}
+			switch {
+			case err != nil:
+				i.conf.logger.Warn("failed to apply lifecycle", "error", errValue(err))
+			case len(r.Failed) > 0:
+				for name, err := range r.Failed {
+					i.conf.logger.Warn("failed to expire object", "name", name, "error", errValue(err))
+				}
+			}
+			if len(r.Expired) > 0 {
+				i.conf.logger.Info("lifecycle applied", "scanned", r.Scanned, "expired", len(r.Expired))
+			}
+		}
+	}()
+	return nil
+}
+
+// background registers a goroutine stopped by cancel on Close, which must call i.bg.Done once
+// it returns. It's false once closed
+func (i *Impl) background(cancel context.CancelFunc) bool {
+	i.closeMu.Lock()
+	defer i.closeMu.Unlock()
+	if i.closed {
+		return false
+	}
+	i.cancels = append(i.cancels, cancel)
+	i.bg.Add(1)
+	return true
+}
+
+// Close stops the lifecycles started by StartLifecycle and waits for their runs to return. The
+// FileSystem can still be used, the driver it's on isn't dropped. Close is idempotent
+func (i *Impl) Close() error {
+	i.closeMu.Lock()
+	i.closed = true
+	cancels := i.cancels
+	i.cancels = nil
+	i.closeMu.Unlock()
+	for _, cancel := range cancels {
+		cancel()
+	}
+	i.bg.Wait()
+	return nil
+}
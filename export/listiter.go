@@ -0,0 +1,124 @@
+package export
+
+import (
+	"context"
+	stdpath "path"
+
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/alist-org/alist/v3/internal/model"
+	"github.com/pkg/errors"
+)
+
+// ErrStopList is returned by the fn of ListIter to stop the listing, ListIter returns nil then
+var ErrStopList = errors.New("stop listing")
+
+// Pager is for drivers which can list a dir page by page, so that a huge dir is never held at
+// once. ListPages calls fn with the pages in order and stops with its error. None of the drivers
+// of alist implements it yet, it's the extension point for drivers wrapped by NewWithStorage
+type Pager interface {
+	ListPages(ctx context.Context, dir model.Obj, args model.ListArgs, fn func(page []model.Obj) error) error
+}
+
+// ListIter calls fn with the entries of dir in order until fn returns an error, which is
+// returned unless it's ErrStopList. Drivers implementing Pager are listed page by page and
+// the dir isn't cached, the other ones, which are all the drivers of alist, are listed at once
+// like List does, so ListIter only saves the entries made. The filters of opts drop
+// the objects before their entries are made, the entries sorted are held until all are listed
+func (i *Impl) ListIter(ctx context.Context, dir string, fn func(Entry) error, opts ...ListOption) (err error) {
+	ctx, end := i.startOp(ctx, "list", dir)
+	defer end(&err)
+	path, err := i.cleanPath(dir)
+	if err != nil {
+		return err
+	}
+	atBase := path == i.conf.baseDir
+	o := newListOptions(opts)
+	var held []Entry
+	var fnErr error
+	err = i.iter(ctx, path, func(obj model.Obj) error {
+		if atBase && i.hidden(stdpath.Join(path, obj.GetName())) || !o.keep(obj) {
+			return nil
+		}
+		if o.sorted() {
+			held = append(held, newEntry(obj))
+			return nil
+		}
+		fnErr = fn(newEntry(obj))
+		return fnErr
+	})
+	if err == nil && o.sorted() {
+		o.sort(held)
+		for _, e := range held {
+			if fnErr = fn(e); fnErr != nil {
+				err = fnErr
+				break
+			}
+		}
+	}
+	switch {
+	case errors.Is(err, ErrStopList):
+		return nil
+	case err != nil && err == fnErr:
+		return err
+	case err != nil:
+		return errors.WithMessage(err, "failed to list dir")
+	}
+	return nil
+}
+
+// iter calls fn with the objects of dir in order until fn returns an error, which is returned
+func (i *Impl) iter(ctx context.Context, dir string, fn func(model.Obj) error) error {
+	// a dir cached is listed from the cache
+	p, ok := i.storage.(Pager)
+	if ok && i.conf.cacheTTL > 0 {
+		_, cached := i.listCache.Get(dir)
+		ok = !cached
+	}
+	if !ok {
+		objs, err := i.list(ctx, dir, model.ListArgs{})
+		if err != nil {
+			return err
+		}
+		for _, obj := range objs {
+			if err := fn(obj); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	ctx, cancel := withTimeout(ctx, i.conf.metaTimeout)
+	defer cancel()
+	d, err := i.get(ctx, dir)
+	if err != nil {
+		return err
+	}
+	if !d.IsDir() {
+		return errors.WithStack(errs.NotFolder)
+	}
+	// the slot is only taken to start, fn may call the FileSystem between the pages
+	release, err := i.beginMeta(ctx)
+	if err != nil {
+		return err
+	}
+	release()
+	i.stats.lists.Add(1)
+	callCtx, end := i.startCall(ctx, "List", dir)
+	err = p.ListPages(callCtx, d, model.ListArgs{}, func(page []model.Obj) error {
+		model.WrapObjsName(page)
+		for _, f := range page {
+			path := stdpath.Join(dir, f.GetName())
+			f, err := i.resolveChunked(ctx, path, f)
+			if err != nil {
+				return err
+			}
+			i.setObj(path, f)
+			if err := fn(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	end(0, err)
+	return err
+}
@@ -0,0 +1,130 @@
+package export
+
+import (
+	"context"
+	stdpath "path"
+	"sort"
+	"strings"
+
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/alist-org/alist/v3/internal/model"
+	"github.com/pkg/errors"
+)
+
+// defaultListLimit is how many entries ListObjects returns at most by default, like S3 does
+const defaultListLimit = 1000
+
+// errListFull stops the walk of ListObjects once the page is full and another key is found
+var errListFull = errors.New("list full")
+
+// ListObjects lists the files under the base dir like an object store does: the entries are
+// named by their keys, the paths relative to the base dir, and come in key order. Only the keys
+// starting with prefix and after startAfter are listed, at most limit of them, 1000 if limit <= 0.
+// nextMarker is the key to pass as startAfter for the next page, or "" if this is the last one.
+// Only the dirs which may have such keys are listed, a dir at a time, so pages are made without
+// listing the whole tree
+func (i *Impl) ListObjects(ctx context.Context, prefix, startAfter string, limit int) (entries []Entry, nextMarker string, err error) {
+	ctx, end := i.startOp(ctx, "listobjects", prefix)
+	defer end(&err)
+	prefix = strings.TrimLeft(toSlash(prefix), "/")
+	dir := ""
+	if idx := strings.LastIndexByte(prefix, '/'); idx >= 0 {
+		dir = prefix[:idx]
+	}
+	path, err := i.cleanPath(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+	l := &objLister{i: i, prefix: prefix, startAfter: startAfter, limit: limit}
+	err = l.list(ctx, strings.TrimPrefix(strings.TrimPrefix(path, i.conf.baseDir), "/"), path)
+	if errors.Is(err, errListFull) {
+		return l.entries, l.entries[len(l.entries)-1].Name, nil
+	}
+	if errs.IsObjectNotFound(err) || errors.Is(err, errs.NotFolder) {
+		// nothing has the prefix
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return l.entries, "", nil
+}
+
+type objLister struct {
+	i          *Impl
+	prefix     string
+	startAfter string
+	limit      int
+	entries    []Entry
+}
+
+// list adds the keys under the dir at path, whose key is dir, in key order
+func (l *objLister) list(ctx context.Context, dir, path string) error {
+	objs, err := l.i.list(ctx, path, model.ListArgs{})
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(objs))
+	kept := make([]model.Obj, 0, len(objs))
+	for _, obj := range objs {
+		key := stdpath.Join(dir, obj.GetName())
+		if l.i.hidden(stdpath.Join(path, obj.GetName())) {
+			continue
+		}
+		// the keys under a dir follow its name with a "/"
+		if obj.IsDir() {
+			key += "/"
+		}
+		keys, kept = append(keys, key), append(kept, obj)
+	}
+	sort.Sort(byKey{keys, kept})
+	for n, obj := range kept {
+		key := keys[n]
+		if obj.IsDir() {
+			if !strings.HasPrefix(key, l.prefix) && !strings.HasPrefix(l.prefix, key) {
+				continue
+			}
+			// all its keys are before startAfter
+			if key <= l.startAfter && !strings.HasPrefix(l.startAfter, key) {
+				continue
+			}
+			err := l.list(ctx, strings.TrimSuffix(key, "/"), stdpath.Join(path, obj.GetName()))
+			if errors.Is(err, errListFull) {
+				return err
+			}
+			// removed since listed
+			if err != nil && !errs.IsObjectNotFound(err) {
+				return errors.WithMessagef(err, "failed to list dir [%s]", key)
+			}
+			continue
+		}
+		if !strings.HasPrefix(key, l.prefix) || key <= l.startAfter {
+			continue
+		}
+		if len(l.entries) == l.limit {
+			return errListFull
+		}
+		e := newEntry(obj)
+		e.Name = key
+		l.entries = append(l.entries, e)
+	}
+	return nil
+}
+
+// byKey sorts the objects of a dir by their keys
+type byKey struct {
+	keys []string
+	objs []model.Obj
+}
+
+func (s byKey) Len() int { return len(s.keys) }
+
+func (s byKey) Less(a, b int) bool { return s.keys[a] < s.keys[b] }
+
+func (s byKey) Swap(a, b int) {
+	s.keys[a], s.keys[b] = s.keys[b], s.keys[a]
+	s.objs[a], s.objs[b] = s.objs[b], s.objs[a]
+}
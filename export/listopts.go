@@ -0,0 +1,137 @@
+package export
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alist-org/alist/v3/internal/model"
+)
+
+// SortKey is what the entries of List and ListIter are sorted by
+type SortKey int
+
+const (
+	// SortNone keeps the order of the driver
+	SortNone SortKey = iota
+	SortName
+	SortSize
+	SortModified
+)
+
+type listOptions struct {
+	sortBy    SortKey
+	desc      bool
+	dirsFirst bool
+	minSize   int64
+	maxSize   int64
+	after     time.Time
+}
+
+// ListOption configures a single listing of List or ListIter
+type ListOption func(*listOptions)
+
+// WithSort sorts the entries by key, descending if desc is set. The entries which are equal
+// by key keep the order of the driver. ListIter then has to hold the entries kept to sort them
+func WithSort(key SortKey, desc bool) ListOption {
+	return func(o *listOptions) {
+		o.sortBy, o.desc = key, desc
+	}
+}
+
+// WithDirsFirst lists the dirs before the files, each in the order they'd be listed otherwise
+func WithDirsFirst() ListOption {
+	return func(o *listOptions) {
+		o.dirsFirst = true
+	}
+}
+
+// WithMinSize keeps only the files of at least n bytes, dirs are kept
+func WithMinSize(n int64) ListOption {
+	return func(o *listOptions) {
+		o.minSize = n
+	}
+}
+
+// WithMaxSize keeps only the files of at most n bytes, dirs are kept
+func WithMaxSize(n int64) ListOption {
+	return func(o *listOptions) {
+		o.maxSize = n
+	}
+}
+
+// WithModifiedAfter keeps only the files modified after t, dirs are kept
+func WithModifiedAfter(t time.Time) ListOption {
+	return func(o *listOptions) {
+		o.after = t
+	}
+}
+
+func newListOptions(opts []ListOption) listOptions {
+	o := listOptions{maxSize: -1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// keep reports whether obj passes the filters, before its entry is made
+func (o *listOptions) keep(obj model.Obj) bool {
+	return o.keepEntry(obj.IsDir(), obj.GetSize(), obj.ModTime())
+}
+
+// keepEntry is keep given the entry
+func (o *listOptions) keepEntry(isDir bool, size int64, modified time.Time) bool {
+	if isDir {
+		return true
+	}
+	if size < o.minSize || o.maxSize >= 0 && size > o.maxSize {
+		return false
+	}
+	return o.after.IsZero() || modified.After(o.after)
+}
+
+// byName reports whether the entries are sorted by name alone, ascending
+func (o *listOptions) byName() bool {
+	return o.sortBy == SortName && !o.desc && !o.dirsFirst
+}
+
+// sorted reports whether the entries are reordered
+func (o *listOptions) sorted() bool {
+	return o.sortBy != SortNone || o.dirsFirst
+}
+
+func (o *listOptions) sort(entries []Entry) {
+	if !o.sorted() {
+		return
+	}
+	sort.SliceStable(entries, func(a, b int) bool {
+		x, y := &entries[a], &entries[b]
+		if o.dirsFirst && x.IsDir != y.IsDir {
+			return x.IsDir
+		}
+		var c int
+		switch o.sortBy {
+		case SortName:
+			c = strings.Compare(x.Name, y.Name)
+		case SortSize:
+			c = compareInt64(x.Size, y.Size)
+		case SortModified:
+			c = x.Modified.Compare(y.Modified)
+		}
+		if o.desc {
+			return c > 0
+		}
+		return c < 0
+	})
+}
+
+func compareInt64(x, y int64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
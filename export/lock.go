@@ -0,0 +1,55 @@
+package export
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// pathLocks serializes the operations on the same path, the lock of a path is
+// dropped once no one holds or waits for it
+type pathLocks struct {
+	mu    sync.Mutex
+	locks map[string]*pathLock
+}
+
+type pathLock struct {
+	ch   chan struct{}
+	refs int
+}
+
+func newPathLocks() *pathLocks {
+	return &pathLocks{locks: map[string]*pathLock{}}
+}
+
+// lock waits for the lock of path until ctx is done, the returned func unlocks it
+func (l *pathLocks) lock(ctx context.Context, path string) (func(), error) {
+	l.mu.Lock()
+	pl, ok := l.locks[path]
+	if !ok {
+		pl = &pathLock{ch: make(chan struct{}, 1)}
+		l.locks[path] = pl
+	}
+	pl.refs++
+	l.mu.Unlock()
+
+	select {
+	case pl.ch <- struct{}{}:
+		return func() {
+			<-pl.ch
+			l.release(path, pl)
+		}, nil
+	case <-ctx.Done():
+		l.release(path, pl)
+		return nil, errors.WithStack(ctx.Err())
+	}
+}
+
+func (l *pathLocks) release(path string, pl *pathLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if pl.refs--; pl.refs == 0 {
+		delete(l.locks, path)
+	}
+}
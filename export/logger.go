@@ -0,0 +1,55 @@
+package export
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Logger receives the events of a FileSystem with key-value pairs, like log/slog does,
+// so a *slog.Logger such as slog.Default() can be passed to WithLogger as is
+type Logger interface {
+	Debug(msg string, kv ...any)
+	Info(msg string, kv ...any)
+	Warn(msg string, kv ...any)
+}
+
+var _ Logger = (*slog.Logger)(nil)
+
+// slowOpThreshold is how long a public operation takes before it's logged as slow by default
+const slowOpThreshold = 10 * time.Second
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, kv ...any) {}
+
+func (nopLogger) Info(msg string, kv ...any) {}
+
+func (nopLogger) Warn(msg string, kv ...any) {}
+
+// errValue is err to log, the stack of pkg/errors is left out
+func errValue(err error) any {
+	if err == nil {
+		return nil
+	}
+	return err.Error()
+}
+
+// WithSlowThreshold logs the public operations taking longer than d as slow, with the time spent
+// in looking up objects, getting links and transferring data. Read is measured until its reader
+// is closed. The default is 10s, d <= 0 logs none
+func WithSlowThreshold(d time.Duration) Option {
+	return func(c *config) {
+		c.slowThreshold = d
+	}
+}
+
+// WithLogger logs the driver init, retries, cache invalidations, link refreshes
+// and slow operations to l, nothing is logged by default
+func WithLogger(l Logger) Option {
+	return func(c *config) {
+		if l == nil {
+			l = nopLogger{}
+		}
+		c.logger = l
+	}
+}
@@ -0,0 +1,916 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alist-org/alist/v3/internal/conf"
+	"github.com/alist-org/alist/v3/internal/driver"
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/alist-org/alist/v3/internal/model"
+	stream_ "github.com/alist-org/alist/v3/internal/stream"
+	"github.com/alist-org/alist/v3/pkg/http_range"
+	"github.com/alist-org/alist/v3/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+// memDriver is an in-memory driver identifying objects by path, used by tests
+type memDriver struct {
+	model.Storage
+	driver.RootPath
+
+	mu    sync.Mutex
+	nodes map[string]*memNode
+}
+
+type memNode struct {
+	obj  model.Object
+	data []byte
+}
+
+var _ driver.Driver = (*memDriver)(nil)
+var _ driver.Mkdir = (*memDriver)(nil)
+var _ driver.Put = (*memDriver)(nil)
+var _ driver.Remove = (*memDriver)(nil)
+var _ driver.Rename = (*memDriver)(nil)
+
+func newMemDriver() *memDriver {
+	return &memDriver{
+		RootPath: driver.RootPath{RootFolderPath: "/"},
+		nodes:    map[string]*memNode{},
+	}
+}
+
+func (d *memDriver) Config() driver.Config {
+	return driver.Config{Name: "mem"}
+}
+
+func (d *memDriver) GetAddition() driver.Additional {
+	return &d.RootPath
+}
+
+func (d *memDriver) Init(ctx context.Context) error {
+	return nil
+}
+
+func (d *memDriver) Drop(ctx context.Context) error {
+	return nil
+}
+
+func (d *memDriver) List(ctx context.Context, dir model.Obj, args model.ListArgs) ([]model.Obj, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var objs []model.Obj
+	for p, n := range d.nodes {
+		if path.Dir(p) == dir.GetPath() {
+			obj := n.obj
+			objs = append(objs, &obj)
+		}
+	}
+	sort.Slice(objs, func(i, j int) bool {
+		return objs[i].GetName() < objs[j].GetName()
+	})
+	return objs, nil
+}
+
+func (d *memDriver) Link(ctx context.Context, file model.Obj, args model.LinkArgs) (*model.Link, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n, ok := d.nodes[file.GetPath()]
+	if !ok {
+		return nil, errors.WithStack(errs.ObjectNotFound)
+	}
+	return &model.Link{MFile: model.NewNopMFile(bytes.NewReader(n.data))}, nil
+}
+
+func (d *memDriver) MakeDir(ctx context.Context, parentDir model.Obj, dirName string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p := path.Join(parentDir.GetPath(), dirName)
+	if _, ok := d.nodes[p]; ok {
+		return errors.Errorf("%s already exists", p)
+	}
+	d.nodes[p] = &memNode{obj: model.Object{
+		Path:     p,
+		Name:     dirName,
+		Modified: time.Now(),
+		IsFolder: true,
+	}}
+	return nil
+}
+
+func (d *memDriver) Remove(ctx context.Context, obj model.Obj) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p := obj.GetPath()
+	if _, ok := d.nodes[p]; !ok {
+		return errors.WithStack(errs.ObjectNotFound)
+	}
+	for k := range d.nodes {
+		if k == p || strings.HasPrefix(k, p+"/") {
+			delete(d.nodes, k)
+		}
+	}
+	return nil
+}
+
+func (d *memDriver) Put(ctx context.Context, dstDir model.Obj, stream model.FileStreamer, up driver.UpdateProgress) error {
+	data, err := io.ReadAll(stream)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p := path.Join(dstDir.GetPath(), stream.GetName())
+	d.nodes[p] = &memNode{
+		obj: model.Object{
+			Path:     p,
+			Name:     stream.GetName(),
+			Size:     int64(len(data)),
+			Modified: stream.ModTime(),
+			Ctime:    stream.CreateTime(),
+			HashInfo: stream.GetHash(),
+		},
+		data: data,
+	}
+	up(100)
+	return nil
+}
+
+func (d *memDriver) Rename(ctx context.Context, srcObj model.Obj, newName string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.move(srcObj.GetPath(), path.Join(path.Dir(srcObj.GetPath()), newName))
+}
+
+// memMover is a memDriver which can move objects on the server side
+type memMover struct {
+	*memDriver
+}
+
+func (d memMover) Move(ctx context.Context, srcObj, dstDir model.Obj) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.move(srcObj.GetPath(), path.Join(dstDir.GetPath(), srcObj.GetName()))
+}
+
+// memNormalizer is a memDriver reporting created objects, names are put in lower case
+type memNormalizer struct {
+	*memDriver
+}
+
+func (d memNormalizer) Put(ctx context.Context, dstDir model.Obj, stream model.FileStreamer, up driver.UpdateProgress) (model.Obj, error) {
+	name := strings.ToLower(stream.GetName())
+	err := d.memDriver.Put(ctx, dstDir, &stream_.FileStream{Obj: &model.Object{Name: name, Modified: stream.ModTime()}, Reader: stream}, up)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	obj := d.nodes[path.Join(dstDir.GetPath(), name)].obj
+	obj.ID = "id-" + name
+	return &obj, nil
+}
+
+// move relocates src and all its children to dst, d.mu must be held
+func (d *memDriver) move(src, dst string) error {
+	if _, ok := d.nodes[src]; !ok {
+		return errors.WithStack(errs.ObjectNotFound)
+	}
+	if _, ok := d.nodes[dst]; ok {
+		return errors.Errorf("%s already exists", dst)
+	}
+	for k, n := range d.nodes {
+		if k == src || strings.HasPrefix(k, src+"/") {
+			delete(d.nodes, k)
+			n.obj.Path = dst + strings.TrimPrefix(k, src)
+			n.obj.Name = path.Base(n.obj.Path)
+			d.nodes[n.obj.Path] = n
+		}
+	}
+	return nil
+}
+
+// file returns the content stored at p on the driver
+func (d *memDriver) file(p string) ([]byte, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n, ok := d.nodes[p]
+	if !ok {
+		return nil, false
+	}
+	return n.data, true
+}
+
+// newTestFS returns an Impl on d with its base dir created
+func newTestFS(t testing.TB, d driver.Driver, opts ...Option) *Impl {
+	i := newImpl(d, opts...)
+	if err := i.mkdir(context.Background(), i.conf.baseDir); err != nil {
+		t.Fatal(err)
+	}
+	return i
+}
+
+// memFlaky is a memDriver whose List and Put fail with err until failures and putFailures
+// run out respectively, lists and puts count the calls
+type memFlaky struct {
+	*memDriver
+	err         error
+	failures    atomic.Int32
+	putFailures atomic.Int32
+	lists       atomic.Int32
+	puts        atomic.Int32
+}
+
+func (d *memFlaky) fail(failures *atomic.Int32) error {
+	if failures.Add(-1) < 0 {
+		return nil
+	}
+	if d.err != nil {
+		return d.err
+	}
+	return errors.New("temporary failure")
+}
+
+func (d *memFlaky) List(ctx context.Context, dir model.Obj, args model.ListArgs) ([]model.Obj, error) {
+	d.lists.Add(1)
+	if err := d.fail(&d.failures); err != nil {
+		return nil, err
+	}
+	return d.memDriver.List(ctx, dir, args)
+}
+
+func (d *memFlaky) Put(ctx context.Context, dstDir model.Obj, stream model.FileStreamer, up driver.UpdateProgress) error {
+	d.puts.Add(1)
+	if err := d.fail(&d.putFailures); err != nil {
+		// consume part of the body like a failed upload does
+		_, _ = io.CopyN(io.Discard, stream, 1)
+		return err
+	}
+	return d.memDriver.Put(ctx, dstDir, stream, up)
+}
+
+// memFlakyMover is a memFlaky which can move
+type memFlakyMover struct {
+	*memFlaky
+}
+
+func (d memFlakyMover) Move(ctx context.Context, srcObj, dstDir model.Obj) error {
+	return memMover{d.memDriver}.Move(ctx, srcObj, dstDir)
+}
+
+// memSlow is a memDriver which stalls for delay in List, Link and Put until ctx is done,
+// if slow is set, peak records the most stalled calls at the same time
+type memSlow struct {
+	*memDriver
+	delay    time.Duration
+	slow     atomic.Bool
+	inflight atomic.Int32
+	peak     atomic.Int32
+}
+
+func (d *memSlow) wait(ctx context.Context) error {
+	if !d.slow.Load() {
+		return nil
+	}
+	n := d.inflight.Add(1)
+	defer d.inflight.Add(-1)
+	for p := d.peak.Load(); n > p && !d.peak.CompareAndSwap(p, n); p = d.peak.Load() {
+	}
+	select {
+	case <-time.After(d.delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *memSlow) List(ctx context.Context, dir model.Obj, args model.ListArgs) ([]model.Obj, error) {
+	if err := d.wait(ctx); err != nil {
+		return nil, err
+	}
+	return d.memDriver.List(ctx, dir, args)
+}
+
+func (d *memSlow) Link(ctx context.Context, file model.Obj, args model.LinkArgs) (*model.Link, error) {
+	if err := d.wait(ctx); err != nil {
+		return nil, err
+	}
+	return d.memDriver.Link(ctx, file, args)
+}
+
+func (d *memSlow) Put(ctx context.Context, dstDir model.Obj, stream model.FileStreamer, up driver.UpdateProgress) error {
+	if err := d.wait(ctx); err != nil {
+		return err
+	}
+	return d.memDriver.Put(ctx, dstDir, stream, up)
+}
+
+// memMkdir is a memDriver whose MakeDir takes delay and counts the calls in mkdirs,
+// if raced is set, the dir is made by someone else right before MakeDir fails
+type memMkdir struct {
+	*memDriver
+	delay  time.Duration
+	raced  atomic.Bool
+	mkdirs atomic.Int32
+}
+
+func (d *memMkdir) MakeDir(ctx context.Context, parentDir model.Obj, dirName string) error {
+	d.mkdirs.Add(1)
+	time.Sleep(d.delay)
+	if d.raced.Load() {
+		_ = d.memDriver.MakeDir(ctx, parentDir, dirName)
+		return errors.Errorf("%s already exists", path.Join(parentDir.GetPath(), dirName))
+	}
+	return d.memDriver.MakeDir(ctx, parentDir, dirName)
+}
+
+// memURL is a memDriver which links to srv, which fails with 403 while expired is set
+type memURL struct {
+	*memDriver
+	srv     *httptest.Server
+	expired atomic.Bool
+	links   atomic.Int32
+}
+
+func newMemURL(t *testing.T) *memURL {
+	d := &memURL{memDriver: newMemDriver()}
+	d.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d.expired.Load() {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		data, ok := d.file(r.URL.Path)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(d.srv.Close)
+	if conf.Conf == nil {
+		conf.Conf = conf.DefaultConfig()
+		t.Cleanup(func() { conf.Conf = nil })
+	}
+	return d
+}
+
+func (d *memURL) Link(ctx context.Context, file model.Obj, args model.LinkArgs) (*model.Link, error) {
+	d.links.Add(1)
+	return &model.Link{URL: d.srv.URL + file.GetPath()}, nil
+}
+
+// memGetter is a memDriver implementing driver.Getter, paths records the paths passed to Get
+// and err is returned by Get if it's set
+type memGetter struct {
+	*memDriver
+	err   error
+	mu    sync.Mutex
+	paths []string
+}
+
+func (d *memGetter) Get(ctx context.Context, p string) (model.Obj, error) {
+	d.mu.Lock()
+	d.paths = append(d.paths, p)
+	d.mu.Unlock()
+	if d.err != nil {
+		return nil, d.err
+	}
+	d.memDriver.mu.Lock()
+	defer d.memDriver.mu.Unlock()
+	if p == "/" {
+		return &model.Object{Path: "/", Name: RootName, IsFolder: true}, nil
+	}
+	n, ok := d.nodes[p]
+	if !ok {
+		return nil, errors.WithStack(errs.ObjectNotFound)
+	}
+	obj := n.obj
+	return &obj, nil
+}
+
+// lastPath returns the path passed to the last Get
+func (d *memGetter) lastPath() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.paths) == 0 {
+		return ""
+	}
+	return d.paths[len(d.paths)-1]
+}
+
+// memRapid is a memDriver with rapid upload, a put with the md5 of a stored file copies it
+// without reading the stream, rapid counts them
+type memRapid struct {
+	*memDriver
+	rapid atomic.Int32
+}
+
+func (d *memRapid) Put(ctx context.Context, dstDir model.Obj, stream model.FileStreamer, up driver.UpdateProgress) error {
+	if md5 := stream.GetHash().GetHash(utils.MD5); md5 != "" {
+		d.mu.Lock()
+		for _, n := range d.nodes {
+			if !n.obj.IsFolder && utils.HashData(utils.MD5, n.data) == md5 {
+				p := path.Join(dstDir.GetPath(), stream.GetName())
+				obj := n.obj
+				obj.Path, obj.Name = p, stream.GetName()
+				d.nodes[p] = &memNode{obj: obj, data: n.data}
+				d.mu.Unlock()
+				d.rapid.Add(1)
+				up(100)
+				return nil
+			}
+		}
+		d.mu.Unlock()
+	}
+	return d.memDriver.Put(ctx, dstDir, stream, up)
+}
+
+// memTruncate is a memDriver losing the last byte of each file put, while telling success
+type memTruncate struct {
+	*memDriver
+}
+
+func (d memTruncate) Put(ctx context.Context, dstDir model.Obj, stream model.FileStreamer, up driver.UpdateProgress) error {
+	data, err := io.ReadAll(stream)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		data = data[:len(data)-1]
+	}
+	return d.memDriver.Put(ctx, dstDir, &stream_.FileStream{Obj: stream, Reader: bytes.NewReader(data)}, up)
+}
+
+// memFailPart is a memDriver whose Put of name fails once, puts counts the puts by name
+type memFailPart struct {
+	*memDriver
+	name   string
+	failed atomic.Bool
+	mu     sync.Mutex
+	puts   map[string]int
+}
+
+func (d *memFailPart) Put(ctx context.Context, dstDir model.Obj, stream model.FileStreamer, up driver.UpdateProgress) error {
+	d.mu.Lock()
+	d.puts[stream.GetName()]++
+	d.mu.Unlock()
+	if stream.GetName() == d.name && !d.failed.Swap(true) {
+		// part of the body is read before the failure
+		_, _ = io.CopyN(io.Discard, stream, 1)
+		return errors.New("connection lost")
+	}
+	return d.memDriver.Put(ctx, dstDir, stream, up)
+}
+
+// memRanged is a memDriver giving links read by range which advertise concurrency, the ranges
+// earlier in the file take longer, and the range at failAt fails
+type memRanged struct {
+	*memDriver
+	concurrency int
+	failAt      int64
+	delay       time.Duration
+
+	rmu          sync.Mutex
+	active, peak int
+	ranges       int
+}
+
+func (d *memRanged) Link(ctx context.Context, file model.Obj, args model.LinkArgs) (*model.Link, error) {
+	data, ok := d.file(file.GetPath())
+	if !ok {
+		return nil, errors.WithStack(errs.ObjectNotFound)
+	}
+	read := func(ctx context.Context, r http_range.Range) (io.ReadCloser, error) {
+		d.rmu.Lock()
+		d.ranges++
+		d.active++
+		d.peak = max(d.peak, d.active)
+		d.rmu.Unlock()
+		defer func() {
+			d.rmu.Lock()
+			d.active--
+			d.rmu.Unlock()
+		}()
+		if r.Start == d.failAt {
+			return nil, errors.New("range failed")
+		}
+		select {
+		case <-time.After(time.Duration(int64(len(data))-r.Start) * d.delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return io.NopCloser(bytes.NewReader(data[r.Start : r.Start+r.Length])), nil
+	}
+	return &model.Link{Concurrency: d.concurrency, RangeReadCloser: &model.RangeReadCloser{RangeReader: read}}, nil
+}
+
+// memExpiring is a memDriver giving links read by range, which expire after valid bytes are read
+type memExpiring struct {
+	*memDriver
+	valid int64
+	links atomic.Int32
+}
+
+func (d *memExpiring) Link(ctx context.Context, file model.Obj, args model.LinkArgs) (*model.Link, error) {
+	data, ok := d.file(file.GetPath())
+	if !ok {
+		return nil, errors.WithStack(errs.ObjectNotFound)
+	}
+	d.links.Add(1)
+	var read atomic.Int64
+	rrc := &model.RangeReadCloser{RangeReader: func(ctx context.Context, r http_range.Range) (io.ReadCloser, error) {
+		if read.Load() >= d.valid {
+			return nil, errors.New("status code: 403")
+		}
+		return io.NopCloser(&expiringReader{r: bytes.NewReader(data[r.Start : r.Start+r.Length]), read: &read, valid: d.valid}), nil
+	}}
+	return &model.Link{RangeReadCloser: rrc}, nil
+}
+
+type expiringReader struct {
+	r     io.Reader
+	read  *atomic.Int64
+	valid int64
+}
+
+func (r *expiringReader) Read(p []byte) (int, error) {
+	remain := r.valid - r.read.Load()
+	if remain <= 0 {
+		return 0, errors.New("signature expired")
+	}
+	n, err := r.r.Read(p[:min(int64(len(p)), remain)])
+	r.read.Add(int64(n))
+	return n, err
+}
+
+// memStalling is a memDriver giving links read by range, the first stalls ranges stop delivering
+// bytes after at bytes until they are canceled or closed
+type memStalling struct {
+	*memDriver
+	at     int64
+	stalls int32
+
+	ranges atomic.Int32
+	mu     sync.Mutex
+	last   context.Context
+}
+
+func (d *memStalling) Link(ctx context.Context, file model.Obj, args model.LinkArgs) (*model.Link, error) {
+	data, ok := d.file(file.GetPath())
+	if !ok {
+		return nil, errors.WithStack(errs.ObjectNotFound)
+	}
+	rrc := &model.RangeReadCloser{RangeReader: func(ctx context.Context, r http_range.Range) (io.ReadCloser, error) {
+		d.mu.Lock()
+		d.last = ctx
+		d.mu.Unlock()
+		body := data[r.Start : r.Start+r.Length]
+		if d.ranges.Add(1) > d.stalls {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+		return &stallingReader{r: bytes.NewReader(body[:min(d.at, int64(len(body)))]), ctx: ctx, closed: make(chan struct{})}, nil
+	}}
+	return &model.Link{RangeReadCloser: rrc}, nil
+}
+
+type stallingReader struct {
+	r      io.Reader
+	ctx    context.Context
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (r *stallingReader) Read(p []byte) (int, error) {
+	if n, err := r.r.Read(p); err != io.EOF {
+		return n, err
+	}
+	select {
+	case <-r.ctx.Done():
+		return 0, r.ctx.Err()
+	case <-r.closed:
+		return 0, os.ErrClosed
+	}
+}
+
+func (r *stallingReader) Close() error {
+	r.once.Do(func() { close(r.closed) })
+	return nil
+}
+
+// memPartial is a memDriver whose Put stores half of the content and fails while failing is set
+type memPartial struct {
+	*memDriver
+	failing atomic.Bool
+}
+
+func (d *memPartial) Put(ctx context.Context, dstDir model.Obj, stream model.FileStreamer, up driver.UpdateProgress) error {
+	if !d.failing.Load() {
+		return d.memDriver.Put(ctx, dstDir, stream, up)
+	}
+	data, err := io.ReadAll(stream)
+	if err != nil {
+		return err
+	}
+	half := &stream_.FileStream{Obj: stream, Reader: bytes.NewReader(data[:len(data)/2])}
+	if err := d.memDriver.Put(ctx, dstDir, half, up); err != nil {
+		return err
+	}
+	return errors.New("connection lost")
+}
+
+// memWriter only exposes the methods of a memPartial to list, read and write, it can't rename
+type memWriter struct {
+	driver.Driver
+	d *memPartial
+}
+
+func (w memWriter) MakeDir(ctx context.Context, parentDir model.Obj, dirName string) error {
+	return w.d.MakeDir(ctx, parentDir, dirName)
+}
+
+func (w memWriter) Put(ctx context.Context, dstDir model.Obj, stream model.FileStreamer, up driver.UpdateProgress) error {
+	return w.d.Put(ctx, dstDir, stream, up)
+}
+
+func (w memWriter) Remove(ctx context.Context, obj model.Obj) error {
+	return w.d.Remove(ctx, obj)
+}
+
+// memWriteMover is a memWriter which can move objects on the server side
+type memWriteMover struct {
+	memWriter
+}
+
+func (w memWriteMover) Move(ctx context.Context, srcObj, dstDir model.Obj) error {
+	return memMover{w.d.memDriver}.Move(ctx, srcObj, dstDir)
+}
+
+// paths returns the paths of the objects stored under dir, dir excluded
+func (d *memDriver) paths(dir string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var paths []string
+	for p := range d.nodes {
+		if strings.HasPrefix(p, dir+"/") {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// memExclusive is a memDriver whose Put fails if the object exists
+type memExclusive struct {
+	*memDriver
+}
+
+func (d memExclusive) Put(ctx context.Context, dstDir model.Obj, stream model.FileStreamer, up driver.UpdateProgress) error {
+	if _, ok := d.file(path.Join(dstDir.GetPath(), stream.GetName())); ok {
+		return errors.Errorf("%s already exists", stream.GetName())
+	}
+	return d.memDriver.Put(ctx, dstDir, stream, up)
+}
+
+// memRacing is a memDriver reporting the IDs of the objects put, which are raced by another
+// writer once put: replaced by it if replaced is set, or duplicated with a lesser ID if dup is set
+type memRacing struct {
+	*memDriver
+	replaced atomic.Bool
+	dup      atomic.Bool
+	removes  atomic.Int32
+}
+
+func (d *memRacing) Put(ctx context.Context, dstDir model.Obj, stream model.FileStreamer, up driver.UpdateProgress) (model.Obj, error) {
+	if err := d.memDriver.Put(ctx, dstDir, stream, up); err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := d.nodes[path.Join(dstDir.GetPath(), stream.GetName())]
+	n.obj.ID = "id-ours"
+	obj := n.obj
+	if d.replaced.Load() {
+		n.obj.ID, n.data = "id-theirs", []byte("theirs")
+	}
+	return &obj, nil
+}
+
+func (d *memRacing) List(ctx context.Context, dir model.Obj, args model.ListArgs) ([]model.Obj, error) {
+	objs, err := d.memDriver.List(ctx, dir, args)
+	if err != nil || !d.dup.Load() {
+		return objs, err
+	}
+	for _, o := range objs {
+		if o.GetID() == "id-ours" {
+			objs = append(objs, &model.Object{ID: "id-0", Name: o.GetName(), Path: o.GetPath()})
+		}
+	}
+	return objs, nil
+}
+
+func (d *memRacing) Remove(ctx context.Context, obj model.Obj) error {
+	d.removes.Add(1)
+	return d.memDriver.Remove(ctx, obj)
+}
+
+// memModTime is a memDriver whose modified times are set alone by modTimeSetters, puts counts
+// the puts
+type memModTime struct {
+	*memDriver
+	puts atomic.Int32
+}
+
+func (d *memModTime) Config() driver.Config {
+	return driver.Config{Name: "memModTime"}
+}
+
+func (d *memModTime) Put(ctx context.Context, dstDir model.Obj, stream model.FileStreamer, up driver.UpdateProgress) error {
+	d.puts.Add(1)
+	return d.memDriver.Put(ctx, dstDir, stream, up)
+}
+
+func (d *memModTime) setModTime(file model.Obj, modified time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n, ok := d.nodes[file.GetPath()]
+	if !ok {
+		return errors.WithStack(errs.ObjectNotFound)
+	}
+	n.obj.Modified = modified
+	return nil
+}
+
+// memNoEmpty is a memDriver named name rejecting empty uploads
+type memNoEmpty struct {
+	*memDriver
+	name string
+}
+
+func (d memNoEmpty) Config() driver.Config {
+	return driver.Config{Name: d.name}
+}
+
+func (d memNoEmpty) Put(ctx context.Context, dstDir model.Obj, stream model.FileStreamer, up driver.UpdateProgress) error {
+	if stream.GetSize() == 0 {
+		return errors.New("file size cannot be zero")
+	}
+	return d.memDriver.Put(ctx, dstDir, stream, up)
+}
+
+// memPager is a memDriver listing pages of size objects, pages counts the pages of dir listed
+type memPager struct {
+	*memDriver
+	size  int
+	dir   string
+	pages atomic.Int32
+}
+
+func (d *memPager) ListPages(ctx context.Context, dir model.Obj, args model.ListArgs, fn func(page []model.Obj) error) error {
+	objs, err := d.memDriver.List(ctx, dir, args)
+	if err != nil {
+		return err
+	}
+	for len(objs) > 0 {
+		page := objs[:min(d.size, len(objs))]
+		objs = objs[len(page):]
+		if dir.GetPath() == d.dir {
+			d.pages.Add(1)
+		}
+		if err := fn(page); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memLooping is a memDriver whose dir loop lists itself as its child loop, like a symlink would
+type memLooping struct {
+	*memDriver
+}
+
+func (d memLooping) List(ctx context.Context, dir model.Obj, args model.ListArgs) ([]model.Obj, error) {
+	objs, err := d.memDriver.List(ctx, dir, args)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range objs {
+		if o.GetName() == "loop" {
+			o.(*model.Object).ID = "id-loop"
+		}
+	}
+	if path.Base(dir.GetPath()) == "loop" {
+		objs = append(objs, &model.Object{ID: "id-loop", Name: "loop", Path: dir.GetPath(), IsFolder: true})
+	}
+	return objs, nil
+}
+
+// memListLog is a memDriver recording the dirs listed
+type memListLog struct {
+	*memDriver
+	lmu    sync.Mutex
+	listed []string
+}
+
+func (d *memListLog) List(ctx context.Context, dir model.Obj, args model.ListArgs) ([]model.Obj, error) {
+	d.lmu.Lock()
+	d.listed = append(d.listed, dir.GetPath())
+	d.lmu.Unlock()
+	return d.memDriver.List(ctx, dir, args)
+}
+
+// memVanishing is a memDriver whose objects gone are removed once listed by their parent
+type memVanishing struct {
+	*memDriver
+	gone []string
+}
+
+func (d *memVanishing) isGone(p string) bool {
+	for _, g := range d.gone {
+		if g == p {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *memVanishing) List(ctx context.Context, dir model.Obj, args model.ListArgs) ([]model.Obj, error) {
+	if d.isGone(dir.GetPath()) {
+		return nil, errors.WithStack(errs.ObjectNotFound)
+	}
+	return d.memDriver.List(ctx, dir, args)
+}
+
+func (d *memVanishing) Link(ctx context.Context, file model.Obj, args model.LinkArgs) (*model.Link, error) {
+	if d.isGone(file.GetPath()) {
+		return nil, errors.WithStack(errs.ObjectNotFound)
+	}
+	return d.memDriver.Link(ctx, file, args)
+}
+
+// statOverwritten is a FileSystem whose object name is overwritten with data by another writer
+// once it's put, before its stat
+type statOverwritten struct {
+	FileSystem
+	name, data string
+}
+
+func (f *statOverwritten) PutWithOptions(ctx context.Context, name string, body io.Reader, opts ...PutOption) (ObjInfo, error) {
+	info, err := f.FileSystem.PutWithOptions(ctx, name, body, opts...)
+	if err == nil && name == f.name {
+		err = f.FileSystem.Put(ctx, name, strings.NewReader(f.data))
+	}
+	return info, err
+}
+
+// failingReads is a FileSystem whose lookups fail with err
+type failingReads struct {
+	FileSystem
+	err error
+}
+
+func (f *failingReads) Stat(context.Context, string) (ObjInfo, error) { return ObjInfo{}, f.err }
+
+func (f *failingReads) Read(context.Context, string, int64, int64) (io.ReadCloser, error) {
+	return nil, f.err
+}
+
+func (f *failingReads) ListIter(context.Context, string, func(Entry) error, ...ListOption) error {
+	return f.err
+}
+
+// failingPuts is a FileSystem whose puts fail with err
+type failingPuts struct {
+	FileSystem
+	err error
+}
+
+func (f *failingPuts) PutWithOptions(context.Context, string, io.Reader, ...PutOption) (ObjInfo, error) {
+	return ObjInfo{}, f.err
+}
+
+// countingReads is a FileSystem counting its reads, which fail with err if set
+type countingReads struct {
+	FileSystem
+	reads atomic.Int64
+	err   error
+}
+
+func (f *countingReads) Read(ctx context.Context, name string, off, limit int64) (io.ReadCloser, error) {
+	f.reads.Add(1)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.FileSystem.Read(ctx, name, off, limit)
+}
@@ -0,0 +1,145 @@
+package export
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alist-org/alist/v3/internal/model"
+	"github.com/pkg/errors"
+)
+
+// memoryCacheObjectSize is the size of the largest object kept by WithMemoryCache
+const memoryCacheObjectSize = 1 << 20
+
+// WithMemoryCache keeps the content of the objects up to 1MiB read by Read in memory, once they
+// are read first, which suits the many small blocks written by JuiceFS. The objects take at most
+// maxBytes, the least recently read ones are dropped first, and an object is dropped once it's
+// put or deleted, or read in another version by its size and modified time
+func WithMemoryCache(maxBytes int64) Option {
+	return func(c *config) {
+		c.memCacheBytes = maxBytes
+	}
+}
+
+// memCache keeps the content of objects by path
+type memCache struct {
+	i        *Impl
+	maxBytes int64
+
+	mu   sync.Mutex
+	used int64
+	// ll has the most recently read entries at the front
+	ll      *list.List
+	entries map[string]*list.Element
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type memEntry struct {
+	path     string
+	size     int64
+	modified time.Time
+	data     []byte
+}
+
+func newMemCache(i *Impl) *memCache {
+	if i.conf.memCacheBytes <= 0 {
+		return nil
+	}
+	return &memCache{i: i, maxBytes: i.conf.memCacheBytes, ll: list.New(), entries: map[string]*list.Element{}}
+}
+
+// MemoryCacheStats returns the lookups of the cache enabled by WithMemoryCache,
+// the objects too large to be kept aren't looked up
+func (i *Impl) MemoryCacheStats() CacheStats {
+	if i.memCache == nil {
+		return CacheStats{}
+	}
+	return CacheStats{Hits: i.memCache.hits.Load(), Misses: i.memCache.misses.Load()}
+}
+
+// read returns the range of file at path from the cache, file is read whole and kept first if
+// it isn't yet. It returns nil without an error if file is too large to be kept
+func (c *memCache) read(ctx context.Context, path string, file model.Obj, off, limit int64) (io.ReadCloser, error) {
+	if c == nil || file.GetSize() > min(memoryCacheObjectSize, c.maxBytes) {
+		return nil, nil
+	}
+	data, ok := c.get(path, file)
+	c.i.cacheLookup("memory", ok)
+	if ok {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+		rc, err := c.i.rangeRead(ctx, file, 0, file.GetSize())
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		data = make([]byte, file.GetSize())
+		if _, err := io.ReadFull(rc, data); err != nil {
+			return nil, errors.WithMessage(err, "failed to read the object to cache")
+		}
+		c.set(&memEntry{path: path, size: file.GetSize(), modified: file.ModTime(), data: data})
+	}
+	// the reader copies out of data, which is never changed
+	return io.NopCloser(bytes.NewReader(data[off : off+limit])), nil
+}
+
+func (c *memCache) get(path string, file model.Obj) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[path]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*memEntry)
+	if e.size != file.GetSize() || !e.modified.Equal(file.ModTime()) {
+		c.remove(el)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return e.data, true
+}
+
+// set keeps e and drops the least recently read entries beyond maxBytes
+func (c *memCache) set(e *memEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.path]; ok {
+		c.remove(el)
+	}
+	c.entries[e.path] = c.ll.PushFront(e)
+	c.used += e.size
+	for c.used > c.maxBytes {
+		c.remove(c.ll.Back())
+	}
+}
+
+func (c *memCache) remove(el *list.Element) {
+	e := el.Value.(*memEntry)
+	c.ll.Remove(el)
+	delete(c.entries, e.path)
+	c.used -= e.size
+}
+
+// forget drops the objects at path and below it
+func (c *memCache) forget(path string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	for p, el := range c.entries {
+		if p == path || strings.HasPrefix(p, prefix) {
+			c.remove(el)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Package metrics exports the operations of an export.FileSystem as prometheus metrics,
+// it's a package of its own so that export doesn't depend on the prometheus client
+package metrics
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alist-org/alist/v3/export"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The names of the metrics, they are kept stable across releases
+const (
+	// OpDuration is a histogram of the seconds taken by the operations, labeled by op and outcome,
+	// the outcome is "ok" or the kind of the error, like "not_found"
+	OpDuration = "alist_export_operation_duration_seconds"
+	// OpsInFlight is a gauge of the running operations, labeled by op
+	OpsInFlight = "alist_export_operations_in_flight"
+	// TransferredBytes is a counter of the bytes transferred, labeled by direction, which is "upload" or "download"
+	TransferredBytes = "alist_export_transferred_bytes_total"
+	// CacheLookups is a counter of the cache lookups, labeled by cache and result, which is "hit" or "miss"
+	CacheLookups = "alist_export_cache_lookups_total"
+	// CacheHitRatio is a gauge of the hits of all lookups of each cache, labeled by cache
+	CacheHitRatio = "alist_export_cache_hit_ratio"
+)
+
+type collector struct {
+	duration    *prometheus.HistogramVec
+	inflight    *prometheus.GaugeVec
+	transferred *prometheus.CounterVec
+	lookups     *prometheus.CounterVec
+	hitRatio    *prometheus.GaugeVec
+
+	mu   sync.Mutex
+	hits map[string][2]float64
+}
+
+var (
+	collectorsMu sync.Mutex
+	collectors   = map[prometheus.Registerer]*collector{}
+)
+
+// WithMetrics registers the metrics of the FileSystem in reg, FileSystems given the same reg share the metrics
+func WithMetrics(reg prometheus.Registerer) export.Option {
+	return export.WithObserver(collectorOf(reg))
+}
+
+// collectorOf returns the collector registered in reg, registering a new one for the first time
+func collectorOf(reg prometheus.Registerer) *collector {
+	collectorsMu.Lock()
+	defer collectorsMu.Unlock()
+	if c, ok := collectors[reg]; ok {
+		return c
+	}
+	c := &collector{
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    OpDuration,
+			Help:    "Seconds taken by the operations of the storage.",
+			Buckets: prometheus.ExponentialBuckets(0.005, 4, 8),
+		}, []string{"op", "outcome"}),
+		inflight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: OpsInFlight,
+			Help: "Operations of the storage running now.",
+		}, []string{"op"}),
+		transferred: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: TransferredBytes,
+			Help: "Bytes uploaded to or downloaded from the storage.",
+		}, []string{"direction"}),
+		lookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: CacheLookups,
+			Help: "Lookups of the caches of the storage.",
+		}, []string{"cache", "result"}),
+		hitRatio: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: CacheHitRatio,
+			Help: "Hits of all lookups of the caches of the storage.",
+		}, []string{"cache"}),
+		hits: map[string][2]float64{},
+	}
+	for _, m := range []prometheus.Collector{c.duration, c.inflight, c.transferred, c.lookups, c.hitRatio} {
+		if err := reg.Register(m); err != nil {
+			// registered by something else, the metrics of the FileSystem won't show up in reg then
+			var are prometheus.AlreadyRegisteredError
+			if !errors.As(err, &are) {
+				panic(err)
+			}
+		}
+	}
+	collectors[reg] = c
+	return c
+}
+
+func outcome(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	if k := export.KindOf(err); k != export.KindOther {
+		return strings.ReplaceAll(k.String(), " ", "_")
+	}
+	return "error"
+}
+
+func (c *collector) StartOp(ctx context.Context, op, name string) (context.Context, func(err error)) {
+	start := time.Now()
+	g := c.inflight.WithLabelValues(op)
+	g.Inc()
+	return ctx, func(err error) {
+		g.Dec()
+		c.duration.WithLabelValues(op, outcome(err)).Observe(time.Since(start).Seconds())
+	}
+}
+
+func (c *collector) Transferred(upload bool, n int64) {
+	direction := "download"
+	if upload {
+		direction = "upload"
+	}
+	c.transferred.WithLabelValues(direction).Add(float64(n))
+}
+
+func (c *collector) CacheLookup(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	c.lookups.WithLabelValues(cache, result).Inc()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := c.hits[cache]
+	if hit {
+		h[0]++
+	}
+	h[1]++
+	c.hits[cache] = h
+	c.hitRatio.WithLabelValues(cache).Set(h[0] / h[1])
+}
@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alist-org/alist/v3/drivers/local"
+	"github.com/alist-org/alist/v3/export"
+	"github.com/alist-org/alist/v3/internal/driver"
+	"github.com/alist-org/alist/v3/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	export.Register("test-local", func() driver.Driver {
+		return &local.Local{}
+	})
+}
+
+func TestWithMetrics(t *testing.T) {
+	ctx := context.Background()
+	reg := prometheus.NewRegistry()
+	addition, _ := utils.Json.MarshalToString(map[string]string{"root_folder_path": t.TempDir()})
+	fsys, err := export.NewByName(ctx, "test-local", addition, WithMetrics(reg), export.WithObjCache(16, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Put(ctx, "a", strings.NewReader("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := fsys.Read(ctx, "a", 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.ReadAll(rc)
+	rc.Close()
+	if _, err := fsys.Stat(ctx, "missing"); err == nil {
+		t.Fatal("missing should not exist")
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := map[string]bool{}
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			key := f.GetName()
+			for _, l := range m.GetLabel() {
+				key += "," + l.GetName() + "=" + l.GetValue()
+			}
+			series[key] = true
+		}
+	}
+	for _, want := range []string{
+		OpDuration + ",op=put,outcome=ok",
+		OpDuration + ",op=read,outcome=ok",
+		OpDuration + ",op=stat,outcome=not_found",
+		OpsInFlight + ",op=read",
+		TransferredBytes + ",direction=upload",
+		TransferredBytes + ",direction=download",
+		CacheLookups + ",cache=obj,result=miss",
+		CacheHitRatio + ",cache=obj",
+	} {
+		if !series[want] {
+			t.Errorf("series %s is missing in %v", want, series)
+		}
+	}
+}
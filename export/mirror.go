@@ -0,0 +1,466 @@
+package export
+
+import (
+	"context"
+	"io"
+	stdpath "path"
+	"sync"
+	"time"
+
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/alist-org/alist/v3/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+// MirrorOptions configures NewMirror
+type MirrorOptions struct {
+	// Concurrent puts to both storages at once, the body being read once for both, instead of
+	// copying the object put to the primary by CopyBetween afterwards
+	Concurrent bool
+	// Repair is called with the objects left different between the storages by an op which
+	// succeeded on one side only, so they can be reconciled later by ReconcileMirror
+	Repair func(MirrorRepair)
+	// ReadPolicy spreads Read, Open and OpenReaderAt across both storages, like RoundRobin, instead
+	// of reading the primary. A read failing with a retryable error or missing the object is tried
+	// on the other storage, as the secondary may lag behind
+	ReadPolicy ReadPolicy
+	// EjectAfter is how many retryable errors in a row keep a storage from being picked by
+	// ReadPolicy for EjectFor, 3 and 30s if <= 0
+	EjectAfter int
+	EjectFor   time.Duration
+}
+
+// MirrorRepair is an object of a mirror which is to be made in the secondary like in the primary
+type MirrorRepair struct {
+	Op   string
+	Name string
+	// Err is the error of the side which failed
+	Err error
+}
+
+// NewMirror returns a FileSystem writing to both primary and secondary: the puts, deletes and other
+// writes are done on the primary, failing with it, then on the secondary, whose failures are given
+// to opts.Repair. Read, Open, OpenReaderAt and Stat fail over to the secondary on the retryable
+// errors of the primary, see ErrorKind, or the first three are spread by opts.ReadPolicy.
+// The other reads are of the primary
+func NewMirror(_ context.Context, primary, secondary FileSystem, opts MirrorOptions) FileSystem {
+	m := &mirror{FileSystem: primary, secondary: secondary, opts: opts}
+	if opts.ReadPolicy != nil {
+		m.replicas = newReplicaSet([]FileSystem{primary, secondary}, opts)
+	}
+	return m
+}
+
+// ReconcileMirror makes the object name of the secondary like the one of the primary after r:
+// it's removed if the primary doesn't have it, copied by CopyBetween if it's a file, and the tree
+// is copied by CopyTreeBetween if it's a dir, where the objects absent in the primary are kept
+func ReconcileMirror(ctx context.Context, primary, secondary FileSystem, r MirrorRepair) error {
+	info, err := primary.Stat(ctx, r.Name)
+	switch {
+	case errs.IsObjectNotFound(err):
+		return secondary.RemoveAll(ctx, r.Name)
+	case err != nil:
+		return err
+	case !info.IsDir:
+		return CopyBetween(ctx, primary, secondary, r.Name, WithConflict(ConflictOverwrite))
+	}
+	failed, err := CopyTreeBetween(ctx, primary, secondary, r.Name, 0, WithConflict(ConflictOverwrite))
+	if err != nil {
+		return err
+	}
+	for name, err := range failed {
+		return errors.WithMessagef(err, "failed to copy %d objects, like [%s]", len(failed), name)
+	}
+	return nil
+}
+
+// mirror is the FileSystem of NewMirror, the ops not overridden are of the primary
+type mirror struct {
+	FileSystem
+	secondary FileSystem
+	opts      MirrorOptions
+	// replicas are the storages read by ReadPolicy, nil without one
+	replicas *replicaSet
+}
+
+func (m *mirror) repair(op, name string, err error) {
+	if m.opts.Repair != nil {
+		m.opts.Repair(MirrorRepair{Op: op, Name: name, Err: err})
+	}
+}
+
+// replicate does f on the primary, then on the secondary unless it failed,
+// names are the objects to repair if the secondary fails
+func (m *mirror) replicate(op string, f func(l FileSystem) error, names ...string) error {
+	if err := f(m.FileSystem); err != nil {
+		return err
+	}
+	if err := f(m.secondary); err != nil {
+		for _, name := range names {
+			m.repair(op, name, err)
+		}
+	}
+	return nil
+}
+
+// copy copies the object name of the primary to the secondary
+func (m *mirror) copy(ctx context.Context, op, name string) {
+	if _, err := copyBetween(ctx, m.FileSystem, m.secondary, name, WithConflict(ConflictOverwrite)); err != nil {
+		m.repair(op, name, err)
+	}
+}
+
+// put puts body by put to the primary then copies it, or to both at once if Concurrent
+func (m *mirror) put(ctx context.Context, name string, body io.Reader, put func(l FileSystem, r io.Reader, secondary bool) (ObjInfo, error)) (ObjInfo, error) {
+	if !m.opts.Concurrent {
+		info, err := put(m.FileSystem, body, false)
+		if err != nil {
+			return ObjInfo{}, err
+		}
+		if info.Name != "" {
+			// the name put, e.g. by ConflictKeepBoth
+			name = stdpath.Join(stdpath.Dir(name), info.Name)
+		}
+		m.copy(ctx, "put", name)
+		return info, nil
+	}
+	var info ObjInfo
+	perr, serr := tee(body, func(r io.Reader) (err error) {
+		info, err = put(m.FileSystem, r, false)
+		return err
+	}, func(r io.Reader) error {
+		_, err := put(m.secondary, r, true)
+		return err
+	})
+	switch {
+	case perr != nil && serr == nil:
+		m.repair("put", name, perr)
+	case perr == nil && serr != nil:
+		m.repair("put", name, serr)
+	}
+	return info, perr
+}
+
+// tee calls primary and secondary at once with the content of body, which is read once.
+// The secondary failing doesn't stall the primary, whose error fails the reads of the secondary
+func tee(body io.Reader, primary, secondary func(r io.Reader) error) (perr, serr error) {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := secondary(pr)
+		// the rest is read so the primary isn't blocked
+		_, _ = io.Copy(io.Discard, pr)
+		done <- err
+	}()
+	perr = primary(io.TeeReader(body, pw))
+	pw.CloseWithError(perr)
+	return perr, <-done
+}
+
+func (m *mirror) Put(ctx context.Context, name string, body io.Reader) error {
+	_, err := m.PutWithOptions(ctx, name, body)
+	return err
+}
+
+func (m *mirror) PutWithSize(ctx context.Context, name string, body io.Reader, size int64) error {
+	_, err := m.put(ctx, name, body, func(l FileSystem, r io.Reader, _ bool) (ObjInfo, error) {
+		return ObjInfo{}, l.PutWithSize(ctx, name, r, size)
+	})
+	return err
+}
+
+func (m *mirror) PutResult(ctx context.Context, name string, body io.Reader) (ObjInfo, error) {
+	return m.PutWithOptions(ctx, name, body)
+}
+
+func (m *mirror) PutWithOptions(ctx context.Context, name string, body io.Reader, opts ...PutOption) (ObjInfo, error) {
+	return m.put(ctx, name, body, func(l FileSystem, r io.Reader, secondary bool) (ObjInfo, error) {
+		if secondary {
+			// the progress and resume state are of the primary
+			o := newPutOptions(opts)
+			o.progress, o.resumeState = nil, nil
+			return l.PutWithOptions(ctx, name, r, func(p *putOptions) { *p = o })
+		}
+		return l.PutWithOptions(ctx, name, r, opts...)
+	})
+}
+
+func (m *mirror) PutWithHash(ctx context.Context, name string, size int64, hashes utils.HashInfo, body io.Reader) error {
+	_, err := m.put(ctx, name, body, func(l FileSystem, r io.Reader, _ bool) (ObjInfo, error) {
+		return ObjInfo{}, l.PutWithHash(ctx, name, size, hashes, r)
+	})
+	return err
+}
+
+// PutIfAbsent is never concurrent, so that the secondary isn't overwritten if the object exists
+func (m *mirror) PutIfAbsent(ctx context.Context, name string, body io.Reader) error {
+	if err := m.FileSystem.PutIfAbsent(ctx, name, body); err != nil {
+		return err
+	}
+	m.copy(ctx, "put", name)
+	return nil
+}
+
+func (m *mirror) ResumePut(ctx context.Context, name string, state []byte, body io.ReadSeeker, opts ...PutOption) error {
+	if err := m.FileSystem.ResumePut(ctx, name, state, body, opts...); err != nil {
+		return err
+	}
+	m.copy(ctx, "put", name)
+	return nil
+}
+
+// PutBatch puts items to the primary, then copies the ones put to the secondary
+func (m *mirror) PutBatch(ctx context.Context, items []PutItem, parallel int) []error {
+	results := m.FileSystem.PutBatch(ctx, items, parallel)
+	if parallel <= 0 {
+		parallel = defaultPutParallel
+	}
+	forEach(ctx, parallel, len(items), func(n int) {
+		if results[n] == nil {
+			m.copy(ctx, "put", items[n].Name)
+		}
+	})
+	return results
+}
+
+func (m *mirror) Append(ctx context.Context, name string, body io.Reader) error {
+	if err := m.FileSystem.Append(ctx, name, body); err != nil {
+		return err
+	}
+	m.copy(ctx, "append", name)
+	return nil
+}
+
+func (m *mirror) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	w, err := m.FileSystem.Create(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &mirrorWriter{WriteCloser: w, m: m, ctx: ctx, name: name}, nil
+}
+
+// mirrorWriter copies the object written to the secondary once closed
+type mirrorWriter struct {
+	io.WriteCloser
+	m    *mirror
+	ctx  context.Context
+	name string
+	once sync.Once
+}
+
+func (w *mirrorWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	w.once.Do(func() { w.m.copy(w.ctx, "put", w.name) })
+	return nil
+}
+
+func (m *mirror) Touch(ctx context.Context, name string) error {
+	return m.replicate("touch", func(l FileSystem) error { return l.Touch(ctx, name) }, name)
+}
+
+func (m *mirror) WriteAt(ctx context.Context, name string, off int64, data []byte) error {
+	return m.replicate("writeat", func(l FileSystem) error { return l.WriteAt(ctx, name, off, data) }, name)
+}
+
+func (m *mirror) Delete(ctx context.Context, name string) error {
+	return m.replicate("delete", func(l FileSystem) error { return l.Delete(ctx, name) }, name)
+}
+
+// DeleteBatch deletes names from the primary, then the ones deleted from the secondary
+func (m *mirror) DeleteBatch(ctx context.Context, names []string, parallel int) map[string]error {
+	failed := m.FileSystem.DeleteBatch(ctx, names, parallel)
+	deleted := make([]string, 0, len(names))
+	for _, name := range names {
+		if failed[name] == nil {
+			deleted = append(deleted, name)
+		}
+	}
+	for name, err := range m.secondary.DeleteBatch(ctx, deleted, parallel) {
+		m.repair("delete", name, err)
+	}
+	return failed
+}
+
+func (m *mirror) RemoveAll(ctx context.Context, dir string) error {
+	return m.replicate("delete", func(l FileSystem) error { return l.RemoveAll(ctx, dir) }, dir)
+}
+
+func (m *mirror) Mkdir(ctx context.Context, dir string) error {
+	return m.replicate("mkdir", func(l FileSystem) error { return l.Mkdir(ctx, dir) }, dir)
+}
+
+func (m *mirror) Rename(ctx context.Context, name, newName string) error {
+	to := stdpath.Join(stdpath.Dir(toSlash(name)), stdpath.Base(toSlash(newName)))
+	return m.replicate("rename", func(l FileSystem) error { return l.Rename(ctx, name, newName) }, name, to)
+}
+
+func (m *mirror) Move(ctx context.Context, src, dstDir string) error {
+	to := stdpath.Join(toSlash(dstDir), stdpath.Base(toSlash(src)))
+	return m.replicate("move", func(l FileSystem) error { return l.Move(ctx, src, dstDir) }, src, to)
+}
+
+func (m *mirror) Copy(ctx context.Context, src, dstDir string) error {
+	to := stdpath.Join(toSlash(dstDir), stdpath.Base(toSlash(src)))
+	return m.replicate("copy", func(l FileSystem) error { return l.Copy(ctx, src, dstDir) }, to)
+}
+
+// UploadArchive expands the archive in both at once, it's read once
+func (m *mirror) UploadArchive(ctx context.Context, dir string, r io.Reader, format ArchiveFormat, opts ...ArchiveOption) error {
+	perr, serr := tee(r, func(r io.Reader) error {
+		return m.FileSystem.UploadArchive(ctx, dir, r, format, opts...)
+	}, func(r io.Reader) error {
+		return m.secondary.UploadArchive(ctx, dir, r, format, opts...)
+	})
+	if perr == nil && serr != nil {
+		m.repair("unarchive", dir, serr)
+	}
+	return perr
+}
+
+// SyncUp syncs the local dir to the primary, then to the secondary
+func (m *mirror) SyncUp(ctx context.Context, localDir, remoteDir string, opts SyncOptions) (SyncReport, error) {
+	r, err := m.FileSystem.SyncUp(ctx, localDir, remoteDir, opts)
+	if err != nil || opts.DryRun {
+		return r, err
+	}
+	sr, err := m.secondary.SyncUp(ctx, localDir, remoteDir, opts)
+	if err != nil {
+		m.repair("syncup", remoteDir, err)
+	}
+	for name, err := range sr.Failed {
+		m.repair("syncup", stdpath.Join(remoteDir, name), err)
+	}
+	return r, nil
+}
+
+// failover calls f with the primary, then with the secondary if it failed with a retryable error,
+// the error of the primary is returned if both fail
+func (m *mirror) failover(f func(l FileSystem) error) error {
+	err := f(m.FileSystem)
+	if err == nil || !KindOf(err).Retryable() {
+		return err
+	}
+	if f(m.secondary) == nil {
+		return nil
+	}
+	return err
+}
+
+func (m *mirror) Read(ctx context.Context, name string, off, limit int64) (rc io.ReadCloser, err error) {
+	f := func(l FileSystem) (err error) {
+		rc, err = l.Read(ctx, name, off, limit)
+		return err
+	}
+	if m.replicas == nil {
+		return rc, m.failover(f)
+	}
+	release, err := m.replicas.read(f)
+	if err != nil {
+		return nil, err
+	}
+	return &releaseReadCloser{ReadCloser: rc, release: release}, nil
+}
+
+func (m *mirror) Open(ctx context.Context, name string) (r io.ReadSeekCloser, err error) {
+	f := func(l FileSystem) (err error) {
+		r, err = l.Open(ctx, name)
+		return err
+	}
+	if m.replicas == nil {
+		return r, m.failover(f)
+	}
+	release, err := m.replicas.read(f)
+	if err != nil {
+		return nil, err
+	}
+	return &releaseReadSeekCloser{ReadSeekCloser: r, release: release}, nil
+}
+
+func (m *mirror) OpenReaderAt(ctx context.Context, name string) (r io.ReaderAt, c io.Closer, err error) {
+	f := func(l FileSystem) (err error) {
+		r, c, err = l.OpenReaderAt(ctx, name)
+		return err
+	}
+	if m.replicas == nil {
+		return r, c, m.failover(f)
+	}
+	release, err := m.replicas.read(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r, &releaseCloser{Closer: c, release: release}, nil
+}
+
+func (m *mirror) Stat(ctx context.Context, name string) (info ObjInfo, err error) {
+	err = m.failover(func(l FileSystem) (err error) {
+		info, err = l.Stat(ctx, name)
+		return err
+	})
+	return info, err
+}
+
+func (m *mirror) Flush() {
+	m.FileSystem.Flush()
+	m.secondary.Flush()
+}
+
+// ApplyLifecycle applies rules to the primary, then to the secondary, whose failures are repaired
+func (m *mirror) ApplyLifecycle(ctx context.Context, rules []LifecycleRule) (LifecycleReport, error) {
+	r, err := m.FileSystem.ApplyLifecycle(ctx, rules)
+	if err != nil {
+		return r, err
+	}
+	sr, err := m.secondary.ApplyLifecycle(ctx, rules)
+	if err != nil {
+		m.repair("lifecycle", "", err)
+	}
+	for name, err := range sr.Failed {
+		m.repair("lifecycle", name, err)
+	}
+	return r, nil
+}
+
+// StartLifecycle applies rules to each of the primary and the secondary in the background
+func (m *mirror) StartLifecycle(rules []LifecycleRule, interval time.Duration) error {
+	if err := m.FileSystem.StartLifecycle(rules, interval); err != nil {
+		return err
+	}
+	return m.secondary.StartLifecycle(rules, interval)
+}
+
+func (m *mirror) Restore(ctx context.Context, name string) error {
+	return m.replicate("restore", func(l FileSystem) error { return l.Restore(ctx, name) }, name)
+}
+
+// EmptyTrash empties the trash of the primary, then of the secondary, and returns how many
+// batches of the primary are removed
+func (m *mirror) EmptyTrash(ctx context.Context, olderThan time.Duration) (int, error) {
+	n, err := m.FileSystem.EmptyTrash(ctx, olderThan)
+	if err != nil {
+		return n, err
+	}
+	if _, err := m.secondary.EmptyTrash(ctx, olderThan); err != nil {
+		m.repair("emptytrash", "", err)
+	}
+	return n, nil
+}
+
+// RestoreVersion restores the version of the primary, then copies it to the secondary, whose
+// versions have other IDs
+func (m *mirror) RestoreVersion(ctx context.Context, name, version string) error {
+	if err := m.FileSystem.RestoreVersion(ctx, name, version); err != nil {
+		return err
+	}
+	m.copy(ctx, "restoreversion", name)
+	return nil
+}
+
+func (m *mirror) Close() error {
+	err := m.FileSystem.Close()
+	if serr := m.secondary.Close(); err == nil {
+		err = serr
+	}
+	return err
+}
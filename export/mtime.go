@@ -0,0 +1,12 @@
+package export
+
+import "time"
+
+// WithModTime sets the modified time of the object put to t instead of the time of the put,
+// e.g. to keep the times of the files synced. Drivers ignoring the time of the objects put
+// still stamp their own, which Stat reports, so that it can be told whether t was kept
+func WithModTime(t time.Time) PutOption {
+	return func(o *putOptions) {
+		o.modTime = t
+	}
+}
@@ -0,0 +1,146 @@
+package export
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Observer is notified of the operations of a FileSystem, e.g. to export metrics,
+// the methods are called concurrently and must not block
+type Observer interface {
+	// StartOp is called when the public operation op on name starts, the returned func
+	// is called with its error when it ends
+	StartOp(ctx context.Context, op, name string) (context.Context, func(err error))
+	// Transferred is called with the bytes uploaded or, if upload is false, downloaded
+	Transferred(upload bool, n int64)
+	// CacheLookup is called on each lookup of cache, which is "list", "obj", "link" or "memory"
+	CacheLookup(cache string, hit bool)
+}
+
+// CallObserver is an Observer also notified of the calls to the driver
+type CallObserver interface {
+	Observer
+	// StartCall is called when call on path starts, which is the Get, List, Link, Put or Append of the driver,
+	// or Download spanning the range request of Read and the reading of it. The returned func
+	// is called with the bytes transferred and the error when it ends
+	StartCall(ctx context.Context, call, path string) (context.Context, func(n int64, err error))
+}
+
+// WithObserver notifies o of the operations, it can be given more than once
+func WithObserver(o Observer) Option {
+	return func(c *config) {
+		c.observers = append(c.observers, o)
+	}
+}
+
+// startOp starts the public operation op on name, the returned func wraps the error
+// like wrapErr, ends the operation for the observers and audits it
+func (i *Impl) startOp(ctx context.Context, op, name string) (context.Context, func(err *error)) {
+	start := time.Now()
+	t := &opTrace{}
+	ctx = context.WithValue(ctx, opTraceKey{}, t)
+	ends := make([]func(error), len(i.conf.observers))
+	for n, o := range i.conf.observers {
+		ctx, ends[n] = o.StartOp(ctx, op, name)
+	}
+	return ctx, func(err *error) {
+		i.wrapErr(err, op, name)
+		if took := time.Since(start); i.conf.slowThreshold > 0 && took > i.conf.slowThreshold {
+			i.conf.logger.Warn("slow operation", "op", op, "path", name, "duration", took, "bytes", t.bytes.Load(),
+				"lookup", time.Duration(t.lookup.Load()), "link", time.Duration(t.link.Load()),
+				"transfer", time.Duration(t.transfer.Load()), "error", errValue(*err))
+		}
+		if aop, ok := auditOps[op]; ok && i.conf.audit != nil {
+			i.audit(ctx, aop, name, t, *err)
+		}
+		for n := len(ends) - 1; n >= 0; n-- {
+			ends[n](*err)
+		}
+	}
+}
+
+// startCall starts call on path for the observers which are CallObserver,
+// the time it takes is added to the phase of the operation running it
+func (i *Impl) startCall(ctx context.Context, call, path string) (context.Context, func(n int64, err error)) {
+	start := time.Now()
+	t := traceOf(ctx)
+	var ends []func(int64, error)
+	for _, o := range i.conf.observers {
+		if co, ok := o.(CallObserver); ok {
+			var end func(int64, error)
+			ctx, end = co.StartCall(ctx, call, path)
+			ends = append(ends, end)
+		}
+	}
+	return ctx, func(n int64, err error) {
+		t.add(call, time.Since(start), n)
+		for k := len(ends) - 1; k >= 0; k-- {
+			ends[k](n, err)
+		}
+	}
+}
+
+type opTraceKey struct{}
+
+// opTrace is the time an operation spends in each phase, looking up objects, getting links
+// and transferring data, and the bytes transferred. size and target are set by the operation
+// itself for the audit
+type opTrace struct {
+	lookup   atomic.Int64
+	link     atomic.Int64
+	transfer atomic.Int64
+	bytes    atomic.Int64
+
+	size   int64
+	target string
+}
+
+// traceOf returns the trace of the operation running with ctx, or nil
+func traceOf(ctx context.Context) *opTrace {
+	t, _ := ctx.Value(opTraceKey{}).(*opTrace)
+	return t
+}
+
+// setSize sets the size of the object written or removed by the operation, t may be nil
+func (t *opTrace) setSize(n int64) {
+	if t != nil {
+		t.size = n
+	}
+}
+
+// add adds a call of the driver to its phase, t may be nil if the call isn't made by an operation
+func (t *opTrace) add(call string, d time.Duration, n int64) {
+	if t == nil {
+		return
+	}
+	switch call {
+	case "Get", "List":
+		t.lookup.Add(int64(d))
+	case "Link":
+		t.link.Add(int64(d))
+	default:
+		t.transfer.Add(int64(d))
+	}
+	t.bytes.Add(n)
+}
+
+func (i *Impl) uploaded(n int64) {
+	i.stats.bytesUploaded.Add(uint64(n))
+	for _, o := range i.conf.observers {
+		o.Transferred(true, n)
+	}
+}
+
+func (i *Impl) downloadedBytes(n int) {
+	i.stats.bytesDownloaded.Add(uint64(n))
+	for _, o := range i.conf.observers {
+		o.Transferred(false, int64(n))
+	}
+}
+
+func (i *Impl) cacheLookup(cache string, hit bool) {
+	for _, o := range i.conf.observers {
+		o.CacheLookup(cache, hit)
+	}
+}
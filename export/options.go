@@ -0,0 +1,398 @@
+package export
+
+import (
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alist-org/alist/v3/drivers/base"
+	"github.com/alist-org/alist/v3/internal/conf"
+	"github.com/alist-org/alist/v3/internal/stream"
+	"github.com/alist-org/alist/v3/pkg/utils"
+	"github.com/go-resty/resty/v2"
+	"github.com/pkg/errors"
+)
+
+// config holds the behaviors of a FileSystem which can be changed by Option
+type config struct {
+	baseDir          string
+	moveFallback     bool
+	noCopyFallback   bool
+	removeParallel   int
+	spoolThreshold   int64
+	httpClient       *http.Client
+	noAutoMkdir      bool
+	retryAttempts    uint
+	retryDelay       time.Duration
+	retryMaxElapsed  time.Duration
+	cacheTTL         time.Duration
+	listCacheEntries int
+	missingTTL       time.Duration
+	objCacheEntries  int
+	objTTL           time.Duration
+	alistConf        *conf.Config
+	readOnly         bool
+	readTimeout      time.Duration
+	writeTimeout     time.Duration
+	metaTimeout      time.Duration
+	metaRate         float64
+	metaBurst        int
+	dataRate         float64
+	dataBurst        int
+
+	metaConcurrency     int
+	uploadConcurrency   int
+	downloadConcurrency int
+	readConcurrency     int
+	readPartSize        int64
+	readaheadChunks     int
+	readaheadBytes      int64
+	diskCacheDir        string
+	diskCacheBytes      int64
+	memCacheBytes       int64
+
+	breakerThreshold int
+	breakerCooldown  time.Duration
+	breakerOnChange  func(from, to BreakerState)
+
+	linkTTL       time.Duration
+	linkRefreshes int
+	stallTimeout  time.Duration
+	stallRetries  int
+
+	observers     []Observer
+	logger        Logger
+	slowThreshold time.Duration
+	audit         AuditSink
+	uploadHashes  []*utils.HashType
+	verifyPut     bool
+	atomicPut     bool
+	conflict      ConflictPolicy
+	writeAtMax    int64
+	appendMax     int64
+	walkParallel  int
+	verifyRead    bool
+	partSize      int64
+	shardDepth    int
+	shardWidth    int
+	trashDir      string
+	trashKeep     time.Duration
+	versioning    bool
+	versionKeep   int
+	versionMaxAge time.Duration
+}
+
+func defaultConfig() config {
+	return config{
+		baseDir:        baseDir,
+		removeParallel: 4,
+		spoolThreshold: stream.InMemoryBufMaxSizeBytes,
+		retryAttempts:  1,
+		logger:         nopLogger{},
+		slowThreshold:  slowOpThreshold,
+		missingTTL:     missingExpiration,
+		retryDelay:     200 * time.Millisecond,
+		linkRefreshes:  defaultLinkRefreshes,
+	}
+}
+
+func (c *config) validate() error {
+	if !path.IsAbs(c.baseDir) || path.Clean(c.baseDir) != c.baseDir {
+		return errors.Errorf("base dir [%s] must be a clean absolute path", c.baseDir)
+	}
+	if c.shardDepth < 0 || c.shardWidth < 0 || c.shardDepth*c.shardWidth > maxShardDigits ||
+		(c.shardDepth > 0) != (c.shardWidth > 0) {
+		return errors.Errorf("sharded layout of depth %d and width %d must have up to %d digits", c.shardDepth, c.shardWidth, maxShardDigits)
+	}
+	if c.trashDir != "" && (strings.Contains(c.trashDir, "/") || c.trashDir == "." || c.trashDir == ".." || c.trashDir == partsDir || c.trashDir == versionsDir) {
+		return errors.Errorf("trash dir [%s] must be a name of a dir under the base dir", c.trashDir)
+	}
+	return nil
+}
+
+type Option func(*config)
+
+// WithBaseDir keeps all objects of the FileSystem under dir of the storage instead of baseDir,
+// so that independent datasets can share one storage
+func WithBaseDir(dir string) Option {
+	return func(c *config) {
+		c.baseDir = dir
+	}
+}
+
+// WithMoveFallback lets Move copy the object and remove the source
+// when the driver can't move, note that the move isn't atomic then
+func WithMoveFallback() Option {
+	return func(c *config) {
+		c.moveFallback = true
+	}
+}
+
+// WithoutCopyFallback makes Copy return errs.NotImplement
+// instead of streaming the object when the driver can't copy
+func WithoutCopyFallback() Option {
+	return func(c *config) {
+		c.noCopyFallback = true
+	}
+}
+
+// WithRemoveParallel sets how many children of a dir RemoveAll removes at the same time
+func WithRemoveParallel(n int) Option {
+	return func(c *config) {
+		if n > 0 {
+			c.removeParallel = n
+		}
+	}
+}
+
+// WithSpoolThreshold sets how many bytes of a body with unknown size are kept in memory,
+// 10MB by default, larger bodies are spooled to a temp file under the TempDir of conf.Conf
+// before uploading, which lets the retries rewind it and is removed once the put is done
+func WithSpoolThreshold(n int64) Option {
+	return func(c *config) {
+		if n >= 0 {
+			c.spoolThreshold = n
+		}
+	}
+}
+
+// WithHTTPClient makes the drivers send requests with c instead of the clients made by base.InitClient.
+// The clients of base are shared by all drivers in the process, so they're set once: the instances
+// made before send requests with c too, and New fails with ErrGlobalConflict given another client
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *config) {
+		c.httpClient = client
+	}
+}
+
+// WithoutAutoMkdir stops New from making the base dir, which must exist then
+func WithoutAutoMkdir() Option {
+	return func(c *config) {
+		c.noAutoMkdir = true
+	}
+}
+
+// WithReadOnly accepts drivers that can't write, all writes fail with ErrReadOnly
+// and the base dir isn't made by New
+func WithReadOnly() Option {
+	return func(c *config) {
+		c.readOnly = true
+	}
+}
+
+// WithRetry sets how many times driver calls are tried before giving up,
+// permanent errors like not found or auth failures are never retried.
+// Uploads are only retried when the body is seekable or has been spooled
+func WithRetry(attempts uint) Option {
+	return func(c *config) {
+		if attempts > 0 {
+			c.retryAttempts = attempts
+		}
+	}
+}
+
+// WithRetryBackoff sets the delay before the first retry, which doubles for each retry with some jitter,
+// and stops retrying once maxElapsed has passed since the first try if it's positive
+func WithRetryBackoff(delay, maxElapsed time.Duration) Option {
+	return func(c *config) {
+		if delay >= 0 {
+			c.retryDelay = delay
+		}
+		c.retryMaxElapsed = maxElapsed
+	}
+}
+
+// WithTimeouts bounds Read with read until the reader is closed, the writes like Put, Delete and Mkdir
+// with write, and each lookup and listing with meta. No deadline is applied for non-positive ones
+func WithTimeouts(read, write, meta time.Duration) Option {
+	return func(c *config) {
+		c.readTimeout = read
+		c.writeTimeout = write
+		c.metaTimeout = meta
+	}
+}
+
+// WithRateLimit limits all driver calls to rps per second with bursts of burst calls,
+// use WithMetaRateLimit or WithDataRateLimit after it to limit one kind of the calls differently
+func WithRateLimit(rps float64, burst int) Option {
+	return func(c *config) {
+		c.metaRate, c.metaBurst = rps, burst
+		c.dataRate, c.dataBurst = rps, burst
+	}
+}
+
+// WithMetaRateLimit limits the metadata calls, which are List, Get, MakeDir, Remove, Rename, Move and Copy
+func WithMetaRateLimit(rps float64, burst int) Option {
+	return func(c *config) {
+		c.metaRate, c.metaBurst = rps, burst
+	}
+}
+
+// WithDataRateLimit limits the data calls, which are Link and Put
+func WithDataRateLimit(rps float64, burst int) Option {
+	return func(c *config) {
+		c.dataRate, c.dataBurst = rps, burst
+	}
+}
+
+// WithMaxConcurrency caps the metadata calls, uploads and downloads in flight at n each,
+// use the options for one kind after it to cap the kind differently
+func WithMaxConcurrency(n int) Option {
+	return func(c *config) {
+		c.metaConcurrency, c.uploadConcurrency, c.downloadConcurrency = n, n, n
+	}
+}
+
+// WithMaxMetaConcurrency caps the metadata calls in flight, which are the calls other than Link and Put
+func WithMaxMetaConcurrency(n int) Option {
+	return func(c *config) {
+		c.metaConcurrency = n
+	}
+}
+
+// WithMaxUploadConcurrency caps the Put calls in flight
+func WithMaxUploadConcurrency(n int) Option {
+	return func(c *config) {
+		c.uploadConcurrency = n
+	}
+}
+
+// WithMaxDownloadConcurrency caps the downloads in flight, a download of Read lasts until
+// the reader is closed, while one of Open or OpenReaderAt only lasts for each request of a range
+func WithMaxDownloadConcurrency(n int) Option {
+	return func(c *config) {
+		c.downloadConcurrency = n
+	}
+}
+
+// WithCircuitBreaker makes driver calls fail fast with ErrStorageUnavailable for cooldown after
+// failures consecutive retryable failures, then one probe call is let through to check the storage.
+// onChange is called on each state change if it's not nil
+func WithCircuitBreaker(failures int, cooldown time.Duration, onChange func(from, to BreakerState)) Option {
+	return func(c *config) {
+		c.breakerThreshold = failures
+		c.breakerCooldown = cooldown
+		c.breakerOnChange = onChange
+	}
+}
+
+// WithLinkCache keeps the URL links of objects for reading them again, until the expiration
+// reported by the driver, or ttl if it's not reported. The cache is disabled by default
+func WithLinkCache(ttl time.Duration) Option {
+	return func(c *config) {
+		c.linkTTL = ttl
+	}
+}
+
+// WithListCache keeps the listed dirs for ttl, evicting the least recently used ones when there are
+// more than maxEntries of them, or never if maxEntries is 0. Writes through the FileSystem drop
+// the listings they change, the cache is disabled by default
+func WithListCache(ttl time.Duration, maxEntries int) Option {
+	return func(c *config) {
+		if ttl >= 0 {
+			c.cacheTTL = ttl
+		}
+		if maxEntries >= 0 {
+			c.listCacheEntries = maxEntries
+		}
+	}
+}
+
+// WithObjCache keeps up to size of the objects resolved or listed for ttl, so that resolving a path
+// doesn't list its parents again. Writes through the FileSystem drop the objects they change,
+// the cache is disabled by default
+func WithObjCache(size int, ttl time.Duration) Option {
+	return func(c *config) {
+		if size >= 0 {
+			c.objCacheEntries = size
+		}
+		c.objTTL = ttl
+	}
+}
+
+// WithNegativeCache remembers that an object is missing for ttl, so that probing it again doesn't
+// list its parent. Objects created through the FileSystem are seen at once, while ones created by
+// others may be taken as missing for ttl. It's 3 seconds by default, 0 disables it
+func WithNegativeCache(ttl time.Duration) Option {
+	return func(c *config) {
+		if ttl >= 0 {
+			c.missingTTL = ttl
+		}
+	}
+}
+
+// WithCacheTTL keeps the listed dirs for ttl without limiting the entries
+//
+// Deprecated: use WithListCache
+func WithCacheTTL(ttl time.Duration) Option {
+	return WithListCache(ttl, 0)
+}
+
+// WithConf makes New use cfg as the configuration of alist. conf.Conf is read by all drivers in
+// the process, so it's set once: New fails with ErrGlobalConflict if conf.Conf is another config
+// already, unless it's the default one set up by a New without WithConf, which cfg replaces.
+// Without it New only sets conf.Conf to the default if it's nil
+func WithConf(cfg *conf.Config) Option {
+	return func(c *config) {
+		c.alistConf = cfg
+	}
+}
+
+// ErrGlobalConflict is returned by New given a setting which differs from the one the process
+// is set up with already, as the drivers read it from the globals of alist
+var ErrGlobalConflict = errors.New("conflicting global setting")
+
+var (
+	// initMu guards the globals of alist set up by New
+	initMu sync.Mutex
+	// defaultConf is the conf.Conf set up by a New without WithConf, which WithConf may replace
+	defaultConf *conf.Config
+	// httpClient is the client of WithHTTPClient the clients of base are set up with
+	httpClient *http.Client
+)
+
+// initGlobals sets up conf.Conf and the clients of base, which are kept if they're set up
+// already so that repeated New calls don't replace them while other instances are using them
+func initGlobals(c config) error {
+	initMu.Lock()
+	defer initMu.Unlock()
+	if c.alistConf != nil && conf.Conf != nil && conf.Conf != defaultConf && conf.Conf != c.alistConf {
+		return errors.WithMessage(ErrGlobalConflict, "conf.Conf is set up with another config")
+	}
+	if c.httpClient != nil && httpClient != nil && httpClient != c.httpClient {
+		return errors.WithMessage(ErrGlobalConflict, "the clients of base are set up with another http.Client")
+	}
+	switch {
+	case c.alistConf != nil:
+		conf.Conf, defaultConf = c.alistConf, nil
+	case conf.Conf == nil:
+		conf.Conf = conf.DefaultConfig()
+		defaultConf = conf.Conf
+	}
+	if c.httpClient != nil && httpClient == nil {
+		setHTTPClient(c.httpClient)
+		httpClient = c.httpClient
+	}
+	if base.RestyClient == nil {
+		base.InitClient()
+	}
+	return nil
+}
+
+// setHTTPClient replaces the clients of base with ones sending requests by c
+func setHTTPClient(c *http.Client) {
+	base.HttpClient = c
+	base.RestyClient = resty.NewWithClient(c).
+		SetHeader("user-agent", base.UserAgent).
+		SetRetryCount(3).
+		SetRetryResetReaders(true).
+		SetTimeout(base.DefaultTimeout)
+	noRedirect := *c
+	noRedirect.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	base.NoRedirectClient = resty.NewWithClient(&noRedirect).
+		SetHeader("user-agent", base.UserAgent)
+}
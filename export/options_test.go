@@ -0,0 +1,1265 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/alist-org/alist/v3/drivers/base"
+	"github.com/alist-org/alist/v3/internal/conf"
+	"github.com/alist-org/alist/v3/internal/driver"
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/pkg/errors"
+)
+
+func TestWithoutAutoMkdir(t *testing.T) {
+	d := newMemDriver()
+	if _, err := NewWithStorage(context.Background(), d, WithoutAutoMkdir()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.file(baseDir); ok {
+		t.Fatalf("%s should not be made", baseDir)
+	}
+	if _, err := NewWithStorage(context.Background(), d); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.file(baseDir); !ok {
+		t.Fatalf("%s should be made", baseDir)
+	}
+}
+
+func TestWithHTTPClient(t *testing.T) {
+	Register("mem-http", func() driver.Driver {
+		return newMemDriver()
+	})
+	old := httpClient
+	t.Cleanup(func() { httpClient = old })
+	httpClient = nil
+	client := &http.Client{}
+	for n := 0; n < 2; n++ {
+		if _, err := NewByName(context.Background(), "mem-http", "{}", WithHTTPClient(client)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if base.HttpClient != client || base.RestyClient.GetClient() != client {
+		t.Fatal("drivers should use the given client")
+	}
+	if _, err := NewByName(context.Background(), "mem-http", "{}", WithHTTPClient(&http.Client{})); !errors.Is(err, ErrGlobalConflict) {
+		t.Fatalf("New shouldn't replace the client set up, got %v", err)
+	}
+	if base.HttpClient != client {
+		t.Fatal("the client set up should be kept")
+	}
+}
+
+func TestNewKeepsConf(t *testing.T) {
+	Register("mem-conf", func() driver.Driver {
+		return newMemDriver()
+	})
+	old, oldDefault := conf.Conf, defaultConf
+	t.Cleanup(func() { conf.Conf, defaultConf = old, oldDefault })
+	cfg := conf.DefaultConfig()
+	cfg.TempDir = t.TempDir()
+	conf.Conf = cfg
+	if _, err := NewByName(context.Background(), "mem-conf", "{}"); err != nil {
+		t.Fatal(err)
+	}
+	client := base.RestyClient
+	if _, err := NewByName(context.Background(), "mem-conf", "{}"); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Conf != cfg {
+		t.Fatal("New should keep the initialized conf")
+	}
+	if base.RestyClient != client {
+		t.Fatal("New should not rebuild the clients")
+	}
+
+	other := conf.DefaultConfig()
+	if _, err := NewByName(context.Background(), "mem-conf", "{}", WithConf(other)); !errors.Is(err, ErrGlobalConflict) {
+		t.Fatalf("New shouldn't replace the conf set up, got %v", err)
+	}
+	if _, err := NewByName(context.Background(), "mem-conf", "{}", WithConf(cfg)); err != nil {
+		t.Fatal(err)
+	}
+
+	conf.Conf = nil
+	if _, err := NewByName(context.Background(), "mem-conf", "{}"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewByName(context.Background(), "mem-conf", "{}", WithConf(other)); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Conf != other {
+		t.Fatal("New should replace the default conf by the conf of WithConf")
+	}
+	if base.RestyClient != client {
+		t.Fatal("New should not rebuild the clients for WithConf")
+	}
+	if _, err := NewByName(context.Background(), "mem-conf", "{}", WithConf(cfg)); !errors.Is(err, ErrGlobalConflict) {
+		t.Fatalf("New shouldn't replace the conf of WithConf, got %v", err)
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	ctx := context.Background()
+	d := &memFlaky{memDriver: newMemDriver()}
+	i := newTestFS(t, d)
+	d.failures.Store(1)
+	if _, err := i.List(ctx, "/"); err == nil {
+		t.Fatal("list should fail without retry")
+	}
+
+	i = newTestFS(t, d, WithRetry(3), WithRetryBackoff(time.Millisecond, 0))
+	d.failures.Store(2)
+	if _, err := i.List(ctx, "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	d.putFailures.Store(2)
+	if err := i.Put(ctx, "a", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := d.file(baseDir + "/a"); string(b) != "hello" {
+		t.Fatalf("the body should be rewound before retrying, got %q", b)
+	}
+
+	d.putFailures.Store(1)
+	d.puts.Store(0)
+	body := struct{ io.Reader }{strings.NewReader("hello")}
+	if err := i.PutWithSize(ctx, "b", body, 5); err == nil || d.puts.Load() != 1 {
+		t.Fatalf("a body which can't be rewound should not be retried, puts %d: %v", d.puts.Load(), err)
+	}
+}
+
+func TestRetryPermanent(t *testing.T) {
+	ctx := context.Background()
+	d := &memFlaky{memDriver: newMemDriver(), err: errs.PermissionDenied}
+	i := newTestFS(t, d, WithRetry(3), WithRetryBackoff(time.Millisecond, 0))
+	d.failures.Store(3)
+	d.lists.Store(0)
+	if _, err := i.List(ctx, "/"); !errors.Is(err, errs.PermissionDenied) || d.lists.Load() != 1 {
+		t.Fatalf("permanent errors should not be retried, lists %d: %v", d.lists.Load(), err)
+	}
+
+	d = &memFlaky{memDriver: newMemDriver(), err: errors.New("401 Unauthorized")}
+	i = newTestFS(t, d, WithRetry(3), WithRetryBackoff(time.Millisecond, 0))
+	d.failures.Store(3)
+	d.lists.Store(0)
+	if _, err := i.List(ctx, "/"); err == nil || d.lists.Load() != 1 {
+		t.Fatalf("auth failures should not be retried, lists %d: %v", d.lists.Load(), err)
+	}
+}
+
+func TestRetryMaxElapsed(t *testing.T) {
+	ctx := context.Background()
+	d := &memFlaky{memDriver: newMemDriver()}
+	i := newTestFS(t, d, WithRetry(10), WithRetryBackoff(20*time.Millisecond, 10*time.Millisecond))
+	d.failures.Store(10)
+	d.lists.Store(0)
+	if _, err := i.List(ctx, "/"); err == nil || d.lists.Load() != 2 {
+		t.Fatalf("retrying should stop after max elapsed, lists %d: %v", d.lists.Load(), err)
+	}
+
+	d.failures.Store(0)
+	i = newTestFS(t, d, WithRetry(10), WithRetryBackoff(time.Hour, 0))
+	d.failures.Store(10)
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := i.List(cctx, "/"); err == nil {
+		t.Fatal("retrying should stop when ctx is done")
+	}
+}
+
+func TestWithCacheTTL(t *testing.T) {
+	ctx := context.Background()
+	d := &memFlaky{memDriver: newMemDriver()}
+	i := newTestFS(t, d, WithCacheTTL(time.Minute))
+	if err := i.Put(ctx, "dir/a", strings.NewReader("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.List(ctx, "dir"); err != nil {
+		t.Fatal(err)
+	}
+	lists := d.lists.Load()
+	if _, err := i.List(ctx, "dir"); err != nil {
+		t.Fatal(err)
+	}
+	if d.lists.Load() != lists {
+		t.Fatal("listing should be cached")
+	}
+
+	if err := i.Put(ctx, "dir/b", strings.NewReader("b")); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := i.List(ctx, "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("put should invalidate the listing, got %v", entries)
+	}
+	if err := i.Delete(ctx, "dir/a"); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := i.List(ctx, "dir"); len(entries) != 1 {
+		t.Fatalf("delete should invalidate the listing, got %v", entries)
+	}
+	if err := i.Rename(ctx, "dir/b", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := i.List(ctx, "dir"); len(entries) != 1 || entries[0].Name != "c" {
+		t.Fatalf("rename should invalidate the listing, got %v", entries)
+	}
+}
+
+func TestWithTimeouts(t *testing.T) {
+	ctx := context.Background()
+	d := &memSlow{memDriver: newMemDriver(), delay: time.Minute}
+	i := newTestFS(t, d, WithTimeouts(50*time.Millisecond, 50*time.Millisecond, 50*time.Millisecond))
+	if err := i.Put(ctx, "a", strings.NewReader("a")); err != nil {
+		t.Fatal(err)
+	}
+	d.slow.Store(true)
+
+	check := func(op string, f func() error) {
+		t.Helper()
+		start := time.Now()
+		err := f()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("%s should exceed the deadline, got %v", op, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("%s took %s", op, elapsed)
+		}
+	}
+	check("list", func() error {
+		_, err := i.List(ctx, "/")
+		return err
+	})
+	check("put", func() error {
+		return i.Put(ctx, "b", strings.NewReader("b"))
+	})
+	check("read", func() error {
+		_, err := i.Read(ctx, "a", 0, 1)
+		return err
+	})
+
+	// an earlier deadline of the caller is kept
+	d.slow.Store(false)
+	i = newTestFS(t, d, WithTimeouts(time.Hour, time.Hour, time.Hour))
+	d.slow.Store(true)
+	cctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	check("list with deadline", func() error {
+		_, err := i.List(cctx, "/")
+		return err
+	})
+}
+
+func TestWithRateLimit(t *testing.T) {
+	ctx := context.Background()
+	i := newTestFS(t, newMemDriver(), WithMetaRateLimit(50, 1))
+	start := time.Now()
+	for n := 0; n < 6; n++ {
+		if _, err := i.List(ctx, "/"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// one token is consumed by each list and by getting the listed dir
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("lists should be limited, took %s", elapsed)
+	}
+
+	// data calls are limited separately
+	i = newTestFS(t, newMemDriver(), WithDataRateLimit(0.001, 1))
+	if err := i.Put(ctx, "a", strings.NewReader("a")); err != nil {
+		t.Fatal(err)
+	}
+	start = time.Now()
+	if _, err := i.List(ctx, "/"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("lists should not wait for the data limiter, took %s", elapsed)
+	}
+	cctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := i.Read(cctx, "a", 0, 1); err == nil {
+		t.Fatal("waiting for a token should stop when ctx is done")
+	}
+}
+
+func TestWithMaxConcurrency(t *testing.T) {
+	ctx := context.Background()
+	d := &memSlow{memDriver: newMemDriver(), delay: 20 * time.Millisecond}
+	i := newTestFS(t, d, WithMaxConcurrency(8), WithMaxMetaConcurrency(2))
+	for n := 0; n < 8; n++ {
+		if err := i.Mkdir(ctx, strconv.Itoa(n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.slow.Store(true)
+	var wg sync.WaitGroup
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func(dir string) {
+			defer wg.Done()
+			if _, err := i.List(ctx, dir); err != nil {
+				t.Error(err)
+			}
+		}(strconv.Itoa(n))
+	}
+	wg.Wait()
+	if p := d.peak.Load(); p != 2 {
+		t.Fatalf("at most 2 lists should be in flight, got %d", p)
+	}
+
+	// a blocked acquisition stops when ctx is done
+	d.slow.Store(false)
+	d.delay = time.Second
+	i = newTestFS(t, d, WithMaxMetaConcurrency(1), WithListCache(time.Minute, 0))
+	if _, err := i.List(ctx, "/"); err != nil {
+		t.Fatal(err)
+	}
+	d.slow.Store(true)
+	go i.List(ctx, "0")
+	time.Sleep(20 * time.Millisecond)
+	cctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := i.List(cctx, "1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("list should stop waiting when ctx is done, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("list waited for %s", elapsed)
+	}
+}
+
+func TestWithCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	d := &memFlaky{memDriver: newMemDriver()}
+	var mu sync.Mutex
+	var changes []string
+	i := newTestFS(t, d, WithCircuitBreaker(3, 50*time.Millisecond, func(from, to BreakerState) {
+		mu.Lock()
+		defer mu.Unlock()
+		changes = append(changes, from.String()+"->"+to.String())
+	}))
+	d.failures.Store(100)
+	for n := 0; n < 3; n++ {
+		if _, err := i.List(ctx, "/"); err == nil || errors.Is(err, ErrStorageUnavailable) {
+			t.Fatalf("list should fail with the driver error, got %v", err)
+		}
+	}
+	lists := d.lists.Load()
+	if _, err := i.List(ctx, "/"); !errors.Is(err, ErrStorageUnavailable) {
+		t.Fatalf("list should fail fast when the breaker is open, got %v", err)
+	}
+	if d.lists.Load() != lists {
+		t.Fatal("the driver should not be called when the breaker is open")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	d.failures.Store(0)
+	if _, err := i.List(ctx, "/"); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(changes, ",") != "closed->open,open->half-open,half-open->closed" {
+		t.Fatalf("unexpected state changes %v", changes)
+	}
+}
+
+func TestWithLinkCache(t *testing.T) {
+	ctx := context.Background()
+	d := newMemURL(t)
+	i := newTestFS(t, d, WithLinkCache(time.Minute), WithLinkRefreshes(0))
+	if err := i.Put(ctx, "a", strings.NewReader("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	read := func(off int64) (string, error) {
+		rc, err := i.Read(ctx, "a", off, 2)
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		b, err := io.ReadAll(rc)
+		return string(b), err
+	}
+	for off := int64(0); off < 10; off += 2 {
+		if s, err := read(off); err != nil || s != "0123456789"[off:off+2] {
+			t.Fatalf("unexpected read at %d: %q %v", off, s, err)
+		}
+	}
+	if n := d.links.Load(); n != 1 {
+		t.Fatalf("the link should be resolved once, got %d", n)
+	}
+	if s := i.LinkCacheStats(); s.Hits != 4 || s.Misses != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+
+	// a failed read drops the link
+	d.expired.Store(true)
+	if _, err := read(0); err == nil {
+		t.Fatal("read should fail with an expired link")
+	}
+	d.expired.Store(false)
+	if _, err := read(0); err != nil {
+		t.Fatal(err)
+	}
+	if n := d.links.Load(); n != 2 {
+		t.Fatalf("the link should be resolved again after a failure, got %d", n)
+	}
+}
+
+func TestWithLinkRefreshes(t *testing.T) {
+	ctx := context.Background()
+	d := &memExpiring{memDriver: newMemDriver(), valid: 4}
+	i := newTestFS(t, d)
+	body := "0123456789"
+	if err := i.Put(ctx, "a", strings.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, i, "a", 0, 0); got != body {
+		t.Errorf("the read should go on with new links, got %q", got)
+	}
+	if n := d.links.Load(); n != 3 {
+		t.Errorf("the link should be resolved 3 times, got %d", n)
+	}
+
+	i = newTestFS(t, d, WithLinkRefreshes(1))
+	rc, err := i.Read(ctx, "a", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if b, err := io.ReadAll(rc); err == nil || string(b) != body[:8] {
+		t.Errorf("the read should fail once the refreshes are used up, got %q %v", b, err)
+	}
+}
+
+func TestWithReadStallTimeout(t *testing.T) {
+	ctx := context.Background()
+	d := &memStalling{memDriver: newMemDriver(), at: 3, stalls: 2}
+	i := newTestFS(t, d, WithReadStallTimeout(20*time.Millisecond, 2))
+	body := "0123456789"
+	if err := i.Put(ctx, "a", strings.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, i, "a", 0, 0); got != body {
+		t.Errorf("the stalled range should be read again, got %q", got)
+	}
+	if n := d.ranges.Load(); n != 3 {
+		t.Errorf("the range should be read 3 times, got %d", n)
+	}
+
+	d.ranges.Store(0)
+	d.stalls = 3
+	rc, err := i.Read(ctx, "a", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(rc); !errors.Is(err, ErrReadStalled) || KindOf(err) != KindTemporary {
+		t.Errorf("the read should fail as it stalled, got %v", err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Error(err)
+	}
+
+	// closing the reader early stops the transfer
+	d.ranges.Store(0)
+	if rc, err = i.Read(ctx, "a", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rc.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Error(err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.last.Err() == nil {
+		t.Error("the transfer should be canceled once the reader is closed")
+	}
+}
+
+func TestWithReadahead(t *testing.T) {
+	ctx := context.Background()
+	d := &memRanged{memDriver: newMemDriver(), failAt: -1}
+	i := newTestFS(t, d, WithReadahead(3, 8))
+	body := "0123456789abcdefghij"
+	if err := i.Put(ctx, "a", strings.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+	prefetched := func() (int, int64) {
+		i.readahead.mu.Lock()
+		defer i.readahead.mu.Unlock()
+		n := 0
+		for _, s := range i.readahead.streams {
+			n += len(s.chunks)
+		}
+		return n, i.readahead.used
+	}
+	for off := int64(0); off < 20; off += 4 {
+		if got := readAll(t, i, "a", off, 4); got != body[off:off+4] {
+			t.Fatalf("unexpected read at %d: %q", off, got)
+		}
+		if off == 4 {
+			// 3 chunks are wanted, 2 fit
+			if n, used := prefetched(); n != 2 || used != 8 {
+				t.Errorf("2 chunks of 8 bytes should be prefetched, got %d of %d bytes", n, used)
+			}
+		}
+	}
+	d.rmu.Lock()
+	ranges := d.ranges
+	d.rmu.Unlock()
+	if ranges != 5 {
+		t.Errorf("each range should be read once, got %d ranges", ranges)
+	}
+
+	// read randomly, the chunks are dropped
+	readAll(t, i, "a", 0, 4)
+	readAll(t, i, "a", 4, 4)
+	readAll(t, i, "a", 16, 4)
+	if n, used := prefetched(); n != 0 || used != 0 {
+		t.Errorf("the chunks should be dropped, got %d of %d bytes", n, used)
+	}
+
+	// the chunks of a changed object aren't served
+	readAll(t, i, "a", 0, 4)
+	readAll(t, i, "a", 4, 4)
+	body = "ABCDEFGHIJKLMNOPQRST"
+	if err := i.Put(ctx, "a", strings.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, i, "a", 8, 4); got != body[8:12] {
+		t.Errorf("the new content should be read, got %q", got)
+	}
+}
+
+func TestWithDiskCache(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	d := &memRanged{memDriver: newMemDriver(), failAt: -1}
+	open := func() *Impl {
+		fsys, err := newWithAddition(ctx, d, "{}", WithDiskCache(dir, 3*8))
+		if err != nil {
+			t.Fatal(err)
+		}
+		i := fsys.(*Impl)
+		i.diskCache.chunkSize = 4
+		return i
+	}
+	ranges := func() int {
+		d.rmu.Lock()
+		defer d.rmu.Unlock()
+		return d.ranges
+	}
+	chunks := func(prefix string) []string {
+		files, err := filepath.Glob(filepath.Join(dir, keyHash(baseDir+"/"+prefix, 16)+"-*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return files
+	}
+	i := open()
+	if err := i.Put(ctx, "a", strings.NewReader("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < 2; n++ {
+		if got := readAll(t, i, "a", 1, 6); got != "123456" {
+			t.Fatalf("unexpected read %q", got)
+		}
+	}
+	if n := ranges(); n != 2 {
+		t.Errorf("2 chunks should be read once, got %d ranges", n)
+	}
+
+	// the chunks are kept after a restart
+	i = open()
+	if got := readAll(t, i, "a", 0, 8); got != "01234567" || ranges() != 2 {
+		t.Errorf("the chunks should be read from the disk, got %q by %d ranges", got, ranges())
+	}
+
+	// a truncated chunk is read again
+	files := chunks("a")
+	sort.Strings(files)
+	if err := os.Truncate(files[0], 2); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, i, "a", 0, 4); got != "0123" || ranges() != 3 {
+		t.Errorf("the corrupted chunk should be read again, got %q by %d ranges", got, ranges())
+	}
+
+	// the chunks of a changed object are removed once it's stat
+	d.mu.Lock()
+	n := d.nodes[baseDir+"/a"]
+	n.data, n.obj.Size, n.obj.Modified = []byte("abcdefghij"), 10, n.obj.Modified.Add(time.Hour)
+	d.mu.Unlock()
+	if _, err := i.Stat(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if files := chunks("a"); len(files) != 0 {
+		t.Errorf("the chunks of the old version should be removed, got %v", files)
+	}
+	if got := readAll(t, i, "a", 0, 4); got != "abcd" {
+		t.Errorf("the new version should be read, got %q", got)
+	}
+
+	// the least recently used chunks are evicted
+	if err := i.Put(ctx, "b", strings.NewReader("0123456789ab")); err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, i, "b", 0, 0)
+	if files := chunks("a"); len(files) != 0 {
+		t.Errorf("the chunks of a should be evicted, got %v", files)
+	}
+	if files := chunks("b"); len(files) != 3 {
+		t.Errorf("the chunks of b should be kept, got %v", files)
+	}
+
+	// the readers of a chunk share its read
+	d.delay = time.Millisecond
+	before := ranges()
+	var wg sync.WaitGroup
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rc, err := i.Read(ctx, "a", 4, 4)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer rc.Close()
+			if b, err := io.ReadAll(rc); err != nil || string(b) != "efgh" {
+				t.Errorf("unexpected read %q %v", b, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := ranges() - before; n != 1 {
+		t.Errorf("the chunk should be read once, got %d ranges", n)
+	}
+}
+
+func TestWithMemoryCache(t *testing.T) {
+	ctx := context.Background()
+	d := &memRanged{memDriver: newMemDriver(), failAt: -1}
+	i := newTestFS(t, d, WithMemoryCache(16))
+	for name, body := range map[string]string{"a": "0123456789", "b": "abcdefgh", "large": strings.Repeat("x", 17)} {
+		if err := i.Put(ctx, name, strings.NewReader(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ranges := func() int {
+		d.rmu.Lock()
+		defer d.rmu.Unlock()
+		return d.ranges
+	}
+	if got := readAll(t, i, "a", 2, 3); got != "234" {
+		t.Fatalf("unexpected read %q", got)
+	}
+	rc, err := i.Read(ctx, "a", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 10)
+	if _, err := io.ReadFull(rc, p); err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+	copy(p, "XXXX")
+	if got := readAll(t, i, "a", 0, 0); got != "0123456789" || ranges() != 1 {
+		t.Errorf("a should be read from the cache unchanged, got %q by %d ranges", got, ranges())
+	}
+	if s := i.MemoryCacheStats(); s.Hits != 2 || s.Misses != 1 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+
+	// the objects too large aren't kept, b evicts a
+	readAll(t, i, "large", 0, 0)
+	readAll(t, i, "large", 0, 0)
+	readAll(t, i, "b", 0, 0)
+	if n := ranges(); n != 4 {
+		t.Errorf("large should be read twice and b once, got %d ranges", n)
+	}
+	readAll(t, i, "a", 0, 0)
+	if n := ranges(); n != 5 {
+		t.Errorf("a should be evicted, got %d ranges", n)
+	}
+
+	if err := i.Put(ctx, "a", strings.NewReader("new")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, i, "a", 0, 0); got != "new" {
+		t.Errorf("the put should drop the cached a, got %q", got)
+	}
+	if err := i.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.Read(ctx, "a", 0, 0); !errors.Is(err, errs.ObjectNotFound) {
+		t.Errorf("a deleted shouldn't be read, got %v", err)
+	}
+	i.memCache.mu.Lock()
+	defer i.memCache.mu.Unlock()
+	if _, ok := i.memCache.entries[baseDir+"/a"]; ok {
+		t.Error("the delete should drop the cached a")
+	}
+}
+
+func BenchmarkReadahead(b *testing.B) {
+	for _, chunks := range []int{0, 4} {
+		b.Run("chunks="+strconv.Itoa(chunks), func(b *testing.B) {
+			ctx := context.Background()
+			d := &memSlow{memDriver: newMemDriver(), delay: time.Millisecond}
+			fsys, err := newWithAddition(ctx, d, "{}", WithObjCache(16, time.Minute), WithReadahead(chunks, 1<<20))
+			if err != nil {
+				b.Fatal(err)
+			}
+			const chunk = 128 << 10
+			if err := fsys.Put(ctx, "a", bytes.NewReader(make([]byte, 32*chunk))); err != nil {
+				b.Fatal(err)
+			}
+			d.slow.Store(true)
+			b.SetBytes(chunk)
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				rc, err := fsys.Read(ctx, "a", int64(n%32)*chunk, chunk)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(io.Discard, rc); err != nil {
+					b.Fatal(err)
+				}
+				rc.Close()
+			}
+		})
+	}
+}
+
+func TestWithListCache(t *testing.T) {
+	ctx := context.Background()
+	d := &memFlaky{memDriver: newMemDriver()}
+	i := newTestFS(t, d, WithListCache(time.Minute, 2))
+	for _, name := range []string{"a/1", "b/1", "c/1"} {
+		if err := i.Put(ctx, name, strings.NewReader("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dir := range []string{"a", "b", "c"} {
+		if _, err := i.List(ctx, dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := i.listCache.Len(); n != 2 {
+		t.Fatalf("the cache should keep 2 entries, got %d", n)
+	}
+	// c is the most recently listed, a has been evicted
+	d.lists.Store(0)
+	if _, err := i.List(ctx, "c"); err != nil || d.lists.Load() != 0 {
+		t.Fatalf("c should be cached, lists %d: %v", d.lists.Load(), err)
+	}
+
+	// writes are visible at once
+	if err := i.Put(ctx, "c/2", strings.NewReader("2")); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := i.List(ctx, "c"); err != nil || len(entries) != 2 {
+		t.Fatalf("the put file should be listed: %v %v", entries, err)
+	}
+	if err := i.RemoveAll(ctx, "c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.List(ctx, "c"); !errs.IsObjectNotFound(err) {
+		t.Fatalf("the removed dir should not be listed, got %v", err)
+	}
+
+	i.Flush()
+	if n := i.listCache.Len(); n != 0 {
+		t.Fatalf("flush should drop all entries, got %d", n)
+	}
+}
+
+func TestWithNegativeCache(t *testing.T) {
+	ctx := context.Background()
+	d := &memFlaky{memDriver: newMemDriver()}
+	i := newTestFS(t, d, WithNegativeCache(50*time.Millisecond))
+	if _, err := i.Stat(ctx, "a"); !errs.IsObjectNotFound(err) {
+		t.Fatalf("a should be missing, got %v", err)
+	}
+	lists := d.lists.Load()
+	if _, err := i.Stat(ctx, "a"); !errs.IsObjectNotFound(err) || d.lists.Load() != lists {
+		t.Fatalf("the missing a should be remembered, lists %d: %v", d.lists.Load()-lists, err)
+	}
+
+	// an object created by others is seen after ttl
+	other := newTestFS(t, d)
+	if err := other.Put(ctx, "a", strings.NewReader("a")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, err := i.Stat(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// objects created through the FileSystem are seen at once
+	if _, err := i.Stat(ctx, "b"); !errs.IsObjectNotFound(err) {
+		t.Fatalf("b should be missing, got %v", err)
+	}
+	if err := i.Put(ctx, "b", strings.NewReader("b")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.Stat(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.Stat(ctx, "c"); !errs.IsObjectNotFound(err) {
+		t.Fatalf("c should be missing, got %v", err)
+	}
+	if err := i.Mkdir(ctx, "c"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := i.Stat(ctx, "c"); err != nil || !info.IsDir {
+		t.Fatalf("c should be a dir: %+v %v", info, err)
+	}
+
+	i = newTestFS(t, d, WithNegativeCache(0))
+	for n := 0; n < 2; n++ {
+		lists = d.lists.Load()
+		if _, err := i.Stat(ctx, "d"); !errs.IsObjectNotFound(err) {
+			t.Fatalf("d should be missing, got %v", err)
+		}
+		if d.lists.Load() == lists {
+			t.Fatal("missing objects should not be remembered when disabled")
+		}
+	}
+}
+
+func TestWithObjCache(t *testing.T) {
+	ctx := context.Background()
+	d := &memFlaky{memDriver: newMemDriver()}
+	i := newTestFS(t, d, WithObjCache(100, time.Minute))
+	if err := i.Put(ctx, "chunks/0/12/a", strings.NewReader("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.Stat(ctx, "chunks/0/12/a"); err != nil {
+		t.Fatal(err)
+	}
+	lists := d.lists.Load()
+	for n := 0; n < 3; n++ {
+		if _, err := i.Stat(ctx, "chunks/0/12/a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d.lists.Load() != lists {
+		t.Fatalf("cached objects should not be listed, lists %d", d.lists.Load()-lists)
+	}
+	if s := i.ObjCacheStats(); s.Hits < 3 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+
+	if err := i.Rename(ctx, "chunks/0/12/a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.Stat(ctx, "chunks/0/12/a"); !errs.IsObjectNotFound(err) {
+		t.Fatalf("the renamed object should be missing, got %v", err)
+	}
+	if _, err := i.Stat(ctx, "chunks/0/12/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Delete(ctx, "chunks/0/12/b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.Stat(ctx, "chunks/0/12/b"); !errs.IsObjectNotFound(err) {
+		t.Fatalf("the deleted object should be missing, got %v", err)
+	}
+	if err := i.RemoveAll(ctx, "chunks"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.Stat(ctx, "chunks/0"); !errs.IsObjectNotFound(err) {
+		t.Fatalf("objects below a removed dir should be missing, got %v", err)
+	}
+}
+
+// recorder is a CallObserver recording the ends of operations and calls
+type recorder struct {
+	mu     sync.Mutex
+	events []string
+	bytes  map[string]int64
+}
+
+func (r *recorder) record(e string, n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+	if r.bytes == nil {
+		r.bytes = map[string]int64{}
+	}
+	r.bytes[e] += n
+}
+
+func (r *recorder) StartOp(ctx context.Context, op, name string) (context.Context, func(err error)) {
+	return ctx, func(err error) { r.record(op+" "+name, 0) }
+}
+
+func (r *recorder) StartCall(ctx context.Context, call, path string) (context.Context, func(n int64, err error)) {
+	return ctx, func(n int64, err error) { r.record(call+" "+path, n) }
+}
+
+func (r *recorder) Transferred(upload bool, n int64) {}
+
+func (r *recorder) CacheLookup(cache string, hit bool) {}
+
+func TestWithObserver(t *testing.T) {
+	ctx := context.Background()
+	r := &recorder{}
+	i := newTestFS(t, newMemDriver(), WithObserver(r))
+	if err := i.Put(ctx, "a", strings.NewReader("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := i.Read(ctx, "a", 2, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.ReadAll(rc)
+	rc.Close()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	got := strings.Join(r.events, ",")
+	for _, want := range []string{"Put " + baseDir + "/a", "put a", "Link " + baseDir + "/a", "Download " + baseDir + "/a", "read a"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%s should be observed in %s", want, got)
+		}
+	}
+	if r.bytes["Put "+baseDir+"/a"] != 10 || r.bytes["Download "+baseDir+"/a"] != 8 {
+		t.Fatalf("unexpected bytes %v", r.bytes)
+	}
+}
+
+func TestWithLogger(t *testing.T) {
+	ctx := context.Background()
+	var buf bytes.Buffer
+	l := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	d := &memFlaky{memDriver: newMemDriver()}
+	fsys, err := newWithAddition(ctx, d, "{}", WithLogger(l), WithRetry(2), WithRetryBackoff(time.Millisecond, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.putFailures.Store(1)
+	if err := fsys.Put(ctx, "a", strings.NewReader("a")); err != nil {
+		t.Fatal(err)
+	}
+	fsys.Flush()
+	out := buf.String()
+	for _, want := range []string{
+		`msg="driver initialized" driver=mem`,
+		`msg="retrying driver call" attempt=1 error="temporary failure"`,
+		`msg="cache invalidated" path=` + baseDir + `/a dir=false reason=created`,
+		`msg="caches flushed"`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("%s should be logged in\n%s", want, out)
+		}
+	}
+}
+
+func TestWithSlowThreshold(t *testing.T) {
+	ctx := context.Background()
+	var buf bytes.Buffer
+	l := slog.New(slog.NewTextHandler(&buf, nil))
+	fsys, err := newWithAddition(ctx, newMemDriver(), "{}", WithLogger(l), WithSlowThreshold(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Put(ctx, "a", strings.NewReader("abc")); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := fsys.Read(ctx, "a", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if strings.Contains(buf.String(), "slow operation") {
+		t.Fatalf("the read should be logged when its reader is closed\n%s", buf.String())
+	}
+	if _, err := io.ReadAll(rc); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if strings.Count(out, "slow operation") != 1 {
+		t.Fatalf("only the read should be logged as slow in\n%s", out)
+	}
+	for _, want := range []string{`msg="slow operation" op=read path=a duration=`, " bytes=3 lookup=", " link=", " transfer="} {
+		if !strings.Contains(out, want) {
+			t.Errorf("%s should be logged in\n%s", want, out)
+		}
+	}
+}
+
+func TestWithAtomicPut(t *testing.T) {
+	ctx := context.Background()
+	d := &memPartial{memDriver: newMemDriver()}
+	fsys, err := newWithAddition(ctx, d, "{}", WithAtomicPut(), WithRetry(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := fsys.Capabilities(); !c.Has(CapAtomicPut) {
+		t.Fatalf("the puts should be atomic, got %s", c)
+	}
+	if err := fsys.Put(ctx, "a", strings.NewReader("old")); err != nil {
+		t.Fatal(err)
+	}
+	d.failing.Store(true)
+	if err := fsys.Put(ctx, "a", strings.NewReader("new content")); err == nil {
+		t.Fatal("the put should fail")
+	}
+	if paths := d.paths(baseDir); len(paths) != 1 || paths[0] != baseDir+"/a" {
+		t.Errorf("the temp object should be removed, got %v", paths)
+	}
+	if data, _ := d.file(baseDir + "/a"); string(data) != "old" {
+		t.Errorf("a failed put should keep the object, got %q", data)
+	}
+	d.failing.Store(false)
+	if err := fsys.Put(ctx, "a", strings.NewReader("new content")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := d.file(baseDir + "/a"); string(data) != "new content" {
+		t.Errorf("the object should be replaced, got %q", data)
+	}
+	if paths := d.paths(baseDir); len(paths) != 1 {
+		t.Errorf("only the object should be left, got %v", paths)
+	}
+
+	// without rename the temp object is put in a temp dir and moved
+	p := &memPartial{memDriver: newMemDriver()}
+	w := memWriter{Driver: p.memDriver, d: p}
+	fsys, err = newWithAddition(ctx, memWriteMover{w}, "{}", WithAtomicPut(), WithRetry(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := fsys.Capabilities(); !c.Has(CapAtomicPut) || c.Has(CapRename) {
+		t.Fatalf("the puts should be atomic by moves, got %s", c)
+	}
+	p.failing.Store(true)
+	if err := fsys.Put(ctx, "b/c", strings.NewReader("content")); err == nil {
+		t.Fatal("the put should fail")
+	}
+	if paths := p.paths(baseDir); len(paths) != 1 || paths[0] != baseDir+"/b" {
+		t.Errorf("the temp dir should be removed, got %v", paths)
+	}
+	p.failing.Store(false)
+	if err := fsys.Put(ctx, "b/c", strings.NewReader("content")); err != nil {
+		t.Fatal(err)
+	}
+	if paths := p.paths(baseDir); len(paths) != 2 || paths[1] != baseDir+"/b/c" {
+		t.Errorf("only the object should be left, got %v", paths)
+	}
+	info, err := fsys.Stat(ctx, "b/c")
+	if err != nil || info.Size != 7 {
+		t.Fatalf("the object should be put, got %+v, %v", info, err)
+	}
+
+	// the puts are direct if the driver can neither rename nor move
+	fsys, err = newWithAddition(ctx, w, "{}", WithAtomicPut(), WithRetry(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := fsys.Capabilities(); c.Has(CapAtomicPut) {
+		t.Fatalf("the puts can't be atomic, got %s", c)
+	}
+	p.failing.Store(true)
+	if err := fsys.Put(ctx, "d", strings.NewReader("content")); err == nil {
+		t.Fatal("the put should fail")
+	}
+	if data, ok := p.file(baseDir + "/d"); !ok || string(data) != "con" {
+		t.Errorf("a direct put leaves the partial object, got %q", data)
+	}
+}
+
+func TestWithConflictPolicy(t *testing.T) {
+	ctx := context.Background()
+	d := memExclusive{newMemDriver()}
+	fsys, err := newWithAddition(ctx, d, "{}", WithConflictPolicy(ConflictFail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Put(ctx, "a.txt", strings.NewReader("a")); err != nil {
+		t.Fatal(err)
+	}
+	err = fsys.Put(ctx, "a.txt", iotest.ErrReader(errors.New("the body shouldn't be read")))
+	if !errors.Is(err, ErrExist) || !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("the put should fail with ErrExist, got %v", err)
+	}
+
+	for n, want := range []string{"a (1).txt", "a (2).txt"} {
+		info, err := fsys.PutWithOptions(ctx, "a.txt", strings.NewReader(strconv.Itoa(n)), WithConflict(ConflictKeepBoth))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Name != want {
+			t.Errorf("the put should keep both as %s, got %s", want, info.Name)
+		}
+	}
+	if data, _ := d.file(baseDir + "/a (2).txt"); string(data) != "1" {
+		t.Errorf("the second put should be kept, got %q", data)
+	}
+
+	if _, err := fsys.PutWithOptions(ctx, "a.txt", strings.NewReader("b"), WithConflict(ConflictDriver)); err == nil {
+		t.Fatal("the driver should fail the put")
+	}
+	if _, err := fsys.PutWithOptions(ctx, "a.txt", strings.NewReader("b"), WithConflict(ConflictOverwrite)); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := d.file(baseDir + "/a.txt"); string(data) != "b" {
+		t.Errorf("the object should be overwritten, got %q", data)
+	}
+	if err := fsys.Mkdir(ctx, "dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsys.PutWithOptions(ctx, "dir", strings.NewReader("b"), WithConflict(ConflictOverwrite)); !errors.Is(err, errs.NotFile) {
+		t.Fatalf("a dir shouldn't be overwritten, got %v", err)
+	}
+
+	flaky := &memFlaky{memDriver: newMemDriver(), err: errs.PermissionDenied}
+	if fsys, err = newWithAddition(ctx, flaky, "{}"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Put(ctx, "a.txt", strings.NewReader("a")); err != nil {
+		t.Fatal(err)
+	}
+	flaky.putFailures.Store(1)
+	if _, err := fsys.PutWithOptions(ctx, "a.txt", strings.NewReader("b"), WithConflict(ConflictOverwrite)); err == nil {
+		t.Fatal("the put should fail")
+	}
+	if data, _ := flaky.file(baseDir + "/a.txt"); string(data) != "a" {
+		t.Errorf("a failed overwrite should keep the object, got %q", data)
+	}
+
+	for name, want := range map[string]string{"a": "a (3)", "d/a.tar.gz": "d/a.tar (3).gz", ".env": ".env (3)"} {
+		if got := conflictName(name, 3); got != want {
+			t.Errorf("the suffixed name of %s should be %s, got %s", name, want, got)
+		}
+	}
+}
+
+func TestWithModTime(t *testing.T) {
+	ctx := context.Background()
+	fsys, err := newWithAddition(ctx, newMemDriver(), "{}", WithChunkedUpload(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, name := range []string{"small", "chunked"} {
+		body := strings.Repeat("a", len(name))
+		if _, err := fsys.PutWithOptions(ctx, name, strings.NewReader(body), WithModTime(mtime)); err != nil {
+			t.Fatal(err)
+		}
+		info, err := fsys.Stat(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.Modified.Equal(mtime) {
+			t.Errorf("%s should be modified at %v, got %v", name, mtime, info.Modified)
+		}
+	}
+}
+
+func TestListOptions(t *testing.T) {
+	ctx := context.Background()
+	fsys, err := newWithAddition(ctx, &memPager{memDriver: newMemDriver(), size: 2}, "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, f := range []struct {
+		name    string
+		size    int
+		modTime time.Time
+	}{
+		{"d/a", 3, t0.Add(time.Hour)},
+		{"d/b", 1, t0.Add(2 * time.Hour)},
+		{"d/c", 2, t0},
+		{"d/e", 1, t0.Add(3 * time.Hour)},
+	} {
+		if _, err := fsys.PutWithOptions(ctx, f.name, strings.NewReader(strings.Repeat("x", f.size)), WithModTime(f.modTime)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fsys.Mkdir(ctx, "d/cc"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		opts []ListOption
+		want string
+	}{
+		{nil, "a b c cc e"},
+		{[]ListOption{WithSort(SortName, true)}, "e cc c b a"},
+		{[]ListOption{WithSort(SortSize, false)}, "cc b e c a"},
+		{[]ListOption{WithSort(SortSize, true)}, "a c b e cc"},
+		{[]ListOption{WithSort(SortModified, false)}, "c a b e cc"},
+		{[]ListOption{WithDirsFirst()}, "cc a b c e"},
+		{[]ListOption{WithDirsFirst(), WithSort(SortSize, true)}, "cc a c b e"},
+		{[]ListOption{WithMinSize(2)}, "a c cc"},
+		{[]ListOption{WithMaxSize(1)}, "b cc e"},
+		{[]ListOption{WithMinSize(2), WithMaxSize(2)}, "c cc"},
+		{[]ListOption{WithModifiedAfter(t0.Add(time.Hour))}, "b cc e"},
+	} {
+		opts, want := c.opts, c.want
+		entries, err := fsys.List(ctx, "d", opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name)
+		}
+		if got := strings.Join(names, " "); got != want {
+			t.Errorf("List should give %q, got %q", want, got)
+		}
+		names = nil
+		err = fsys.ListIter(ctx, "d", func(e Entry) error {
+			names = append(names, e.Name)
+			return nil
+		}, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(names, " "); got != want {
+			t.Errorf("ListIter should give %q, got %q", want, got)
+		}
+	}
+
+	// the entries sorted are given once listed, and fn still stops the listing
+	var names []string
+	err = fsys.ListIter(ctx, "d", func(e Entry) error {
+		names = append(names, e.Name)
+		if len(names) == 2 {
+			return ErrStopList
+		}
+		return nil
+	}, WithSort(SortModified, true))
+	if err != nil || strings.Join(names, " ") != "cc e" {
+		t.Errorf("ListIter should stop after cc e, got %v and %v", names, err)
+	}
+}
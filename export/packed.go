@@ -0,0 +1,1028 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	stdpath "path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/alist-org/alist/v3/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+// PackOptions configures NewPacked
+type PackOptions struct {
+	// MaxObject is the size up to which an object is packed, 64KiB if <= 0, the larger objects
+	// are put to inner as they are
+	MaxObject int
+	// PackSize is the size of the batch written without waiting for FlushDelay, and of the packs
+	// written by CompactPacks, 16MiB if <= 0
+	PackSize int
+	// FlushDelay is how long a put waits for others to be written in the same pack, 20ms if <= 0
+	FlushDelay time.Duration
+	// CheckpointEvery is how many packs are written between the checkpoints of the index,
+	// 64 if <= 0. The packs written since are replayed when the index is loaded
+	CheckpointEvery int
+}
+
+// ErrCorruptPackIndex is the error of loading a pack index which can't be parsed
+var ErrCorruptPackIndex = errors.New("pack index corrupted")
+
+const (
+	// packDir holds the packs and the index in inner, it's hidden by NewPacked
+	packDir                = ".packs"
+	packIndexName          = packDir + "/.index"
+	packMagic              = "ALXPACK1"
+	packTrailerSize        = 4 + len(packMagic)
+	defaultMaxPacked       = 64 << 10
+	defaultPackSize        = 16 << 20
+	defaultPackFlushDelay  = 20 * time.Millisecond
+	defaultPackCheckpoints = 64
+)
+
+// NewPacked returns a FileSystem packing the objects of up to opts.MaxObject bytes put to inner:
+// the puts made within opts.FlushDelay of each other are written as a single pack under .packs,
+// each put returning once its pack is written. The packs are never modified, an index maps each
+// name to its pack, offset and length, and Read reads the range of the pack. The dirs of the
+// objects packed are made in inner, so List and Walk merge the objects packed with those of
+// inner, and .packs is hidden from the root.
+//
+// Each pack ends with the records of its puts and deletes, which are the log of the index: the
+// index is checkpointed to .packs every opts.CheckpointEvery packs and the packs written since are
+// replayed when it's loaded, so a crash loses no put returned, and a pack written partly is
+// ignored. Deletes write a pack of their records too, leaving the content in its pack until
+// CompactPacks rewrites it. The index is kept in memory, so a single FileSystem must write inner
+// at a time, the puts and deletes of concurrent goroutines being batched together.
+//
+// The puts overwrite the object unless ConflictFail is given by WithConflict. Renaming, moving or
+// copying an object packed points the index to its content, and Touch sets the mtime in the index.
+// Glob, ListObjects, Snapshot, DiffLive, VerifyLocal, SyncUp, DownloadTar, WriteAt, Append,
+// ResumePut, ApplyLifecycle, StartLifecycle, Restore, ListVersions and RestoreVersion fail with
+// errs.NotSupport. The other ops go to inner, Usage reports the sizes stored
+func NewPacked(inner FileSystem, opts PackOptions) FileSystem {
+	if opts.MaxObject <= 0 {
+		opts.MaxObject = defaultMaxPacked
+	}
+	if opts.PackSize <= 0 {
+		opts.PackSize = defaultPackSize
+	}
+	if opts.FlushDelay <= 0 {
+		opts.FlushDelay = defaultPackFlushDelay
+	}
+	if opts.CheckpointEvery <= 0 {
+		opts.CheckpointEvery = defaultPackCheckpoints
+	}
+	return &packed{FileSystem: inner, opts: opts}
+}
+
+// packed is the FileSystem of NewPacked, the ops not overridden are of inner
+type packed struct {
+	FileSystem
+	opts PackOptions
+	// writeMu serializes the loading of the index and the writes of the packs and the index
+	writeMu sync.Mutex
+
+	// mu guards the fields below
+	mu     sync.RWMutex
+	loaded bool
+	index  packIndex
+	// files are the base names of the objects packed, by dir
+	files map[string]map[string]bool
+	packs map[uint64]*packStat
+	// next is the seq of the next pack
+	next        uint64
+	uncommitted int
+	batch       *packBatch
+	madeDirs    map[string]bool
+}
+
+// packIndex maps the names to the objects packed, Seq is the last pack applied
+type packIndex struct {
+	Seq     uint64               `json:"seq"`
+	Entries map[string]packEntry `json:"entries"`
+}
+
+// packEntry is the content of an object in a pack
+type packEntry struct {
+	Pack     uint64    `json:"pack"`
+	Off      int64     `json:"off"`
+	Len      int64     `json:"len"`
+	Modified time.Time `json:"mtime"`
+}
+
+// packRecord is a put or a delete of name written in a pack, a Pack of 0 is the pack itself
+type packRecord struct {
+	Name string `json:"name"`
+	packEntry
+	Deleted bool `json:"del,omitempty"`
+}
+
+type packStat struct {
+	size, live int64
+}
+
+// packBatch collects the records of the puts and deletes to write in the same pack
+type packBatch struct {
+	records []packRecord
+	data    bytes.Buffer
+	// full is closed once the batch holds PackSize bytes, done once it's written
+	full chan struct{}
+	done chan struct{}
+	err  error
+}
+
+func notPacked(op string) error {
+	return errors.WithMessagef(errs.NotSupport, "%s of a packed FileSystem", op)
+}
+
+func packHidden(name string) bool {
+	return reservedIn(name, packDir)
+}
+
+// packKey is the name in the index of name
+func packKey(name string) string {
+	return stdpath.Clean(strings.TrimLeft(toSlash(name), "/"))
+}
+
+func packName(seq uint64) string {
+	return stdpath.Join(packDir, fmt.Sprintf("%020d", seq))
+}
+
+// load reads the index and replays the packs written after it
+func (p *packed) load(ctx context.Context) error {
+	p.mu.RLock()
+	loaded := p.loaded
+	p.mu.RUnlock()
+	if loaded {
+		return nil
+	}
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	if p.loaded {
+		return nil
+	}
+	index := packIndex{Entries: map[string]packEntry{}}
+	if err := readJSON(ctx, p.FileSystem, packIndexName, &index, ErrCorruptPackIndex); err != nil && !errs.IsObjectNotFound(err) {
+		return err
+	}
+	if index.Entries == nil {
+		index.Entries = map[string]packEntry{}
+	}
+	entries, err := p.FileSystem.List(ctx, packDir)
+	if err != nil && !errs.IsObjectNotFound(err) {
+		return err
+	}
+	p.index = packIndex{Seq: index.Seq, Entries: map[string]packEntry{}}
+	p.files = map[string]map[string]bool{}
+	p.packs = map[uint64]*packStat{}
+	p.madeDirs = map[string]bool{}
+	p.next = index.Seq + 1
+	var replay []uint64
+	for _, e := range entries {
+		seq, perr := strconv.ParseUint(e.Name, 10, 64)
+		if e.IsDir || perr != nil {
+			continue
+		}
+		p.packs[seq] = &packStat{size: e.Size}
+		p.next = max(p.next, seq+1)
+		if seq > index.Seq {
+			replay = append(replay, seq)
+		}
+	}
+	for name, e := range index.Entries {
+		p.apply(packRecord{Name: name, packEntry: e})
+	}
+	sort.Slice(replay, func(a, b int) bool { return replay[a] < replay[b] })
+	for _, seq := range replay {
+		records, err := readPackRecords(ctx, p.FileSystem, seq, p.packs[seq].size)
+		if err != nil {
+			return err
+		}
+		for _, r := range records {
+			p.apply(r)
+		}
+		p.index.Seq = seq
+		p.uncommitted++
+	}
+	p.mu.Lock()
+	p.loaded = true
+	p.mu.Unlock()
+	return nil
+}
+
+// readPackRecords reads the records of the pack seq of size bytes, none if it was written partly
+func readPackRecords(ctx context.Context, fsys FileSystem, seq uint64, size int64) ([]packRecord, error) {
+	if size < int64(packTrailerSize) {
+		return nil, nil
+	}
+	tail, err := readRange(ctx, fsys, packName(seq), size-int64(packTrailerSize), int64(packTrailerSize))
+	if err != nil {
+		return nil, err
+	}
+	if string(tail[4:]) != packMagic {
+		return nil, nil
+	}
+	n := int64(binary.BigEndian.Uint32(tail))
+	if n+int64(packTrailerSize) > size {
+		return nil, nil
+	}
+	b, err := readRange(ctx, fsys, packName(seq), size-int64(packTrailerSize)-n, n)
+	if err != nil {
+		return nil, err
+	}
+	var records []packRecord
+	if err := json.Unmarshal(b, &records); err != nil {
+		return nil, nil
+	}
+	for k := range records {
+		if !records[k].Deleted && records[k].Pack == 0 {
+			records[k].Pack = seq
+		}
+	}
+	return records, nil
+}
+
+func readRange(ctx context.Context, fsys FileSystem, name string, off, n int64) ([]byte, error) {
+	rc, err := fsys.Read(ctx, name, off, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rc, b); err != nil {
+		return nil, errors.WithMessagef(err, "failed to read [%s]", name)
+	}
+	return b, nil
+}
+
+// apply applies r to the index, p.mu must be held for writing unless the index is being loaded
+func (p *packed) apply(r packRecord) {
+	dir, base := stdpath.Split(r.Name)
+	dir = stdpath.Clean(dir)
+	if old, ok := p.index.Entries[r.Name]; ok {
+		if s := p.packs[old.Pack]; s != nil {
+			s.live -= old.Len
+		}
+		delete(p.index.Entries, r.Name)
+		if delete(p.files[dir], base); len(p.files[dir]) == 0 {
+			delete(p.files, dir)
+		}
+	}
+	if r.Deleted {
+		return
+	}
+	p.index.Entries[r.Name] = r.packEntry
+	if p.files[dir] == nil {
+		p.files[dir] = map[string]bool{}
+	}
+	p.files[dir][base] = true
+	if s := p.packs[r.Pack]; s != nil {
+		s.live += r.Len
+	}
+}
+
+// entry returns the object packed as name
+func (p *packed) entry(ctx context.Context, name string) (packEntry, bool, error) {
+	if err := p.load(ctx); err != nil {
+		return packEntry{}, false, err
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	e, ok := p.index.Entries[packKey(name)]
+	return e, ok, nil
+}
+
+// commit adds records to the batch written next, data being the content of the first, and
+// returns once it's written. The first record of a batch waits FlushDelay for the others
+func (p *packed) commit(ctx context.Context, data []byte, records ...packRecord) error {
+	if err := p.load(ctx); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	b := p.batch
+	leader := b == nil
+	if leader {
+		b = &packBatch{full: make(chan struct{}), done: make(chan struct{})}
+		p.batch = b
+	}
+	if data != nil {
+		records[0].Pack, records[0].Off, records[0].Len = 0, int64(b.data.Len()), int64(len(data))
+		b.data.Write(data)
+	}
+	b.records = append(b.records, records...)
+	if b.data.Len() >= p.opts.PackSize && p.batch == b {
+		p.batch = nil
+		close(b.full)
+	}
+	p.mu.Unlock()
+	if leader {
+		t := time.NewTimer(p.opts.FlushDelay)
+		select {
+		case <-b.full:
+		case <-t.C:
+		}
+		t.Stop()
+		p.mu.Lock()
+		if p.batch == b {
+			p.batch = nil
+		}
+		p.mu.Unlock()
+		// the puts of the batch don't fail with the ctx of the first
+		b.err = p.write(context.WithoutCancel(ctx), &b.data, b.records)
+		close(b.done)
+	}
+	<-b.done
+	return b.err
+}
+
+// write writes data and records as the next pack and applies them to the index
+func (p *packed) write(ctx context.Context, data *bytes.Buffer, records []packRecord) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	return p.writeLocked(ctx, data, records)
+}
+
+// writeLocked writes the pack like write, p.writeMu must be held
+func (p *packed) writeLocked(ctx context.Context, data *bytes.Buffer, records []packRecord) error {
+	seq := p.next
+	p.next++
+	footer, err := json.Marshal(records)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	data.Write(footer)
+	data.Write(binary.BigEndian.AppendUint32(nil, uint32(len(footer))))
+	data.WriteString(packMagic)
+	size := int64(data.Len())
+	_, err = p.FileSystem.PutWithOptions(ctx, packName(seq), data, WithSize(size), WithConflict(ConflictOverwrite))
+	if err != nil {
+		return errors.WithMessage(err, "failed to write the pack")
+	}
+	p.mu.Lock()
+	p.packs[seq] = &packStat{size: size}
+	for _, r := range records {
+		if !r.Deleted && r.Pack == 0 {
+			r.Pack = seq
+		}
+		p.apply(r)
+	}
+	p.index.Seq = seq
+	p.uncommitted++
+	checkpoint := p.uncommitted >= p.opts.CheckpointEvery
+	p.mu.Unlock()
+	if checkpoint {
+		// the packs are replayed until checkpointed, so a failure is left to the next pack
+		_ = p.checkpoint(ctx)
+	}
+	return nil
+}
+
+// checkpoint writes the index, p.writeMu must be held
+func (p *packed) checkpoint(ctx context.Context) error {
+	p.mu.RLock()
+	b, err := json.Marshal(p.index)
+	p.mu.RUnlock()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = p.FileSystem.PutWithOptions(ctx, packIndexName, bytes.NewReader(b), WithSize(int64(len(b))), WithConflict(ConflictOverwrite))
+	if err != nil {
+		return errors.WithMessage(err, "failed to write the pack index")
+	}
+	p.mu.Lock()
+	p.uncommitted = 0
+	p.mu.Unlock()
+	return nil
+}
+
+// forgetDirs forgets the dirs made, after some were removed or moved
+func (p *packed) forgetDirs() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.madeDirs = map[string]bool{}
+}
+
+// mkdirParent makes the dir of name in inner once
+func (p *packed) mkdirParent(ctx context.Context, name string) error {
+	dir := stdpath.Dir(packKey(name))
+	p.mu.RLock()
+	made := dir == "." || p.madeDirs[dir]
+	p.mu.RUnlock()
+	if made {
+		return nil
+	}
+	if err := p.FileSystem.Mkdir(ctx, dir); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.madeDirs[dir] = true
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *packed) PutWithOptions(ctx context.Context, name string, body io.Reader, opts ...PutOption) (ObjInfo, error) {
+	if packHidden(name) {
+		return ObjInfo{}, errors.WithMessagef(ErrInvalidName, "[%s] is reserved by packing", name)
+	}
+	if err := p.load(ctx); err != nil {
+		return ObjInfo{}, err
+	}
+	o := newPutOptions(opts)
+	if o.conflict != nil && *o.conflict == ConflictFail {
+		if ok, err := p.Exists(ctx, name); err != nil || ok {
+			if err == nil {
+				err = errors.WithMessagef(ErrExist, "[%s]", name)
+			}
+			return ObjInfo{}, err
+		}
+	}
+	var head []byte
+	small := o.sized && o.size <= int64(p.opts.MaxObject)
+	if !o.sized || small {
+		head = make([]byte, p.opts.MaxObject+1)
+		n, err := io.ReadFull(body, head)
+		switch err {
+		case io.EOF, io.ErrUnexpectedEOF:
+			head, small = head[:n], true
+		case nil:
+			small = false
+		default:
+			return ObjInfo{}, err
+		}
+	}
+	key := packKey(name)
+	if !small {
+		if head != nil {
+			body = io.MultiReader(bytes.NewReader(head), body)
+		}
+		info, err := p.FileSystem.PutWithOptions(ctx, name, body, opts...)
+		if err != nil {
+			return ObjInfo{}, err
+		}
+		if _, ok, err := p.entry(ctx, name); err != nil || !ok {
+			return info, err
+		}
+		return info, p.commit(ctx, nil, packRecord{Name: key, Deleted: true})
+	}
+	if err := p.mkdirParent(ctx, name); err != nil {
+		return ObjInfo{}, err
+	}
+	modified := o.modTime
+	if modified.IsZero() {
+		modified = time.Now()
+	}
+	if head == nil {
+		head = []byte{}
+	}
+	if err := p.commit(ctx, head, packRecord{Name: key, packEntry: packEntry{Modified: modified}}); err != nil {
+		return ObjInfo{}, err
+	}
+	// the object of inner would show again once the one packed is deleted
+	if err := p.FileSystem.Delete(ctx, name); err != nil && !errs.IsObjectNotFound(err) {
+		return ObjInfo{}, err
+	}
+	return ObjInfo{Name: stdpath.Base(key), Size: int64(len(head)), Modified: modified, Ctime: modified}, nil
+}
+
+func (p *packed) Put(ctx context.Context, name string, body io.Reader) error {
+	_, err := p.PutWithOptions(ctx, name, body)
+	return err
+}
+
+func (p *packed) PutWithSize(ctx context.Context, name string, body io.Reader, size int64) error {
+	_, err := p.PutWithOptions(ctx, name, body, WithSize(size))
+	return err
+}
+
+func (p *packed) PutResult(ctx context.Context, name string, body io.Reader) (ObjInfo, error) {
+	return p.PutWithOptions(ctx, name, body)
+}
+
+// PutWithHash keeps the hashes for an object put to inner only
+func (p *packed) PutWithHash(ctx context.Context, name string, size int64, hashes utils.HashInfo, body io.Reader) error {
+	_, err := p.PutWithOptions(ctx, name, body, WithSize(size), WithHashes(hashes))
+	return err
+}
+
+func (p *packed) PutIfAbsent(ctx context.Context, name string, body io.Reader) error {
+	_, err := p.PutWithOptions(ctx, name, body, WithConflict(ConflictFail))
+	return err
+}
+
+// PutBatch puts up to parallel items at once, defaultPutParallel if <= 0, so the small ones
+// are written in the same packs
+func (p *packed) PutBatch(ctx context.Context, items []PutItem, parallel int) []error {
+	return putEach(ctx, items, parallel, p.PutWithOptions)
+}
+
+func (p *packed) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	if packHidden(name) {
+		return nil, errors.WithMessagef(ErrInvalidName, "[%s] is reserved by packing", name)
+	}
+	pr, pw := io.Pipe()
+	cw := &pipeWriter{pw: pw, w: nopWriteCloser{}, done: make(chan error, 1)}
+	go func() {
+		_, err := p.PutWithOptions(ctx, name, pr)
+		pr.CloseWithError(err)
+		cw.done <- err
+	}()
+	return cw, nil
+}
+
+func (p *packed) Read(ctx context.Context, name string, off, limit int64) (io.ReadCloser, error) {
+	if off < 0 {
+		return nil, errors.WithMessagef(ErrInvalidRange, "negative offset %d", off)
+	}
+	if packHidden(name) {
+		return nil, errors.WithStack(errs.ObjectNotFound)
+	}
+	// a pack compacted meanwhile is read again from the pack the content was moved to
+	for retried := false; ; retried = true {
+		e, ok, err := p.entry(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return p.FileSystem.Read(ctx, name, off, limit)
+		}
+		if off >= e.Len {
+			return io.NopCloser(bytes.NewReader(nil)), nil
+		}
+		if limit <= 0 || limit > e.Len-off {
+			limit = e.Len - off
+		}
+		rc, err := p.FileSystem.Read(ctx, packName(e.Pack), e.Off+off, limit)
+		if err == nil || retried || !errs.IsObjectNotFound(err) {
+			return rc, err
+		}
+	}
+}
+
+func (p *packed) Open(ctx context.Context, name string) (io.ReadSeekCloser, error) {
+	e, ok, err := p.entry(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return p.FileSystem.Open(ctx, name)
+	}
+	return &rangeFile{ctx: ctx, fsys: p, name: name, size: e.Len}, nil
+}
+
+func (p *packed) OpenReaderAt(ctx context.Context, name string) (io.ReaderAt, io.Closer, error) {
+	e, ok, err := p.entry(ctx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		return p.FileSystem.OpenReaderAt(ctx, name)
+	}
+	return &rangeReaderAt{ctx: ctx, fsys: p, name: name, size: e.Len}, io.NopCloser(nil), nil
+}
+
+func (p *packed) Stat(ctx context.Context, name string) (ObjInfo, error) {
+	if packHidden(name) {
+		return ObjInfo{}, errors.WithStack(errs.ObjectNotFound)
+	}
+	e, ok, err := p.entry(ctx, name)
+	if err != nil {
+		return ObjInfo{}, err
+	}
+	if !ok {
+		return p.FileSystem.Stat(ctx, name)
+	}
+	return ObjInfo{Name: stdpath.Base(packKey(name)), Size: e.Len, Modified: e.Modified, Ctime: e.Modified}, nil
+}
+
+// Hashes reports none for an object packed
+func (p *packed) Hashes(ctx context.Context, name string) (map[*utils.HashType]string, error) {
+	if _, err := p.Stat(ctx, name); err != nil {
+		return nil, err
+	}
+	if _, ok, _ := p.entry(ctx, name); ok {
+		return map[*utils.HashType]string{}, nil
+	}
+	return p.FileSystem.Hashes(ctx, name)
+}
+
+func (p *packed) Exists(ctx context.Context, name string) (bool, error) {
+	if packHidden(name) {
+		return false, nil
+	}
+	_, ok, err := p.entry(ctx, name)
+	if err != nil || ok {
+		return ok, err
+	}
+	return p.FileSystem.Exists(ctx, name)
+}
+
+// Touch sets the mtime of an object packed in the index
+func (p *packed) Touch(ctx context.Context, name string) error {
+	e, ok, err := p.entry(ctx, name)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return p.FileSystem.Touch(ctx, name)
+	}
+	e.Modified = time.Now()
+	return p.commit(ctx, nil, packRecord{Name: packKey(name), packEntry: e})
+}
+
+func (p *packed) List(ctx context.Context, dir string, opts ...ListOption) ([]Entry, error) {
+	var entries []Entry
+	err := p.ListIter(ctx, dir, func(e Entry) error {
+		entries = append(entries, e)
+		return nil
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// ListIter lists the objects of inner followed by those packed, which take the place of the
+// objects of the same names left in inner
+func (p *packed) ListIter(ctx context.Context, dir string, fn func(Entry) error, opts ...ListOption) error {
+	if packHidden(dir) {
+		return errors.WithStack(errs.ObjectNotFound)
+	}
+	if err := p.load(ctx); err != nil {
+		return err
+	}
+	o := newListOptions(opts)
+	key := packKey(dir)
+	p.mu.RLock()
+	files := make([]Entry, 0, len(p.files[key]))
+	for base := range p.files[key] {
+		e := p.index.Entries[stdpath.Join(key, base)]
+		files = append(files, Entry{Name: base, Size: e.Len, Modified: e.Modified, Hashes: utils.NewHashInfo(nil, "")})
+	}
+	p.mu.RUnlock()
+	sort.Slice(files, func(a, b int) bool { return files[a].Name < files[b].Name })
+
+	var (
+		held    []Entry
+		stopped error
+	)
+	emit := func(e Entry) error {
+		if !o.keepEntry(e.IsDir, e.Size, e.Modified) {
+			return nil
+		}
+		if o.sorted() {
+			held = append(held, e)
+			return nil
+		}
+		if err := fn(e); err != nil {
+			stopped = err
+			return err
+		}
+		return nil
+	}
+	err := p.FileSystem.ListIter(ctx, dir, func(e Entry) error {
+		if packHidden(stdpath.Join(key, e.Name)) {
+			return nil
+		}
+		if n := sort.Search(len(files), func(n int) bool { return files[n].Name >= e.Name }); n < len(files) && files[n].Name == e.Name {
+			return nil
+		}
+		return emit(e)
+	})
+	if stopped != nil {
+		return stopped
+	}
+	if err != nil && !(errs.IsObjectNotFound(err) && len(files) > 0) {
+		return err
+	}
+	for _, e := range files {
+		if err := emit(e); err != nil {
+			return err
+		}
+	}
+	o.sort(held)
+	for _, e := range held {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Walk walks the tree at root by List, see walkList
+func (p *packed) Walk(ctx context.Context, root string, fn fs.WalkDirFunc) error {
+	return walkList(ctx, p, root, fn)
+}
+
+// Delete writes the delete of an object packed in a pack
+func (p *packed) Delete(ctx context.Context, name string) error {
+	if packHidden(name) {
+		return nil
+	}
+	_, ok, err := p.entry(ctx, name)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return p.FileSystem.Delete(ctx, name)
+	}
+	return p.commit(ctx, nil, packRecord{Name: packKey(name), Deleted: true})
+}
+
+// DeleteBatch deletes up to parallel names at once, defaultPutParallel if <= 0, so the deletes
+// of the objects packed are written in the same packs
+func (p *packed) DeleteBatch(ctx context.Context, names []string, parallel int) map[string]error {
+	return deleteEach(ctx, names, parallel, p.Delete)
+}
+
+// under returns the records of the objects packed as name or under it, renamed by rename
+func (p *packed) under(name string, rename func(key string) packRecord) []packRecord {
+	key := packKey(name)
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var records []packRecord
+	for k := range p.index.Entries {
+		if k == key || strings.HasPrefix(k, key+"/") || key == "." {
+			records = append(records, rename(k))
+		}
+	}
+	sort.Slice(records, func(a, b int) bool { return records[a].Name < records[b].Name })
+	return records
+}
+
+func (p *packed) RemoveAll(ctx context.Context, dir string) error {
+	if packHidden(dir) {
+		return nil
+	}
+	if err := p.load(ctx); err != nil {
+		return err
+	}
+	defer p.forgetDirs()
+	deletes := p.under(dir, func(k string) packRecord { return packRecord{Name: k, Deleted: true} })
+	if len(deletes) > 0 {
+		if err := p.commit(ctx, nil, deletes...); err != nil {
+			return err
+		}
+	}
+	return p.FileSystem.RemoveAll(ctx, dir)
+}
+
+// relocate points the objects packed as src or under it to dst, removing them from src unless
+// keep. The dir of dst must exist in inner
+func (p *packed) relocate(ctx context.Context, src, dst string, keep bool) error {
+	srcKey, dstKey := packKey(src), packKey(dst)
+	var records []packRecord
+	moved := p.under(src, func(k string) packRecord {
+		return packRecord{Name: stdpath.Join(dstKey, strings.TrimPrefix(k, srcKey)), packEntry: p.index.Entries[k]}
+	})
+	for _, r := range moved {
+		records = append(records, r)
+		if !keep {
+			records = append(records, packRecord{Name: stdpath.Join(srcKey, strings.TrimPrefix(r.Name, dstKey)), Deleted: true})
+		}
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	return p.commit(ctx, nil, records...)
+}
+
+// transfer does op on inner for a dir or an object of inner, and relocates what's packed
+func (p *packed) transfer(ctx context.Context, src, dst string, keep bool, op func() error) error {
+	if packHidden(src) || packHidden(dst) {
+		return errors.WithMessagef(ErrInvalidName, "[%s] is reserved by packing", packDir)
+	}
+	_, ok, err := p.entry(ctx, src)
+	if err != nil {
+		return err
+	}
+	if ok {
+		if ok, err := p.Exists(ctx, dst); err != nil || ok {
+			if err == nil {
+				err = errors.WithMessagef(ErrExist, "[%s]", dst)
+			}
+			return err
+		}
+		if err := p.mkdirParent(ctx, dst); err != nil {
+			return err
+		}
+		return p.relocate(ctx, src, dst, keep)
+	}
+	if !keep {
+		defer p.forgetDirs()
+	}
+	if err := op(); err != nil {
+		return err
+	}
+	return p.relocate(ctx, src, dst, keep)
+}
+
+func (p *packed) Rename(ctx context.Context, name, newName string) error {
+	if stdpath.Dir(packKey(name)) != stdpath.Dir(packKey(newName)) {
+		return errors.WithStack(ErrCrossDirRename)
+	}
+	return p.transfer(ctx, name, newName, false, func() error {
+		return p.FileSystem.Rename(ctx, name, newName)
+	})
+}
+
+func (p *packed) Move(ctx context.Context, src, dstDir string) error {
+	dst := stdpath.Join(packKey(dstDir), stdpath.Base(packKey(src)))
+	return p.transfer(ctx, src, dst, false, func() error {
+		return p.FileSystem.Move(ctx, src, dstDir)
+	})
+}
+
+func (p *packed) Copy(ctx context.Context, src, dstDir string) error {
+	dst := stdpath.Join(packKey(dstDir), stdpath.Base(packKey(src)))
+	return p.transfer(ctx, src, dst, true, func() error {
+		return p.FileSystem.Copy(ctx, src, dstDir)
+	})
+}
+
+func (p *packed) Glob(context.Context, string) ([]string, error) {
+	return nil, notPacked("glob")
+}
+
+// Restore fails, the content of an object deleted isn't kept
+func (p *packed) Restore(context.Context, string) error {
+	return notPacked("restore")
+}
+
+// ListVersions fails, the content of an object replaced isn't kept
+func (p *packed) ListVersions(context.Context, string) ([]Version, error) {
+	return nil, notPacked("versions")
+}
+
+func (p *packed) RestoreVersion(context.Context, string, string) error {
+	return notPacked("versions")
+}
+
+func (p *packed) ApplyLifecycle(context.Context, []LifecycleRule) (LifecycleReport, error) {
+	return LifecycleReport{}, notPacked("lifecycle")
+}
+
+func (p *packed) StartLifecycle([]LifecycleRule, time.Duration) error {
+	return notPacked("lifecycle")
+}
+
+func (p *packed) ListObjects(context.Context, string, string, int) ([]Entry, string, error) {
+	return nil, "", notPacked("list objects")
+}
+
+func (p *packed) Snapshot(context.Context, string, io.Writer) error {
+	return notPacked("snapshot")
+}
+
+func (p *packed) DiffLive(context.Context, string, *SnapshotReader, func(DiffEntry) error) error {
+	return notPacked("diff")
+}
+
+func (p *packed) VerifyLocal(context.Context, string, string, VerifyOptions) (Report, error) {
+	return Report{}, notPacked("verify")
+}
+
+func (p *packed) SyncUp(context.Context, string, string, SyncOptions) (SyncReport, error) {
+	return SyncReport{}, notPacked("syncup")
+}
+
+func (p *packed) DownloadTar(context.Context, string, io.Writer, ...TarOption) error {
+	return notPacked("tar")
+}
+
+func (p *packed) WriteAt(context.Context, string, int64, []byte) error {
+	return notPacked("writeat")
+}
+
+func (p *packed) Append(context.Context, string, io.Reader) error {
+	return notPacked("append")
+}
+
+func (p *packed) ResumePut(context.Context, string, []byte, io.ReadSeeker, ...PutOption) error {
+	return notPacked("resume")
+}
+
+// PackReport is the result of CompactPacks
+type PackReport struct {
+	// Rewritten are how many packs were rewritten into Written ones
+	Rewritten int
+	Written   int
+	// Reclaimed is how many bytes the packs removed held more than those written
+	Reclaimed int64
+}
+
+// CompactPacks rewrites the packs of fsys, made by NewPacked, whose live bytes are below
+// liveRatio of their size, 0.5 if <= 0, or which are smaller than a quarter of PackSize: their
+// objects are read and written to new packs of up to PackSize, then the index is checkpointed
+// and the packs are removed. The puts and deletes wait for the compaction, the reads of the
+// packs removed are retried on the new ones
+func CompactPacks(ctx context.Context, fsys FileSystem, liveRatio float64) (PackReport, error) {
+	p, ok := fsys.(*packed)
+	if !ok {
+		return PackReport{}, errors.WithMessage(errs.NotSupport, "compact packs of a FileSystem not made by NewPacked")
+	}
+	if liveRatio <= 0 {
+		liveRatio = 0.5
+	}
+	if err := p.load(ctx); err != nil {
+		return PackReport{}, err
+	}
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	p.mu.RLock()
+	var rewrite []uint64
+	for seq, s := range p.packs {
+		if float64(s.live) < liveRatio*float64(s.size) || s.size < int64(p.opts.PackSize/4) {
+			rewrite = append(rewrite, seq)
+		}
+	}
+	sort.Slice(rewrite, func(a, b int) bool { return rewrite[a] < rewrite[b] })
+	live := map[uint64][]string{}
+	for name, e := range p.index.Entries {
+		live[e.Pack] = append(live[e.Pack], name)
+	}
+	p.mu.RUnlock()
+	// a single small pack full of live objects is as good as rewritten
+	if len(rewrite) == 0 || len(rewrite) == 1 && len(live[rewrite[0]]) > 0 &&
+		float64(p.packs[rewrite[0]].live) >= liveRatio*float64(p.packs[rewrite[0]].size) {
+		return PackReport{}, nil
+	}
+
+	var (
+		r       PackReport
+		data    bytes.Buffer
+		records []packRecord
+	)
+	flush := func() error {
+		if len(records) == 0 {
+			return nil
+		}
+		written := int64(data.Len())
+		if err := p.writeLocked(ctx, &data, records); err != nil {
+			return err
+		}
+		r.Written++
+		r.Reclaimed -= written
+		data.Reset()
+		records = nil
+		return nil
+	}
+	for _, seq := range rewrite {
+		names := live[seq]
+		sort.Strings(names)
+		var content []byte
+		if len(names) > 0 {
+			var err error
+			if content, err = readRange(ctx, p.FileSystem, packName(seq), 0, p.packs[seq].size); err != nil {
+				return r, err
+			}
+		}
+		p.mu.RLock()
+		for _, name := range names {
+			e := p.index.Entries[name]
+			records = append(records, packRecord{Name: name, packEntry: packEntry{Off: int64(data.Len()), Len: e.Len, Modified: e.Modified}})
+			data.Write(content[e.Off : e.Off+e.Len])
+		}
+		p.mu.RUnlock()
+		if data.Len() >= p.opts.PackSize {
+			if err := flush(); err != nil {
+				return r, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return r, err
+	}
+	// the packs removed must not be replayed, nor their objects be read from the index
+	if err := p.checkpoint(ctx); err != nil {
+		return r, err
+	}
+	names := make([]string, len(rewrite))
+	for n, seq := range rewrite {
+		names[n] = packName(seq)
+		r.Reclaimed += p.packs[seq].size
+	}
+	failed := p.FileSystem.DeleteBatch(ctx, names, 0)
+	p.mu.Lock()
+	for _, seq := range rewrite {
+		if failed[packName(seq)] == nil {
+			delete(p.packs, seq)
+		}
+	}
+	p.mu.Unlock()
+	r.Rewritten = len(rewrite)
+	for name, err := range failed {
+		return r, errors.WithMessagef(err, "failed to remove %d packs, like [%s]", len(failed), name)
+	}
+	return r, nil
+}
@@ -0,0 +1,197 @@
+package export
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/alist-org/alist/v3/internal/model"
+	"github.com/alist-org/alist/v3/internal/stream"
+	"github.com/alist-org/alist/v3/pkg/http_range"
+	"github.com/pkg/errors"
+)
+
+// defaultReadPartSize is the size of the sub-ranges read in parallel when neither
+// WithParallelRead nor the link gives one
+const defaultReadPartSize = 10 * 1024 * 1024
+
+// WithParallelRead reads the ranges larger than partSize as sub-ranges of partSize, n of them at
+// a time, which speeds up the providers throttling each connection. The bytes are still read in
+// order, at most n sub-ranges are buffered in memory. By default, the concurrency and part size
+// advertised by the link are used, n <= 1 reads each range at once
+func WithParallelRead(n int, partSize int64) Option {
+	return func(c *config) {
+		c.readConcurrency = n
+		c.readPartSize = partSize
+	}
+}
+
+// readParallelism returns how many sub-ranges of which size to read limit bytes from link with
+func (i *Impl) readParallelism(link *model.Link, limit int64) (int, int64) {
+	if link.MFile != nil {
+		return 1, 0
+	}
+	n, partSize := i.conf.readConcurrency, i.conf.readPartSize
+	if n == 0 {
+		n = link.Concurrency
+	}
+	if partSize <= 0 {
+		partSize = int64(link.PartSize)
+	}
+	if partSize <= 0 {
+		partSize = defaultReadPartSize
+	}
+	if n <= 1 || limit <= partSize {
+		return 1, 0
+	}
+	return n, partSize
+}
+
+// parallelRead opens limit bytes of file from off, read by n sub-ranges of partSize at a time,
+// release is called once the returned reader is closed
+func (i *Impl) parallelRead(ctx context.Context, file model.Obj, link *model.Link, off, limit int64, n int, partSize int64, release func()) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	// the sub-ranges are the parallelism, the streams mustn't split them again
+	l := *link
+	l.Concurrency, l.PartSize = 0, 0
+	// a stream isn't safe for concurrent use, each sub-range being read takes one
+	streams := make(chan *stream.SeekableStream, n)
+	for k := 0; k < n; k++ {
+		ss, err := i.newStream(ctx, file, &l)
+		if err != nil {
+			cancel()
+			closeStreams(streams)
+			release()
+			return nil, err
+		}
+		streams <- ss
+	}
+	r := &parallelReader{
+		i:        i,
+		ctx:      ctx,
+		cancel:   cancel,
+		streams:  streams,
+		release:  release,
+		n:        n,
+		partSize: partSize,
+		next:     off,
+		end:      off + limit,
+	}
+	r.launch()
+	return r, nil
+}
+
+type partResult struct {
+	data []byte
+	err  error
+}
+
+// parallelReader reads the sub-ranges up to n ahead of the one being read, the first
+// failure of any of them cancels the others and is returned by Read
+type parallelReader struct {
+	i       *Impl
+	ctx     context.Context
+	cancel  context.CancelFunc
+	streams chan *stream.SeekableStream
+	release func()
+
+	n        int
+	partSize int64
+	// next is the offset of the next sub-range to read, end is where the range ends
+	next, end int64
+	pending   []chan partResult
+	buf       []byte
+	readErr   error
+	wg        sync.WaitGroup
+
+	errOnce sync.Once
+	err     error
+}
+
+// launch starts reading sub-ranges until n are pending
+func (r *parallelReader) launch() {
+	for len(r.pending) < r.n && r.next < r.end {
+		off, length := r.next, min(r.partSize, r.end-r.next)
+		r.next += length
+		ch := make(chan partResult, 1)
+		r.pending = append(r.pending, ch)
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			data, err := r.readPart(off, length)
+			if err != nil {
+				r.fail(err)
+			}
+			ch <- partResult{data: data, err: err}
+		}()
+	}
+}
+
+// fail keeps the first error and cancels the sub-ranges still being read
+func (r *parallelReader) fail(err error) {
+	r.errOnce.Do(func() {
+		r.err = err
+		r.cancel()
+	})
+}
+
+func (r *parallelReader) readPart(off, length int64) ([]byte, error) {
+	data := make([]byte, length)
+	// there are as many streams as sub-ranges being read
+	ss := <-r.streams
+	defer func() { r.streams <- ss }()
+	err := r.i.retry(r.ctx, func() error {
+		reader, err := ss.RangeRead(http_range.Range{Start: off, Length: length})
+		if err != nil {
+			return err
+		}
+		if c, ok := reader.(io.Closer); ok {
+			defer c.Close()
+		}
+		_, err = io.ReadFull(newStallReader(reader, r.i.conf.stallTimeout, func() {}), data)
+		return errors.WithMessagef(err, "failed to read %d bytes at %d", length, off)
+	})
+	return data, err
+}
+
+func (r *parallelReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.readErr != nil {
+			return 0, r.readErr
+		}
+		if len(r.pending) == 0 {
+			return 0, io.EOF
+		}
+		res := <-r.pending[0]
+		r.pending = r.pending[1:]
+		if res.err != nil {
+			// the first failure, not the cancellation of this sub-range by it, the sub-range
+			// has called fail before sending it
+			r.readErr = r.err
+			continue
+		}
+		r.buf = res.data
+		r.launch()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *parallelReader) Close() error {
+	r.cancel()
+	r.wg.Wait()
+	defer r.release()
+	return closeStreams(r.streams)
+}
+
+// closeStreams closes the streams in the channel
+func closeStreams(streams chan *stream.SeekableStream) error {
+	var err error
+	for len(streams) > 0 {
+		if e := (<-streams).Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+package export
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/alist-org/alist/v3/pkg/utils"
+)
+
+// putOptions are the options of a single put
+type putOptions struct {
+	progress func(sent, total int64)
+	hashes   utils.HashInfo
+	// lazy leaves body to the driver, which may not read it
+	lazy bool
+	// resumeState is called with the state of a chunked upload failed, resume continues one
+	resumeState func(state []byte)
+	resume      *uploadState
+	// conflict overrides the ConflictPolicy of the FileSystem
+	conflict *ConflictPolicy
+	modTime  time.Time
+	// atomic makes the put atomic if the driver can, even without WithAtomicPut
+	atomic bool
+	// size is the size of the body if sized is set
+	size  int64
+	sized bool
+}
+
+// PutOption configures a single put of PutWithOptions
+type PutOption func(*putOptions)
+
+// WithProgress calls fn with the bytes sent so far and the total size during the upload,
+// the calls are monotonic and the last one of a successful upload has sent equal to total
+func WithProgress(fn func(sent, total int64)) PutOption {
+	return func(o *putOptions) {
+		o.progress = fn
+	}
+}
+
+// WithSize gives the size of the body of PutWithOptions, which isn't spooled to know it then
+func WithSize(n int64) PutOption {
+	return func(o *putOptions) {
+		o.size, o.sized = n, true
+	}
+}
+
+func newPutOptions(opts []PutOption) putOptions {
+	var o putOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// progress reports the progress of an upload of total bytes to fn, which is fed both
+// by the UpdateProgress of the driver and by counting the body read by the driver,
+// a nil progress reports nothing
+type progress struct {
+	fn    func(sent, total int64)
+	total int64
+
+	mu   sync.Mutex
+	last int64
+}
+
+func newProgress(fn func(sent, total int64), total int64) *progress {
+	if fn == nil {
+		return nil
+	}
+	return &progress{fn: fn, total: total, last: -1}
+}
+
+// report calls fn if sent is beyond the last reported, the body may be read again from
+// the start on retries and drivers may report less than they have read
+func (p *progress) report(sent int64) {
+	if p == nil {
+		return
+	}
+	sent = min(max(sent, 0), p.total)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if sent <= p.last {
+		return
+	}
+	p.last = sent
+	p.fn(sent, p.total)
+}
+
+// update is the driver.UpdateProgress feeding p, percent is in [0, 100]
+func (p *progress) update(percent float64) {
+	if p == nil {
+		return
+	}
+	p.report(int64(percent / 100 * float64(p.total)))
+}
+
+// done reports the completion
+func (p *progress) done() {
+	if p == nil {
+		return
+	}
+	p.report(p.total)
+}
+
+// reader counts the bytes read from r for p, r is returned as is if p is nil
+func (p *progress) reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &countingReader{r: r, p: p}
+}
+
+// countingReader counts the bytes read from r in n, reporting them to p if it's not nil
+type countingReader struct {
+	r io.Reader
+	p *progress
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	if c.p != nil {
+		c.p.report(c.n)
+	}
+	return n, err
+}
@@ -0,0 +1,207 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alist-org/alist/v3/internal/model"
+)
+
+// readaheadStreams is how many objects read sequentially are followed at most,
+// the least recently read one is forgotten first
+const readaheadStreams = 64
+
+// WithReadahead prefetches the next chunks ranges in the background once an object is read
+// sequentially by Read, which is a range starting where the previous range of the object ended,
+// like the reads of JuiceFS, and serves the following reads from them. The prefetched ranges take
+// at most maxBytes for all objects, and those of an object are dropped once it's read elsewhere
+func WithReadahead(chunks int, maxBytes int64) Option {
+	return func(c *config) {
+		c.readaheadChunks = chunks
+		c.readaheadBytes = maxBytes
+	}
+}
+
+// readahead follows the reads of objects by path and keeps the ranges prefetched for them
+type readahead struct {
+	i        *Impl
+	chunks   int
+	maxBytes int64
+
+	mu      sync.Mutex
+	used    int64
+	streams map[string]*raStream
+}
+
+func newReadahead(i *Impl) *readahead {
+	if i.conf.readaheadChunks <= 0 || i.conf.readaheadBytes <= 0 {
+		return nil
+	}
+	return &readahead{
+		i:        i,
+		chunks:   i.conf.readaheadChunks,
+		maxBytes: i.conf.readaheadBytes,
+		streams:  map[string]*raStream{},
+	}
+}
+
+// raStream is the reads of an object, the size and modified time of which tell its version
+type raStream struct {
+	size     int64
+	modified time.Time
+	// next is where the last read ended
+	next   int64
+	used   time.Time
+	chunks map[int64]*raChunk
+}
+
+// raChunk is a range being prefetched, data and err are set once done is closed
+type raChunk struct {
+	length int64
+	done   chan struct{}
+	data   []byte
+	err    error
+	cancel context.CancelFunc
+}
+
+// read returns the range of file at path from the prefetched ones, or nil if it isn't prefetched,
+// and prefetches the ranges after it if the file is read sequentially
+func (ra *readahead) read(ctx context.Context, path string, file model.Obj, off, limit int64) io.ReadCloser {
+	if ra == nil {
+		return nil
+	}
+	ra.mu.Lock()
+	s := ra.stream(path, file)
+	c := s.chunks[off]
+	if c != nil {
+		delete(s.chunks, off)
+		ra.used -= c.length
+	} else if off != s.next {
+		// read randomly, the chunks prefetched are unlikely to be read
+		ra.drop(s)
+	}
+	sequential := c != nil || off == s.next
+	s.next, s.used = off+limit, time.Now()
+	if sequential {
+		ra.prefetch(s, file, off+limit, limit)
+	}
+	ra.mu.Unlock()
+
+	if c == nil {
+		return nil
+	}
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		c.cancel()
+		return nil
+	}
+	if c.err != nil || c.length < limit {
+		return nil
+	}
+	return io.NopCloser(bytes.NewReader(c.data[:limit]))
+}
+
+// stream returns the reads of file at path, which are started again if the file has changed
+func (ra *readahead) stream(path string, file model.Obj) *raStream {
+	s := ra.streams[path]
+	if s != nil && s.size == file.GetSize() && s.modified.Equal(file.ModTime()) {
+		return s
+	}
+	if s != nil {
+		ra.drop(s)
+	} else if len(ra.streams) >= readaheadStreams {
+		ra.evict(nil)
+	}
+	s = &raStream{size: file.GetSize(), modified: file.ModTime(), next: -1, chunks: map[int64]*raChunk{}}
+	ra.streams[path] = s
+	return s
+}
+
+// prefetch starts prefetching the chunks of length of s from off which aren't yet, as long as
+// they fit in maxBytes, the chunks of the least recently read objects are dropped to fit them
+func (ra *readahead) prefetch(s *raStream, file model.Obj, off, length int64) {
+	for k := 0; k < ra.chunks && off < s.size; k, off = k+1, off+length {
+		if _, ok := s.chunks[off]; ok {
+			continue
+		}
+		n := min(length, s.size-off)
+		for ra.used+n > ra.maxBytes {
+			if !ra.evict(s) {
+				return
+			}
+		}
+		ra.used += n
+		// the prefetch outlives the read which started it
+		ctx, cancel := withTimeout(context.Background(), ra.i.conf.readTimeout)
+		ctx, cancelPrefetch := context.WithCancel(ctx)
+		c := &raChunk{length: n, done: make(chan struct{}), cancel: func() {
+			cancelPrefetch()
+			cancel()
+		}}
+		s.chunks[off] = c
+		go ra.fetch(ctx, file, off, c)
+	}
+}
+
+func (ra *readahead) fetch(ctx context.Context, file model.Obj, off int64, c *raChunk) {
+	defer close(c.done)
+	defer c.cancel()
+	rc, err := ra.i.rangeRead(ctx, file, off, c.length)
+	if err != nil {
+		c.err = err
+		return
+	}
+	defer rc.Close()
+	data := make([]byte, c.length)
+	if _, c.err = io.ReadFull(rc, data); c.err == nil {
+		c.data = data
+	}
+}
+
+// drop cancels the chunks of s and drops them
+func (ra *readahead) drop(s *raStream) {
+	for off, c := range s.chunks {
+		c.cancel()
+		ra.used -= c.length
+		delete(s.chunks, off)
+	}
+}
+
+// evict forgets the least recently read object other than keep,
+// it reports false if there is none with chunks
+func (ra *readahead) evict(keep *raStream) bool {
+	var path string
+	var lru *raStream
+	for p, s := range ra.streams {
+		if s != keep && (lru == nil || s.used.Before(lru.used)) && (keep == nil || len(s.chunks) > 0) {
+			path, lru = p, s
+		}
+	}
+	if lru == nil {
+		return false
+	}
+	ra.drop(lru)
+	delete(ra.streams, path)
+	return true
+}
+
+// forget drops the reads of the objects at path and below it, which have changed
+func (ra *readahead) forget(path string) {
+	if ra == nil {
+		return
+	}
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	for p, s := range ra.streams {
+		if p == path || strings.HasPrefix(p, prefix) {
+			ra.drop(s)
+			delete(ra.streams, p)
+		}
+	}
+}
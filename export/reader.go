@@ -0,0 +1,213 @@
+package export
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/alist-org/alist/v3/internal/model"
+	"github.com/alist-org/alist/v3/internal/stream"
+	"github.com/alist-org/alist/v3/pkg/http_range"
+	"github.com/pkg/errors"
+)
+
+// link gets the link of file from the driver
+func (i *Impl) link(ctx context.Context, file model.Obj) (*model.Link, error) {
+	var link *model.Link
+	err := i.retry(ctx, func() (err error) {
+		if err := wait(ctx, i.dataLimiter); err != nil {
+			return err
+		}
+		ctx, end := i.startCall(ctx, "Link", file.GetPath())
+		link, err = i.storage.Link(ctx, file, model.LinkArgs{Header: http.Header{}})
+		end(0, err)
+		return err
+	})
+	return link, err
+}
+
+// openStream gets the link of file and opens a stream on it
+func (i *Impl) openStream(ctx context.Context, file model.Obj) (*stream.SeekableStream, error) {
+	link, err := i.cachedLink(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	return i.newStream(ctx, file, link)
+}
+
+// newStream opens a stream on the link of file
+func (i *Impl) newStream(ctx context.Context, file model.Obj, link *model.Link) (*stream.SeekableStream, error) {
+	fs := stream.FileStream{
+		Obj: file,
+		Ctx: ctx,
+	}
+	// any link provided is seekable
+	ss, err := stream.NewSeekableStream(fs, link)
+	if err != nil {
+		i.forgetLink(file)
+		return nil, errors.WithMessagef(err, "failed get [%s] stream", file)
+	}
+	return ss, nil
+}
+
+// rangeRead opens the range of file, closing the returned reader releases the stream
+func (i *Impl) rangeRead(ctx context.Context, file model.Obj, off, limit int64) (io.ReadCloser, error) {
+	if c, ok := file.(*chunkedObj); ok {
+		return i.readChunked(ctx, c, off, limit), nil
+	}
+	if i.diskCache != nil {
+		return i.diskCache.read(ctx, file.GetPath(), file, off, limit, func(ctx context.Context, off, limit int64) (io.ReadCloser, error) {
+			return i.linkRead(ctx, file, off, limit)
+		}), nil
+	}
+	return i.linkRead(ctx, file, off, limit)
+}
+
+// linkRead opens the range of file from its link
+func (i *Impl) linkRead(ctx context.Context, file model.Obj, off, limit int64) (io.ReadCloser, error) {
+	release, err := i.beginDownload(ctx)
+	if err != nil {
+		return nil, err
+	}
+	link, err := i.cachedLink(ctx, file)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if n, partSize := i.readParallelism(link, limit); n > 1 {
+		return i.parallelRead(ctx, file, link, off, limit, n, partSize, release)
+	}
+	r := &linkReader{ctx: ctx, i: i, file: file, off: off, end: off + limit, release: release}
+	if err := r.open(link); err != nil {
+		if err = r.reopen(err); err != nil {
+			// the link may have expired, resolve it again next time
+			i.forgetLink(file)
+			release()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Open opens name for reading and seeking, a new range is requested
+// from the driver on the first Read after each Seek
+func (i *Impl) Open(ctx context.Context, name string) (_ io.ReadSeekCloser, err error) {
+	ctx, end := i.startOp(ctx, "open", name)
+	defer end(&err)
+	path, err := i.cleanPath(name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := i.get(ctx, path)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to get file")
+	}
+	if file.IsDir() {
+		return nil, errors.WithStack(errs.NotFile)
+	}
+	if _, ok := file.(*chunkedObj); ok {
+		i.stats.gets.Add(1)
+		return &fileReader{ctx: ctx, i: i, file: file, size: file.GetSize()}, nil
+	}
+	release, err := i.beginDownload(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ss, err := i.openStream(ctx, file)
+	release()
+	if err != nil {
+		return nil, err
+	}
+	i.stats.gets.Add(1)
+	return &fileReader{ctx: ctx, i: i, file: file, ss: ss, size: file.GetSize()}, nil
+}
+
+type fileReader struct {
+	ctx  context.Context
+	i    *Impl
+	file model.Obj
+	// ss is nil for a chunked object, whose ranges are read by rangeRead
+	ss   *stream.SeekableStream
+	size int64
+	off  int64
+	// r reads from off to the end, nil until the next Read
+	r      io.Reader
+	closed bool
+}
+
+func (fr *fileReader) Read(p []byte) (int, error) {
+	if fr.closed {
+		return 0, os.ErrClosed
+	}
+	if fr.off >= fr.size {
+		return 0, io.EOF
+	}
+	if fr.r == nil && fr.ss == nil {
+		r, err := fr.i.rangeRead(fr.ctx, fr.file, fr.off, fr.size-fr.off)
+		if err != nil {
+			return 0, err
+		}
+		fr.r = r
+	}
+	if fr.r == nil {
+		release, err := fr.i.beginDownload(fr.ctx)
+		if err != nil {
+			return 0, err
+		}
+		r, err := fr.ss.RangeRead(http_range.Range{Start: fr.off, Length: fr.size - fr.off})
+		release()
+		if err != nil {
+			fr.i.forgetLink(fr.file)
+			return 0, err
+		}
+		fr.r = r
+	}
+	n, err := fr.r.Read(p)
+	fr.off += int64(n)
+	fr.i.downloadedBytes(n)
+	return n, err
+}
+
+func (fr *fileReader) Seek(offset int64, whence int) (int64, error) {
+	if fr.closed {
+		return 0, os.ErrClosed
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += fr.off
+	case io.SeekEnd:
+		offset += fr.size
+	default:
+		return 0, errors.New("Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("Seek: invalid offset")
+	}
+	if offset != fr.off {
+		fr.closeRange()
+		fr.off = offset
+	}
+	return offset, nil
+}
+
+func (fr *fileReader) closeRange() {
+	if c, ok := fr.r.(io.Closer); ok {
+		_ = c.Close()
+	}
+	fr.r = nil
+}
+
+func (fr *fileReader) Close() error {
+	if fr.closed {
+		return os.ErrClosed
+	}
+	fr.closed = true
+	fr.closeRange()
+	if fr.ss == nil {
+		return nil
+	}
+	return fr.ss.Close()
+}
@@ -0,0 +1,181 @@
+package export
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/alist-org/alist/v3/internal/model"
+	"github.com/alist-org/alist/v3/internal/stream"
+	"github.com/alist-org/alist/v3/pkg/http_range"
+	"github.com/pkg/errors"
+)
+
+// OpenReaderAt opens name for concurrent random reads, the object and its link are resolved once
+// and shared by all ReadAt calls, the link is resolved again when it expires or a read fails
+func (i *Impl) OpenReaderAt(ctx context.Context, name string) (_ io.ReaderAt, _ io.Closer, err error) {
+	ctx, end := i.startOp(ctx, "open", name)
+	defer end(&err)
+	path, err := i.cleanPath(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := i.get(ctx, path)
+	if err != nil {
+		return nil, nil, errors.WithMessage(err, "failed to get file")
+	}
+	if file.IsDir() {
+		return nil, nil, errors.WithStack(errs.NotFile)
+	}
+	if c, ok := file.(*chunkedObj); ok {
+		i.stats.gets.Add(1)
+		ra := &chunkedReaderAt{ctx: ctx, i: i, c: c}
+		return ra, ra, nil
+	}
+	ra := &readerAt{ctx: ctx, i: i, file: file}
+	if _, err := ra.source(nil); err != nil {
+		return nil, nil, err
+	}
+	i.stats.gets.Add(1)
+	return ra, ra, nil
+}
+
+// linkSource reads ranges from a link
+type linkSource struct {
+	mFile    model.File
+	rrc      model.RangeReadCloserIF
+	expireAt time.Time
+}
+
+func (s *linkSource) expired() bool {
+	return !s.expireAt.IsZero() && time.Now().After(s.expireAt)
+}
+
+func (s *linkSource) readAt(ctx context.Context, p []byte, off int64) (int, error) {
+	if s.mFile != nil {
+		return s.mFile.ReadAt(p, off)
+	}
+	rc, err := s.rrc.RangeRead(ctx, http_range.Range{Start: off, Length: int64(len(p))})
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	return io.ReadFull(rc, p)
+}
+
+func (s *linkSource) close() error {
+	if s.mFile != nil {
+		return s.mFile.Close()
+	}
+	return s.rrc.Close()
+}
+
+type readerAt struct {
+	ctx  context.Context
+	i    *Impl
+	file model.Obj
+
+	mu  sync.Mutex
+	cur *linkSource
+	// replaced sources may still be in use, they are closed with the reader
+	old []*linkSource
+}
+
+// source returns the current link source, resolving a new link if it's expired or is stale,
+// which is the source that failed a read
+func (ra *readerAt) source(stale *linkSource) (*linkSource, error) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	if ra.cur != nil && ra.cur != stale && !ra.cur.expired() {
+		return ra.cur, nil
+	}
+	if ra.cur != nil {
+		ra.i.conf.logger.Debug("link refreshed", "path", ra.file.GetPath(), "expired", ra.cur.expired())
+	}
+	release, err := ra.i.beginDownload(ra.ctx)
+	if err != nil {
+		return nil, err
+	}
+	link, err := ra.i.link(ra.ctx, ra.file)
+	release()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed get link")
+	}
+	s := &linkSource{}
+	if link.Expiration != nil {
+		s.expireAt = time.Now().Add(*link.Expiration)
+	}
+	switch {
+	case link.MFile != nil:
+		s.mFile = link.MFile
+	case link.RangeReadCloser != nil:
+		s.rrc = link.RangeReadCloser
+	case len(link.URL) > 0:
+		if s.rrc, err = stream.GetRangeReadCloserFromLink(ra.file.GetSize(), link); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.Errorf("illegal link of [%s]", ra.file.GetName())
+	}
+	if ra.cur != nil {
+		ra.old = append(ra.old, ra.cur)
+	}
+	ra.cur = s
+	return s, nil
+}
+
+func (ra *readerAt) ReadAt(p []byte, off int64) (int, error) {
+	size := ra.file.GetSize()
+	if off >= size {
+		return 0, io.EOF
+	}
+	want := p
+	if remain := size - off; int64(len(want)) > remain {
+		want = want[:remain]
+	}
+	s, err := ra.source(nil)
+	if err != nil {
+		return 0, err
+	}
+	n, err := ra.readAt(s, want, off)
+	if err != nil && err != io.EOF {
+		// the link may have been revoked, retry once with a new one
+		if s, err = ra.source(s); err != nil {
+			return 0, err
+		}
+		n, err = ra.readAt(s, want, off)
+	}
+	if err == nil && len(want) < len(p) {
+		err = io.EOF
+	}
+	ra.i.downloadedBytes(n)
+	return n, err
+}
+
+// readAt reads from s taking a slot of downloads
+func (ra *readerAt) readAt(s *linkSource, p []byte, off int64) (int, error) {
+	release, err := ra.i.beginDownload(ra.ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	return s.readAt(ra.ctx, p, off)
+}
+
+func (ra *readerAt) Close() error {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	var err error
+	for _, s := range append(ra.old, ra.cur) {
+		if s == nil {
+			continue
+		}
+		if e := s.close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	ra.cur, ra.old = nil, nil
+	return err
+}
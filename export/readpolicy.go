@@ -0,0 +1,193 @@
+package export
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alist-org/alist/v3/internal/errs"
+)
+
+// ReadPolicy picks the replica each read of a mirror is sent to, see MirrorOptions.ReadPolicy
+type ReadPolicy interface {
+	// Pick returns the position in replicas of the one to read from, replicas are the healthy
+	// ones, never empty. It's called concurrently
+	Pick(replicas []Replica) int
+}
+
+// Replica is a storage a read may be sent to
+type Replica struct {
+	// Index is 0 for the primary and 1 for the secondary
+	Index int
+	// InFlight is how many reads of it are open
+	InFlight int64
+}
+
+// RoundRobin returns the ReadPolicy sending the reads to each replica in turn
+func RoundRobin() ReadPolicy {
+	return &roundRobin{}
+}
+
+type roundRobin struct {
+	next atomic.Uint64
+}
+
+func (p *roundRobin) Pick(replicas []Replica) int {
+	return int((p.next.Add(1) - 1) % uint64(len(replicas)))
+}
+
+// LeastInFlight returns the ReadPolicy sending the reads to the replica with the fewest reads open,
+// the first one of them on ties
+func LeastInFlight() ReadPolicy {
+	return leastInFlight{}
+}
+
+type leastInFlight struct{}
+
+func (leastInFlight) Pick(replicas []Replica) int {
+	best := 0
+	for n, r := range replicas {
+		if r.InFlight < replicas[best].InFlight {
+			best = n
+		}
+	}
+	return best
+}
+
+const (
+	defaultEjectAfter = 3
+	defaultEjectFor   = 30 * time.Second
+)
+
+// replicaSet spreads the reads across the replicas by the policy, ejecting the unhealthy ones
+type replicaSet struct {
+	replicas   []FileSystem
+	policy     ReadPolicy
+	ejectAfter int
+	ejectFor   time.Duration
+	health     []replicaHealth
+}
+
+type replicaHealth struct {
+	inFlight atomic.Int64
+
+	mu        sync.Mutex
+	failures  int
+	ejectedAt time.Time
+}
+
+func newReplicaSet(replicas []FileSystem, opts MirrorOptions) *replicaSet {
+	s := &replicaSet{
+		replicas:   replicas,
+		policy:     opts.ReadPolicy,
+		ejectAfter: opts.EjectAfter,
+		ejectFor:   opts.EjectFor,
+		health:     make([]replicaHealth, len(replicas)),
+	}
+	if s.ejectAfter <= 0 {
+		s.ejectAfter = defaultEjectAfter
+	}
+	if s.ejectFor <= 0 {
+		s.ejectFor = defaultEjectFor
+	}
+	return s
+}
+
+func (s *replicaSet) ejected(n int, now time.Time) bool {
+	h := &s.health[n]
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !h.ejectedAt.IsZero() && now.Sub(h.ejectedAt) < s.ejectFor
+}
+
+// done records the result of a read of replica n, the retryable errors count for its ejection
+func (s *replicaSet) done(n int, err error) {
+	h := &s.health[n]
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch {
+	case err == nil:
+		h.failures, h.ejectedAt = 0, time.Time{}
+	case KindOf(err).Retryable():
+		if h.failures++; h.failures >= s.ejectAfter {
+			h.failures, h.ejectedAt = 0, time.Now()
+		}
+	}
+}
+
+// read calls f with the replica picked, then with the others in order while it fails with a
+// retryable error or the object is missing, since a replica may lag behind. The replica read is
+// in flight until release is called, the error of the first one tried is returned if all fail
+func (s *replicaSet) read(f func(l FileSystem) error) (release func(), err error) {
+	now := time.Now()
+	healthy := make([]Replica, 0, len(s.replicas))
+	for n := range s.replicas {
+		if !s.ejected(n, now) {
+			healthy = append(healthy, Replica{Index: n, InFlight: s.health[n].inFlight.Load()})
+		}
+	}
+	if len(healthy) == 0 {
+		// the replicas are all tried rather than failing
+		for n := range s.replicas {
+			healthy = append(healthy, Replica{Index: n, InFlight: s.health[n].inFlight.Load()})
+		}
+	}
+	picked := healthy[s.policy.Pick(healthy)].Index
+	order := []int{picked}
+	for _, r := range healthy {
+		if r.Index != picked {
+			order = append(order, r.Index)
+		}
+	}
+	var first error
+	for _, n := range order {
+		h := &s.health[n]
+		h.inFlight.Add(1)
+		err := f(s.replicas[n])
+		s.done(n, err)
+		if err == nil {
+			var once sync.Once
+			return func() { once.Do(func() { h.inFlight.Add(-1) }) }, nil
+		}
+		h.inFlight.Add(-1)
+		if first == nil {
+			first = err
+		}
+		if !KindOf(err).Retryable() && !errs.IsObjectNotFound(err) {
+			break
+		}
+	}
+	return nil, first
+}
+
+// releaseReadCloser releases its replica once closed
+type releaseReadCloser struct {
+	io.ReadCloser
+	release func()
+}
+
+func (r *releaseReadCloser) Close() error {
+	defer r.release()
+	return r.ReadCloser.Close()
+}
+
+type releaseReadSeekCloser struct {
+	io.ReadSeekCloser
+	release func()
+}
+
+func (r *releaseReadSeekCloser) Close() error {
+	defer r.release()
+	return r.ReadSeekCloser.Close()
+}
+
+type releaseCloser struct {
+	io.Closer
+	release func()
+}
+
+func (r *releaseCloser) Close() error {
+	defer r.release()
+	return r.Closer.Close()
+}
@@ -0,0 +1,132 @@
+package export
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/alist-org/alist/v3/internal/driver"
+)
+
+// redacted replaces the secrets of an addition
+const redacted = "******"
+
+// secretNames are parts of the names of addition fields holding credentials,
+// fields tagged with type:"password" are secrets too
+var secretNames = []string{"password", "passwd", "token", "secret", "cookie", "credential", "private_key", "access_key", "api_key"}
+
+// RedactAddition returns addition with the values of its credential fields masked for logging,
+// driverName is used to find the fields marked as passwords, an addition which isn't a json
+// object is masked as a whole
+func RedactAddition(driverName, addition string) string {
+	var d driver.Driver
+	if factory, err := lookup(driverName); err == nil {
+		d = factory()
+	}
+	return redactAddition(d, addition)
+}
+
+func redactAddition(d driver.Driver, addition string) string {
+	var m map[string]any
+	if err := json.Unmarshal([]byte(addition), &m); err != nil {
+		return redacted
+	}
+	fields := passwordFields(d)
+	for k, v := range m {
+		if s, ok := v.(string); ok && s != "" && isSecret(k, fields) {
+			m[k] = redacted
+		}
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return redacted
+	}
+	return string(b)
+}
+
+// secrets returns the values of the credential fields of addition, longest first
+func secrets(d driver.Driver, addition string) []string {
+	var m map[string]any
+	if err := json.Unmarshal([]byte(addition), &m); err != nil {
+		return nil
+	}
+	fields := passwordFields(d)
+	var ss []string
+	for k, v := range m {
+		if s, ok := v.(string); ok && s != "" && isSecret(k, fields) {
+			ss = append(ss, s)
+		}
+	}
+	sort.Slice(ss, func(a, b int) bool { return len(ss[a]) > len(ss[b]) })
+	return ss
+}
+
+func isSecret(name string, passwordFields map[string]bool) bool {
+	if passwordFields[name] {
+		return true
+	}
+	name = strings.ToLower(name)
+	for _, s := range secretNames {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// passwordFields finds the json names of the addition fields of d tagged with type:"password"
+func passwordFields(d driver.Driver) map[string]bool {
+	fields := map[string]bool{}
+	if d == nil {
+		return fields
+	}
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		for t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return
+		}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Type.Kind() == reflect.Struct {
+				walk(f.Type)
+				continue
+			}
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name != "" && f.Tag.Get("type") == "password" {
+				fields[name] = true
+			}
+		}
+	}
+	walk(reflect.TypeOf(d.GetAddition()))
+	return fields
+}
+
+// redactedError masks the secrets in the message of err, which is still in the chain for errors.Is
+type redactedError struct {
+	err error
+	msg string
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// redactErr masks the credentials of addition echoed by err, e.g. in the errors of Init
+func redactErr(err error, d driver.Driver, addition string) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	for _, s := range secrets(d, addition) {
+		msg = strings.ReplaceAll(msg, s, redacted)
+	}
+	return &redactedError{err: err, msg: msg}
+}
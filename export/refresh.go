@@ -0,0 +1,161 @@
+package export
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/alist-org/alist/v3/internal/model"
+	"github.com/alist-org/alist/v3/internal/stream"
+	"github.com/alist-org/alist/v3/pkg/http_range"
+	"github.com/pkg/errors"
+)
+
+// defaultLinkRefreshes is how many times a range read by Read resolves a new link by default
+const defaultLinkRefreshes = 3
+
+// WithLinkRefreshes sets how many times the range read by Read resolves a new link and reads on
+// from where it stopped, when the range fails as the link expired or was revoked, like the signed
+// URLs of aliyundrive expiring after a while. The default is 3, n <= 0 never refreshes it
+func WithLinkRefreshes(n int) Option {
+	return func(c *config) {
+		c.linkRefreshes = n
+	}
+}
+
+// linkExpired reports whether err of reading from a link expiring at expireAt
+// is likely to go away with a new link
+func linkExpired(err error, expireAt time.Time) bool {
+	if !expireAt.IsZero() && time.Now().After(expireAt) || KindOf(err) == KindPermissionDenied {
+		return true
+	}
+	return strings.Contains(strings.ToLower(err.Error()), "expired")
+}
+
+// linkReader reads the range of file from off to end, once it fails as the link expired,
+// a new link is resolved and the range is read again from where it failed
+type linkReader struct {
+	ctx  context.Context
+	i    *Impl
+	file model.Obj
+	// off is where the range is read at
+	off, end int64
+
+	ss       *stream.SeekableStream
+	r        io.Reader
+	expireAt time.Time
+
+	cancel context.CancelFunc
+
+	refreshes, stalls int
+	// err is the failure of the range, which isn't read on
+	err     error
+	release func()
+}
+
+// open reads the rest of the range from link
+func (r *linkReader) open(link *model.Link) error {
+	// the transfer is canceled once it stalls
+	ctx, cancel := context.WithCancel(r.ctx)
+	ss, err := r.i.newStream(ctx, r.file, link)
+	if err != nil {
+		cancel()
+		return err
+	}
+	stop := watchStall(r.i.conf.stallTimeout, cancel)
+	reader, err := ss.RangeRead(http_range.Range{Start: r.off, Length: r.end - r.off})
+	if stop() {
+		err = errors.WithStack(ErrReadStalled)
+	}
+	if err != nil {
+		_ = ss.Close()
+		cancel()
+		return err
+	}
+	r.ss, r.r, r.cancel = ss, newStallReader(reader, r.i.conf.stallTimeout, cancel), cancel
+	r.expireAt = time.Time{}
+	if link.Expiration != nil {
+		r.expireAt = time.Now().Add(*link.Expiration)
+	}
+	return nil
+}
+
+// reopen reads the rest of the range again if err is of the read stalled, or from a new link if
+// err is of the link expired, it returns err if it's neither or the retries are used up
+func (r *linkReader) reopen(err error) error {
+	for {
+		switch {
+		case errors.Is(err, ErrReadStalled) && r.stalls < r.i.conf.stallRetries:
+			r.stalls++
+			r.i.conf.logger.Warn("read stalled, retrying", "path", r.file.GetPath(), "offset", r.off, "attempt", r.stalls)
+		case r.refreshes < r.i.conf.linkRefreshes && linkExpired(err, r.expireAt):
+			r.refreshes++
+			r.i.forgetLink(r.file)
+			r.i.conf.logger.Debug("link refreshed", "path", r.file.GetPath(), "offset", r.off, "error", errValue(err))
+		default:
+			return err
+		}
+		r.closeStream()
+		var link *model.Link
+		if link, err = r.i.cachedLink(r.ctx, r.file); err != nil {
+			return err
+		}
+		if err = r.open(link); err == nil {
+			return nil
+		}
+	}
+}
+
+func (r *linkReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.ss == nil {
+		return 0, os.ErrClosed
+	}
+	for {
+		n, err := r.r.Read(p)
+		r.off += int64(n)
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		if err = r.reopen(err); err != nil {
+			r.err = err
+			return n, err
+		}
+		if n > 0 || r.off >= r.end {
+			return n, nil
+		}
+	}
+}
+
+func (r *linkReader) closeStream() {
+	if r.ss == nil {
+		return
+	}
+	if c, ok := r.r.(io.Closer); ok {
+		_ = c.Close()
+	}
+	_ = r.ss.Close()
+	r.cancel()
+	r.ss = nil
+}
+
+func (r *linkReader) Close() error {
+	defer r.release()
+	if r.ss == nil {
+		return nil
+	}
+	ss := r.ss
+	r.ss = nil
+	defer r.cancel()
+	if c, ok := r.r.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			_ = ss.Close()
+			return err
+		}
+	}
+	return ss.Close()
+}
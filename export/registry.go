@@ -0,0 +1,81 @@
+package export
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/alist-org/alist/v3/internal/driver"
+	"github.com/alist-org/alist/v3/internal/op"
+	"github.com/alist-org/alist/v3/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]func() driver.Driver{}
+	// defaultName is the first registered driver, used by New
+	defaultName string
+)
+
+// Register makes the driver created by factory available to NewByName as name,
+// the first registered driver is also the default one of New
+func Register(name string, factory func() driver.Driver) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[name] = factory
+	if defaultName == "" {
+		defaultName = name
+	}
+}
+
+func defaultFactory() (func() driver.Driver, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	if defaultName == "" {
+		return nil, errors.New("no driver is registered, build with the tag of a driver or use NewByName")
+	}
+	return registry[defaultName], nil
+}
+
+// UnknownDriverError is returned by NewByName for a driver which is not registered
+type UnknownDriverError struct {
+	Name string
+	// Registered are the names which can be used instead
+	Registered []string
+}
+
+func (e *UnknownDriverError) Error() string {
+	return fmt.Sprintf("unknown driver [%s], registered drivers: [%s]", e.Name, strings.Join(e.Registered, ", "))
+}
+
+// lookup finds the factory of name in the registry, then in the drivers compiled into alist
+func lookup(name string) (func() driver.Driver, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	if factory, ok := registry[name]; ok {
+		return factory, nil
+	}
+	if constructor, err := op.GetDriver(name); err == nil {
+		return constructor, nil
+	}
+	names := op.GetDriverNames()
+	for n := range registry {
+		if !utils.SliceContains(names, n) {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	return nil, &UnknownDriverError{Name: name, Registered: names}
+}
+
+// NewByName is New with the driver chosen at runtime by name
+func NewByName(ctx context.Context, driverName, addition string, opts ...Option) (FileSystem, error) {
+	factory, err := lookup(driverName)
+	if err != nil {
+		return nil, err
+	}
+	return newWithAddition(ctx, factory(), addition, opts...)
+}
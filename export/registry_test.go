@@ -0,0 +1,138 @@
+package export
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alist-org/alist/v3/internal/driver"
+	"github.com/pkg/errors"
+)
+
+func TestNewByName(t *testing.T) {
+	Register("mem-test", func() driver.Driver {
+		return newMemDriver()
+	})
+	ctx := context.Background()
+	f, err := NewByName(ctx, "mem-test", "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Put(ctx, "a.txt", strings.NewReader("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewByName(ctx, "no-such-driver", "{}")
+	var ue *UnknownDriverError
+	if !errors.As(err, &ue) {
+		t.Fatalf("expected UnknownDriverError, got %v", err)
+	}
+	if ue.Name != "no-such-driver" {
+		t.Fatalf("unexpected name: %s", ue.Name)
+	}
+	found := false
+	for _, n := range ue.Registered {
+		found = found || n == "mem-test"
+	}
+	if !found {
+		t.Fatalf("mem-test should be listed in %v", ue.Registered)
+	}
+}
+
+func TestNewByNameConcurrently(t *testing.T) {
+	Register("mem-race", func() driver.Driver {
+		return newMemDriver()
+	})
+	ctx := context.Background()
+	var fs []FileSystem
+	for _, root := range []string{"/a", "/b"} {
+		f, err := NewByName(ctx, "mem-race", `{"root_folder_path": "`+root+`"}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs = append(fs, f)
+	}
+	var wg sync.WaitGroup
+	for n, f := range fs {
+		n, f := n, f
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				name := fmt.Sprintf("dir/%d", j)
+				want := fmt.Sprintf("%d-%d", n, j)
+				if err := f.Put(ctx, name, strings.NewReader(want)); err != nil {
+					t.Error(err)
+					return
+				}
+				rc, err := f.Read(ctx, name, 0, int64(len(want)))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				data, _ := io.ReadAll(rc)
+				rc.Close()
+				if string(data) != want {
+					t.Errorf("expected %q, got %q", want, data)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for n, f := range fs {
+		entries, err := f.List(ctx, "dir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 20 {
+			t.Fatalf("fs %d should have 20 entries, got %d", n, len(entries))
+		}
+	}
+}
+
+// memLogin is a memDriver with credentials, whose Init fails echoing them
+type memLogin struct {
+	*memDriver
+	addition struct {
+		driver.RootPath
+		Username string `json:"username"`
+		Pin      string `json:"pin" type:"password"`
+		Refresh  string `json:"refresh_token"`
+	}
+}
+
+func (d *memLogin) GetAddition() driver.Additional {
+	return &d.addition
+}
+
+func (d *memLogin) Init(ctx context.Context) error {
+	return errors.Errorf("login of %s with pin %s and token %s failed", d.addition.Username, d.addition.Pin, d.addition.Refresh)
+}
+
+func TestRedactAddition(t *testing.T) {
+	Register("mem-login", func() driver.Driver {
+		return &memLogin{memDriver: newMemDriver()}
+	})
+	addition := `{"username":"alice","pin":"s3cr3t-pin","refresh_token":"r3fr3sh-t0ken"}`
+	_, err := NewByName(context.Background(), "mem-login", addition)
+	if err == nil {
+		t.Fatal("init should fail")
+	}
+	if msg := fmt.Sprintf("%v %+v", err, err); strings.Contains(msg, "s3cr3t-pin") || strings.Contains(msg, "r3fr3sh-t0ken") || !strings.Contains(msg, "alice") {
+		t.Fatalf("the credentials should be masked in %q", msg)
+	}
+
+	got := RedactAddition("mem-login", addition)
+	if want := `{"pin":"******","refresh_token":"******","username":"alice"}`; got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+	if got := RedactAddition("no-such-driver", `{"password":"p","user":"u"}`); got != `{"password":"******","user":"u"}` {
+		t.Fatalf("password fields should be masked by name, got %s", got)
+	}
+	if got := RedactAddition("mem-login", `{"pin":"s3cr3t`); got != "******" {
+		t.Fatalf("a broken addition should be masked as a whole, got %s", got)
+	}
+}
@@ -0,0 +1,126 @@
+package export
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	stdpath "path"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrSourceChanged is the error of resuming an upload with content other than the one started
+	ErrSourceChanged = errors.New("source changed since the upload started")
+	// ErrInvalidUploadState is the error of resuming an upload with a state not made by WithResumeState
+	ErrInvalidUploadState = errors.New("invalid upload state")
+)
+
+// uploadState is the progress of a chunked upload, it's serialized to continue the upload later
+type uploadState struct {
+	Path     string `json:"path"`
+	UploadID string `json:"upload_id"`
+	Size     int64  `json:"size"`
+	PartSize int64  `json:"part_size"`
+	// Parts are the parts completed, they are always the first ones
+	Parts []int `json:"parts"`
+	// PrefixSHA256 is the sha256 of the content of Parts
+	PrefixSHA256 string `json:"prefix_sha256"`
+}
+
+func newUploadState(path string, size, partSize int64) *uploadState {
+	return &uploadState{Path: path, UploadID: newUploadID(), Size: size, PartSize: partSize, Parts: []int{}}
+}
+
+func (st *uploadState) marshal() []byte {
+	b, _ := json.Marshal(st)
+	return b
+}
+
+// WithResumeState calls fn with the state of a chunked upload, see WithChunkedUpload, when it
+// fails, so that ResumePut can continue it from the last part completed, even in another process
+func WithResumeState(fn func(state []byte)) PutOption {
+	return func(o *putOptions) {
+		o.resumeState = fn
+	}
+}
+
+// ResumePut continues the chunked upload of body to name from state given by WithResumeState,
+// body is the whole content from the start. It fails with ErrSourceChanged if body differs from
+// the parts completed, and WithResumeState of the upload failing again gets a new state.
+// The parts of an upload not resumed for longer than CollectParts allows are removed by it
+func (i *Impl) ResumePut(ctx context.Context, name string, state []byte, body io.ReadSeeker, opts ...PutOption) (err error) {
+	ctx, end := i.startOp(ctx, "put", name)
+	defer end(&err)
+	if i.conf.partSize <= 0 {
+		return errors.WithMessage(ErrInvalidUploadState, "chunked uploads aren't enabled")
+	}
+	var st uploadState
+	if err := json.Unmarshal(state, &st); err != nil {
+		return errors.WithMessage(ErrInvalidUploadState, err.Error())
+	}
+	if st.UploadID == "" || st.PartSize <= 0 || st.Size < 0 || int64(len(st.Parts))*st.PartSize > st.Size+st.PartSize {
+		return errors.WithStack(ErrInvalidUploadState)
+	}
+	for n, part := range st.Parts {
+		if part != n {
+			return errors.WithMessagef(ErrInvalidUploadState, "part %d is completed before part %d", part, n)
+		}
+	}
+	path, err := i.objPath(name)
+	if err != nil {
+		return err
+	}
+	if st.Path != path {
+		return errors.WithMessagef(ErrInvalidUploadState, "the upload is of [%s]", st.Path)
+	}
+	off, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	last, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := body.Seek(off, io.SeekStart); err != nil {
+		return errors.WithStack(err)
+	}
+	if size := last - off; size != st.Size {
+		return errors.WithMessagef(ErrSourceChanged, "body has %d bytes instead of %d", size, st.Size)
+	}
+	o := newPutOptions(opts)
+	o.resume = &st
+	_, err = i.putFile(ctx, name, body, st.Size, o)
+	return err
+}
+
+// checkResumed checks the parts completed of st are still in dir and have the content read
+// from body, which is left at the first part to upload, the content is written to prefix
+func (i *Impl) checkResumed(ctx context.Context, dir string, body io.Reader, ra io.ReaderAt, base int64, m manifest, st *uploadState, prefix hash.Hash) error {
+	if len(st.Parts) == 0 {
+		return nil
+	}
+	n := min(int64(len(st.Parts))*m.PartSize, m.Size)
+	var r io.Reader = io.LimitReader(body, n)
+	if ra != nil {
+		r = io.NewSectionReader(ra, base, n)
+	}
+	if _, err := io.Copy(prefix, r); err != nil {
+		return errors.WithMessage(err, "failed to hash the parts completed")
+	}
+	if hex.EncodeToString(prefix.Sum(nil)) != st.PrefixSHA256 {
+		return errors.WithMessagef(ErrSourceChanged, "the first %d bytes differ", n)
+	}
+	for _, part := range st.Parts {
+		obj, err := i.get(ctx, stdpath.Join(dir, partName(part)))
+		if err != nil {
+			return errors.WithMessagef(err, "part %d of the upload is gone", part)
+		}
+		if want := min(m.PartSize, m.Size-int64(part)*m.PartSize); obj.GetSize() != want {
+			return errors.WithMessagef(ErrSizeMismatch, "part %d has %d bytes instead of %d", part, obj.GetSize(), want)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package export
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/avast/retry-go"
+	"github.com/pkg/errors"
+)
+
+// the delay between retries is doubled each time up to retryMaxDelay
+const retryMaxDelay = 10 * time.Second
+
+// permanentMessages are parts of the messages drivers return on quota failures
+var permanentMessages = []string{"quota", "insufficient storage", "not enough space"}
+
+// isNotFound reports whether err tells that the object doesn't exist, drivers return
+// either errs.ObjectNotFound or the errors of os for it
+func isNotFound(err error) bool {
+	return errs.IsObjectNotFound(err) || errors.Is(err, fs.ErrNotExist)
+}
+
+// permanent reports whether err won't go away by trying again, which is decided by its kind
+// unless it's of KindOther, errors of no known kind are tried again except a few
+func permanent(err error) bool {
+	// the deadline of ctx is the one of the whole retry
+	if !retry.IsRecoverable(err) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	if k := KindOf(err); k != KindOther {
+		return !k.Retryable()
+	}
+	if isAny(err, errs.NotFolder, errs.NotFile, ErrDirNotEmpty) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, m := range permanentMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// retry calls f until it succeeds, conf.retryAttempts is reached or conf.retryMaxElapsed has passed,
+// waiting with exponential backoff and jitter in between. Permanent errors are returned at once,
+// so is ErrStorageUnavailable when the circuit breaker opens
+func (i *Impl) retry(ctx context.Context, f func() error) error {
+	start := time.Now()
+	return retry.Do(func() error {
+		err := i.call(f)
+		if errors.Is(err, ErrStorageUnavailable) {
+			return retry.Unrecoverable(err)
+		}
+		return err
+	},
+		retry.Context(ctx),
+		retry.Attempts(i.conf.retryAttempts),
+		retry.Delay(i.conf.retryDelay),
+		retry.MaxDelay(retryMaxDelay),
+		retry.MaxJitter(max(i.conf.retryDelay, 1)),
+		retry.DelayType(retry.CombineDelay(retry.BackOffDelay, retry.RandomDelay)),
+		retry.LastErrorOnly(true),
+		retry.OnRetry(func(n uint, err error) {
+			i.conf.logger.Warn("retrying driver call", "attempt", n+1, "error", errValue(err))
+		}),
+		retry.RetryIf(func(err error) bool {
+			if permanent(err) {
+				return false
+			}
+			return i.conf.retryMaxElapsed <= 0 || time.Since(start) < i.conf.retryMaxElapsed
+		}))
+}
+
+// retryBody retries f like retry when body can be rewound to where it's at now, f is called once otherwise
+func (i *Impl) retryBody(ctx context.Context, body io.Reader, f func() error) error {
+	s, ok := body.(io.Seeker)
+	if !ok {
+		return i.call(f)
+	}
+	off, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return i.call(f)
+	}
+	first := true
+	return i.retry(ctx, func() error {
+		if !first {
+			if _, err := s.Seek(off, io.SeekStart); err != nil {
+				return retry.Unrecoverable(errors.WithStack(err))
+			}
+		}
+		first = false
+		return f()
+	})
+}
@@ -0,0 +1,320 @@
+package s3gw
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/Mikubill/gofakes3"
+	"github.com/alist-org/alist/v3/export"
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/alist-org/alist/v3/pkg/utils"
+)
+
+var timeFormat = "Mon, 2 Jan 2006 15:04:05.999999999 GMT"
+
+// backend implements gofakes3.Backend with a single bucket
+type backend struct {
+	fsys   export.FileSystem
+	bucket string
+}
+
+var _ gofakes3.Backend = (*backend)(nil)
+
+func newBackend(fsys export.FileSystem, bucket string) *backend {
+	return &backend{fsys: fsys, bucket: bucket}
+}
+
+// etag is the md5 reported by the driver, or synthesized from the name, size and modified time
+// for drivers without it
+func etag(info export.ObjInfo) []byte {
+	if b, err := hex.DecodeString(info.Hashes.GetHash(utils.MD5)); err == nil && len(b) == md5.Size {
+		return b
+	}
+	sum := md5.Sum([]byte(fmt.Sprintf("%s-%d-%d", info.Name, info.Size, info.Modified.UnixNano())))
+	return sum[:]
+}
+
+func (b *backend) checkBucket(name string) error {
+	if name != b.bucket {
+		return gofakes3.BucketNotFound(name)
+	}
+	return nil
+}
+
+func (b *backend) ListBuckets() ([]gofakes3.BucketInfo, error) {
+	info, err := b.fsys.Stat(context.Background(), "/")
+	if err != nil {
+		return nil, err
+	}
+	return []gofakes3.BucketInfo{{
+		Name:         b.bucket,
+		CreationDate: gofakes3.NewContentTime(info.Modified),
+	}}, nil
+}
+
+// listItem is either an object or a common prefix in the listing
+type listItem struct {
+	key     string
+	content *gofakes3.Content
+}
+
+// ListBucket walks the directories matching the prefix, only "/" is supported as delimiter.
+// Without a delimiter, the page is listed by ListObjects
+func (b *backend) ListBucket(name string, prefix *gofakes3.Prefix, page gofakes3.ListBucketPage) (*gofakes3.ObjectList, error) {
+	if err := b.checkBucket(name); err != nil {
+		return nil, err
+	}
+	if prefix == nil {
+		prefix = &gofakes3.Prefix{}
+	}
+	if prefix.HasDelimiter && prefix.Delimiter != "/" {
+		return nil, gofakes3.ErrNotImplemented
+	}
+	maxKeys := page.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = gofakes3.DefaultMaxBucketKeys
+	}
+	if !prefix.HasDelimiter {
+		return b.listObjects(prefix.Prefix, page, maxKeys)
+	}
+	dir := ""
+	if idx := strings.LastIndexByte(prefix.Prefix, '/'); idx >= 0 {
+		dir = prefix.Prefix[:idx]
+	}
+	var items []listItem
+	err := b.walk(context.Background(), dir, prefix.Prefix, prefix.HasDelimiter, &items)
+	if err != nil && !errs.IsObjectNotFound(err) {
+		return nil, err
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].key < items[j].key
+	})
+
+	list := gofakes3.NewObjectList()
+	var count int64
+	for _, item := range items {
+		if page.HasMarker && item.key <= page.Marker {
+			continue
+		}
+		if count == maxKeys {
+			list.IsTruncated = true
+			break
+		}
+		if item.content != nil {
+			list.Add(item.content)
+		} else {
+			list.AddPrefix(item.key)
+		}
+		list.NextMarker = item.key
+		count++
+	}
+	if !list.IsTruncated {
+		list.NextMarker = ""
+	}
+	return list, nil
+}
+
+// walk collects the objects under dir whose key starts with prefix, sub directories are
+// collected as common prefixes instead of walked into if delimited is set
+func (b *backend) walk(ctx context.Context, dir, prefix string, delimited bool, items *[]listItem) error {
+	entries, err := b.fsys.List(ctx, dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		key := path.Join(dir, e.Name)
+		if e.IsDir {
+			key += "/"
+			if !strings.HasPrefix(key, prefix) && !strings.HasPrefix(prefix, key) {
+				continue
+			}
+			if delimited && strings.HasPrefix(key, prefix) {
+				*items = append(*items, listItem{key: key})
+				continue
+			}
+			if err := b.walk(ctx, key, prefix, delimited, items); err != nil {
+				return err
+			}
+			continue
+		}
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		*items = append(*items, listItem{key: key, content: content(key, e)})
+	}
+	return nil
+}
+
+// listObjects lists a page of the keys starting with prefix
+func (b *backend) listObjects(prefix string, page gofakes3.ListBucketPage, maxKeys int64) (*gofakes3.ObjectList, error) {
+	marker := ""
+	if page.HasMarker {
+		marker = page.Marker
+	}
+	entries, next, err := b.fsys.ListObjects(context.Background(), prefix, marker, int(maxKeys))
+	if err != nil {
+		return nil, err
+	}
+	list := gofakes3.NewObjectList()
+	for _, e := range entries {
+		list.Add(content(e.Name, e))
+	}
+	list.IsTruncated, list.NextMarker = next != "", next
+	return list, nil
+}
+
+// content is the listed object of the file e at key
+func content(key string, e export.Entry) *gofakes3.Content {
+	return &gofakes3.Content{
+		Key:          key,
+		LastModified: gofakes3.NewContentTime(e.Modified),
+		ETag:         fmt.Sprintf(`"%x"`, etag(export.ObjInfo{Name: path.Base(key), Size: e.Size, Modified: e.Modified, Hashes: e.Hashes})),
+		Size:         e.Size,
+		StorageClass: gofakes3.StorageStandard,
+	}
+}
+
+func (b *backend) CreateBucket(name string) error {
+	return gofakes3.ErrNotImplemented
+}
+
+func (b *backend) BucketExists(name string) (exists bool, err error) {
+	return name == b.bucket, nil
+}
+
+func (b *backend) DeleteBucket(name string) error {
+	return gofakes3.ErrNotImplemented
+}
+
+// stat returns the file at key, directories are reported as missing keys
+func (b *backend) stat(ctx context.Context, key string) (export.ObjInfo, error) {
+	info, err := b.fsys.Stat(ctx, key)
+	if err != nil {
+		if errs.IsObjectNotFound(err) {
+			return info, gofakes3.KeyNotFound(key)
+		}
+		return info, err
+	}
+	if info.IsDir {
+		return info, gofakes3.KeyNotFound(key)
+	}
+	return info, nil
+}
+
+func newObject(key string, info export.ObjInfo) *gofakes3.Object {
+	return &gofakes3.Object{
+		Name: key,
+		Hash: etag(info),
+		Metadata: map[string]string{
+			"Last-Modified": info.Modified.UTC().Format(timeFormat),
+			"Content-Type":  utils.GetMimeType(key),
+		},
+		Size: info.Size,
+	}
+}
+
+func (b *backend) HeadObject(bucketName, objectName string) (*gofakes3.Object, error) {
+	if err := b.checkBucket(bucketName); err != nil {
+		return nil, err
+	}
+	info, err := b.stat(context.Background(), objectName)
+	if err != nil {
+		return nil, err
+	}
+	obj := newObject(objectName, info)
+	obj.Contents = io.NopCloser(strings.NewReader(""))
+	return obj, nil
+}
+
+// GetObject reads only the requested range of the object
+func (b *backend) GetObject(bucketName, objectName string, rangeRequest *gofakes3.ObjectRangeRequest) (*gofakes3.Object, error) {
+	if err := b.checkBucket(bucketName); err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	info, err := b.stat(ctx, objectName)
+	if err != nil {
+		return nil, err
+	}
+	rnge, err := rangeRequest.Range(info.Size)
+	if err != nil {
+		return nil, err
+	}
+	off, limit := int64(0), info.Size
+	if rnge != nil {
+		off, limit = rnge.Start, rnge.Length
+	}
+	rc, err := b.fsys.Read(ctx, objectName, off, limit)
+	if err != nil {
+		return nil, err
+	}
+	obj := newObject(objectName, info)
+	obj.Range = rnge
+	obj.Contents = rc
+	return obj, nil
+}
+
+func (b *backend) DeleteObject(bucketName, objectName string) (result gofakes3.ObjectDeleteResult, err error) {
+	if err = b.checkBucket(bucketName); err != nil {
+		return result, err
+	}
+	// Delete succeeds on missing objects as S3 does
+	return result, b.fsys.Delete(context.Background(), objectName)
+}
+
+func (b *backend) PutObject(bucketName, key string, meta map[string]string, input io.Reader, size int64) (result gofakes3.PutObjectResult, err error) {
+	if err = b.checkBucket(bucketName); err != nil {
+		return result, err
+	}
+	return result, b.fsys.PutWithSize(context.Background(), key, input, size)
+}
+
+func (b *backend) DeleteMulti(bucketName string, objects ...string) (result gofakes3.MultiDeleteResult, err error) {
+	if err = b.checkBucket(bucketName); err != nil {
+		return result, err
+	}
+	for _, object := range objects {
+		if _, err := b.DeleteObject(bucketName, object); err != nil {
+			utils.Log.Errorf("s3gw: failed to delete object [%s]: %+v", object, err)
+			result.Error = append(result.Error, gofakes3.ErrorResult{
+				Code:    gofakes3.ErrInternal,
+				Message: gofakes3.ErrInternal.Message(),
+				Key:     object,
+			})
+			continue
+		}
+		result.Deleted = append(result.Deleted, gofakes3.ObjectID{Key: object})
+	}
+	return result, nil
+}
+
+// CopyObject streams the source into the destination since keys may differ in name
+func (b *backend) CopyObject(srcBucket, srcKey, dstBucket, dstKey string, meta map[string]string) (result gofakes3.CopyObjectResult, err error) {
+	if err = b.checkBucket(dstBucket); err != nil {
+		return result, err
+	}
+	src, err := b.GetObject(srcBucket, srcKey, nil)
+	if err != nil {
+		return result, err
+	}
+	defer src.Contents.Close()
+	if srcKey != dstKey {
+		if _, err = b.PutObject(dstBucket, dstKey, meta, src.Contents, src.Size); err != nil {
+			return result, err
+		}
+	}
+	info, err := b.stat(context.Background(), dstKey)
+	if err != nil {
+		return result, err
+	}
+	return gofakes3.CopyObjectResult{
+		ETag:         fmt.Sprintf(`"%x"`, etag(info)),
+		LastModified: gofakes3.NewContentTime(info.Modified),
+	}, nil
+}
@@ -0,0 +1,55 @@
+// Package s3gw serves a subset of the S3 API on top of export.FileSystem
+package s3gw
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+
+	"github.com/Mikubill/gofakes3"
+	"github.com/alist-org/alist/v3/export"
+	"github.com/alist-org/alist/v3/pkg/utils"
+)
+
+const DefaultBucket = "juicefs"
+
+type Config struct {
+	// Bucket is the name of the only bucket, whose keys map to paths of the FileSystem
+	Bucket string
+	// AccessKey and SecretKey enable V4 signature auth when both of them are set
+	AccessKey string
+	SecretKey string
+}
+
+// Handler serves fsys as a single S3 bucket, multipart uploads are buffered by gofakes3
+// and put as a whole on completion
+func Handler(fsys export.FileSystem, cfg Config) http.Handler {
+	if cfg.Bucket == "" {
+		cfg.Bucket = DefaultBucket
+	}
+	opts := []gofakes3.Option{
+		gofakes3.WithLogger(logger{}),
+		gofakes3.WithRequestID(rand.Uint64()),
+		gofakes3.WithoutVersioning(),
+		gofakes3.WithIntegrityCheck(true),
+	}
+	if cfg.AccessKey != "" && cfg.SecretKey != "" {
+		opts = append(opts, gofakes3.WithV4Auth(map[string]string{cfg.AccessKey: cfg.SecretKey}))
+	}
+	return gofakes3.New(newBackend(fsys, cfg.Bucket), opts...).Server()
+}
+
+type logger struct{}
+
+func (l logger) Print(level gofakes3.LogLevel, v ...interface{}) {
+	switch level {
+	default:
+		fallthrough
+	case gofakes3.LogErr:
+		utils.Log.Errorf("s3gw: %s", fmt.Sprintln(v...))
+	case gofakes3.LogWarn:
+		utils.Log.Infof("s3gw: %s", fmt.Sprintln(v...))
+	case gofakes3.LogInfo:
+		utils.Log.Debugf("s3gw: %s", fmt.Sprintln(v...))
+	}
+}
@@ -0,0 +1,125 @@
+package s3gw
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alist-org/alist/v3/drivers/local"
+	"github.com/alist-org/alist/v3/export"
+	"github.com/alist-org/alist/v3/internal/driver"
+	"github.com/alist-org/alist/v3/pkg/utils"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func init() {
+	export.Register("test-local", func() driver.Driver {
+		return &local.Local{}
+	})
+}
+
+func newTestClient(t *testing.T, secret string) *s3.S3 {
+	addition, _ := utils.Json.MarshalToString(map[string]string{"root_folder_path": t.TempDir()})
+	fsys, err := export.NewByName(context.Background(), "test-local", addition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(Handler(fsys, Config{AccessKey: "access", SecretKey: "secret"}))
+	t.Cleanup(srv.Close)
+	sess, err := session.NewSession(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials("access", secret, ""),
+		Endpoint:         aws.String(srv.URL),
+		Region:           aws.String("us-east-1"),
+		S3ForcePathStyle: aws.Bool(true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s3.New(sess)
+}
+
+func TestGateway(t *testing.T) {
+	c := newTestClient(t, "secret")
+	bucket := aws.String(DefaultBucket)
+	for _, key := range []string{"a/1.txt", "a/2.txt", "a/b/3.txt", "c.txt"} {
+		_, err := c.PutObject(&s3.PutObjectInput{Bucket: bucket, Key: aws.String(key), Body: bytes.NewReader([]byte("0123456789"))})
+		if err != nil {
+			t.Fatalf("put %s: %+v", key, err)
+		}
+	}
+
+	head, err := c.HeadObject(&s3.HeadObjectInput{Bucket: bucket, Key: aws.String("a/1.txt")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *head.ContentLength != 10 || head.ETag == nil || *head.ETag == "" {
+		t.Fatalf("unexpected head: %+v", head)
+	}
+
+	get, err := c.GetObject(&s3.GetObjectInput{Bucket: bucket, Key: aws.String("a/b/3.txt"), Range: aws.String("bytes=2-4")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(get.Body)
+	get.Body.Close()
+	if string(body) != "234" || *get.ContentRange != "bytes 2-4/10" {
+		t.Fatalf("unexpected range get: %q %s", body, *get.ContentRange)
+	}
+
+	list, err := c.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: bucket, Prefix: aws.String("a/"), Delimiter: aws.String("/")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Contents) != 2 || *list.Contents[0].Key != "a/1.txt" || len(list.CommonPrefixes) != 1 || *list.CommonPrefixes[0].Prefix != "a/b/" {
+		t.Fatalf("unexpected delimited list: %+v", list)
+	}
+
+	var keys []string
+	err = c.ListObjectsV2Pages(&s3.ListObjectsV2Input{Bucket: bucket, MaxKeys: aws.Int64(2)}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, o := range page.Contents {
+			keys = append(keys, *o.Key)
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 4 || keys[0] != "a/1.txt" || keys[3] != "c.txt" {
+		t.Fatalf("unexpected paged list: %v", keys)
+	}
+
+	if _, err := c.DeleteObject(&s3.DeleteObjectInput{Bucket: bucket, Key: aws.String("c.txt")}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.HeadObject(&s3.HeadObjectInput{Bucket: bucket, Key: aws.String("c.txt")})
+	if aerr, ok := err.(awserr.RequestFailure); !ok || aerr.StatusCode() != 404 {
+		t.Fatalf("expected 404 after delete, got %v", err)
+	}
+}
+
+func TestGatewayAuth(t *testing.T) {
+	c := newTestClient(t, "wrong")
+	_, err := c.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String(DefaultBucket)})
+	if aerr, ok := err.(awserr.RequestFailure); !ok || aerr.StatusCode() != 403 {
+		t.Fatalf("expected 403 with a wrong secret, got %v", err)
+	}
+}
+
+func TestETag(t *testing.T) {
+	md5 := utils.HashData(utils.MD5, []byte("hello"))
+	info := export.ObjInfo{Name: "a", Size: 5, Hashes: utils.NewHashInfo(utils.MD5, md5)}
+	if got := fmt.Sprintf("%x", etag(info)); got != md5 {
+		t.Errorf("the etag should be the md5 of the driver, got %s", got)
+	}
+	info.Hashes = utils.HashInfo{}
+	if got := etag(info); len(got) != 16 {
+		t.Errorf("the etag should be synthesized, got %x", got)
+	}
+}
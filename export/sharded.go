@@ -0,0 +1,667 @@
+package export
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	stdpath "path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/alist-org/alist/v3/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxShardDigits is how many hex digits of the SHA-1 of a name the shards can take
+	maxShardDigits = sha1.Size * 2
+	// shardPrefix starts the names of the shards, so they aren't taken for the dirs of the names
+	shardPrefix = ".s"
+)
+
+// WithShardedLayout stores each file under depth levels of dirs named by ".s" and width hex
+// digits of the SHA-1 of its base name, so with depth 2 and width 2 "chunks/123456" is stored as
+// "chunks/.s1a/.s2b/123456" and no dir of the storage holds more than 16^width files and shards,
+// for the drivers slow to list large dirs. The puts, reads, deletes and stats map the names
+// to their shards, and List presents the flat dirs by listing their shards in parallel. The
+// files put before are still read and listed where they are, MigrateSharded moves them.
+//
+// The names with a dir named like a shard, ".s" and width hex digits, fail with
+// ErrInvalidName. The rules of ApplyLifecycle match the names stored, so a prefix must end at a
+// dir to match the files of its shards. Glob, ListObjects, Snapshot, DiffLive, VerifyLocal,
+// SyncUp, DownloadTar and UploadArchive fail with errs.NotSupport, Usage counts the shards as dirs
+func WithShardedLayout(depth, width int) Option {
+	return func(c *config) {
+		c.shardDepth = depth
+		c.shardWidth = width
+	}
+}
+
+// layout returns i, or the sharded layer over it by WithShardedLayout
+func (i *Impl) layout() FileSystem {
+	if i.conf.shardDepth == 0 {
+		return i
+	}
+	return &sharded{FileSystem: i, depth: i.conf.shardDepth, width: i.conf.shardWidth, parallel: i.conf.walkParallel}
+}
+
+// sharded is the FileSystem of WithShardedLayout, the ops not overridden are of inner
+type sharded struct {
+	FileSystem
+	depth, width int
+	// parallel is how many shards List lists at once
+	parallel int
+}
+
+func notSharded(op string) error {
+	return errors.WithMessagef(errs.NotSupport, "%s of a sharded layout", op)
+}
+
+// isShard reports whether the dir elem is a shard
+func (s *sharded) isShard(elem string) bool {
+	digits, ok := strings.CutPrefix(elem, shardPrefix)
+	if !ok || len(digits) != s.width {
+		return false
+	}
+	for _, c := range digits {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// check fails with ErrInvalidName if a dir of name could be taken as a shard
+func (s *sharded) check(name string) error {
+	for _, elem := range strings.Split(stdpath.Dir(packKey(name)), "/") {
+		if s.isShard(elem) {
+			return errors.WithMessagef(ErrInvalidName, "[%s] has the dir [%s] named like a shard", name, elem)
+		}
+	}
+	return nil
+}
+
+// shardDir returns the dir the file base is stored in under dir
+func (s *sharded) shardDir(dir, base string) string {
+	sum := sha1.Sum([]byte(base))
+	digits := hex.EncodeToString(sum[:])
+	elems := []string{dir}
+	for n := 0; n < s.depth; n++ {
+		elems = append(elems, shardPrefix+digits[n*s.width:(n+1)*s.width])
+	}
+	return stdpath.Join(elems...)
+}
+
+// path returns where the file name is stored
+func (s *sharded) path(name string) (string, error) {
+	if err := s.check(name); err != nil {
+		return "", err
+	}
+	key := packKey(name)
+	if key == "." {
+		return "", errors.WithMessagef(ErrInvalidName, "[%s] is the base dir", name)
+	}
+	dir, base := stdpath.Split(key)
+	return stdpath.Join(s.shardDir(dir, base), base), nil
+}
+
+// logical returns the name of the file stored at path, without its shards
+func (s *sharded) logical(path string) string {
+	dir, base := stdpath.Split(packKey(path))
+	elems := strings.Split(stdpath.Clean(dir), "/")
+	if len(elems) >= s.depth {
+		shards := elems[len(elems)-s.depth:]
+		all := true
+		for _, elem := range shards {
+			all = all && s.isShard(elem)
+		}
+		if all {
+			elems = elems[:len(elems)-s.depth]
+		}
+	}
+	return stdpath.Join(append(elems, base)...)
+}
+
+// stat returns the info of the file name where it's stored, or of the object name of inner,
+// which is a dir or a file put before the layout, and the path of the object
+func (s *sharded) stat(ctx context.Context, name string) (ObjInfo, string, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return ObjInfo{}, "", err
+	}
+	info, err := s.FileSystem.Stat(ctx, path)
+	if err == nil || !errs.IsObjectNotFound(err) {
+		return info, path, err
+	}
+	info, err = s.FileSystem.Stat(ctx, name)
+	return info, name, err
+}
+
+// file returns the path of the file name, where it's stored unless it's only found at name
+func (s *sharded) file(ctx context.Context, name string) (string, error) {
+	info, path, err := s.stat(ctx, name)
+	if errs.IsObjectNotFound(err) {
+		return s.path(name)
+	}
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir {
+		return "", errors.WithStack(errs.NotFile)
+	}
+	return path, nil
+}
+
+func (s *sharded) Stat(ctx context.Context, name string) (ObjInfo, error) {
+	info, _, err := s.stat(ctx, name)
+	return info, err
+}
+
+func (s *sharded) Exists(ctx context.Context, name string) (bool, error) {
+	_, _, err := s.stat(ctx, name)
+	if errs.IsObjectNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *sharded) Hashes(ctx context.Context, name string) (map[*utils.HashType]string, error) {
+	_, path, err := s.stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return s.FileSystem.Hashes(ctx, path)
+}
+
+func (s *sharded) Read(ctx context.Context, name string, off, limit int64) (io.ReadCloser, error) {
+	path, err := s.file(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return s.FileSystem.Read(ctx, path, off, limit)
+}
+
+func (s *sharded) Open(ctx context.Context, name string) (io.ReadSeekCloser, error) {
+	path, err := s.file(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return s.FileSystem.Open(ctx, path)
+}
+
+func (s *sharded) OpenReaderAt(ctx context.Context, name string) (io.ReaderAt, io.Closer, error) {
+	path, err := s.file(ctx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.FileSystem.OpenReaderAt(ctx, path)
+}
+
+// put maps name to its shard for f, removing the file put before the layout once it's replaced
+func (s *sharded) put(ctx context.Context, name string, f func(path string) error) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := f(path); err != nil {
+		return err
+	}
+	if info, err := s.FileSystem.Stat(ctx, name); err == nil && !info.IsDir {
+		return s.FileSystem.Delete(ctx, name)
+	}
+	return nil
+}
+
+func (s *sharded) Put(ctx context.Context, name string, body io.Reader) error {
+	return s.put(ctx, name, func(path string) error {
+		return s.FileSystem.Put(ctx, path, body)
+	})
+}
+
+func (s *sharded) PutWithSize(ctx context.Context, name string, body io.Reader, size int64) error {
+	return s.put(ctx, name, func(path string) error {
+		return s.FileSystem.PutWithSize(ctx, path, body, size)
+	})
+}
+
+func (s *sharded) PutResult(ctx context.Context, name string, body io.Reader) (info ObjInfo, err error) {
+	err = s.put(ctx, name, func(path string) error {
+		info, err = s.FileSystem.PutResult(ctx, path, body)
+		return err
+	})
+	return info, err
+}
+
+func (s *sharded) PutWithOptions(ctx context.Context, name string, body io.Reader, opts ...PutOption) (info ObjInfo, err error) {
+	err = s.put(ctx, name, func(path string) error {
+		info, err = s.FileSystem.PutWithOptions(ctx, path, body, opts...)
+		return err
+	})
+	return info, err
+}
+
+func (s *sharded) PutWithHash(ctx context.Context, name string, size int64, hashes utils.HashInfo, body io.Reader) error {
+	return s.put(ctx, name, func(path string) error {
+		return s.FileSystem.PutWithHash(ctx, path, size, hashes, body)
+	})
+}
+
+func (s *sharded) ResumePut(ctx context.Context, name string, state []byte, body io.ReadSeeker, opts ...PutOption) error {
+	return s.put(ctx, name, func(path string) error {
+		return s.FileSystem.ResumePut(ctx, path, state, body, opts...)
+	})
+}
+
+// PutIfAbsent fails with ErrExist for a file put before the layout too
+func (s *sharded) PutIfAbsent(ctx context.Context, name string, body io.Reader) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if ok, err := s.FileSystem.Exists(ctx, name); err != nil || ok {
+		if err == nil {
+			err = errors.WithMessagef(ErrExist, "[%s]", name)
+		}
+		return err
+	}
+	return s.FileSystem.PutIfAbsent(ctx, path, body)
+}
+
+// PutBatch puts the items to their shards by the PutBatch of inner
+func (s *sharded) PutBatch(ctx context.Context, items []PutItem, parallel int) []error {
+	mapped := make([]PutItem, 0, len(items))
+	index := make([]int, 0, len(items))
+	results := make([]error, len(items))
+	for n, item := range items {
+		path, err := s.path(item.Name)
+		if err != nil {
+			results[n] = err
+			continue
+		}
+		item.Name = path
+		mapped = append(mapped, item)
+		index = append(index, n)
+	}
+	for k, err := range s.FileSystem.PutBatch(ctx, mapped, parallel) {
+		results[index[k]] = err
+	}
+	return results
+}
+
+func (s *sharded) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.FileSystem.Create(ctx, path)
+}
+
+func (s *sharded) Touch(ctx context.Context, name string) error {
+	path, err := s.file(ctx, name)
+	if err != nil {
+		return err
+	}
+	return s.FileSystem.Touch(ctx, path)
+}
+
+func (s *sharded) WriteAt(ctx context.Context, name string, off int64, data []byte) error {
+	path, err := s.file(ctx, name)
+	if err != nil {
+		return err
+	}
+	return s.FileSystem.WriteAt(ctx, path, off, data)
+}
+
+func (s *sharded) Append(ctx context.Context, name string, body io.Reader) error {
+	path, err := s.file(ctx, name)
+	if err != nil {
+		return err
+	}
+	return s.FileSystem.Append(ctx, path, body)
+}
+
+// Delete removes the file name where it's stored, or the object name of inner
+func (s *sharded) Delete(ctx context.Context, name string) error {
+	_, path, err := s.stat(ctx, name)
+	if errs.IsObjectNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.FileSystem.Delete(ctx, path)
+}
+
+// Restore restores the file name to its shard, or where it was put before the layout
+func (s *sharded) Restore(ctx context.Context, name string) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := s.FileSystem.Restore(ctx, path); !errs.IsObjectNotFound(err) {
+		return err
+	}
+	return s.FileSystem.Restore(ctx, name)
+}
+
+func (s *sharded) ListVersions(ctx context.Context, name string) ([]Version, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.FileSystem.ListVersions(ctx, path)
+}
+
+func (s *sharded) RestoreVersion(ctx context.Context, name, version string) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	return s.FileSystem.RestoreVersion(ctx, path, version)
+}
+
+func (s *sharded) DeleteBatch(ctx context.Context, names []string, parallel int) map[string]error {
+	return deleteEach(ctx, names, parallel, s.Delete)
+}
+
+func (s *sharded) RemoveAll(ctx context.Context, dir string) error {
+	info, path, err := s.stat(ctx, dir)
+	if errs.IsObjectNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir {
+		return s.FileSystem.Delete(ctx, path)
+	}
+	return s.FileSystem.RemoveAll(ctx, path)
+}
+
+func (s *sharded) Mkdir(ctx context.Context, dir string) error {
+	if err := s.check(stdpath.Join(dir, "x")); err != nil {
+		return err
+	}
+	return s.FileSystem.Mkdir(ctx, dir)
+}
+
+// relocate moves or copies the file at path to the shard of dst, by transfer given the dir
+func (s *sharded) relocate(ctx context.Context, path, dst string, transfer func(src, dstDir string) error) error {
+	target, err := s.path(dst)
+	if err != nil {
+		return err
+	}
+	if err := s.FileSystem.Mkdir(ctx, stdpath.Dir(target)); err != nil {
+		return err
+	}
+	return transfer(path, stdpath.Dir(target))
+}
+
+// Rename renames a file by moving it to the shard of newName, after renaming it in its shard
+// if the base name changes
+func (s *sharded) Rename(ctx context.Context, name, newName string) error {
+	if stdpath.Dir(packKey(name)) != stdpath.Dir(packKey(newName)) {
+		return errors.WithStack(ErrCrossDirRename)
+	}
+	if err := s.check(newName); err != nil {
+		return err
+	}
+	info, path, err := s.stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir {
+		return s.FileSystem.Rename(ctx, path, newName)
+	}
+	renamed := stdpath.Join(stdpath.Dir(path), stdpath.Base(packKey(newName)))
+	if renamed != path {
+		if err := s.FileSystem.Rename(ctx, path, renamed); err != nil {
+			return err
+		}
+	}
+	target, err := s.path(newName)
+	if err != nil || target == renamed {
+		return err
+	}
+	return s.relocate(ctx, renamed, newName, func(src, dstDir string) error {
+		return s.FileSystem.Move(ctx, src, dstDir)
+	})
+}
+
+func (s *sharded) Move(ctx context.Context, src, dstDir string) error {
+	if err := s.check(stdpath.Join(dstDir, "x")); err != nil {
+		return err
+	}
+	info, path, err := s.stat(ctx, src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir {
+		return s.FileSystem.Move(ctx, path, dstDir)
+	}
+	return s.relocate(ctx, path, stdpath.Join(dstDir, stdpath.Base(path)), func(src, dstDir string) error {
+		return s.FileSystem.Move(ctx, src, dstDir)
+	})
+}
+
+func (s *sharded) Copy(ctx context.Context, src, dstDir string) error {
+	if err := s.check(stdpath.Join(dstDir, "x")); err != nil {
+		return err
+	}
+	info, path, err := s.stat(ctx, src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir {
+		return s.FileSystem.Copy(ctx, path, dstDir)
+	}
+	return s.relocate(ctx, path, stdpath.Join(dstDir, stdpath.Base(path)), func(src, dstDir string) error {
+		return s.FileSystem.Copy(ctx, src, dstDir)
+	})
+}
+
+func (s *sharded) List(ctx context.Context, dir string, opts ...ListOption) ([]Entry, error) {
+	var entries []Entry
+	err := s.ListIter(ctx, dir, func(e Entry) error {
+		entries = append(entries, e)
+		return nil
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// ListIter lists dir with the files of its shards in place of the shards, the shards are
+// listed up to WithWalkParallel at once, so the entries are held until all are listed
+func (s *sharded) ListIter(ctx context.Context, dir string, fn func(Entry) error, opts ...ListOption) error {
+	if err := s.check(stdpath.Join(dir, "x")); err != nil {
+		return err
+	}
+	top, err := s.FileSystem.List(ctx, dir)
+	if err != nil {
+		return err
+	}
+	var (
+		entries []Entry
+		shards  []string
+	)
+	for _, e := range top {
+		if e.IsDir && s.isShard(e.Name) {
+			shards = append(shards, stdpath.Join(dir, e.Name))
+		} else {
+			entries = append(entries, e)
+		}
+	}
+	files, err := s.listShards(ctx, shards, s.depth-1)
+	if err != nil {
+		return err
+	}
+	entries = append(entries, files...)
+	o := newListOptions(opts)
+	kept := entries[:0]
+	for _, e := range entries {
+		if o.keepEntry(e.IsDir, e.Size, e.Modified) {
+			kept = append(kept, e)
+		}
+	}
+	if o.sorted() {
+		o.sort(kept)
+	} else {
+		sort.SliceStable(kept, func(a, b int) bool { return kept[a].Name < kept[b].Name })
+	}
+	for _, e := range kept {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listShards lists the files of dirs, which are shards of levels more levels below them
+func (s *sharded) listShards(ctx context.Context, dirs []string, levels int) ([]Entry, error) {
+	parallel := s.parallel
+	if parallel <= 0 {
+		parallel = defaultWalkParallel
+	}
+	var (
+		mu       sync.Mutex
+		files    []Entry
+		next     []string
+		firstErr error
+	)
+	started := make([]bool, len(dirs))
+	forEach(ctx, parallel, len(dirs), func(n int) {
+		started[n] = true
+		entries, err := s.FileSystem.List(ctx, dirs[n])
+		mu.Lock()
+		defer mu.Unlock()
+		if errs.IsObjectNotFound(err) {
+			// a shard removed since its dir was listed
+			return
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			return
+		}
+		for _, e := range entries {
+			switch {
+			case levels > 0 && e.IsDir && s.isShard(e.Name):
+				next = append(next, stdpath.Join(dirs[n], e.Name))
+			case levels == 0 && !e.IsDir:
+				files = append(files, e)
+			}
+		}
+	})
+	for n := range dirs {
+		if !started[n] && firstErr == nil {
+			firstErr = errors.WithStack(ctx.Err())
+		}
+	}
+	if firstErr != nil || len(next) == 0 {
+		return files, firstErr
+	}
+	deeper, err := s.listShards(ctx, next, levels-1)
+	return append(files, deeper...), err
+}
+
+// Walk walks the tree at root by List, see walkList
+func (s *sharded) Walk(ctx context.Context, root string, fn fs.WalkDirFunc) error {
+	return walkList(ctx, s, root, fn)
+}
+
+func (s *sharded) Glob(context.Context, string) ([]string, error) {
+	return nil, notSharded("glob")
+}
+
+func (s *sharded) ListObjects(context.Context, string, string, int) ([]Entry, string, error) {
+	return nil, "", notSharded("list objects")
+}
+
+func (s *sharded) Snapshot(context.Context, string, io.Writer) error {
+	return notSharded("snapshot")
+}
+
+func (s *sharded) DiffLive(context.Context, string, *SnapshotReader, func(DiffEntry) error) error {
+	return notSharded("diff")
+}
+
+func (s *sharded) VerifyLocal(context.Context, string, string, VerifyOptions) (Report, error) {
+	return Report{}, notSharded("verify")
+}
+
+func (s *sharded) SyncUp(context.Context, string, string, SyncOptions) (SyncReport, error) {
+	return SyncReport{}, notSharded("syncup")
+}
+
+func (s *sharded) DownloadTar(context.Context, string, io.Writer, ...TarOption) error {
+	return notSharded("tar")
+}
+
+func (s *sharded) UploadArchive(context.Context, string, io.Reader, ArchiveFormat, ...ArchiveOption) error {
+	return notSharded("archive")
+}
+
+// ShardReport is the result of MigrateSharded
+type ShardReport struct {
+	// Moved are the names of the files moved to their shards
+	Moved []string
+	// Failed are the errors of the files which couldn't be moved, by name
+	Failed map[string]error
+}
+
+// MigrateSharded moves the files of the tree at dir of fsys, made WithShardedLayout, which aren't
+// in their shards, like the files put before the layout or left by a rename interrupted, with up
+// to parallel moves at once, 4 if <= 0. The failures of single files are in the report, the error
+// is of walking the tree
+func MigrateSharded(ctx context.Context, fsys FileSystem, dir string, parallel int) (ShardReport, error) {
+	s, ok := fsys.(*sharded)
+	if !ok {
+		return ShardReport{}, errors.WithMessage(errs.NotSupport, "migrate a FileSystem without WithShardedLayout")
+	}
+	var misplaced []string
+	err := s.FileSystem.Walk(ctx, dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if target, err := s.path(s.logical(p)); err != nil || target != packKey(p) {
+			misplaced = append(misplaced, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return ShardReport{}, err
+	}
+	if parallel <= 0 {
+		parallel = defaultPutParallel
+	}
+	r := ShardReport{Failed: map[string]error{}}
+	var mu sync.Mutex
+	forEach(ctx, parallel, len(misplaced), func(n int) {
+		p := misplaced[n]
+		err := s.relocate(ctx, p, s.logical(p), func(src, dstDir string) error {
+			return s.FileSystem.Move(ctx, src, dstDir)
+		})
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			r.Failed[p] = err
+		} else {
+			r.Moved = append(r.Moved, p)
+		}
+	})
+	sort.Strings(r.Moved)
+	if err := ctx.Err(); err != nil {
+		return r, errors.WithStack(err)
+	}
+	return r, nil
+}
@@ -0,0 +1,141 @@
+package export
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/alist-org/alist/v3/internal/model"
+	"github.com/alist-org/alist/v3/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+// snapshotVersion is the version of the format written by Snapshot
+const snapshotVersion = 1
+
+// ErrSnapshotVersion is returned by LoadSnapshot for a snapshot of a version it can't read
+var ErrSnapshotVersion = errors.New("unsupported snapshot version")
+
+// snapshotHeader is the first line of a snapshot
+type snapshotHeader struct {
+	Version int       `json:"version"`
+	Root    string    `json:"root"`
+	Time    time.Time `json:"time"`
+}
+
+// SnapshotEntry is an object of a snapshot
+type SnapshotEntry struct {
+	// Path is relative to the root of the snapshot
+	Path     string
+	Size     int64
+	Modified time.Time
+	IsDir    bool
+	// Hashes are the hashes reported by the driver
+	Hashes utils.HashInfo
+}
+
+type snapshotLine struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"mtime"`
+	IsDir    bool      `json:"dir,omitempty"`
+	// Hashes are by the names of their types, like {"md5":"..."}
+	Hashes json.RawMessage `json:"hashes,omitempty"`
+}
+
+// Snapshot walks the tree at dir like Walk does and writes its objects to w as JSON lines
+// as they are walked, after a header line with the version of the format. The objects removed
+// while walked and the dirs which would be walked again are left out, see LoadSnapshot
+func (i *Impl) Snapshot(ctx context.Context, dir string, w io.Writer) (err error) {
+	ctx, end := i.startOp(ctx, "snapshot", dir)
+	defer end(&err)
+	path, err := i.cleanPath(dir)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	root := strings.TrimPrefix(strings.TrimPrefix(path, i.conf.baseDir), "/")
+	if err := enc.Encode(snapshotHeader{Version: snapshotVersion, Root: root, Time: time.Now()}); err != nil {
+		return errors.WithStack(err)
+	}
+	err = i.walkSnapshot(ctx, path, func(e SnapshotEntry) error {
+		l := snapshotLine{Path: e.Path, Size: e.Size, Modified: e.Modified, IsDir: e.IsDir}
+		if len(e.Hashes.Export()) > 0 {
+			l.Hashes = json.RawMessage(e.Hashes.String())
+		}
+		return errors.WithStack(enc.Encode(l))
+	})
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(bw.Flush())
+}
+
+// walkSnapshot calls fn with the objects under the dir at path in the order walked, which would
+// be written to its snapshot
+func (i *Impl) walkSnapshot(ctx context.Context, path string, fn func(SnapshotEntry) error) error {
+	return i.walk(ctx, "", path, func(name string, obj model.Obj, err error) error {
+		if errors.Is(err, ErrWalkLoop) || err != nil && obj != nil && errs.IsObjectNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			return nil
+		}
+		return fn(SnapshotEntry{Path: name, Size: obj.GetSize(), Modified: obj.ModTime(), IsDir: obj.IsDir(), Hashes: obj.GetHash()})
+	})
+}
+
+// SnapshotReader reads the objects of a snapshot written by Snapshot one at a time
+type SnapshotReader struct {
+	// Root is the dir the snapshot was taken of, relative to the base dir
+	Root string
+	// Time is when the snapshot was started
+	Time time.Time
+	dec  *json.Decoder
+}
+
+// LoadSnapshot reads the header of the snapshot in r, its objects are read by Next
+func LoadSnapshot(r io.Reader) (*SnapshotReader, error) {
+	dec := json.NewDecoder(r)
+	var h snapshotHeader
+	if err := dec.Decode(&h); err != nil {
+		return nil, errors.WithMessage(err, "failed to read snapshot header")
+	}
+	if h.Version != snapshotVersion {
+		return nil, errors.WithMessagef(ErrSnapshotVersion, "version %d", h.Version)
+	}
+	return &SnapshotReader{Root: h.Root, Time: h.Time, dec: dec}, nil
+}
+
+// Next returns the next object of the snapshot, in the order walked, or io.EOF after the last one
+func (s *SnapshotReader) Next() (SnapshotEntry, error) {
+	var l snapshotLine
+	if err := s.dec.Decode(&l); err == io.EOF {
+		return SnapshotEntry{}, io.EOF
+	} else if err != nil {
+		return SnapshotEntry{}, errors.WithMessage(err, "failed to read snapshot")
+	}
+	if !fs.ValidPath(l.Path) {
+		return SnapshotEntry{}, errors.WithMessagef(ErrInvalidName, "[%s] in snapshot", l.Path)
+	}
+	hashes := utils.NewHashInfo(nil, "")
+	if len(l.Hashes) > 0 {
+		hashes = utils.FromString(string(l.Hashes))
+	}
+	return SnapshotEntry{
+		Path:     l.Path,
+		Size:     l.Size,
+		Modified: l.Modified,
+		IsDir:    l.IsDir,
+		Hashes:   hashes,
+	}, nil
+}
@@ -0,0 +1,177 @@
+package export
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/alist-org/alist/v3/internal/conf"
+	"github.com/alist-org/alist/v3/internal/model"
+	"github.com/pkg/errors"
+)
+
+// tempFile removes itself when closed
+type tempFile struct {
+	*os.File
+}
+
+func (f tempFile) Close() error {
+	err := f.File.Close()
+	if rmErr := os.Remove(f.Name()); rmErr != nil && err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+func tempDir() (string, error) {
+	dir := os.TempDir()
+	if conf.Conf != nil && conf.Conf.TempDir != "" {
+		dir = conf.Conf.TempDir
+	}
+	return dir, os.MkdirAll(dir, 0o777)
+}
+
+// spoolWriter keeps the written data in memory until it's larger than threshold,
+// and then moves it into a temp file. The memory is got from the buffer pools
+type spoolWriter struct {
+	threshold int64
+	buf       []byte
+	f         *tempFile
+	size      int64
+}
+
+func newSpoolWriter(threshold int64) *spoolWriter {
+	return &spoolWriter{threshold: threshold}
+}
+
+func (w *spoolWriter) Write(p []byte) (int, error) {
+	if w.f == nil && w.size+int64(len(p)) > w.threshold {
+		if err := w.toFile(); err != nil {
+			return 0, err
+		}
+	}
+	if w.f != nil {
+		n, err := w.f.Write(p)
+		w.size += int64(n)
+		return n, err
+	}
+	if len(w.buf)+len(p) > cap(w.buf) {
+		w.grow(len(w.buf) + len(p))
+	}
+	w.buf = append(w.buf, p...)
+	w.size += int64(len(p))
+	return len(p), nil
+}
+
+// ReadFrom reads r into the memory directly, which spares the buffer of io.Copy
+func (w *spoolWriter) ReadFrom(r io.Reader) (int64, error) {
+	start := w.size
+	for w.f == nil {
+		if len(w.buf) == cap(w.buf) {
+			w.grow(2 * cap(w.buf))
+		}
+		// a byte beyond threshold tells the data is too large for the memory
+		room := min(int64(cap(w.buf)-len(w.buf)), w.threshold+1-w.size)
+		n, err := r.Read(w.buf[len(w.buf) : len(w.buf)+int(room)])
+		w.buf = w.buf[:len(w.buf)+n]
+		w.size += int64(n)
+		if err == io.EOF {
+			return w.size - start, nil
+		}
+		if err != nil {
+			return w.size - start, err
+		}
+		if w.size > w.threshold {
+			if err := w.toFile(); err != nil {
+				return w.size - start, err
+			}
+		}
+	}
+	n, err := io.Copy(w.f, r)
+	w.size += n
+	return w.size - start, err
+}
+
+// grow replaces the memory by a buffer of at least n bytes
+func (w *spoolWriter) grow(n int) {
+	buf := append(getBuf(n), w.buf...)
+	putBuf(w.buf)
+	w.buf = buf
+}
+
+// toFile moves the data into a temp file
+func (w *spoolWriter) toFile() error {
+	dir, err := tempDir()
+	if err != nil {
+		return errors.WithMessage(err, "failed to make temp dir")
+	}
+	f, err := os.CreateTemp(dir, "export-*")
+	if err != nil {
+		return errors.WithMessage(err, "failed to create temp file")
+	}
+	w.f = &tempFile{f}
+	_, err = f.Write(w.buf)
+	putBuf(w.buf)
+	w.buf = nil
+	return err
+}
+
+// Size returns how many bytes have been written
+func (w *spoolWriter) Size() int64 {
+	return w.size
+}
+
+// File returns the written data to read from the start, no more writes are allowed.
+// Closing the returned file releases the temp file or the memory
+func (w *spoolWriter) File() (model.File, error) {
+	if w.f == nil {
+		f := newPooledFile(w.buf)
+		w.buf = nil
+		return f, nil
+	}
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		_ = w.f.Close()
+		return nil, err
+	}
+	return w.f, nil
+}
+
+// Discard releases the written data
+func (w *spoolWriter) Discard() error {
+	putBuf(w.buf)
+	w.buf = nil
+	if w.f != nil {
+		return w.f.Close()
+	}
+	return nil
+}
+
+// ctxReader fails the reads once ctx is done
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return r.r.Read(p)
+}
+
+// spool reads all of body so that its size is known, the data is kept in memory
+// until it's larger than threshold and then moved into a temp file, which is removed
+// if the body fails or ctx is done in the meantime.
+// Closing the returned file releases the temp file or the memory
+func spool(ctx context.Context, body io.Reader, threshold int64) (model.File, int64, error) {
+	w := newSpoolWriter(threshold)
+	if _, err := w.ReadFrom(ctxReader{ctx: ctx, r: body}); err != nil {
+		_ = w.Discard()
+		return nil, 0, err
+	}
+	f, err := w.File()
+	if err != nil {
+		return nil, 0, err
+	}
+	return f, w.Size(), nil
+}
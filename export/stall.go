@@ -0,0 +1,79 @@
+package export
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrReadStalled is the error of a download delivering no bytes for the timeout of
+// WithReadStallTimeout, it's a timeout like os.ErrDeadlineExceeded
+var ErrReadStalled = errors.WithMessage(os.ErrDeadlineExceeded, "read stalled")
+
+// WithReadStallTimeout aborts the transfer of the ranges read by Read once no bytes arrive for d,
+// and reads the rest of the range again up to retries times before failing with ErrReadStalled.
+// The sub-ranges of WithParallelRead are retried like the other driver calls, see WithRetry.
+// It isn't enabled by default
+func WithReadStallTimeout(d time.Duration, retries int) Option {
+	return func(c *config) {
+		c.stallTimeout = d
+		c.stallRetries = retries
+	}
+}
+
+// watchStall calls abort if stop isn't called within d, stop reports whether abort was called
+func watchStall(d time.Duration, abort func()) (stop func() bool) {
+	if d <= 0 {
+		return func() bool { return false }
+	}
+	var stalled atomic.Bool
+	t := time.AfterFunc(d, func() {
+		stalled.Store(true)
+		abort()
+	})
+	return func() bool {
+		return !t.Stop() && stalled.Load()
+	}
+}
+
+// stallReader reads from r, aborting a read and failing it with ErrReadStalled
+// once it has waited for timeout
+type stallReader struct {
+	r       io.Reader
+	timeout time.Duration
+	abort   func()
+}
+
+// newStallReader watches the reads of r if timeout is positive, abort is on top of
+// cancel, which is called to abort a read and when the reader is closed
+func newStallReader(r io.Reader, timeout time.Duration, cancel context.CancelFunc) io.Reader {
+	if timeout <= 0 {
+		return r
+	}
+	return &stallReader{r: r, timeout: timeout, abort: func() {
+		cancel()
+		if c, ok := r.(io.Closer); ok {
+			_ = c.Close()
+		}
+	}}
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	stop := watchStall(s.timeout, s.abort)
+	n, err := s.r.Read(p)
+	if stop() {
+		return n, errors.WithStack(ErrReadStalled)
+	}
+	return n, err
+}
+
+func (s *stallReader) Close() error {
+	if c, ok := s.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package export
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// StatsSnapshot is a copy of the transfer counters of a FileSystem
+type StatsSnapshot struct {
+	// BytesUploaded is the size of the uploaded objects
+	BytesUploaded uint64
+	// BytesDownloaded is the bytes actually read from the opened objects
+	BytesDownloaded uint64
+	Puts            uint64
+	// Gets are the objects opened for reading
+	Gets    uint64
+	Deletes uint64
+	// Lists are the listings requested from the driver, cached ones are not counted
+	Lists uint64
+	// Errors are the failed operations
+	Errors uint64
+}
+
+type stats struct {
+	bytesUploaded   atomic.Uint64
+	bytesDownloaded atomic.Uint64
+	puts            atomic.Uint64
+	gets            atomic.Uint64
+	deletes         atomic.Uint64
+	lists           atomic.Uint64
+	errors          atomic.Uint64
+}
+
+// Stats returns a copy of the counters since the FileSystem is made or ResetStats is called
+func (i *Impl) Stats() StatsSnapshot {
+	return StatsSnapshot{
+		BytesUploaded:   i.stats.bytesUploaded.Load(),
+		BytesDownloaded: i.stats.bytesDownloaded.Load(),
+		Puts:            i.stats.puts.Load(),
+		Gets:            i.stats.gets.Load(),
+		Deletes:         i.stats.deletes.Load(),
+		Lists:           i.stats.lists.Load(),
+		Errors:          i.stats.errors.Load(),
+	}
+}
+
+// ResetStats zeros the counters
+func (i *Impl) ResetStats() {
+	for _, c := range []*atomic.Uint64{&i.stats.bytesUploaded, &i.stats.bytesDownloaded, &i.stats.puts,
+		&i.stats.gets, &i.stats.deletes, &i.stats.lists, &i.stats.errors} {
+		c.Store(0)
+	}
+}
+
+// wrapErr wraps *err like the function wrapErr, counting the failed operation once
+func (i *Impl) wrapErr(err *error, op, name string) {
+	if *err == nil {
+		return
+	}
+	if _, ok := (*err).(*OpError); !ok {
+		i.stats.errors.Add(1)
+	}
+	wrapErr(err, op, name)
+}
+
+// downloaded counts the bytes read from r as downloaded
+func (i *Impl) downloaded(r io.Reader) io.Reader {
+	return &statsReader{r: r, i: i}
+}
+
+type statsReader struct {
+	r io.Reader
+	i *Impl
+}
+
+func (s *statsReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.i.downloadedBytes(n)
+	return n, err
+}
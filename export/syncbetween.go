@@ -0,0 +1,398 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	stdpath "path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/pkg/errors"
+)
+
+// syncStateName is the name of the state of Sync in the dir synced of dst, which isn't synced
+const syncStateName = ".alist-sync"
+
+// syncCheckpointEvery is how many files Sync transfers between the checkpoints of its state
+const syncCheckpointEvery = 16
+
+// syncState is the state of Sync kept in dst: the files it put, by their names relative to the
+// dir synced, with the object dst reported right after
+type syncState struct {
+	Files map[string]syncStateFile `json:"files"`
+}
+
+type syncStateFile struct {
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"mtime"`
+}
+
+// matches reports whether e is still the object put
+func (f syncStateFile) matches(e *SnapshotEntry) bool {
+	return !e.IsDir && e.Size == f.Size && sameSecond(e.Modified, f.Modified)
+}
+
+// Sync mirrors the tree at dir of src to the same dir in dst: both are walked like Snapshot does
+// and the files missing in dst or whose object has another size or mtime, or hash by
+// opts.CompareHash, are copied by CopyBetween with up to opts.Parallel at once, the dirs missing
+// are made and, by opts.Delete, the objects absent in src are removed. The mtimes are compared
+// to the second.
+//
+// The files put are checkpointed to a state object in dir of dst as they're put, so a sync
+// interrupted is resumed by syncing again. An object whose stat right after it's put isn't the
+// object put, or which changed in dst since a previous sync put it, has been modified by another
+// writer: it's reported in Conflicts and neither overwritten nor removed until it's removed from
+// dst. An object which is a file on one side and a dir on the other fails with ErrExist. The
+// failures of single objects are in the report, the error is of walking either tree or of
+// writing the state
+func Sync(ctx context.Context, src, dst FileSystem, dir string, opts SyncOptions) (SyncReport, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	st, err := loadSyncState(ctx, dst, dir)
+	if err != nil {
+		return SyncReport{}, err
+	}
+	srcNext, err := snapshotPipe(ctx, src, dir)
+	if err != nil {
+		return SyncReport{}, err
+	}
+	dstNext := func() (SnapshotEntry, error) { return SnapshotEntry{}, io.EOF }
+	if _, err := dst.Stat(ctx, dir); err == nil {
+		if dstNext, err = snapshotPipe(ctx, dst, dir); err != nil {
+			return SyncReport{}, err
+		}
+	} else if !errs.IsObjectNotFound(err) {
+		return SyncReport{}, err
+	} else if !opts.DryRun {
+		if err := dst.Mkdir(ctx, dir); err != nil {
+			return SyncReport{}, err
+		}
+	}
+
+	parallel := opts.Parallel
+	if parallel <= 0 {
+		parallel = defaultPutParallel
+	}
+	s := &syncer{
+		src: src, dst: dst, dir: dir, opts: opts, state: st, cancel: cancel,
+		jobs:   make(chan SnapshotEntry),
+		report: SyncReport{Failed: map[string]error{}},
+	}
+	if !opts.DryRun {
+		for n := 0; n < parallel; n++ {
+			s.wg.Add(1)
+			go s.worker(ctx)
+		}
+	}
+	var files int64
+	err = diffEntries(s.skipState(dstNext, nil), s.skipState(srcNext, &files), func(e DiffEntry) error {
+		return s.entry(ctx, e)
+	})
+	close(s.jobs)
+	s.wg.Wait()
+	if err == nil {
+		err = s.err
+	}
+	if err == nil && len(s.deletes) > 0 {
+		s.delete(ctx, parallel)
+	}
+	if !opts.DryRun && (s.puts > 0 || len(s.deletes) > 0) {
+		// the files put are kept even if the sync failed
+		if werr := s.checkpoint(context.WithoutCancel(ctx)); err == nil {
+			err = werr
+		}
+	}
+	if err != nil {
+		return SyncReport{}, err
+	}
+	r := s.report
+	r.Unchanged = files - s.handled
+	for _, l := range [][]string{r.Uploaded, r.Deleted, r.Conflicts} {
+		sort.Strings(l)
+	}
+	return r, nil
+}
+
+type syncer struct {
+	src, dst FileSystem
+	dir      string
+	opts     SyncOptions
+	cancel   context.CancelFunc
+	jobs     chan SnapshotEntry
+	wg       sync.WaitGroup
+	// handled is how many files of src weren't unchanged
+	handled int64
+	// deletes are the objects of dst to remove, dirs are removed after the objects in them
+	deletes []SnapshotEntry
+
+	mu     sync.Mutex
+	state  *syncState
+	puts   int
+	report SyncReport
+	err    error
+}
+
+// skipState returns next leaving out the state of Sync, counting the files read in files
+func (s *syncer) skipState(next func() (SnapshotEntry, error), files *int64) func() (SnapshotEntry, error) {
+	return func() (SnapshotEntry, error) {
+		for {
+			e, err := next()
+			if err != nil || e.Path != syncStateName {
+				if err == nil && files != nil && !e.IsDir {
+					*files++
+				}
+				return e, err
+			}
+		}
+	}
+}
+
+// entry handles the object e differing between dst and src, A is the one of dst
+func (s *syncer) entry(ctx context.Context, e DiffEntry) error {
+	name := stdpath.Join(s.dir, e.Path)
+	switch e.Kind {
+	case DiffAdded:
+		if e.B.IsDir {
+			if s.opts.DryRun {
+				return nil
+			}
+			if err := s.dst.Mkdir(ctx, name); err != nil {
+				s.fail(e.Path, err)
+			}
+			return nil
+		}
+		s.handled++
+		return s.transfer(ctx, *e.B)
+	case DiffRemoved:
+		if !s.opts.Delete {
+			return nil
+		}
+		if !e.A.IsDir && s.conflicts(e.A) {
+			s.conflict(e.Path)
+			return nil
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.deletes = append(s.deletes, *e.A)
+		if !e.A.IsDir {
+			s.report.Deleted = append(s.report.Deleted, e.Path)
+		}
+		return nil
+	}
+	if !e.B.IsDir {
+		s.handled++
+	}
+	switch {
+	case e.Changes&ChangedType != 0:
+		kind := "dir"
+		if e.A.IsDir {
+			kind = "file"
+		}
+		s.fail(e.Path, errors.WithMessagef(ErrExist, "[%s] is a %s in src", name, kind))
+	case !entryChanged(e.A, e.B, s.opts.CompareHash):
+		if !e.B.IsDir {
+			s.handled--
+		}
+	case s.conflicts(e.A):
+		s.conflict(e.Path)
+	default:
+		return s.transfer(ctx, *e.B)
+	}
+	return nil
+}
+
+// conflicts reports whether the file e of dst was put by a previous sync and changed since
+func (s *syncer) conflicts(e *SnapshotEntry) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.state.Files[e.Path]
+	return ok && !f.matches(e)
+}
+
+// transfer queues the file e of src to be copied
+func (s *syncer) transfer(ctx context.Context, e SnapshotEntry) error {
+	s.mu.Lock()
+	s.report.Uploaded = append(s.report.Uploaded, e.Path)
+	s.report.Bytes += e.Size
+	s.mu.Unlock()
+	if s.opts.DryRun {
+		return nil
+	}
+	select {
+	case s.jobs <- e:
+		return nil
+	case <-ctx.Done():
+		return errors.WithStack(ctx.Err())
+	}
+}
+
+func (s *syncer) worker(ctx context.Context) {
+	defer s.wg.Done()
+	for e := range s.jobs {
+		name := stdpath.Join(s.dir, e.Path)
+		put, err := copyBetween(ctx, s.src, s.dst, name, WithConflict(ConflictOverwrite))
+		if err != nil {
+			s.untransfer(e)
+			s.fail(e.Path, err)
+			continue
+		}
+		got, err := s.dst.Stat(ctx, name)
+		if err != nil && !errs.IsObjectNotFound(err) {
+			s.untransfer(e)
+			s.fail(e.Path, err)
+			continue
+		}
+		f := syncStateFile{Size: got.Size, Modified: got.Modified}
+		if err != nil || got.IsDir || got.Size != put.Size || !sameSecond(got.Modified, put.Modified) {
+			// the object put is recorded so that the one of the other writer isn't overwritten
+			f = syncStateFile{Size: put.Size, Modified: put.Modified}
+			s.untransfer(e)
+			s.conflict(e.Path)
+		}
+		s.record(ctx, e.Path, f)
+	}
+}
+
+// untransfer takes the file e out of the files reported uploaded
+func (s *syncer) untransfer(e SnapshotEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for n, name := range s.report.Uploaded {
+		if name == e.Path {
+			s.report.Uploaded = append(s.report.Uploaded[:n], s.report.Uploaded[n+1:]...)
+			break
+		}
+	}
+	s.report.Bytes -= e.Size
+}
+
+// record records the file f put as name, checkpointing the state every syncCheckpointEvery files
+func (s *syncer) record(ctx context.Context, name string, f syncStateFile) {
+	s.mu.Lock()
+	s.state.Files[name] = f
+	s.puts++
+	checkpoint := s.puts%syncCheckpointEvery == 0
+	s.mu.Unlock()
+	if checkpoint {
+		if err := s.checkpoint(ctx); err != nil {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.err == nil {
+				s.err = err
+				s.cancel()
+			}
+		}
+	}
+}
+
+// checkpoint writes the state to dst
+func (s *syncer) checkpoint(ctx context.Context) error {
+	s.mu.Lock()
+	b, err := json.Marshal(s.state)
+	s.mu.Unlock()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = s.dst.PutWithOptions(ctx, stdpath.Join(s.dir, syncStateName), bytes.NewReader(b),
+		WithSize(int64(len(b))), WithConflict(ConflictOverwrite))
+	return errors.WithMessage(err, "failed to write sync state")
+}
+
+// delete removes the objects of dst absent in src
+func (s *syncer) delete(ctx context.Context, parallel int) {
+	if s.opts.DryRun {
+		return
+	}
+	names := make([]string, len(s.deletes))
+	for n, e := range s.deletes {
+		names[n] = stdpath.Join(s.dir, e.Path)
+	}
+	failed := s.dst.DeleteBatch(ctx, names, parallel)
+	deleted := s.report.Deleted[:0]
+	for n, e := range s.deletes {
+		if err := failed[names[n]]; err != nil {
+			s.report.Failed[e.Path] = err
+			continue
+		}
+		delete(s.state.Files, e.Path)
+		if !e.IsDir {
+			deleted = append(deleted, e.Path)
+		}
+	}
+	s.report.Deleted = deleted
+}
+
+func (s *syncer) fail(name string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.report.Failed[name] = err
+}
+
+func (s *syncer) conflict(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.report.Conflicts = append(s.report.Conflicts, name)
+}
+
+// loadSyncState reads the state of Sync in dir of dst, which is empty if there's none
+func loadSyncState(ctx context.Context, dst FileSystem, dir string) (*syncState, error) {
+	st := &syncState{Files: map[string]syncStateFile{}}
+	rc, err := dst.Read(ctx, stdpath.Join(dir, syncStateName), 0, 0)
+	if errs.IsObjectNotFound(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to read sync state")
+	}
+	defer rc.Close()
+	if err := json.NewDecoder(rc).Decode(st); err != nil {
+		return nil, errors.WithMessage(err, "failed to read sync state")
+	}
+	if st.Files == nil {
+		st.Files = map[string]syncStateFile{}
+	}
+	return st, nil
+}
+
+// snapshotPipe returns the Next of the snapshot of dir in fsys, which is taken as it's read
+// until ctx is done
+func snapshotPipe(ctx context.Context, fsys FileSystem, dir string) (func() (SnapshotEntry, error), error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(fsys.Snapshot(ctx, dir, pw))
+	}()
+	go func() {
+		<-ctx.Done()
+		pr.CloseWithError(ctx.Err())
+	}()
+	s, err := LoadSnapshot(pr)
+	if err != nil {
+		return nil, err
+	}
+	return s.Next, nil
+}
+
+// entryChanged reports whether the file b differs from a, like fileChanged does
+func entryChanged(a, b *SnapshotEntry, compareHash bool) bool {
+	if a.Size != b.Size {
+		return true
+	}
+	if compareHash {
+		for _, t := range verifiableHashes {
+			x, y := a.Hashes.GetHash(t), b.Hashes.GetHash(t)
+			if x != "" && y != "" {
+				return !strings.EqualFold(x, y)
+			}
+		}
+	}
+	return !sameSecond(a.Modified, b.Modified)
+}
+
+func sameSecond(x, y time.Time) bool {
+	return x.Truncate(time.Second).Equal(y.Truncate(time.Second))
+}
@@ -0,0 +1,238 @@
+package export
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	stdpath "path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/alist-org/alist/v3/internal/model"
+	"github.com/pkg/errors"
+)
+
+// SyncOptions configures SyncUp and Sync
+type SyncOptions struct {
+	// Delete removes the remote files absent locally
+	Delete bool
+	// CompareHash compares the hash reported by the driver with the one of the local file instead
+	// of the mtime, the objects without one are still compared by mtime
+	CompareHash bool
+	// DryRun only reports what would be uploaded and removed
+	DryRun bool
+	// FollowSymlinks uploads the files and dirs linked by SyncUp, the symlinks are skipped otherwise
+	FollowSymlinks bool
+	// Parallel is how many files are uploaded or removed at once, 4 if <= 0
+	Parallel int
+}
+
+// SyncReport is the result of SyncUp and Sync, the files are named relative to the dirs synced in order
+type SyncReport struct {
+	// Uploaded are the files new or changed which have been uploaded
+	Uploaded []string
+	// Deleted are the remote files absent locally which have been removed
+	Deleted []string
+	// Unchanged is how many files were skipped
+	Unchanged int64
+	// Bytes is the size of the files uploaded
+	Bytes int64
+	// Failed are the errors of the files which couldn't be uploaded or removed
+	Failed map[string]error
+	// Conflicts are the files of Sync whose object in dst was modified by another writer since
+	// it was put, which are left as they are
+	Conflicts []string
+}
+
+// SyncUp mirrors the local dir localDir to remoteDir: the files missing remotely or whose object
+// has another size or mtime are uploaded by PutBatch with their mtime, replacing the objects, and
+// the others are skipped. The mtimes are compared to the second. The failures of single files are
+// in the report, the error is of walking either tree
+func (i *Impl) SyncUp(ctx context.Context, localDir, remoteDir string, opts SyncOptions) (_ SyncReport, err error) {
+	ctx, end := i.startOp(ctx, "syncup", remoteDir)
+	defer end(&err)
+	root, err := i.cleanPath(remoteDir)
+	if err != nil {
+		return SyncReport{}, err
+	}
+	if !opts.DryRun {
+		if err := i.writable(); err != nil {
+			return SyncReport{}, err
+		}
+	}
+	remote := map[string]model.Obj{}
+	err = i.walk(ctx, "", root, func(name string, obj model.Obj, err error) error {
+		// a missing remoteDir has no files
+		if errors.Is(err, ErrWalkLoop) || err != nil && errs.IsObjectNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !obj.IsDir() {
+			remote[name] = obj
+		}
+		return nil
+	})
+	if err != nil {
+		return SyncReport{}, err
+	}
+
+	var r SyncReport
+	var items []PutItem
+	dir := strings.TrimPrefix(strings.TrimPrefix(root, i.conf.baseDir), "/")
+	err = walkLocal(localDir, opts.FollowSymlinks, func(name, p string, info fs.FileInfo) error {
+		if err := ctx.Err(); err != nil {
+			return errors.WithStack(err)
+		}
+		obj, ok := remote[name]
+		delete(remote, name)
+		if ok {
+			changed, err := fileChanged(p, info, obj, opts.CompareHash)
+			if err != nil {
+				return err
+			}
+			if !changed {
+				r.Unchanged++
+				return nil
+			}
+		}
+		r.Uploaded = append(r.Uploaded, name)
+		r.Bytes += info.Size()
+		items = append(items, PutItem{
+			Name: stdpath.Join(dir, name),
+			Size: info.Size(),
+			Open: func() (io.ReadCloser, error) { return os.Open(p) },
+			Opts: []PutOption{WithModTime(info.ModTime()), WithConflict(ConflictOverwrite)},
+		})
+		return nil
+	})
+	if err != nil {
+		return SyncReport{}, errors.WithMessagef(err, "failed to walk [%s]", localDir)
+	}
+	if opts.Delete {
+		for name := range remote {
+			r.Deleted = append(r.Deleted, name)
+		}
+		sort.Strings(r.Deleted)
+	}
+	if opts.DryRun {
+		return r, nil
+	}
+
+	parallel := opts.Parallel
+	if parallel <= 0 {
+		parallel = defaultPutParallel
+	}
+	r.Failed = map[string]error{}
+	uploaded := r.Uploaded[:0]
+	for n, err := range i.PutBatch(ctx, items, parallel) {
+		if err != nil {
+			r.Failed[r.Uploaded[n]] = err
+			r.Bytes -= items[n].Size
+			continue
+		}
+		uploaded = append(uploaded, r.Uploaded[n])
+	}
+	r.Uploaded = uploaded
+	if len(r.Deleted) > 0 {
+		names := make([]string, len(r.Deleted))
+		for n, name := range r.Deleted {
+			names[n] = stdpath.Join(dir, name)
+		}
+		failed := i.DeleteBatch(ctx, names, parallel)
+		deleted := r.Deleted[:0]
+		for n, name := range r.Deleted {
+			if err := failed[names[n]]; err != nil {
+				r.Failed[name] = err
+				continue
+			}
+			deleted = append(deleted, name)
+		}
+		r.Deleted = deleted
+	}
+	return r, nil
+}
+
+// fileChanged reports whether the local file at p differs from its object obj
+func fileChanged(p string, info fs.FileInfo, obj model.Obj, compareHash bool) (bool, error) {
+	if info.Size() != obj.GetSize() {
+		return true, nil
+	}
+	if compareHash {
+		for _, t := range verifiableHashes {
+			want := obj.GetHash().GetHash(t)
+			if want == "" {
+				continue
+			}
+			f, err := os.Open(p)
+			if err != nil {
+				return false, errors.WithStack(err)
+			}
+			got, err := hashOf(t, f)
+			_ = f.Close()
+			if err != nil {
+				return false, errors.WithMessagef(err, "failed to hash [%s]", p)
+			}
+			return !strings.EqualFold(got, want), nil
+		}
+	}
+	return !info.ModTime().Truncate(time.Second).Equal(obj.ModTime().Truncate(time.Second)), nil
+}
+
+// walkLocal calls fn with the regular files under the local dir root in lexical order, named
+// relative to root with slashes, and their local path. The symlinks are followed if follow is
+// set, a dir linked to one of its parents is skipped
+func walkLocal(root string, follow bool, fn func(name, p string, info fs.FileInfo) error) error {
+	var walk func(name, p string, parents []string) error
+	walk = func(name, p string, parents []string) error {
+		if follow {
+			real, err := filepath.EvalSymlinks(p)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			for _, parent := range parents {
+				if parent == real {
+					return nil
+				}
+			}
+			parents = append(parents[:len(parents):len(parents)], real)
+		}
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		for _, e := range entries {
+			childName, childPath := stdpath.Join(name, e.Name()), filepath.Join(p, e.Name())
+			var info fs.FileInfo
+			if e.Type()&fs.ModeSymlink != 0 {
+				if !follow {
+					continue
+				}
+				// a dangling symlink has nothing to upload
+				if info, err = os.Stat(childPath); errors.Is(err, fs.ErrNotExist) {
+					continue
+				} else if err != nil {
+					return errors.WithStack(err)
+				}
+			} else if info, err = e.Info(); err != nil {
+				return errors.WithStack(err)
+			}
+			switch {
+			case info.IsDir():
+				err = walk(childName, childPath, parents)
+			case info.Mode().IsRegular():
+				err = fn(childName, childPath, info)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk("", root, nil)
+}
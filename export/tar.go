@@ -0,0 +1,166 @@
+package export
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	stdpath "path"
+	"strings"
+
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/alist-org/alist/v3/internal/model"
+	"github.com/pkg/errors"
+)
+
+// TarOption configures a single DownloadTar
+type TarOption func(*tarOptions)
+
+type tarOptions struct {
+	prefetch int
+	skipped  func(name string, err error)
+}
+
+// WithTarPrefetch opens up to n files ahead of the one written, so their downloads start while
+// it's written, the files are still written one at a time in order. None are by default
+func WithTarPrefetch(n int) TarOption {
+	return func(o *tarOptions) {
+		o.prefetch = n
+	}
+}
+
+// WithTarSkipped calls fn with the objects left out of the archive, which were removed while
+// walked or would be walked again, and why, in the order walked. They're logged as warnings by default
+func WithTarSkipped(fn func(name string, err error)) TarOption {
+	return func(o *tarOptions) {
+		o.skipped = fn
+	}
+}
+
+// DownloadTar writes the tree at dir to w as a tar archive, with the objects named relative to
+// dir with their size and mtime. The tree is walked like Walk does and the files are read like
+// Read does as the archive is written, so it's never held. A file failing once its header has
+// been written fails the archive, which is then truncated
+func (i *Impl) DownloadTar(ctx context.Context, dir string, w io.Writer, opts ...TarOption) (err error) {
+	ctx, end := i.startOp(ctx, "tar", dir)
+	defer end(&err)
+	root, err := i.cleanPath(dir)
+	if err != nil {
+		return err
+	}
+	o := tarOptions{skipped: func(name string, err error) {
+		i.conf.logger.Warn("object left out of tar", "path", name, "error", errValue(err))
+	}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	rel := strings.TrimPrefix(strings.TrimPrefix(root, i.conf.baseDir), "/")
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	entries := make(chan *tarEntry, max(o.prefetch-1, 0))
+	walked := make(chan error, 1)
+	go func() {
+		defer close(entries)
+		walked <- i.walk(ctx, "", root, func(name string, obj model.Obj, err error) error {
+			if obj == nil {
+				return err
+			}
+			e := &tarEntry{name: name, obj: obj}
+			switch {
+			case errors.Is(err, ErrWalkLoop) || err != nil && errs.IsObjectNotFound(err):
+				// skipped by the writer, in order
+				e.err = err
+			case err != nil || name == "":
+				return err
+			case !obj.IsDir() && o.prefetch > 0:
+				e.open(ctx, i, stdpath.Join(rel, name))
+			}
+			select {
+			case entries <- e:
+				return nil
+			case <-ctx.Done():
+				e.close()
+				return errors.WithStack(ctx.Err())
+			}
+		})
+	}()
+	defer func() {
+		cancel()
+		for e := range entries {
+			e.close()
+		}
+	}()
+
+	tw := tar.NewWriter(w)
+	for e := range entries {
+		if err := i.writeTar(ctx, tw, e, rel, o); err != nil {
+			return err
+		}
+	}
+	if err := <-walked; err != nil {
+		return err
+	}
+	return errors.WithStack(tw.Close())
+}
+
+// tarEntry is an object of the archive, a file is opened by open once prefetched,
+// err is set for a dir skipped
+type tarEntry struct {
+	name   string
+	obj    model.Obj
+	opened chan struct{}
+	rc     io.ReadCloser
+	err    error
+}
+
+func (e *tarEntry) open(ctx context.Context, i *Impl, name string) {
+	e.opened = make(chan struct{})
+	go func() {
+		defer close(e.opened)
+		e.rc, e.err = i.Read(ctx, name, 0, 0)
+	}()
+}
+
+// close closes the file opened and not written
+func (e *tarEntry) close() {
+	if e.opened == nil {
+		return
+	}
+	<-e.opened
+	if e.rc != nil {
+		_ = e.rc.Close()
+	}
+}
+
+// writeTar writes e to tw, a file removed before it's read is skipped
+func (i *Impl) writeTar(ctx context.Context, tw *tar.Writer, e *tarEntry, rel string, o tarOptions) error {
+	if e.opened == nil && e.err != nil {
+		o.skipped(e.name, e.err)
+		return nil
+	}
+	h := &tar.Header{Name: e.name, ModTime: e.obj.ModTime()}
+	if e.obj.IsDir() {
+		h.Typeflag, h.Name, h.Mode = tar.TypeDir, e.name+"/", 0o755
+		return errors.WithStack(tw.WriteHeader(h))
+	}
+	if e.opened == nil {
+		e.open(ctx, i, stdpath.Join(rel, e.name))
+	}
+	<-e.opened
+	if errs.IsObjectNotFound(e.err) {
+		o.skipped(e.name, e.err)
+		return nil
+	}
+	if e.err != nil {
+		return errors.WithMessagef(e.err, "failed to read [%s]", e.name)
+	}
+	defer e.rc.Close()
+	h.Typeflag, h.Mode, h.Size = tar.TypeReg, 0o644, e.obj.GetSize()
+	if err := tw.WriteHeader(h); err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := io.CopyN(tw, e.rc, h.Size); err != nil {
+		return errors.WithMessagef(err, "failed to write [%s]", e.name)
+	}
+	return errors.WithStack(e.rc.Close())
+}
@@ -0,0 +1,69 @@
+package export
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
+)
+
+// newLimiter returns a limiter allowing rps calls per second with burst, or nil for no limit
+func newLimiter(rps float64, burst int) *rate.Limiter {
+	if rps <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(rps), max(burst, 1))
+}
+
+// newSemaphore returns a semaphore allowing n operations at the same time, or nil for no limit
+func newSemaphore(n int) *semaphore.Weighted {
+	if n <= 0 {
+		return nil
+	}
+	return semaphore.NewWeighted(int64(n))
+}
+
+func wait(ctx context.Context, l *rate.Limiter) error {
+	if l == nil {
+		return nil
+	}
+	return errors.WithStack(l.Wait(ctx))
+}
+
+// acquire takes a slot of s, the returned release is safe to be called more than once
+func acquire(ctx context.Context, s *semaphore.Weighted) (func(), error) {
+	if s == nil {
+		return func() {}, nil
+	}
+	if err := s.Acquire(ctx, 1); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { s.Release(1) })
+	}, nil
+}
+
+// beginMeta waits for a metadata call, which is any call other than Link and Put
+func (i *Impl) beginMeta(ctx context.Context) (func(), error) {
+	if err := wait(ctx, i.metaLimiter); err != nil {
+		return nil, err
+	}
+	return acquire(ctx, i.metaSem)
+}
+
+// beginUpload waits for a Put call
+func (i *Impl) beginUpload(ctx context.Context) (func(), error) {
+	if err := wait(ctx, i.dataLimiter); err != nil {
+		return nil, err
+	}
+	return acquire(ctx, i.uploadSem)
+}
+
+// beginDownload waits for a download, which includes getting the link and reading the body,
+// the rate of Link calls is limited by link itself
+func (i *Impl) beginDownload(ctx context.Context) (func(), error) {
+	return acquire(ctx, i.downloadSem)
+}
@@ -0,0 +1,14 @@
+package export
+
+import (
+	"context"
+	"time"
+)
+
+// withTimeout bounds ctx by d unless d isn't positive, the deadline of ctx is kept if it's earlier
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, d)
+}
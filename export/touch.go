@@ -0,0 +1,94 @@
+package export
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/alist-org/alist/v3/internal/model"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrEmptyUnsupported is returned by Touch when the driver can't store empty objects
+	ErrEmptyUnsupported = errors.New("empty objects aren't supported by the driver")
+	// ErrTouchUnsupported is returned by Touch for a file whose modified time can't be set
+	// without putting it again
+	ErrTouchUnsupported = errors.New("modified time can't be set by the driver")
+)
+
+// modTimeSetters set the modified time of a file without putting it again, for the drivers
+// which can, by their names
+var modTimeSetters = map[string]func(file model.Obj, modified time.Time) error{
+	// the objects of Local are at their paths of the host
+	"Local": func(file model.Obj, modified time.Time) error {
+		return os.Chtimes(file.GetPath(), modified, modified)
+	},
+}
+
+// emptyUnsupported are the drivers known to reject empty uploads, by their names
+var emptyUnsupported = map[string]bool{
+	"BaiduPhoto": true,
+}
+
+// emptyRejectedMessages are the messages of drivers rejecting an empty upload
+var emptyRejectedMessages = []string{"cannot be zero", "can't be zero", "empty file", "zero size", "size is 0"}
+
+// Touch creates an empty object at name if it's missing, or sets the modified time of the file
+// to now, e.g. to make marker files. The time is set alone by the drivers with CapTouch, the
+// others put an empty file again and fail with ErrTouchUnsupported for the other files rather
+// than uploading them again. Dirs fail with errs.NotImplement, and drivers known to reject
+// empty uploads lack CapEmpty and fail with ErrEmptyUnsupported
+func (i *Impl) Touch(ctx context.Context, name string) (err error) {
+	ctx, end := i.startOp(ctx, "touch", name)
+	defer end(&err)
+	ctx, cancel := withTimeout(ctx, i.conf.writeTimeout)
+	defer cancel()
+	if err := i.writable(); err != nil {
+		return err
+	}
+	path, err := i.objPath(name)
+	if err != nil {
+		return err
+	}
+	obj, err := i.get(ctx, path)
+	if err != nil && !errs.IsObjectNotFound(err) {
+		return errors.WithMessage(err, "failed to get object")
+	}
+	overwrite := ConflictOverwrite
+	if err == nil && obj.IsDir() {
+		return errors.WithMessagef(errs.NotImplement, "dir [%s] can't be touched", path)
+	}
+	if err == nil {
+		if set := modTimeSetters[i.storage.Config().Name]; set != nil {
+			defer i.forgetPath(path)
+			return errors.WithStack(set(obj, time.Now()))
+		}
+		if obj.GetSize() > 0 {
+			return errors.WithMessagef(ErrTouchUnsupported, "[%s] of %d bytes", path, obj.GetSize())
+		}
+	}
+	if !i.Capabilities().Has(CapEmpty) {
+		return errors.WithStack(ErrEmptyUnsupported)
+	}
+	if _, err := i.putFile(ctx, name, strings.NewReader(""), 0, putOptions{conflict: &overwrite}); err != nil {
+		if emptyRejected(err) {
+			return errors.WithMessagef(ErrEmptyUnsupported, "%v", err)
+		}
+		return err
+	}
+	return nil
+}
+
+// emptyRejected reports whether err is a driver rejecting an empty upload
+func emptyRejected(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, m := range emptyRejectedMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,5 @@
+// Package tracing creates OpenTelemetry spans for the operations of an export.FileSystem,
+// a span per public operation with child spans for the calls to the driver.
+// It's built with the otel tag only, e.g. go build -tags otel, so that the OpenTelemetry
+// modules are required only by the builds using it
+package tracing
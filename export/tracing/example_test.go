@@ -0,0 +1,51 @@
+//go:build otel
+
+package tracing_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/alist-org/alist/v3/drivers/local"
+	"github.com/alist-org/alist/v3/export"
+	"github.com/alist-org/alist/v3/export/tracing"
+	"github.com/alist-org/alist/v3/internal/driver"
+	"github.com/alist-org/alist/v3/pkg/utils"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func ExampleWithTracerProvider() {
+	export.Register("example-local", func() driver.Driver {
+		return &local.Local{}
+	})
+	dir, _ := os.MkdirTemp("", "tracing")
+	defer os.RemoveAll(dir)
+
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	ctx := context.Background()
+	addition, _ := utils.Json.MarshalToString(map[string]string{"root_folder_path": dir})
+	fsys, err := export.NewByName(ctx, "example-local", addition, tracing.WithTracerProvider(tp))
+	if err != nil {
+		panic(err)
+	}
+	_ = fsys.Put(ctx, "a", strings.NewReader("hello"))
+	rc, _ := fsys.Read(ctx, "a", 0, -1)
+	_, _ = io.ReadAll(rc)
+	rc.Close()
+
+	for _, s := range exporter.GetSpans() {
+		if s.Name == "export.put" || s.Name == "export.read" || s.Name == "driver.Put" || s.Name == "driver.Download" {
+			fmt.Println(s.Name)
+		}
+	}
+	// Output:
+	// driver.Put
+	// export.put
+	// driver.Download
+	// export.read
+}
@@ -0,0 +1,71 @@
+//go:build otel
+
+package tracing
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/alist-org/alist/v3/export"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/alist-org/alist/v3/export/tracing"
+
+// The attributes of the spans, the paths are hashed since they may be private
+const (
+	PathHashKey  = attribute.Key("alist.path.hash")
+	BytesKey     = attribute.Key("alist.bytes")
+	ErrorKindKey = attribute.Key("alist.error.kind")
+)
+
+// WithTracerProvider creates the spans of the FileSystem by the tracer of tp, the spans of
+// the operations are named like "export.read" and the ones of driver calls like "driver.Link"
+func WithTracerProvider(tp trace.TracerProvider) export.Option {
+	return export.WithObserver(&tracer{t: tp.Tracer(instrumentationName)})
+}
+
+type tracer struct {
+	t trace.Tracer
+}
+
+var _ export.CallObserver = (*tracer)(nil)
+
+// hashPath returns the first 16 hex digits of the sha256 of path
+func hashPath(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return hex.EncodeToString(sum[:8])
+}
+
+// end ends span with the status of err, the message of err is not recorded since it has the paths
+func end(span trace.Span, err error) {
+	if err != nil {
+		kind := export.KindOf(err).String()
+		span.SetAttributes(ErrorKindKey.String(kind))
+		span.SetStatus(codes.Error, kind)
+	}
+	span.End()
+}
+
+func (t *tracer) StartOp(ctx context.Context, op, name string) (context.Context, func(err error)) {
+	ctx, span := t.t.Start(ctx, "export."+op, trace.WithAttributes(PathHashKey.String(hashPath(name))))
+	return ctx, func(err error) {
+		end(span, err)
+	}
+}
+
+func (t *tracer) StartCall(ctx context.Context, call, path string) (context.Context, func(n int64, err error)) {
+	ctx, span := t.t.Start(ctx, "driver."+call,
+		trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(PathHashKey.String(hashPath(path))))
+	return ctx, func(n int64, err error) {
+		span.SetAttributes(BytesKey.Int64(n))
+		end(span, err)
+	}
+}
+
+func (t *tracer) Transferred(upload bool, n int64) {}
+
+func (t *tracer) CacheLookup(cache string, hit bool) {}
@@ -0,0 +1,232 @@
+package export
+
+import (
+	"context"
+	"fmt"
+	stdpath "path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alist-org/alist/v3/internal/driver"
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/alist-org/alist/v3/internal/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultTrashDir is the trash dir under the base dir if WithTrash is given no name
+	defaultTrashDir = ".trash"
+	// trashLayout names the batches of the trash by the time their objects were deleted
+	trashLayout = "20060102T150405Z"
+)
+
+// WithTrash makes Delete and DeleteBatch move the files into the dir named dir under the base dir,
+// ".trash" if dir is "", instead of removing them, at dir/<time deleted>/<name>, so Restore can
+// put them back. A batch of the same second which already has the name gets a suffix, like
+// "20240102T150405Z-1". The trash isn't listed, EmptyTrash removes the batches older than
+// retention, or than it's given. Empty dirs are still removed.
+//
+// The files are moved by the Move of the driver, or copied and removed if WithMoveFallback is set.
+// Otherwise they're removed like without WithTrash, Capabilities tells by CapTrash
+func WithTrash(dir string, retention time.Duration) Option {
+	return func(c *config) {
+		if dir == "" {
+			dir = defaultTrashDir
+		}
+		c.trashDir = dir
+		c.trashKeep = retention
+	}
+}
+
+// trashRoot returns the path of the trash, "" without WithTrash
+func (i *Impl) trashRoot() string {
+	if i.conf.trashDir == "" {
+		return ""
+	}
+	return stdpath.Join(i.conf.baseDir, i.conf.trashDir)
+}
+
+// isTrash reports whether path is in the trash
+func (i *Impl) isTrash(path string) bool {
+	root := i.trashRoot()
+	return root != "" && (path == root || strings.HasPrefix(path, root+"/"))
+}
+
+// canTrash reports whether the deleted files are moved to the trash
+func (i *Impl) canTrash() bool {
+	if i.conf.trashDir == "" {
+		return false
+	}
+	switch i.storage.(type) {
+	case driver.Move, driver.MoveResult:
+		return true
+	}
+	_, ok := i.storage.(driver.Remove)
+	return ok && i.conf.moveFallback
+}
+
+// relName returns the name of the object at path relative to the base dir
+func (i *Impl) relName(path string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(path, i.conf.baseDir), "/")
+}
+
+// trashObj moves the file obj at path into a batch of the trash of now which doesn't have its name
+func (i *Impl) trashObj(ctx context.Context, path string, obj model.Obj) error {
+	name := i.relName(path)
+	unlock, err := i.locks.lock(ctx, "trash:"+name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	batch := time.Now().UTC().Format(trashLayout)
+	for n := 0; ; n++ {
+		dir := batch
+		if n > 0 {
+			dir = fmt.Sprintf("%s-%d", batch, n)
+		}
+		dst := stdpath.Join(i.trashRoot(), dir, name)
+		_, err := i.get(ctx, dst)
+		if err == nil {
+			continue
+		}
+		if !errs.IsObjectNotFound(err) {
+			return errors.WithMessagef(err, "failed to get [%s]", dst)
+		}
+		if err := i.moveTo(ctx, path, obj, stdpath.Dir(dst)); err != nil {
+			return errors.WithMessage(err, "failed to move object to the trash")
+		}
+		return nil
+	}
+}
+
+// trashBatch is a batch of the trash, named by when its objects were deleted and a suffix
+type trashBatch struct {
+	name    string
+	deleted time.Time
+	n       int
+}
+
+// trashBatches returns the batches of the trash, the last deleted first
+func (i *Impl) trashBatches(ctx context.Context) ([]trashBatch, error) {
+	objs, err := i.list(ctx, i.trashRoot(), model.ListArgs{})
+	if errs.IsObjectNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to list the trash")
+	}
+	batches := make([]trashBatch, 0, len(objs))
+	for _, obj := range objs {
+		if !obj.IsDir() {
+			continue
+		}
+		stamp, suffix, _ := strings.Cut(obj.GetName(), "-")
+		deleted, err := time.Parse(trashLayout, stamp)
+		if err != nil {
+			continue
+		}
+		n := 0
+		if suffix != "" {
+			if n, err = strconv.Atoi(suffix); err != nil {
+				continue
+			}
+		}
+		batches = append(batches, trashBatch{name: obj.GetName(), deleted: deleted, n: n})
+	}
+	sort.Slice(batches, func(a, b int) bool {
+		if !batches[a].deleted.Equal(batches[b].deleted) {
+			return batches[a].deleted.After(batches[b].deleted)
+		}
+		return batches[a].n > batches[b].n
+	})
+	return batches, nil
+}
+
+func noTrash() error {
+	return errors.WithMessage(errs.NotSupport, "trash without WithTrash")
+}
+
+// Restore moves the file name deleted last back from the trash. It fails with ErrExist if name
+// has been put again, and with errs.ObjectNotFound if name isn't in the trash
+func (i *Impl) Restore(ctx context.Context, name string) (err error) {
+	ctx, end := i.startOp(ctx, "restore", name)
+	defer end(&err)
+	ctx, cancel := withTimeout(ctx, i.conf.writeTimeout)
+	defer cancel()
+	if i.conf.trashDir == "" {
+		return noTrash()
+	}
+	if err := i.writable(); err != nil {
+		return err
+	}
+	path, err := i.objPath(name)
+	if err != nil {
+		return err
+	}
+	if i.isTrash(path) {
+		return errors.WithMessagef(ErrInvalidName, "[%s] is in the trash", name)
+	}
+	unlock, err := i.locks.lock(ctx, "trash:"+i.relName(path))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if _, err := i.get(ctx, path); err == nil {
+		return errors.WithMessagef(ErrExist, "[%s]", name)
+	} else if !errs.IsObjectNotFound(err) {
+		return errors.WithMessage(err, "failed to get object")
+	}
+	batches, err := i.trashBatches(ctx)
+	if err != nil {
+		return err
+	}
+	for _, b := range batches {
+		src := stdpath.Join(i.trashRoot(), b.name, i.relName(path))
+		obj, err := i.get(ctx, src)
+		if errs.IsObjectNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return errors.WithMessagef(err, "failed to get [%s]", src)
+		}
+		return i.moveTo(ctx, src, obj, stdpath.Dir(path))
+	}
+	return errors.WithMessagef(errs.ObjectNotFound, "[%s] isn't in the trash", name)
+}
+
+// EmptyTrash removes the batches of the trash deleted more than olderThan ago, or than the
+// retention of WithTrash if olderThan is 0, and returns how many are removed
+func (i *Impl) EmptyTrash(ctx context.Context, olderThan time.Duration) (n int, err error) {
+	ctx, end := i.startOp(ctx, "emptytrash", i.conf.trashDir)
+	defer end(&err)
+	if i.conf.trashDir == "" {
+		return 0, noTrash()
+	}
+	if err := i.writable(); err != nil {
+		return 0, err
+	}
+	if olderThan == 0 {
+		olderThan = i.conf.trashKeep
+	}
+	batches, err := i.trashBatches(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, b := range batches {
+		if time.Since(b.deleted) <= olderThan {
+			continue
+		}
+		dir := stdpath.Join(i.trashRoot(), b.name)
+		obj, err := i.get(ctx, dir)
+		if err == nil {
+			err = i.removeAll(ctx, dir, obj)
+		}
+		if err != nil && !errs.IsObjectNotFound(err) {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,302 @@
+package export
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	stdpath "path"
+	"sync"
+
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/alist-org/alist/v3/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+// NewUnion returns a FileSystem reading the layers as one tree: Read, Open, OpenReaderAt, Stat,
+// Hashes and Exists are of the first layer having the object, List and ListIter merge the dirs of
+// all the layers with the entries of the first layers winning by name, and Walk walks the merged
+// tree. A layer missing the object is skipped, any other error is returned, so a miss of an upper
+// layer never hides the failure of a lower one. The other ops, writes and deletes included, are
+// of the first layer, or the one marked by WriteLayer, and see its objects only: an object of
+// another layer is seen again once deleted. It fails without layers
+func NewUnion(layers ...FileSystem) (FileSystem, error) {
+	if len(layers) == 0 {
+		return nil, errors.New("union without layers")
+	}
+	u := &union{layers: make([]FileSystem, len(layers))}
+	for n, l := range layers {
+		if w, ok := l.(writeLayer); ok {
+			u.FileSystem, l = w.FileSystem, w.FileSystem
+		}
+		u.layers[n] = l
+	}
+	if u.FileSystem == nil {
+		u.FileSystem = u.layers[0]
+	}
+	return u, nil
+}
+
+// WriteLayer marks the layer of NewUnion the writes go to instead of the first one
+func WriteLayer(fsys FileSystem) FileSystem {
+	return writeLayer{fsys}
+}
+
+type writeLayer struct {
+	FileSystem
+}
+
+// union is the FileSystem of NewUnion, the ops not overridden are of the write layer
+type union struct {
+	FileSystem
+	layers []FileSystem
+}
+
+// first calls f with the layers in order until one has the object, the error of the first layer
+// is returned if none has it
+func (u *union) first(f func(l FileSystem) error) error {
+	var missing error
+	for _, l := range u.layers {
+		err := f(l)
+		if err == nil || !errs.IsObjectNotFound(err) {
+			return err
+		}
+		if missing == nil {
+			missing = err
+		}
+	}
+	return missing
+}
+
+func (u *union) Read(ctx context.Context, name string, off, limit int64) (rc io.ReadCloser, err error) {
+	err = u.first(func(l FileSystem) (err error) {
+		rc, err = l.Read(ctx, name, off, limit)
+		return err
+	})
+	return rc, err
+}
+
+func (u *union) Open(ctx context.Context, name string) (r io.ReadSeekCloser, err error) {
+	err = u.first(func(l FileSystem) (err error) {
+		r, err = l.Open(ctx, name)
+		return err
+	})
+	return r, err
+}
+
+func (u *union) OpenReaderAt(ctx context.Context, name string) (r io.ReaderAt, c io.Closer, err error) {
+	err = u.first(func(l FileSystem) (err error) {
+		r, c, err = l.OpenReaderAt(ctx, name)
+		return err
+	})
+	return r, c, err
+}
+
+func (u *union) Stat(ctx context.Context, name string) (info ObjInfo, err error) {
+	err = u.first(func(l FileSystem) (err error) {
+		info, err = l.Stat(ctx, name)
+		return err
+	})
+	return info, err
+}
+
+func (u *union) Hashes(ctx context.Context, name string) (hashes map[*utils.HashType]string, err error) {
+	err = u.first(func(l FileSystem) (err error) {
+		hashes, err = l.Hashes(ctx, name)
+		return err
+	})
+	return hashes, err
+}
+
+func (u *union) Exists(ctx context.Context, name string) (bool, error) {
+	for _, l := range u.layers {
+		if ok, err := l.Exists(ctx, name); err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+func (u *union) List(ctx context.Context, dir string, opts ...ListOption) ([]Entry, error) {
+	var entries []Entry
+	err := u.ListIter(ctx, dir, func(e Entry) error {
+		entries = append(entries, e)
+		return nil
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// layerList is the listing of a dir by a layer, sorted by name, which ListIter merges
+type layerList struct {
+	entries chan Entry
+	// err is set once entries is closed
+	err  error
+	head Entry
+	ok   bool
+	done bool
+}
+
+// next reads the next entry of l into head unless it has one or is done
+func (l *layerList) next() {
+	if l.ok || l.done {
+		return
+	}
+	l.head, l.ok = <-l.entries
+	l.done = !l.ok
+}
+
+// ListIter lists the dirs of the layers sorted by name at once and merges them, so only an entry
+// per layer is held beyond what the layers hold to sort, unless the entries are sorted by other
+// than the name. A layer having a file at dir after a layer having the dir is skipped
+func (u *union) ListIter(ctx context.Context, dir string, fn func(Entry) error, opts ...ListOption) error {
+	o := newListOptions(opts)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	lists := make([]*layerList, len(u.layers))
+	for n, fsys := range u.layers {
+		l := &layerList{entries: make(chan Entry, 64)}
+		lists[n] = l
+		wg.Add(1)
+		go func(fsys FileSystem) {
+			defer wg.Done()
+			defer close(l.entries)
+			l.err = fsys.ListIter(ctx, dir, func(e Entry) error {
+				select {
+				case l.entries <- e:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}, WithSort(SortName, false))
+		}(fsys)
+	}
+	var held []Entry
+	for {
+		for _, l := range lists {
+			l.next()
+		}
+		var (
+			found   bool
+			missing error
+			first   *layerList
+		)
+		for _, l := range lists {
+			switch {
+			case !l.done || l.err == nil:
+				found = true
+			case errs.IsObjectNotFound(l.err):
+				if missing == nil {
+					missing = l.err
+				}
+			case found && errors.Is(l.err, errs.NotFolder):
+			default:
+				return l.err
+			}
+			if l.ok && (first == nil || l.head.Name < first.head.Name) {
+				first = l
+			}
+		}
+		if !found {
+			return missing
+		}
+		if first == nil {
+			break
+		}
+		e := first.head
+		// the entry of the first layer having the name wins
+		for _, l := range lists {
+			if l.ok && l.head.Name == e.Name {
+				l.ok = false
+			}
+		}
+		// the filters are applied once merged, so a lower entry doesn't replace an upper one filtered
+		if !o.keepEntry(e.IsDir, e.Size, e.Modified) {
+			continue
+		}
+		if o.sorted() && !o.byName() {
+			held = append(held, e)
+			continue
+		}
+		if err := fn(e); err != nil {
+			return unionStop(err)
+		}
+	}
+	o.sort(held)
+	for _, e := range held {
+		if err := fn(e); err != nil {
+			return unionStop(err)
+		}
+	}
+	return nil
+}
+
+// unionStop returns the error of the fn of ListIter, nil for ErrStopList
+func unionStop(err error) error {
+	if errors.Is(err, ErrStopList) {
+		return nil
+	}
+	return err
+}
+
+// Walk walks the merged tree like fs.WalkDir does, listing a dir at a time
+func (u *union) Walk(ctx context.Context, root string, fn fs.WalkDirFunc) error {
+	info, err := u.Stat(ctx, root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = u.walk(ctx, root, fs.FileInfoToDirEntry(newFileInfo(root, info.Size, info.Modified, info.IsDir)), fn)
+	}
+	if errors.Is(err, fs.SkipDir) || errors.Is(err, fs.SkipAll) {
+		return nil
+	}
+	return err
+}
+
+func (u *union) walk(ctx context.Context, name string, d fs.DirEntry, fn fs.WalkDirFunc) error {
+	if err := fn(name, d, nil); err != nil || !d.IsDir() {
+		if d.IsDir() && errors.Is(err, fs.SkipDir) {
+			return nil
+		}
+		return err
+	}
+	entries, err := u.List(ctx, name, WithSort(SortName, false))
+	if err != nil {
+		// fn is called again with the error of listing the dir, like fs.WalkDir does
+		if err = fn(name, d, err); errors.Is(err, fs.SkipDir) {
+			return nil
+		}
+		return err
+	}
+	for _, e := range entries {
+		child := fs.FileInfoToDirEntry(newFileInfo(e.Name, e.Size, e.Modified, e.IsDir))
+		if err := u.walk(ctx, stdpath.Join(name, e.Name), child, fn); err != nil {
+			// fs.SkipDir of a file skips the rest of its dir
+			if !e.IsDir && errors.Is(err, fs.SkipDir) {
+				return nil
+			}
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+func (u *union) Flush() {
+	for _, l := range u.layers {
+		l.Flush()
+	}
+}
+
+// Close closes each of the layers
+func (u *union) Close() error {
+	var first error
+	for _, l := range u.layers {
+		if err := l.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,178 @@
+package export
+
+import (
+	"context"
+	stdpath "path"
+	"strings"
+	"sync"
+
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/alist-org/alist/v3/internal/model"
+	"github.com/pkg/errors"
+)
+
+// UsageOption configures a single Usage
+type UsageOption func(*usageOptions)
+
+type usageOptions struct {
+	dirUsage func(dir string, files, dirs, bytes int64)
+}
+
+// WithDirUsage calls fn with the usage of each dir under the dir of Usage, and of that dir, once its
+// tree is summed, so the children are given before their parents. The dirs are named relative to
+// the base dir, which is "", and fn is called one at a time
+func WithDirUsage(fn func(dir string, files, dirs, bytes int64)) UsageOption {
+	return func(o *usageOptions) {
+		o.dirUsage = fn
+	}
+}
+
+// Usage returns how many files and dirs are under dir and the bytes of the files, like du does.
+// The dirs are listed in parallel by WithWalkParallel. The objects removed while the tree is
+// listed are skipped, and a dir which would be listed again, like one with the ID of one of its
+// parents, isn't entered
+func (i *Impl) Usage(ctx context.Context, dir string, opts ...UsageOption) (files, dirs, bytes int64, err error) {
+	ctx, end := i.startOp(ctx, "usage", dir)
+	defer end(&err)
+	path, err := i.cleanPath(dir)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	var o usageOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	parallel := i.conf.walkParallel
+	if parallel <= 0 {
+		parallel = defaultWalkParallel
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	root, err := i.get(ctx, path)
+	if err != nil {
+		return 0, 0, 0, errors.WithMessage(err, "failed to get dir")
+	}
+	var ids []string
+	if id := root.GetID(); id != "" {
+		ids = append(ids, id)
+	}
+	c := &usageCounter{i: i, o: o, sem: make(chan struct{}, parallel), cancel: cancel}
+	u, err := c.count(ctx, strings.TrimPrefix(strings.TrimPrefix(path, i.conf.baseDir), "/"), path, ids)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return u.files, u.dirs, u.bytes, nil
+}
+
+type usage struct {
+	files, dirs, bytes int64
+}
+
+type usageCounter struct {
+	i      *Impl
+	o      usageOptions
+	sem    chan struct{}
+	cancel context.CancelFunc
+	// mu serializes dirUsage
+	mu sync.Mutex
+}
+
+// count sums the tree of the dir at path named name, ids are the IDs of its parents
+func (c *usageCounter) count(ctx context.Context, name, path string, ids []string) (usage, error) {
+	objs, err := c.list(ctx, path)
+	if err != nil {
+		return usage{}, err
+	}
+	var (
+		u     usage
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		first error
+	)
+	add := func(sub usage, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			if first == nil {
+				first = err
+				c.cancel()
+			}
+			return
+		}
+		u.files, u.dirs, u.bytes = u.files+sub.files, u.dirs+sub.dirs, u.bytes+sub.bytes
+	}
+	for _, obj := range objs {
+		if !obj.IsDir() {
+			add(usage{files: 1, bytes: obj.GetSize()}, nil)
+			continue
+		}
+		if loops(obj, ids) {
+			continue
+		}
+		sub := ids
+		if id := obj.GetID(); id != "" {
+			sub = append(ids[:len(ids):len(ids)], id)
+		}
+		wg.Add(1)
+		go func(obj model.Obj, ids []string) {
+			defer wg.Done()
+			sub, err := c.count(ctx, stdpath.Join(name, obj.GetName()), stdpath.Join(path, obj.GetName()), ids)
+			// removed since listed
+			if errs.IsObjectNotFound(err) || errors.Is(err, errs.NotFolder) {
+				return
+			}
+			sub.dirs++
+			add(sub, err)
+		}(obj, sub)
+	}
+	wg.Wait()
+	if first != nil {
+		return usage{}, first
+	}
+	if c.o.dirUsage != nil {
+		c.mu.Lock()
+		c.o.dirUsage(name, u.files, u.dirs, u.bytes)
+		c.mu.Unlock()
+	}
+	return u, nil
+}
+
+// list lists the dir at path once a slot is free, without the parts of chunked uploads
+func (c *usageCounter) list(ctx context.Context, path string) ([]model.Obj, error) {
+	select {
+	case c.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, errors.WithStack(ctx.Err())
+	}
+	defer func() { <-c.sem }()
+	if err := ctx.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	objs, err := c.i.list(ctx, path, model.ListArgs{})
+	if errs.IsObjectNotFound(err) || errors.Is(err, errs.NotFolder) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to list dir [%s]", path)
+	}
+	kept := make([]model.Obj, 0, len(objs))
+	for _, obj := range objs {
+		if !c.i.hidden(stdpath.Join(path, obj.GetName())) {
+			kept = append(kept, obj)
+		}
+	}
+	return kept, nil
+}
+
+// loops reports whether the dir obj has the ID of one of its parents
+func loops(obj model.Obj, ids []string) bool {
+	if obj.GetID() == "" {
+		return false
+	}
+	for _, id := range ids {
+		if id == obj.GetID() {
+			return true
+		}
+	}
+	return false
+}
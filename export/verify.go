@@ -0,0 +1,107 @@
+package export
+
+import (
+	"context"
+	"encoding/hex"
+	"hash"
+	"io"
+	stdpath "path"
+	"strings"
+
+	"github.com/alist-org/alist/v3/internal/model"
+	"github.com/alist-org/alist/v3/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrSizeMismatch is the error of an upload whose object hasn't the size of the data written
+	ErrSizeMismatch = errors.New("size mismatch")
+	// ErrChecksumMismatch is the error of a read whose data doesn't have the hash reported by the driver
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// verifiableHashes are the hashes checked by WithVerifyRead, by preference,
+// the others reported by drivers may need parameters to compute
+var verifiableHashes = []*utils.HashType{utils.SHA256, utils.SHA1, utils.MD5}
+
+// WithVerifyPut checks the size of each object uploaded against the bytes written, the object
+// returned by drivers supporting PutResult is trusted, it's looked up otherwise. A mismatched
+// object is removed and the put fails with ErrSizeMismatch
+func WithVerifyPut() Option {
+	return func(c *config) {
+		c.verifyPut = true
+	}
+}
+
+// verifyPut checks the object put at name has size bytes, obj is looked up unless it's
+// from the driver, it's removed if its size differs
+func (i *Impl) verifyPut(ctx context.Context, name string, obj model.Obj, fromDriver bool, size int64) error {
+	if !fromDriver {
+		var err error
+		if obj, err = i.get(ctx, name); err != nil {
+			return errors.WithMessage(err, "failed to verify the upload")
+		}
+	}
+	got := obj.GetSize()
+	if got == size {
+		return nil
+	}
+	err := errors.WithMessagef(ErrSizeMismatch, "[%s] has %d bytes instead of %d", name, got, size)
+	path := stdpath.Join(stdpath.Dir(name), obj.GetName())
+	if rmErr := i.remove(ctx, path, obj); rmErr != nil {
+		i.conf.logger.Warn("failed to remove a mismatched upload", "path", path, "error", errValue(rmErr))
+	}
+	return err
+}
+
+// WithVerifyRead checks the data of a Read of a whole object against the hash reported by
+// the driver, a mismatch fails the Read at EOF and the Close with ErrChecksumMismatch.
+// Reads of a part and objects without a hash aren't checked
+func WithVerifyRead() Option {
+	return func(c *config) {
+		c.verifyRead = true
+	}
+}
+
+// verifyingReader hashes the data read from r and compares it with want at EOF
+type verifyingReader struct {
+	r    io.Reader
+	path string
+	t    *utils.HashType
+	h    hash.Hash
+	want string
+	err  error
+}
+
+// newVerifyingReader returns nil if hashes has none of verifiableHashes
+func newVerifyingReader(r io.Reader, path string, hashes utils.HashInfo) *verifyingReader {
+	for _, t := range verifiableHashes {
+		if want := hashes.GetHash(t); want != "" {
+			return &verifyingReader{r: r, path: path, t: t, h: t.NewFunc(), want: want}
+		}
+	}
+	return nil
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF {
+		if got := hex.EncodeToString(v.h.Sum(nil)); !strings.EqualFold(got, v.want) {
+			v.err = errors.WithMessagef(ErrChecksumMismatch, "[%s] has %s %s instead of %s", v.path, v.t.Name, got, v.want)
+			return n, v.err
+		}
+	}
+	return n, err
+}
+
+// mismatch returns the error of a mismatch found, v may be nil
+func (v *verifyingReader) mismatch() error {
+	if v == nil {
+		return nil
+	}
+	return v.err
+}
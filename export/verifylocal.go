@@ -0,0 +1,247 @@
+package export
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	stdpath "path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/alist-org/alist/v3/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+// VerifyOptions configures VerifyLocal
+type VerifyOptions struct {
+	// Hash is the type of the hashes compared, any of SHA256, SHA1 and MD5 reported by the
+	// driver if nil, MD5 for the objects downloaded
+	Hash *utils.HashType
+	// MaxDownload is how many bytes may be downloaded to hash the objects without a hash
+	// reported, none are by default
+	MaxDownload int64
+	// Parallel is how many files are verified at once, 4 if <= 0
+	Parallel int
+}
+
+// Report is the result of VerifyLocal, the files are named relative to the local dir in order
+type Report struct {
+	// Files is how many local files have been checked
+	Files int64
+	// Missing are the files without an object, or with a dir instead
+	Missing []string
+	// SizeMismatch are the files whose object has another size
+	SizeMismatch []string
+	// HashMismatch are the files whose object has another hash or content
+	HashMismatch []string
+	// Unverified are the files whose object has their size, but no hash reported and
+	// the budget of MaxDownload was spent
+	Unverified []string
+	// Downloaded is how many bytes have been downloaded
+	Downloaded int64
+}
+
+// OK reports whether every file has been verified to match its object
+func (r *Report) OK() bool {
+	return len(r.Missing)+len(r.SizeMismatch)+len(r.HashMismatch)+len(r.Unverified) == 0
+}
+
+// VerifyLocal checks the regular files of the local dir localDir against the objects of the same
+// names under remoteDir. The sizes are compared first, then the hashes reported by the driver,
+// and the objects without one are downloaded and hashed, within the budget of opts.MaxDownload.
+// The objects under remoteDir missing locally aren't reported
+func (i *Impl) VerifyLocal(ctx context.Context, localDir, remoteDir string, opts VerifyOptions) (_ Report, err error) {
+	ctx, end := i.startOp(ctx, "verify", remoteDir)
+	defer end(&err)
+	root, err := i.cleanPath(remoteDir)
+	if err != nil {
+		return Report{}, err
+	}
+	parallel := opts.Parallel
+	if parallel <= 0 {
+		parallel = 4
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	v := &localVerifier{i: i, opts: opts, root: root, localDir: localDir}
+	names := make(chan string)
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		first error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if first == nil {
+			first = err
+			cancel()
+		}
+	}
+	for n := 0; n < parallel; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				if err := v.verify(ctx, name); err != nil {
+					fail(errors.WithMessagef(err, "failed to verify [%s]", name))
+				}
+			}
+		}()
+	}
+	walkErr := filepath.WalkDir(localDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(localDir, p)
+		if err != nil {
+			return err
+		}
+		select {
+		case names <- filepath.ToSlash(rel):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(names)
+	wg.Wait()
+	if first != nil {
+		return Report{}, first
+	}
+	if walkErr != nil {
+		return Report{}, errors.WithMessagef(walkErr, "failed to walk [%s]", localDir)
+	}
+	r := v.report
+	r.Downloaded = v.downloaded.Load()
+	for _, l := range [][]string{r.Missing, r.SizeMismatch, r.HashMismatch, r.Unverified} {
+		sort.Strings(l)
+	}
+	return r, nil
+}
+
+type localVerifier struct {
+	i        *Impl
+	opts     VerifyOptions
+	root     string
+	localDir string
+	// downloaded is the budget of MaxDownload taken
+	downloaded atomic.Int64
+
+	mu     sync.Mutex
+	report Report
+}
+
+// add records the file name in the list of the report picked by f, nil only counts it
+func (v *localVerifier) add(name string, f func(r *Report) *[]string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.report.Files++
+	if f != nil {
+		l := f(&v.report)
+		*l = append(*l, name)
+	}
+}
+
+func (v *localVerifier) verify(ctx context.Context, name string) error {
+	local := filepath.Join(v.localDir, filepath.FromSlash(name))
+	info, err := os.Stat(local)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	obj, err := v.i.get(ctx, stdpath.Join(v.root, name))
+	if errs.IsObjectNotFound(err) || err == nil && obj.IsDir() {
+		v.add(name, func(r *Report) *[]string { return &r.Missing })
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if obj.GetSize() != info.Size() {
+		v.add(name, func(r *Report) *[]string { return &r.SizeMismatch })
+		return nil
+	}
+	if info.Size() == 0 {
+		v.add(name, nil)
+		return nil
+	}
+
+	t, want := v.reported(obj.GetHash())
+	if want == "" {
+		if t = v.opts.Hash; t == nil {
+			t = utils.MD5
+		}
+		if !v.take(obj.GetSize()) {
+			v.add(name, func(r *Report) *[]string { return &r.Unverified })
+			return nil
+		}
+		rc, err := v.i.rangeRead(ctx, obj, 0, obj.GetSize())
+		if err != nil {
+			return errors.WithMessage(err, "failed to read object")
+		}
+		want, err = hashOf(t, rc)
+		_ = rc.Close()
+		if err != nil {
+			return errors.WithMessage(err, "failed to hash object")
+		}
+	}
+	f, err := os.Open(local)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	got, err := hashOf(t, f)
+	_ = f.Close()
+	if err != nil {
+		return errors.WithMessage(err, "failed to hash file")
+	}
+	if !strings.EqualFold(got, want) {
+		v.add(name, func(r *Report) *[]string { return &r.HashMismatch })
+		return nil
+	}
+	v.add(name, nil)
+	return nil
+}
+
+// reported returns the hash of hashes to compare, or "" if there is none
+func (v *localVerifier) reported(hashes utils.HashInfo) (*utils.HashType, string) {
+	types := verifiableHashes
+	if v.opts.Hash != nil {
+		types = []*utils.HashType{v.opts.Hash}
+	}
+	for _, t := range types {
+		if h := hashes.GetHash(t); h != "" {
+			return t, h
+		}
+	}
+	return nil, ""
+}
+
+// take takes size bytes of the budget of MaxDownload if there are enough left
+func (v *localVerifier) take(size int64) bool {
+	for {
+		n := v.downloaded.Load()
+		if n+size > v.opts.MaxDownload {
+			return false
+		}
+		if v.downloaded.CompareAndSwap(n, n+size) {
+			return true
+		}
+	}
+}
+
+func hashOf(t *utils.HashType, r io.Reader) (string, error) {
+	h := t.NewFunc()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,272 @@
+package export
+
+import (
+	"context"
+	"fmt"
+	stdpath "path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/alist-org/alist/v3/internal/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// versionsDir is the hidden dir under the base dir keeping the versions by WithVersioning
+	versionsDir = ".versions"
+	// versionLayout names the versions by the time they were replaced
+	versionLayout = "20060102T150405.000000000Z"
+)
+
+// WithVersioning makes the puts replacing a file keep it as a version, moved to
+// .versions/<name>/<time replaced> under the base dir once the new file is uploaded to a
+// temporary object like by WithAtomicPut, or its parts are, so ListVersions lists the versions of
+// name and RestoreVersion makes one current again. The versions are pruned when one is made,
+// only the keep last ones are kept and the ones replaced more than maxAge ago are removed,
+// 0 keeps all of them. The versions aren't listed, and a file deleted keeps its versions.
+//
+// The files are versioned by the Move and Rename of the driver, the puts replace them like
+// without WithVersioning if the driver lacks either, Capabilities tells by CapVersions
+func WithVersioning(keep int, maxAge time.Duration) Option {
+	return func(c *config) {
+		c.versioning = true
+		c.versionKeep = keep
+		c.versionMaxAge = maxAge
+	}
+}
+
+// versionsRoot returns the path of the versions
+func (i *Impl) versionsRoot() string {
+	return stdpath.Join(i.conf.baseDir, versionsDir)
+}
+
+// isVersion reports whether path is in the versions of WithVersioning
+func (i *Impl) isVersion(path string) bool {
+	if !i.conf.versioning {
+		return false
+	}
+	root := i.versionsRoot()
+	return path == root || strings.HasPrefix(path, root+"/")
+}
+
+// canVersion reports whether the files replaced are kept as versions
+func (i *Impl) canVersion() bool {
+	if !i.conf.versioning {
+		return false
+	}
+	c := capabilities(i.storage)
+	return c.Has(CapMove | CapRename)
+}
+
+// versionDir returns the dir of the versions of the file at path
+func (i *Impl) versionDir(path string) string {
+	return stdpath.Join(i.versionsRoot(), i.relName(path))
+}
+
+// renameTo renames obj at path to newName in its dir, keeping the caches in sync
+func (i *Impl) renameTo(ctx context.Context, path string, obj model.Obj, newName string) error {
+	release, err := i.beginMeta(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := i.renameObj(ctx, obj, newName); err != nil {
+		return err
+	}
+	i.removed(path, obj.IsDir())
+	i.created(stdpath.Join(stdpath.Dir(path), newName), obj.IsDir())
+	return nil
+}
+
+// keepVersion moves the file old at path to a new version of it, which pruneVersions may remove
+func (i *Impl) keepVersion(ctx context.Context, path string, old model.Obj) error {
+	dir := i.versionDir(path)
+	id := time.Now().UTC().Format(versionLayout)
+	for n := 1; ; n++ {
+		_, err := i.get(ctx, stdpath.Join(dir, id))
+		if errs.IsObjectNotFound(err) {
+			break
+		}
+		if err != nil {
+			return errors.WithMessagef(err, "failed to get version [%s]", id)
+		}
+		id = fmt.Sprintf("%s-%d", strings.SplitN(id, "-", 2)[0], n)
+	}
+	if err := i.moveTo(ctx, path, old, dir); err != nil {
+		return errors.WithMessage(err, "failed to move the object replaced to its versions")
+	}
+	moved := stdpath.Join(dir, old.GetName())
+	obj, err := i.get(ctx, moved)
+	if err == nil {
+		err = i.renameTo(ctx, moved, obj, id)
+	}
+	if err != nil {
+		return errors.WithMessagef(err, "failed to name version [%s]", id)
+	}
+	return nil
+}
+
+// Version is a version of a file replaced by a put with WithVersioning
+type Version struct {
+	// ID names the version for RestoreVersion
+	ID string
+	// Replaced is when the version was replaced
+	Replaced time.Time
+	Size     int64
+	Modified time.Time
+}
+
+// versions returns the versions of the file at path with their objects, the last replaced first
+func (i *Impl) versions(ctx context.Context, path string) ([]Version, []model.Obj, error) {
+	objs, err := i.list(ctx, i.versionDir(path), model.ListArgs{})
+	if errs.IsObjectNotFound(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, errors.WithMessage(err, "failed to list versions")
+	}
+	type found struct {
+		v   Version
+		n   int
+		obj model.Obj
+	}
+	all := make([]found, 0, len(objs))
+	for _, obj := range objs {
+		if obj.IsDir() {
+			continue
+		}
+		stamp, suffix, _ := strings.Cut(obj.GetName(), "-")
+		replaced, err := time.Parse(versionLayout, stamp)
+		if err != nil {
+			continue
+		}
+		n := 0
+		if suffix != "" {
+			if n, err = strconv.Atoi(suffix); err != nil {
+				continue
+			}
+		}
+		v := Version{ID: obj.GetName(), Replaced: replaced, Size: obj.GetSize(), Modified: obj.ModTime()}
+		all = append(all, found{v: v, n: n, obj: obj})
+	}
+	sort.Slice(all, func(a, b int) bool {
+		if !all[a].v.Replaced.Equal(all[b].v.Replaced) {
+			return all[a].v.Replaced.After(all[b].v.Replaced)
+		}
+		return all[a].n > all[b].n
+	})
+	versions := make([]Version, len(all))
+	kept := make([]model.Obj, len(all))
+	for n, f := range all {
+		versions[n], kept[n] = f.v, f.obj
+	}
+	return versions, kept, nil
+}
+
+// pruneVersions removes the versions of the file at path beyond versionKeep or versionMaxAge,
+// a failure is only logged
+func (i *Impl) pruneVersions(ctx context.Context, path string) {
+	if err := i.prune(ctx, path); err != nil {
+		i.conf.logger.Warn("failed to prune versions", "path", path, "error", errValue(err))
+	}
+}
+
+func (i *Impl) prune(ctx context.Context, path string) error {
+	versions, objs, err := i.versions(ctx, path)
+	if err != nil {
+		return err
+	}
+	for n, v := range versions {
+		if (i.conf.versionKeep <= 0 || n < i.conf.versionKeep) &&
+			(i.conf.versionMaxAge <= 0 || time.Since(v.Replaced) <= i.conf.versionMaxAge) {
+			continue
+		}
+		p := stdpath.Join(i.versionDir(path), v.ID)
+		if err := i.remove(ctx, p, objs[n]); err != nil && !errs.IsObjectNotFound(err) {
+			return errors.WithMessagef(err, "failed to remove version [%s]", v.ID)
+		}
+	}
+	return nil
+}
+
+func noVersioning() error {
+	return errors.WithMessage(errs.NotSupport, "versions without WithVersioning")
+}
+
+// ListVersions returns the versions kept of the file name, the last replaced first
+func (i *Impl) ListVersions(ctx context.Context, name string) (_ []Version, err error) {
+	ctx, end := i.startOp(ctx, "listversions", name)
+	defer end(&err)
+	if !i.conf.versioning {
+		return nil, noVersioning()
+	}
+	path, err := i.objPath(name)
+	if err != nil {
+		return nil, err
+	}
+	versions, _, err := i.versions(ctx, path)
+	return versions, err
+}
+
+// RestoreVersion makes the version of the file name current again. The current file is kept
+// as a version first, so the restore can be undone, and the version fails with
+// errs.ObjectNotFound if it isn't kept
+func (i *Impl) RestoreVersion(ctx context.Context, name, version string) (err error) {
+	ctx, end := i.startOp(ctx, "restoreversion", name)
+	defer end(&err)
+	ctx, cancel := withTimeout(ctx, i.conf.writeTimeout)
+	defer cancel()
+	if !i.conf.versioning {
+		return noVersioning()
+	}
+	if err := i.writable(); err != nil {
+		return err
+	}
+	if !i.canVersion() {
+		return errors.WithMessage(errs.NotImplement, "restore a version without Move and Rename")
+	}
+	path, err := i.objPath(name)
+	if err != nil {
+		return err
+	}
+	if i.isVersion(path) || stdpath.Base(version) != version || version == "." || version == ".." {
+		return errors.WithMessagef(ErrInvalidName, "[%s] version [%s]", name, version)
+	}
+	unlock, err := i.locks.lock(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	src := stdpath.Join(i.versionDir(path), version)
+	obj, err := i.get(ctx, src)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to get version [%s]", version)
+	}
+	if cur, err := i.get(ctx, path); err == nil {
+		if cur.IsDir() {
+			return errors.WithStack(errs.NotFile)
+		}
+		if err := i.keepVersion(ctx, path, cur); err != nil {
+			return err
+		}
+	} else if !errs.IsObjectNotFound(err) {
+		return errors.WithMessage(err, "failed to get object")
+	}
+	// named in the versions first, so the version isn't seen under its ID
+	base := stdpath.Base(path)
+	if err := i.renameTo(ctx, src, obj, base); err != nil {
+		return errors.WithMessagef(err, "failed to rename version [%s]", version)
+	}
+	renamed := stdpath.Join(stdpath.Dir(src), base)
+	if obj, err = i.get(ctx, renamed); err != nil {
+		return errors.WithMessagef(err, "failed to get version [%s]", version)
+	}
+	if err := i.moveTo(ctx, renamed, obj, stdpath.Dir(path)); err != nil {
+		return err
+	}
+	i.pruneVersions(ctx, path)
+	return nil
+}
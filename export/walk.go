@@ -0,0 +1,234 @@
+package export
+
+import (
+	"context"
+	"io/fs"
+	stdpath "path"
+	"sort"
+	"sync"
+
+	"github.com/alist-org/alist/v3/internal/model"
+	"github.com/pkg/errors"
+)
+
+// ErrWalkLoop is given to the fn of Walk for a dir which would be walked again, like a dir
+// listed twice or a dir with the ID of one of its parents, which isn't entered
+var ErrWalkLoop = errors.New("dir walked again")
+
+// defaultWalkParallel is how many dirs Walk lists at once by default
+const defaultWalkParallel = 4
+
+// WithWalkParallel sets how many dirs Walk lists at once ahead of the dir walked, and Usage
+// lists at once, the default is 4
+func WithWalkParallel(n int) Option {
+	return func(c *config) {
+		c.walkParallel = n
+	}
+}
+
+// Walk walks the tree at root like fs.WalkDir does, calling fn with the paths joined to root in
+// lexical order, fs.SkipDir and fs.SkipAll are honored. The subdirs of the dir walked are listed
+// ahead by WithWalkParallel, fn is called from a single goroutine
+func (i *Impl) Walk(ctx context.Context, root string, fn fs.WalkDirFunc) (err error) {
+	ctx, end := i.startOp(ctx, "walk", root)
+	defer end(&err)
+	path, err := i.cleanPath(root)
+	if err != nil {
+		return err
+	}
+	return i.walk(ctx, root, path, func(name string, obj model.Obj, err error) error {
+		if obj == nil {
+			return fn(name, nil, err)
+		}
+		return fn(name, fs.FileInfoToDirEntry(newFileInfo(name, obj.GetSize(), obj.ModTime(), obj.IsDir())), err)
+	})
+}
+
+// walkFunc is the fs.WalkDirFunc of walk given the objects, obj is nil if the root is missing
+type walkFunc func(name string, obj model.Obj, err error) error
+
+// walk walks the tree at path named root like Walk does
+func (i *Impl) walk(ctx context.Context, root, path string, fn walkFunc) error {
+	obj, err := i.get(ctx, path)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		parallel := i.conf.walkParallel
+		if parallel <= 0 {
+			parallel = defaultWalkParallel
+		}
+		w := &walker{i: i, fn: fn, sem: make(chan struct{}, parallel), visited: map[string]bool{}}
+		defer w.wg.Wait()
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		err = w.walk(ctx, root, path, obj, nil, nil)
+	}
+	if errors.Is(err, fs.SkipDir) || errors.Is(err, fs.SkipAll) {
+		return nil
+	}
+	return err
+}
+
+type walker struct {
+	i       *Impl
+	fn      walkFunc
+	sem     chan struct{}
+	wg      sync.WaitGroup
+	visited map[string]bool
+}
+
+// walkListing is the listing of a dir, which is done once done is closed
+type walkListing struct {
+	done   chan struct{}
+	cancel context.CancelFunc
+	objs   []model.Obj
+	err    error
+}
+
+// list starts listing the dir at path once a slot is free
+func (w *walker) list(ctx context.Context, path string) *walkListing {
+	ctx, cancel := context.WithCancel(ctx)
+	l := &walkListing{done: make(chan struct{}), cancel: cancel}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer close(l.done)
+		select {
+		case w.sem <- struct{}{}:
+		case <-ctx.Done():
+			l.err = errors.WithStack(ctx.Err())
+			return
+		}
+		defer func() { <-w.sem }()
+		objs, err := w.i.list(ctx, path, model.ListArgs{})
+		if err != nil {
+			l.err = errors.WithMessage(err, "failed to list dir")
+			return
+		}
+		atBase := path == w.i.conf.baseDir
+		l.objs = make([]model.Obj, 0, len(objs))
+		for _, obj := range objs {
+			if !atBase || !w.i.hidden(stdpath.Join(path, obj.GetName())) {
+				l.objs = append(l.objs, obj)
+			}
+		}
+		sort.SliceStable(l.objs, func(a, b int) bool {
+			return l.objs[a].GetName() < l.objs[b].GetName()
+		})
+	}()
+	return l
+}
+
+// walk walks obj at path named name, l is its listing if it has been started, ids are the IDs
+// of its parents. It returns fs.SkipDir to skip the rest of the dir containing obj
+func (w *walker) walk(ctx context.Context, name, path string, obj model.Obj, l *walkListing, ids []string) error {
+	if err := w.fn(name, obj, nil); err != nil || !obj.IsDir() {
+		if errors.Is(err, fs.SkipDir) && obj.IsDir() {
+			return nil
+		}
+		return err
+	}
+	w.visited[path] = true
+	if id := obj.GetID(); id != "" {
+		ids = append(ids, id)
+	}
+	if l == nil {
+		l = w.list(ctx, path)
+	}
+	<-l.done
+	if l.err != nil {
+		if err := w.fn(name, obj, l.err); err != nil && !errors.Is(err, fs.SkipDir) {
+			return err
+		}
+		return nil
+	}
+
+	children := make([]*walkListing, len(l.objs))
+	defer func() {
+		for _, c := range children {
+			if c != nil {
+				c.cancel()
+			}
+		}
+	}()
+	next := 0
+	for k, child := range l.objs {
+		childName, childPath := stdpath.Join(name, child.GetName()), stdpath.Join(path, child.GetName())
+		// the subdirs ahead are listed while this one is walked
+		for ; next < len(l.objs) && next < k+cap(w.sem); next++ {
+			if c := l.objs[next]; c.IsDir() && !w.loop(stdpath.Join(path, c.GetName()), c, ids) {
+				children[next] = w.list(ctx, stdpath.Join(path, c.GetName()))
+			}
+		}
+		var err error
+		if child.IsDir() && w.loop(childPath, child, ids) {
+			err = w.fn(childName, child, errors.WithMessagef(ErrWalkLoop, "[%s]", childPath))
+		} else {
+			err = w.walk(ctx, childName, childPath, child, children[k], ids)
+		}
+		if err != nil {
+			if errors.Is(err, fs.SkipDir) && !child.IsDir() {
+				return nil
+			}
+			if errors.Is(err, fs.SkipDir) {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// loop reports whether the dir obj at path would be walked again
+func (w *walker) loop(path string, obj model.Obj, ids []string) bool {
+	if w.visited[path] {
+		return true
+	}
+	for _, id := range ids {
+		if id == obj.GetID() {
+			return true
+		}
+	}
+	return false
+}
+
+// walkList walks the tree at root of fsys like fs.WalkDir does by Stat and List, in lexical order,
+// for the layers whose objects aren't those of the tree walked by their inner FileSystem
+func walkList(ctx context.Context, fsys FileSystem, root string, fn fs.WalkDirFunc) error {
+	info, err := fsys.Stat(ctx, root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkListDir(ctx, fsys, root, fs.FileInfoToDirEntry(newFileInfo(root, info.Size, info.Modified, info.IsDir)), fn)
+	}
+	if err == fs.SkipDir || err == fs.SkipAll {
+		return nil
+	}
+	return err
+}
+
+func walkListDir(ctx context.Context, fsys FileSystem, name string, d fs.DirEntry, fn fs.WalkDirFunc) error {
+	if err := fn(name, d, nil); err != nil || !d.IsDir() {
+		if err == fs.SkipDir && d.IsDir() {
+			err = nil
+		}
+		return err
+	}
+	entries, err := fsys.List(ctx, name, WithSort(SortName, false))
+	if err != nil {
+		if err = fn(name, d, err); err == fs.SkipDir {
+			err = nil
+		}
+		return err
+	}
+	for _, e := range entries {
+		child := stdpath.Join(name, e.Name)
+		if err := walkListDir(ctx, fsys, child, fs.FileInfoToDirEntry(newFileInfo(child, e.Size, e.Modified, e.IsDir)), fn); err != nil {
+			if err == fs.SkipDir {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,303 @@
+package webdav
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/alist-org/alist/v3/export"
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/alist-org/alist/v3/internal/net"
+	"github.com/alist-org/alist/v3/pkg/http_range"
+	"github.com/pkg/errors"
+	dav "golang.org/x/net/webdav"
+)
+
+// Handler serves fsys over WebDAV, locks are only kept in memory and never reach the storage
+func Handler(fsys export.FileSystem) http.Handler {
+	return &handler{
+		fsys: fsys,
+		dav: &dav.Handler{
+			FileSystem: &davFS{fsys: fsys},
+			LockSystem: dav.NewMemLS(),
+		},
+	}
+}
+
+type handler struct {
+	fsys export.FileSystem
+	dav  *dav.Handler
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		name := path.Clean("/" + r.URL.Path)
+		if info, err := h.fsys.Stat(r.Context(), name); err == nil && !info.IsDir {
+			h.serveFile(w, r, name, info)
+			return
+		}
+	}
+	h.dav.ServeHTTP(w, r)
+}
+
+// serveFile replies with the content of name, a range request is mapped to Read(off, limit)
+// so that only the requested part is downloaded
+func (h *handler) serveFile(w http.ResponseWriter, r *http.Request, name string, info export.ObjInfo) {
+	var readers []io.Closer
+	defer func() {
+		for _, rc := range readers {
+			_ = rc.Close()
+		}
+	}()
+	ctx := r.Context()
+	rangeReader := func(_ context.Context, httpRange http_range.Range) (io.ReadCloser, error) {
+		length := httpRange.Length
+		if length < 0 {
+			length = info.Size - httpRange.Start
+		}
+		rc, err := h.fsys.Read(ctx, name, httpRange.Start, length)
+		if err != nil {
+			return nil, err
+		}
+		readers = append(readers, rc)
+		return rc, nil
+	}
+	net.ServeHTTP(w, r, info.Name, info.Modified, info.Size, rangeReader)
+}
+
+// davFS implements dav.FileSystem on top of export.FileSystem
+type davFS struct {
+	fsys export.FileSystem
+}
+
+var _ dav.FileSystem = (*davFS)(nil)
+
+// toOSErr wraps err in *os.PathError so that os.IsNotExist and os.IsExist work in the dav handler
+func toOSErr(op, name string, err error) error {
+	if errs.IsObjectNotFound(err) {
+		err = os.ErrNotExist
+	}
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+func (d *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if _, err := d.fsys.Stat(ctx, name); err == nil {
+		return toOSErr("mkdir", name, os.ErrExist)
+	} else if !errs.IsObjectNotFound(err) {
+		return toOSErr("mkdir", name, err)
+	}
+	// MKCOL must not create intermediate collections
+	parent, err := d.fsys.Stat(ctx, path.Dir(name))
+	if err != nil {
+		return toOSErr("mkdir", name, err)
+	}
+	if !parent.IsDir {
+		return toOSErr("mkdir", name, errs.NotFolder)
+	}
+	if err := d.fsys.Mkdir(ctx, name); err != nil {
+		return toOSErr("mkdir", name, err)
+	}
+	return nil
+}
+
+func (d *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (dav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE) != 0 {
+		w, err := d.fsys.Create(ctx, name)
+		if err != nil {
+			return nil, toOSErr("open", name, err)
+		}
+		return &davWriter{w: w, name: path.Base(name)}, nil
+	}
+	info, err := d.fsys.Stat(ctx, name)
+	if err != nil {
+		return nil, toOSErr("open", name, err)
+	}
+	fi := newFileInfo(info)
+	if info.IsDir {
+		return &davDir{ctx: ctx, fsys: d.fsys, name: name, info: fi}, nil
+	}
+	r, err := d.fsys.Open(ctx, name)
+	if err != nil {
+		return nil, toOSErr("open", name, err)
+	}
+	return &davFile{ReadSeekCloser: r, info: fi}, nil
+}
+
+func (d *davFS) RemoveAll(ctx context.Context, name string) error {
+	if err := d.fsys.RemoveAll(ctx, name); err != nil {
+		return toOSErr("remove", name, err)
+	}
+	return nil
+}
+
+// Rename maps MOVE to Rename within a directory, to Move between directories
+// and to both of them if the name changes too
+func (d *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	srcDir, srcName := path.Split(path.Clean(oldName))
+	dstDir, dstName := path.Split(path.Clean(newName))
+	var err error
+	switch {
+	case srcDir == dstDir:
+		err = d.fsys.Rename(ctx, oldName, dstName)
+	case srcName == dstName:
+		err = d.fsys.Move(ctx, oldName, dstDir)
+	default:
+		err = d.fsys.Move(ctx, oldName, dstDir)
+		if err == nil {
+			err = d.fsys.Rename(ctx, path.Join(dstDir, srcName), dstName)
+		}
+	}
+	if err != nil {
+		return toOSErr("rename", oldName, err)
+	}
+	return nil
+}
+
+func (d *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	info, err := d.fsys.Stat(ctx, name)
+	if err != nil {
+		return nil, toOSErr("stat", name, err)
+	}
+	return newFileInfo(info), nil
+}
+
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+func newFileInfo(info export.ObjInfo) *fileInfo {
+	return &fileInfo{name: info.Name, size: info.Size, modTime: info.Modified, isDir: info.IsDir}
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.isDir }
+func (fi *fileInfo) Sys() any           { return nil }
+
+func (fi *fileInfo) Mode() os.FileMode {
+	if fi.isDir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+var errReadOnly = errors.New("file is opened for reading")
+var errWriteOnly = errors.New("file is opened for writing")
+
+// davFile is a file opened for reading
+type davFile struct {
+	io.ReadSeekCloser
+	info *fileInfo
+}
+
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errs.NotFolder
+}
+
+func (f *davFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	return 0, errReadOnly
+}
+
+// davDir is a directory opened for reading, the entries are listed on the first Readdir
+type davDir struct {
+	ctx     context.Context
+	fsys    export.FileSystem
+	name    string
+	info    *fileInfo
+	entries []os.FileInfo
+	listed  bool
+}
+
+func (d *davDir) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.listed {
+		entries, err := d.fsys.List(d.ctx, d.name)
+		if err != nil {
+			return nil, toOSErr("readdir", d.name, err)
+		}
+		for _, e := range entries {
+			d.entries = append(d.entries, &fileInfo{name: e.Name, size: e.Size, modTime: e.Modified, isDir: e.IsDir})
+		}
+		d.listed = true
+	}
+	if count <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+func (d *davDir) Stat() (os.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *davDir) Read(p []byte) (int, error) {
+	return 0, errs.NotFile
+}
+
+func (d *davDir) Seek(offset int64, whence int) (int64, error) {
+	return 0, errs.NotFile
+}
+
+func (d *davDir) Write(p []byte) (int, error) {
+	return 0, errs.NotFile
+}
+
+func (d *davDir) Close() error {
+	return nil
+}
+
+// davWriter is a file opened for writing, the object is uploaded on Close
+type davWriter struct {
+	w    io.WriteCloser
+	name string
+	size int64
+}
+
+func (f *davWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *davWriter) Close() error {
+	return f.w.Close()
+}
+
+// Stat reports the bytes written so far, which is called by PUT before Close
+func (f *davWriter) Stat() (os.FileInfo, error) {
+	return &fileInfo{name: f.name, size: f.size, modTime: time.Now()}, nil
+}
+
+func (f *davWriter) Read(p []byte) (int, error) {
+	return 0, errWriteOnly
+}
+
+func (f *davWriter) Seek(offset int64, whence int) (int64, error) {
+	return 0, errWriteOnly
+}
+
+func (f *davWriter) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errWriteOnly
+}
+
+var _ dav.File = (*davFile)(nil)
+var _ dav.File = (*davDir)(nil)
+var _ dav.File = (*davWriter)(nil)
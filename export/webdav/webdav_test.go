@@ -0,0 +1,112 @@
+package webdav
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alist-org/alist/v3/drivers/local"
+	"github.com/alist-org/alist/v3/export"
+	"github.com/alist-org/alist/v3/internal/driver"
+	"github.com/alist-org/alist/v3/pkg/utils"
+)
+
+func init() {
+	export.Register("test-local", func() driver.Driver {
+		return &local.Local{}
+	})
+}
+
+func newTestServer(t *testing.T) *httptest.Server {
+	addition, _ := utils.Json.MarshalToString(map[string]string{"root_folder_path": t.TempDir()})
+	fsys, err := export.NewByName(context.Background(), "test-local", addition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(Handler(fsys))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func do(t *testing.T, method, url string, body io.Reader, header map[string]string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, string(b)
+}
+
+func TestHandler(t *testing.T) {
+	srv := newTestServer(t)
+
+	if res, _ := do(t, "MKCOL", srv.URL+"/dir", nil, nil); res.StatusCode != http.StatusCreated {
+		t.Fatalf("MKCOL: %s", res.Status)
+	}
+	if res, _ := do(t, "MKCOL", srv.URL+"/dir", nil, nil); res.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("MKCOL existing: %s", res.Status)
+	}
+	if res, _ := do(t, http.MethodPut, srv.URL+"/dir/a.txt", strings.NewReader("0123456789"), nil); res.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT: %s", res.Status)
+	}
+
+	res, body := do(t, http.MethodGet, srv.URL+"/dir/a.txt", nil, nil)
+	if res.StatusCode != http.StatusOK || body != "0123456789" {
+		t.Fatalf("GET: %s %q", res.Status, body)
+	}
+	if res.Header.Get("Content-Length") != "10" || res.Header.Get("Last-Modified") == "" {
+		t.Fatalf("GET headers: %v", res.Header)
+	}
+	res, body = do(t, http.MethodGet, srv.URL+"/dir/a.txt", nil, map[string]string{"Range": "bytes=2-4"})
+	if res.StatusCode != http.StatusPartialContent || body != "234" {
+		t.Fatalf("range GET: %s %q", res.Status, body)
+	}
+	if res.Header.Get("Content-Range") != "bytes 2-4/10" {
+		t.Fatalf("range GET headers: %v", res.Header)
+	}
+	res, body = do(t, http.MethodHead, srv.URL+"/dir/a.txt", nil, nil)
+	if res.StatusCode != http.StatusOK || body != "" || res.Header.Get("Content-Length") != "10" {
+		t.Fatalf("HEAD: %s %q %v", res.Status, body, res.Header)
+	}
+
+	res, body = do(t, "PROPFIND", srv.URL+"/dir", nil, map[string]string{"Depth": "1"})
+	if res.StatusCode != http.StatusMultiStatus || !strings.Contains(body, "a.txt") {
+		t.Fatalf("PROPFIND: %s %s", res.Status, body)
+	}
+
+	if res, _ := do(t, "MKCOL", srv.URL+"/other", nil, nil); res.StatusCode != http.StatusCreated {
+		t.Fatalf("MKCOL: %s", res.Status)
+	}
+	res, _ = do(t, "MOVE", srv.URL+"/dir/a.txt", nil, map[string]string{"Destination": srv.URL + "/other/b.txt"})
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("MOVE: %s", res.Status)
+	}
+	if res, _ := do(t, http.MethodGet, srv.URL+"/dir/a.txt", nil, nil); res.StatusCode != http.StatusNotFound {
+		t.Fatalf("GET moved source: %s", res.Status)
+	}
+	if res, body := do(t, http.MethodGet, srv.URL+"/other/b.txt", nil, nil); body != "0123456789" {
+		t.Fatalf("GET moved: %s %q", res.Status, body)
+	}
+
+	if res, _ := do(t, http.MethodDelete, srv.URL+"/other", nil, nil); res.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE: %s", res.Status)
+	}
+	if res, _ := do(t, "PROPFIND", srv.URL+"/other", nil, map[string]string{"Depth": "0"}); res.StatusCode != http.StatusNotFound {
+		t.Fatalf("PROPFIND deleted: %s", res.Status)
+	}
+}
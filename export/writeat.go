@@ -0,0 +1,101 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/alist-org/alist/v3/internal/errs"
+	"github.com/alist-org/alist/v3/internal/model"
+	"github.com/pkg/errors"
+)
+
+// ErrObjectTooLarge is returned by WriteAt and Append for the objects which would be larger
+// than the size given to WithWriteAt and WithAppend respectively
+var ErrObjectTooLarge = errors.New("object too large to rewrite")
+
+// WithWriteAt enables WriteAt on the objects of up to maxSize bytes, which are rewritten
+// in memory, so both the object and maxSize are held by each WriteAt
+func WithWriteAt(maxSize int64) Option {
+	return func(c *config) {
+		c.writeAtMax = maxSize
+	}
+}
+
+// WriteAt writes data at off of name, which is made if missing, the bytes skipped beyond
+// the end are zeros. Objects can't be written in place, so the bytes of the object kept are
+// read and spliced with data, which is put again atomically if the driver can rename or move.
+// The writes to the same name are serialized, it's disabled unless WithWriteAt is set
+func (i *Impl) WriteAt(ctx context.Context, name string, off int64, data []byte) (err error) {
+	ctx, end := i.startOp(ctx, "writeat", name)
+	defer end(&err)
+	if i.conf.writeAtMax <= 0 {
+		return errors.WithMessage(errs.NotImplement, "WriteAt needs WithWriteAt")
+	}
+	if err := i.writable(); err != nil {
+		return err
+	}
+	path, err := i.objPath(name)
+	if err != nil {
+		return err
+	}
+	if off < 0 {
+		return errors.WithMessagef(ErrInvalidRange, "negative offset %d", off)
+	}
+	unlock, err := i.locks.lock(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var size int64
+	file, err := i.get(ctx, path)
+	switch {
+	case errs.IsObjectNotFound(err):
+		file = nil
+	case err != nil:
+		return errors.WithMessage(err, "failed to get file")
+	case file.IsDir():
+		return errors.WithStack(errs.NotFile)
+	default:
+		size = file.GetSize()
+	}
+	dataEnd := off + int64(len(data))
+	newSize := max(size, dataEnd)
+	if newSize > i.conf.writeAtMax {
+		return errors.WithMessagef(ErrObjectTooLarge, "[%s] would have %d bytes, more than %d", path, newSize, i.conf.writeAtMax)
+	}
+	buf := getBuf(int(newSize))[:newSize]
+	defer putBuf(buf)
+	// only the bytes not written are read
+	if err := i.readFull(ctx, file, 0, buf[:min(off, size)]); err != nil {
+		return err
+	}
+	if dataEnd < size {
+		if err := i.readFull(ctx, file, dataEnd, buf[dataEnd:]); err != nil {
+			return err
+		}
+	}
+	if off > size {
+		clear(buf[size:off])
+	}
+	copy(buf[off:], data)
+	_, err = i.putFile(ctx, name, bytes.NewReader(buf), newSize, putOptions{atomic: true})
+	return err
+}
+
+// readFull reads len(p) bytes of file from off into p
+func (i *Impl) readFull(ctx context.Context, file model.Obj, off int64, p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	rc, err := i.rangeRead(ctx, file, off, int64(len(p)))
+	if err != nil {
+		return errors.WithMessage(err, "failed to read file")
+	}
+	defer rc.Close()
+	if _, err := io.ReadFull(rc, p); err != nil {
+		return errors.WithMessagef(err, "failed to read %d bytes at %d", len(p), off)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package export
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Create returns a writer uploading all written data to name when it's closed.
+// The data is spooled like Put does, and nothing is uploaded if ctx is done before Close
+func (i *Impl) Create(ctx context.Context, name string) (_ io.WriteCloser, err error) {
+	ctx, end := i.startOp(ctx, "create", name)
+	defer end(&err)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := i.writable(); err != nil {
+		return nil, err
+	}
+	path, err := i.objPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return &fileWriter{
+		ctx:  ctx,
+		i:    i,
+		name: name,
+		path: path,
+		w:    newSpoolWriter(i.conf.spoolThreshold),
+	}, nil
+}
+
+type fileWriter struct {
+	ctx    context.Context
+	i      *Impl
+	name   string
+	path   string
+	w      *spoolWriter
+	closed bool
+}
+
+func (fw *fileWriter) Write(p []byte) (int, error) {
+	if fw.closed {
+		return 0, os.ErrClosed
+	}
+	if err := fw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return fw.w.Write(p)
+}
+
+// Close uploads the written data and returns the upload error
+func (fw *fileWriter) Close() (err error) {
+	ctx, end := fw.i.startOp(fw.ctx, "close", fw.name)
+	defer end(&err)
+	if fw.closed {
+		return os.ErrClosed
+	}
+	fw.closed = true
+	if err := fw.ctx.Err(); err != nil {
+		_ = fw.w.Discard()
+		return err
+	}
+	f, err := fw.w.File()
+	if err != nil {
+		return errors.WithMessage(err, "failed to read spooled data")
+	}
+	defer f.Close()
+
+	_, err = fw.i.get(ctx, fw.path)
+	existed := err == nil
+	if _, err = fw.i.putFile(ctx, fw.name, f, fw.w.Size(), putOptions{}); err != nil {
+		// an interrupted upload may leave a partial object,
+		// remove it unless it's an old one which may still be intact
+		if fw.ctx.Err() != nil && !existed {
+			_ = fw.i.Delete(context.WithoutCancel(fw.ctx), fw.name)
+		}
+		return err
+	}
+	return nil
+}